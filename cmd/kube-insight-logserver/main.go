@@ -8,21 +8,38 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"time"
 
+	"github.com/elastisys/kube-insight-logserver/pkg/auth"
 	"github.com/elastisys/kube-insight-logserver/pkg/log"
+	"github.com/elastisys/kube-insight-logserver/pkg/logstore"
 	"github.com/elastisys/kube-insight-logserver/pkg/logstore/cassandra"
+	"github.com/elastisys/kube-insight-logserver/pkg/logstore/disk"
+	"github.com/elastisys/kube-insight-logserver/pkg/logstore/memory"
 	"github.com/elastisys/kube-insight-logserver/pkg/server"
-	"github.com/gocql/gocql"
+	"github.com/elastisys/kube-insight-logserver/pkg/spool"
 )
 
 // version is the release version of the program. This is intended to be set by
 // the linker at build-time. E.g. `-ldflags "-X main.version=1.0.0"`.
 var version string
 
+// supported LogStore backends
+const (
+	cassandraBackend = "cassandra"
+	diskBackend      = "disk"
+	memoryBackend    = "memory"
+)
+
+// migrateCommand is the subcommand that migrates the Cassandra schema without
+// starting the server.
+const migrateCommand = "migrate"
+
 // command-line defaults
 var (
 	defaultServerIP   = "0.0.0.0"
 	defaultServerPort = 8080
+	defaultBackend    = cassandraBackend
 	// Cassandra keyspace
 	cassandraDefaults = cassandra.Options{
 		Hosts:               []string{"127.0.0.1"},
@@ -31,26 +48,113 @@ var (
 		ReplicationStrategy: cassandra.SimpleStrategy,
 		ReplicationFactors:  cassandra.ReplicationFactorMap{"cluster": 1},
 		LogTableName:        "logs",
+		HostSelectionPolicy: cassandra.RoundRobinPolicy,
+		LocalDC:             "",
+		TokenAware:          true,
+		Username:            "",
+		PasswordFile:        "",
+		EnableTLS:           false,
+		TLSCACertPath:       "",
+		TLSCertPath:         "",
+		TLSKeyPath:          "",
+		TLSVerifyHostname:   true,
+		WriteConsistency:    "ONE",
+		ReadConsistency:     "ONE",
 		WriteConcurrency:    runtime.GOMAXPROCS(-1) * 4,
 		WriteBufferSize:     1024,
+		WriteBatchSize:      50,
+		ReadConcurrency:     8,
+		BucketSize:          cassandra.DailyBuckets,
+		DefaultTTL:          0,
+		NamespaceTTLs:       cassandra.NamespaceTTLs{},
+		CompactionStrategy:  cassandra.TimeWindowCompaction,
+		Compression:         cassandra.LZ4Compression,
+		GCGraceSeconds:      864000,
+	}
+	diskDefaults = disk.Options{
+		Directory:  "/var/lib/kube-insight-logserver",
+		SyncWrites: false,
 	}
+	memoryDefaults = memory.Options{
+		MaxEntries: 100000,
+	}
+	// the spool is disabled unless a directory is given
+	spoolDefaults = spool.Options{
+		Directory:      "",
+		MaxBytes:       1024 * 1024 * 1024,
+		ReplayInterval: 5 * time.Second,
+	}
+	defaultAsyncIngest     = false
 	defaultEnableProfiling = false
+	// TokenReview authentication
+	tokenReviewDefaults = auth.TokenReviewOptions{
+		URL:        "",
+		CACertPath: "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt",
+		TokenPath:  "/var/run/secrets/kubernetes.io/serviceaccount/token",
+		Timeout:    10 * time.Second,
+		CacheTTL:   1 * time.Minute,
+	}
 )
 
 // command-line options
 var (
 	serverBindAddr               string
 	serverPort                   int
+	serverTLSCert                string
+	serverTLSKey                 string
+	serverTLSClientCA            string
+	serverTLSRequireClientCert   bool
+	authTokenFile                string
+	authTokenReviewURL           string
+	authTokenReviewCACert        string
+	authTokenReviewTokenFile     string
+	authPolicyFile               string
+	backend                      string
 	cassandraPort                int
 	cassandraKeyspace            string
+	cassandraLogTable            string
 	cassandraReplicationStrategy string
 	cassandraReplicationFactor   string
+	cassandraHostSelectionPolicy string
+	cassandraLocalDC             string
+	cassandraTokenAware          bool
+	cassandraUsername            string
+	cassandraPassword            string
+	cassandraPasswordFile        string
+	cassandraEnableTLS           bool
+	cassandraTLSCACertPath       string
+	cassandraTLSCertPath         string
+	cassandraTLSKeyPath          string
+	cassandraTLSVerifyHostname   bool
+	cassandraWriteConsistency    string
+	cassandraReadConsistency     string
 	cassandraWriteConcurrency    int
 	cassandraWriteBufferSize     int
+	cassandraWriteBatchSize      int
+	cassandraReadConcurrency     int
+	cassandraBucketSize          string
+	cassandraDefaultTTL          string
+	cassandraNamespaceTTLs       string
+	cassandraCompactionStrategy  string
+	cassandraWindowUnit          string
+	cassandraWindowSize          int
+	cassandraCompression         string
+	cassandraGCGraceSeconds      int
+	diskDirectory                string
+	diskSyncWrites               bool
+	memoryMaxEntries             int
+	spoolDirectory               string
+	spoolMaxBytes                int
+	asyncIngest                  bool
 
 	enableProfiling bool
 
 	showVersion bool
+
+	// migrateApply is only available to the migrate subcommand
+	migrateApply bool
+	// migrateCopyFrom is only available to the migrate subcommand
+	migrateCopyFrom string
 )
 
 func envOrDefaultStr(envVar string, defaultValue string) string {
@@ -88,14 +192,26 @@ func envOrDefaultBool(envVar string, defaultValue bool) bool {
 
 func init() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stdout, "usage: %s [OPTIONS] [<cassandra-node> ...]\n\n",
+		fmt.Fprintf(os.Stdout, "usage: %s [OPTIONS] [<cassandra-node> ...]\n",
 			os.Args[0])
+		fmt.Fprintf(os.Stdout, "       %s %s [--apply] [--copy-from=<log-table>] [OPTIONS] [<cassandra-node> ...]\n\n",
+			os.Args[0], migrateCommand)
 
 		fmt.Fprintf(os.Stdout, "Connects to a (set of) Cassandra node(s) and "+
 			"starts a HTTP server with a REST API through which Kubernetes "+
 			"pod logs can be ingested into the Cassandra cluster and against "+
 			"which queries can be posed to fetch historical log entries. If no "+
-			"Cassandra nodes are given, 127.0.0.1 is assumed.\n\n")
+			"Cassandra nodes are given, 127.0.0.1 is assumed. With the disk "+
+			"backend, logs are instead stored in local files (intended for "+
+			"single-node installations) and with the memory backend, logs are "+
+			"kept in memory (intended for local development and testing).\n\n")
+
+		fmt.Fprintf(os.Stdout, "The %s subcommand prints the pending schema "+
+			"migrations of the Cassandra keyspace, or applies them with --apply, "+
+			"and exits without starting the server. Schema migrations are "+
+			"otherwise applied when the server starts. With --copy-from, it "+
+			"also copies the log entries of another log table into the "+
+			"log table of the current schema version.\n\n", migrateCommand)
 
 		fmt.Fprintf(os.Stdout, "Options:\n")
 		flag.PrintDefaults()
@@ -111,12 +227,64 @@ func init() {
 		fmt.Sprintf("The server port to listen on (default value: %d, environment "+
 			"variable: PORT)", defaultServerPort))
 
+	flag.StringVar(&serverTLSCert, "tls-cert",
+		envOrDefaultStr("TLS_CERT", ""),
+		"A PEM-encoded server certificate. When given (together with --tls-key), the server serves HTTPS. "+
+			"The certificate is reloaded when modified on disk. Environment variable: TLS_CERT.")
+	flag.StringVar(&serverTLSKey, "tls-key",
+		envOrDefaultStr("TLS_KEY", ""),
+		"The PEM-encoded private key of the server certificate. Environment variable: TLS_KEY.")
+	flag.StringVar(&serverTLSClientCA, "tls-client-ca",
+		envOrDefaultStr("TLS_CLIENT_CA", ""),
+		"A PEM-encoded CA bundle used to verify client certificates. When given, only clients with a "+
+			"certificate signed by one of these CAs may write log entries. Environment variable: TLS_CLIENT_CA.")
+	flag.BoolVar(&serverTLSRequireClientCert, "tls-require-client-cert",
+		envOrDefaultBool("TLS_REQUIRE_CLIENT_CERT", false),
+		"Require a client certificate signed by --tls-client-ca for all requests, not only for writes. "+
+			"Default value: false, environment variable: TLS_REQUIRE_CLIENT_CERT.")
+
+	flag.StringVar(&authTokenFile, "auth-token-file",
+		envOrDefaultStr("AUTH_TOKEN_FILE", ""),
+		"A CSV file of static bearer tokens, with lines of the form 'token,user,uid,\"group1,group2\"' "+
+			"(the format of the Kubernetes API server's --token-auth-file). When given, requests must carry "+
+			"a bearer token. Environment variable: AUTH_TOKEN_FILE.")
+	flag.StringVar(&authTokenReviewURL, "auth-token-review-url",
+		envOrDefaultStr("AUTH_TOKEN_REVIEW_URL", tokenReviewDefaults.URL),
+		"A Kubernetes TokenReview endpoint against which bearer tokens are validated. For example, "+
+			"'https://kubernetes.default.svc/apis/authentication.k8s.io/v1/tokenreviews'. When given, requests "+
+			"must carry a bearer token. Environment variable: AUTH_TOKEN_REVIEW_URL.")
+	flag.StringVar(&authTokenReviewCACert, "auth-token-review-ca-cert",
+		envOrDefaultStr("AUTH_TOKEN_REVIEW_CA_CERT", tokenReviewDefaults.CACertPath),
+		fmt.Sprintf("A PEM-encoded CA bundle used to verify the TokenReview endpoint. "+
+			"Default value: %s, environment variable: AUTH_TOKEN_REVIEW_CA_CERT.", tokenReviewDefaults.CACertPath))
+	flag.StringVar(&authTokenReviewTokenFile, "auth-token-review-token-file",
+		envOrDefaultStr("AUTH_TOKEN_REVIEW_TOKEN_FILE", tokenReviewDefaults.TokenPath),
+		fmt.Sprintf("A file holding the bearer token used to authenticate to the TokenReview endpoint. "+
+			"Default value: %s, environment variable: AUTH_TOKEN_REVIEW_TOKEN_FILE.", tokenReviewDefaults.TokenPath))
+	flag.StringVar(&authPolicyFile, "auth-policy-file",
+		envOrDefaultStr("AUTH_POLICY_FILE", ""),
+		"A JSON file of authorization rules that restrict the namespaces that authenticated clients may "+
+			"read and write. If not given, authenticated clients may read and write all namespaces. "+
+			"Environment variable: AUTH_POLICY_FILE.")
+
+	flag.StringVar(&backend, "backend",
+		envOrDefaultStr("BACKEND", defaultBackend),
+		fmt.Sprintf("The log store backend to use. One of '%s', '%s' and '%s'. "+
+			"(default value: %s, environment variable: BACKEND)",
+			cassandraBackend, diskBackend, memoryBackend, defaultBackend))
+
 	flag.StringVar(&cassandraKeyspace, "cassandra-keyspace",
 		envOrDefaultStr("CASSANDRA_KEYSPACE", cassandraDefaults.Keyspace),
 		fmt.Sprintf("The keyspace to use/create. "+
 			"(default value: %s, environment variable: CASSANDRA_KEYSPACE)",
 			cassandraDefaults.Keyspace))
 
+	flag.StringVar(&cassandraLogTable, "cassandra-log-table",
+		envOrDefaultStr("CASSANDRA_LOG_TABLE", cassandraDefaults.LogTableName),
+		fmt.Sprintf("The name of the log table, which prefixes the names of all tables of the log store. "+
+			"(default value: %s, environment variable: CASSANDRA_LOG_TABLE)",
+			cassandraDefaults.LogTableName))
+
 	flag.IntVar(&cassandraPort, "cassandra-port",
 		envOrDefaultInt("CASSANDRA_PORT", cassandraDefaults.CQLPort),
 		fmt.Sprintf("Cassandra cluster CQL port (default value: %d, environment"+
@@ -135,6 +303,62 @@ func init() {
 			"For example, '{\"dc1\": 3, \"dc2\": 3}'. When SimpleStrategy is specified, the map is expected to hold "+
 			"a single value (with datacenter name 'cluster').", cassandraDefaults.ReplicationFactors.JSON()))
 
+	flag.StringVar(&cassandraHostSelectionPolicy, "cassandra-host-selection-policy",
+		envOrDefaultStr("CASSANDRA_HOST_SELECTION_POLICY", cassandraDefaults.HostSelectionPolicy.String()),
+		fmt.Sprintf("The policy used to select the Cassandra node(s) to send a statement to (default value: %s, "+
+			"environment variable: CASSANDRA_HOST_SELECTION_POLICY). One of 'RoundRobin' and 'DCAwareRoundRobin'. "+
+			"DCAwareRoundRobin prefers the nodes in the local datacenter given by --cassandra-local-dc.",
+			cassandraDefaults.HostSelectionPolicy))
+	flag.StringVar(&cassandraLocalDC, "cassandra-local-dc",
+		envOrDefaultStr("CASSANDRA_LOCAL_DC", cassandraDefaults.LocalDC),
+		fmt.Sprintf("The name of the local Cassandra datacenter. Required by the DCAwareRoundRobin host "+
+			"selection policy. (default value: %q, environment variable: CASSANDRA_LOCAL_DC)", cassandraDefaults.LocalDC))
+	flag.BoolVar(&cassandraTokenAware, "cassandra-token-aware",
+		envOrDefaultBool("CASSANDRA_TOKEN_AWARE", cassandraDefaults.TokenAware),
+		fmt.Sprintf("Send statements directly to a replica node of the partition being read/written, "+
+			"among the nodes offered by the host selection policy. "+
+			"Default value: %v, environment variable: CASSANDRA_TOKEN_AWARE.", cassandraDefaults.TokenAware))
+
+	flag.StringVar(&cassandraUsername, "cassandra-username",
+		envOrDefaultStr("CASSANDRA_USERNAME", cassandraDefaults.Username),
+		"The user to authenticate as with Cassandra's PasswordAuthenticator. If not given, no "+
+			"authentication is performed. Environment variable: CASSANDRA_USERNAME.")
+	flag.StringVar(&cassandraPassword, "cassandra-password",
+		envOrDefaultStr("CASSANDRA_PASSWORD", ""),
+		"The password to authenticate with. Prefer --cassandra-password-file (or the environment "+
+			"variable) to avoid exposing the password in the process list. Environment variable: CASSANDRA_PASSWORD.")
+	flag.StringVar(&cassandraPasswordFile, "cassandra-password-file",
+		envOrDefaultStr("CASSANDRA_PASSWORD_FILE", cassandraDefaults.PasswordFile),
+		"A file holding the password to authenticate with. Environment variable: CASSANDRA_PASSWORD_FILE.")
+	flag.BoolVar(&cassandraEnableTLS, "cassandra-enable-tls",
+		envOrDefaultBool("CASSANDRA_ENABLE_TLS", cassandraDefaults.EnableTLS),
+		fmt.Sprintf("Connect to Cassandra over TLS. Default value: %v, environment variable: CASSANDRA_ENABLE_TLS.",
+			cassandraDefaults.EnableTLS))
+	flag.StringVar(&cassandraTLSCACertPath, "cassandra-tls-ca-cert",
+		envOrDefaultStr("CASSANDRA_TLS_CA_CERT", cassandraDefaults.TLSCACertPath),
+		"A PEM-encoded CA certificate bundle used to verify Cassandra node certificates. If not given, the "+
+			"system's root CAs are used. Environment variable: CASSANDRA_TLS_CA_CERT.")
+	flag.StringVar(&cassandraTLSCertPath, "cassandra-tls-cert",
+		envOrDefaultStr("CASSANDRA_TLS_CERT", cassandraDefaults.TLSCertPath),
+		"A PEM-encoded client certificate to present to Cassandra. Environment variable: CASSANDRA_TLS_CERT.")
+	flag.StringVar(&cassandraTLSKeyPath, "cassandra-tls-key",
+		envOrDefaultStr("CASSANDRA_TLS_KEY", cassandraDefaults.TLSKeyPath),
+		"The PEM-encoded private key of the client certificate. Environment variable: CASSANDRA_TLS_KEY.")
+	flag.BoolVar(&cassandraTLSVerifyHostname, "cassandra-tls-verify-hostname",
+		envOrDefaultBool("CASSANDRA_TLS_VERIFY_HOSTNAME", cassandraDefaults.TLSVerifyHostname),
+		fmt.Sprintf("Verify that Cassandra node certificates are signed by a trusted CA and valid for the "+
+			"node's hostname. If false, node certificates are not verified at all. "+
+			"Default value: %v, environment variable: CASSANDRA_TLS_VERIFY_HOSTNAME.", cassandraDefaults.TLSVerifyHostname))
+
+	flag.StringVar(&cassandraWriteConsistency, "cassandra-write-consistency",
+		envOrDefaultStr("CASSANDRA_WRITE_CONSISTENCY", cassandraDefaults.WriteConsistency.String()),
+		fmt.Sprintf("The consistency level to use for inserts, for example 'ONE', 'QUORUM' or 'LOCAL_QUORUM'. "+
+			"Default value: %s, environment variable: CASSANDRA_WRITE_CONSISTENCY.", cassandraDefaults.WriteConsistency))
+	flag.StringVar(&cassandraReadConsistency, "cassandra-read-consistency",
+		envOrDefaultStr("CASSANDRA_READ_CONSISTENCY", cassandraDefaults.ReadConsistency.String()),
+		fmt.Sprintf("The consistency level to use for queries, for example 'ONE', 'QUORUM' or 'LOCAL_ONE'. "+
+			"Default value: %s, environment variable: CASSANDRA_READ_CONSISTENCY.", cassandraDefaults.ReadConsistency))
+
 	flag.IntVar(&cassandraWriteConcurrency, "cassandra-write-concurrency",
 		envOrDefaultInt("CASSANDRA_WRITE_CONCURRENCY", cassandraDefaults.WriteConcurrency),
 		fmt.Sprintf("The number of goroutines to use to write a received log entry batch. "+
@@ -145,6 +369,90 @@ func init() {
 		fmt.Sprintf("The maxiumum number of inserts that can be queued up "+
 			"before additional writes will block. "+
 			"Default value: %d, environment variable: CASSANDRA_WRITE_BUFFER_SIZE.", cassandraDefaults.WriteBufferSize))
+	flag.IntVar(&cassandraWriteBatchSize, "cassandra-write-batch-size",
+		envOrDefaultInt("CASSANDRA_WRITE_BATCH_SIZE", cassandraDefaults.WriteBatchSize),
+		fmt.Sprintf("The maximum number of inserts to send in a single unlogged batch. "+
+			"Only log entries that belong to the same partition (namespace, pod, container and date) "+
+			"are batched together. A value of 1 disables batching. "+
+			"Default value: %d, environment variable: CASSANDRA_WRITE_BATCH_SIZE.", cassandraDefaults.WriteBatchSize))
+	flag.IntVar(&cassandraReadConcurrency, "cassandra-read-concurrency",
+		envOrDefaultInt("CASSANDRA_READ_CONCURRENCY", cassandraDefaults.ReadConcurrency),
+		fmt.Sprintf("The number of goroutines to use to run the per-day sub-queries of a query concurrently. "+
+			"Default value: %d, environment variable: CASSANDRA_READ_CONCURRENCY.", cassandraDefaults.ReadConcurrency))
+	flag.StringVar(&cassandraBucketSize, "cassandra-bucket-size",
+		envOrDefaultStr("CASSANDRA_BUCKET_SIZE", cassandraDefaults.BucketSize.String()),
+		fmt.Sprintf("The time span of log entries to store in a single partition (per container) of the log table. "+
+			"One of '1h', '6h', '1d' and '7d'. Recorded with the log table when it is created, and "+
+			"cannot be changed for an existing table. "+
+			"Default value: %s, environment variable: CASSANDRA_BUCKET_SIZE.", cassandraDefaults.BucketSize))
+	flag.StringVar(&cassandraDefaultTTL, "cassandra-default-ttl",
+		envOrDefaultStr("CASSANDRA_DEFAULT_TTL", cassandraDefaults.DefaultTTL.String()),
+		fmt.Sprintf("The time-to-live of stored log entries, after which they expire. Either a duration "+
+			"such as '12h' or a number of days such as '30d'. A value of zero means that log entries never expire. "+
+			"Default value: %s, environment variable: CASSANDRA_DEFAULT_TTL.", cassandraDefaults.DefaultTTL))
+	flag.StringVar(&cassandraNamespaceTTLs, "cassandra-namespace-ttls",
+		envOrDefaultStr("CASSANDRA_NAMESPACE_TTLS", cassandraDefaults.NamespaceTTLs.JSON()),
+		fmt.Sprintf("Time-to-live overrides for the log entries of certain namespaces, as a map of namespace "+
+			"names (or name prefixes, ending with '*') to time-to-live. "+
+			"For example, '{\"kube-system\": \"7d\", \"prod-*\": \"90d\"}'. "+
+			"Default value: %s, environment variable: CASSANDRA_NAMESPACE_TTLS.", cassandraDefaults.NamespaceTTLs.JSON()))
+	flag.StringVar(&cassandraCompactionStrategy, "cassandra-compaction-strategy",
+		envOrDefaultStr("CASSANDRA_COMPACTION_STRATEGY", cassandraDefaults.CompactionStrategy.String()),
+		fmt.Sprintf("The compaction strategy of the log table. One of 'TimeWindowCompactionStrategy', "+
+			"'SizeTieredCompactionStrategy' and 'LeveledCompactionStrategy'. "+
+			"Default value: %s, environment variable: CASSANDRA_COMPACTION_STRATEGY.", cassandraDefaults.CompactionStrategy))
+	flag.StringVar(&cassandraWindowUnit, "cassandra-compaction-window-unit",
+		envOrDefaultStr("CASSANDRA_COMPACTION_WINDOW_UNIT", cassandraDefaults.CompactionWindowUnit),
+		"The time unit of TimeWindowCompactionStrategy windows. One of 'MINUTES', 'HOURS' and 'DAYS'. "+
+			"Only used together with cassandra-compaction-window-size. "+
+			"Environment variable: CASSANDRA_COMPACTION_WINDOW_UNIT.")
+	flag.IntVar(&cassandraWindowSize, "cassandra-compaction-window-size",
+		envOrDefaultInt("CASSANDRA_COMPACTION_WINDOW_SIZE", cassandraDefaults.CompactionWindowSize),
+		fmt.Sprintf("The number of cassandra-compaction-window-unit units in a TimeWindowCompactionStrategy window. "+
+			"A value of zero makes compaction windows match the bucket size. "+
+			"Default value: %d, environment variable: CASSANDRA_COMPACTION_WINDOW_SIZE.", cassandraDefaults.CompactionWindowSize))
+	flag.StringVar(&cassandraCompression, "cassandra-compression",
+		envOrDefaultStr("CASSANDRA_COMPRESSION", cassandraDefaults.Compression.String()),
+		fmt.Sprintf("The compression of the log table. One of 'LZ4Compressor', 'SnappyCompressor', "+
+			"'DeflateCompressor' and 'none'. "+
+			"Default value: %s, environment variable: CASSANDRA_COMPRESSION.", cassandraDefaults.Compression))
+	flag.IntVar(&cassandraGCGraceSeconds, "cassandra-gc-grace-seconds",
+		envOrDefaultInt("CASSANDRA_GC_GRACE_SECONDS", cassandraDefaults.GCGraceSeconds),
+		fmt.Sprintf("The number of seconds that tombstones in the log table are kept before being garbage collected. "+
+			"Default value: %d, environment variable: CASSANDRA_GC_GRACE_SECONDS.", cassandraDefaults.GCGraceSeconds))
+
+	flag.StringVar(&diskDirectory, "disk-directory",
+		envOrDefaultStr("DISK_DIRECTORY", diskDefaults.Directory),
+		fmt.Sprintf("The directory in which the disk backend stores log segment files. "+
+			"It is created if it does not exist. "+
+			"Default value: %s, environment variable: DISK_DIRECTORY.", diskDefaults.Directory))
+	flag.BoolVar(&diskSyncWrites, "disk-sync-writes",
+		envOrDefaultBool("DISK_SYNC_WRITES", diskDefaults.SyncWrites),
+		fmt.Sprintf("Flush every write of the disk backend to stable storage before acknowledging it. "+
+			"Default value: %v, environment variable: DISK_SYNC_WRITES.", diskDefaults.SyncWrites))
+
+	flag.IntVar(&memoryMaxEntries, "memory-max-entries",
+		envOrDefaultInt("MEMORY_MAX_ENTRIES", memoryDefaults.MaxEntries),
+		fmt.Sprintf("The maximum number of log entries that the memory backend "+
+			"keeps for each pod container before evicting the oldest entries. "+
+			"A value of 0 means no limit. "+
+			"Default value: %d, environment variable: MEMORY_MAX_ENTRIES.", memoryDefaults.MaxEntries))
+
+	flag.StringVar(&spoolDirectory, "spool-directory",
+		envOrDefaultStr("SPOOL_DIRECTORY", spoolDefaults.Directory),
+		"A directory in which to spool log entries that cannot be written because the log store is not ready "+
+			"or fails to write them. Spooled log entries are acknowledged to the client and replayed into the "+
+			"log store once it is ready again. If not given, such writes fail. Environment variable: SPOOL_DIRECTORY.")
+	flag.IntVar(&spoolMaxBytes, "spool-max-bytes",
+		envOrDefaultInt("SPOOL_MAX_BYTES", int(spoolDefaults.MaxBytes)),
+		fmt.Sprintf("The maximum total size of spooled log entries. Writes that do not fit are rejected. "+
+			"Default value: %d, environment variable: SPOOL_MAX_BYTES.", spoolDefaults.MaxBytes))
+	flag.BoolVar(&asyncIngest, "async-ingest",
+		envOrDefaultBool("ASYNC_INGEST", defaultAsyncIngest),
+		fmt.Sprintf("Acknowledge written log entries as soon as they have been appended to the spool, which "+
+			"then serves as a write-ahead log that is drained into the log store in the background. Writes "+
+			"are answered with 429 (Too Many Requests) when the spool is full. Requires --spool-directory. "+
+			"Default value: %v, environment variable: ASYNC_INGEST.", defaultAsyncIngest))
 
 	flag.BoolVar(&enableProfiling, "enable-profiling",
 		envOrDefaultBool("ENABLE_PROFILING", defaultEnableProfiling),
@@ -156,6 +464,18 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == migrateCommand {
+		flag.BoolVar(&migrateApply, "apply", false,
+			"Apply the pending schema migrations. If not given, they are only printed.")
+		flag.StringVar(&migrateCopyFrom, "copy-from", "",
+			"Copy the log entries of another log table (such as the one created by schema version 1, "+
+				"which is named by --cassandra-log-table) into the log table of the current schema version. "+
+				"Implies --apply.")
+		flag.CommandLine.Parse(os.Args[2:])
+		migrate()
+		return
+	}
+
 	flag.Parse()
 
 	if showVersion {
@@ -163,49 +483,28 @@ func main() {
 		os.Exit(0)
 	}
 
-	cqlHosts := cassandraDefaults.Hosts
-	if len(flag.Args()) > 0 {
-		cqlHosts = flag.Args()
-	}
-
-	replStrategy := cassandra.ReplicationStrategy(cassandraReplicationStrategy)
-	if err := replStrategy.Validate(); err != nil {
-		log.Fatalf(err.Error())
-	}
-	replFactorMap, err := cassandra.NewReplicationFactorMap(cassandraReplicationFactor)
-	if err != nil {
-		log.Fatalf(err.Error())
-	}
-	cassandraOptions := &cassandra.Options{
-		Hosts:               cqlHosts,
-		CQLPort:             cassandraPort,
-		Keyspace:            cassandraKeyspace,
-		ReplicationStrategy: replStrategy,
-		ReplicationFactors:  replFactorMap,
-		LogTableName:        cassandraDefaults.LogTableName,
-		WriteConcurrency:    cassandraWriteConcurrency,
-		WriteBufferSize:     cassandraWriteBufferSize,
-	}
-	if err := cassandraOptions.Validate(); err != nil {
-		log.Fatalf(err.Error())
+	logStore := newLogStore()
+	if err := logStore.Connect(); err != nil {
+		log.Fatalf("failed to connect to %s backend: %s", backend, err)
 	}
 
-	// connect to cassandra
-	log.Infof("using cassandra options: %s", cassandraOptions)
-	cluster := gocql.NewCluster(cassandraOptions.Hosts...)
-	cluster.Port = cassandraOptions.CQLPort
-	cluster.Consistency = gocql.One
-	cqlDriver := cassandra.NewCQLDriver(cluster)
-	logStore := cassandra.NewLogStore(cqlDriver, cassandraOptions)
-	err = logStore.Connect()
-	if err != nil {
-		log.Fatalf("failed to connect to cassandra: %s", err)
-	}
+	logSpool := newSpool(logStore)
 
 	// start REST API server
 	serverConfig := server.Config{
-		BindAddress:     fmt.Sprintf("%s:%d", serverBindAddr, serverPort),
-		EnableProfiling: enableProfiling,
+		BindAddress:          fmt.Sprintf("%s:%d", serverBindAddr, serverPort),
+		EnableProfiling:      enableProfiling,
+		TLSCertPath:          serverTLSCert,
+		TLSKeyPath:           serverTLSKey,
+		TLSClientCAPath:      serverTLSClientCA,
+		TLSRequireClientCert: serverTLSRequireClientCert,
+		Authenticator:        newAuthenticator(),
+		Authorizer:           newAuthorizer(),
+		Spool:                logSpool,
+		AsyncIngest:          asyncIngest,
+	}
+	if err := serverConfig.Validate(); err != nil {
+		log.Fatalf("%s", err)
 	}
 	server := server.NewHTTP(&serverConfig, logStore)
 	go func() {
@@ -224,6 +523,257 @@ func main() {
 	// wait for a signal
 	signal := <-sigChannel
 	log.Infof("interrupted by signal: %s", signal)
+	if logSpool != nil {
+		logSpool.Close()
+	}
 	logStore.Disconnect()
 	server.Stop()
 }
+
+// migrate prints the pending schema migrations of the Cassandra keyspace, or
+// applies them if --apply is given. With --copy-from, the migrations are
+// applied and a log table is copied.
+func migrate() {
+	if backend != cassandraBackend {
+		log.Fatalf("%s: schema migrations are only supported by the %s backend", migrateCommand, cassandraBackend)
+	}
+
+	cassandraOptions := newCassandraOptions()
+	if migrateCopyFrom != "" {
+		copyLogTable(cassandraOptions)
+		return
+	}
+
+	cqlDriver := newCassandraDriver(cassandraOptions)
+	if err := cqlDriver.Connect(); err != nil {
+		log.Fatalf("failed to connect to %s backend: %s", backend, err)
+	}
+	defer cqlDriver.Close()
+
+	migrator := cassandra.NewMigrator(cqlDriver, cassandraOptions)
+	if !migrateApply {
+		pending, err := migrator.Pending()
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		fmt.Printf("%d pending schema migration(s)\n", len(pending))
+		for _, migration := range pending {
+			fmt.Printf("  %s\n", migration)
+		}
+		return
+	}
+
+	applied, err := migrator.Migrate()
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	fmt.Printf("applied %d schema migration(s)\n", len(applied))
+	for _, migration := range applied {
+		fmt.Printf("  %s\n", migration)
+	}
+}
+
+// copyLogTable copies the log entries of the log table given by --copy-from
+// into the log table of the current schema version, after applying any
+// pending migrations.
+func copyLogTable(cassandraOptions *cassandra.Options) {
+	logStore := cassandra.NewLogStore(newCassandraDriver(cassandraOptions), cassandraOptions)
+	if err := logStore.Connect(); err != nil {
+		log.Fatalf("failed to connect to %s backend: %s", backend, err)
+	}
+	defer logStore.Disconnect()
+
+	log.Infof("copying log table %s ...", migrateCopyFrom)
+	copied, err := logStore.CopyLogTable(migrateCopyFrom)
+	fmt.Printf("copied %d log entries from %s.%s\n", copied, cassandraOptions.Keyspace, migrateCopyFrom)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+}
+
+// newSpool opens a spool that replays into a LogStore. Returns nil if no spool
+// directory is given.
+func newSpool(logStore logstore.LogStore) *spool.Spool {
+	if spoolDirectory == "" {
+		return nil
+	}
+	spoolOptions := &spool.Options{
+		Directory:      spoolDirectory,
+		MaxBytes:       int64(spoolMaxBytes),
+		ReplayInterval: spoolDefaults.ReplayInterval,
+	}
+	if err := spoolOptions.Validate(); err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	log.Infof("using spool options: %s", spoolOptions)
+	logSpool := spool.NewSpool(spoolOptions, logStore)
+	if err := logSpool.Open(); err != nil {
+		log.Fatalf("failed to open spool: %s", err)
+	}
+	return logSpool
+}
+
+// newAuthenticator creates an Authenticator from the static token file and/or
+// the TokenReview endpoint. Returns nil if neither is given.
+func newAuthenticator() auth.Authenticator {
+	authenticators := auth.Authenticators{}
+	if authTokenFile != "" {
+		authenticator, err := auth.NewStaticTokenAuthenticatorFromFile(authTokenFile)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		authenticators = append(authenticators, authenticator)
+	}
+	if authTokenReviewURL != "" {
+		authenticator, err := auth.NewTokenReviewAuthenticator(&auth.TokenReviewOptions{
+			URL:        authTokenReviewURL,
+			CACertPath: authTokenReviewCACert,
+			TokenPath:  authTokenReviewTokenFile,
+			Timeout:    tokenReviewDefaults.Timeout,
+			CacheTTL:   tokenReviewDefaults.CacheTTL,
+		})
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		authenticators = append(authenticators, authenticator)
+	}
+	if len(authenticators) == 0 {
+		return nil
+	}
+	return authenticators
+}
+
+// newAuthorizer creates an Authorizer from the policy file. Returns nil if no
+// policy file is given.
+func newAuthorizer() auth.Authorizer {
+	if authPolicyFile == "" {
+		return nil
+	}
+	authorizer, err := auth.NewRuleAuthorizerFromFile(authPolicyFile)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	return authorizer
+}
+
+// newLogStore creates a (disconnected) LogStore for the selected backend.
+func newLogStore() logstore.LogStore {
+	switch backend {
+	case cassandraBackend:
+		return newCassandraLogStore()
+	case diskBackend:
+		return newDiskLogStore()
+	case memoryBackend:
+		return newMemoryLogStore()
+	default:
+		log.Fatalf("unrecognized backend: %s: must be one of %s",
+			backend, []string{cassandraBackend, diskBackend, memoryBackend})
+	}
+	return nil
+}
+
+func newCassandraLogStore() logstore.LogStore {
+	cassandraOptions := newCassandraOptions()
+	return cassandra.NewLogStore(newCassandraDriver(cassandraOptions), cassandraOptions)
+}
+
+// newCassandraOptions creates (validated) Cassandra options from the
+// command-line.
+func newCassandraOptions() *cassandra.Options {
+	cqlHosts := cassandraDefaults.Hosts
+	if len(flag.Args()) > 0 {
+		cqlHosts = flag.Args()
+	}
+
+	replStrategy := cassandra.ReplicationStrategy(cassandraReplicationStrategy)
+	if err := replStrategy.Validate(); err != nil {
+		log.Fatalf("%s", err)
+	}
+	replFactorMap, err := cassandra.NewReplicationFactorMap(cassandraReplicationFactor)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	defaultTTL, err := cassandra.ParseTTL(cassandraDefaultTTL)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	namespaceTTLs, err := cassandra.NewNamespaceTTLs(cassandraNamespaceTTLs)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	cassandraOptions := &cassandra.Options{
+		Hosts:                cqlHosts,
+		CQLPort:              cassandraPort,
+		Keyspace:             cassandraKeyspace,
+		ReplicationStrategy:  replStrategy,
+		ReplicationFactors:   replFactorMap,
+		LogTableName:         cassandraLogTable,
+		HostSelectionPolicy:  cassandra.HostSelectionPolicy(cassandraHostSelectionPolicy),
+		LocalDC:              cassandraLocalDC,
+		TokenAware:           cassandraTokenAware,
+		Username:             cassandraUsername,
+		Password:             cassandraPassword,
+		PasswordFile:         cassandraPasswordFile,
+		EnableTLS:            cassandraEnableTLS,
+		TLSCACertPath:        cassandraTLSCACertPath,
+		TLSCertPath:          cassandraTLSCertPath,
+		TLSKeyPath:           cassandraTLSKeyPath,
+		TLSVerifyHostname:    cassandraTLSVerifyHostname,
+		WriteConsistency:     cassandra.Consistency(cassandraWriteConsistency),
+		ReadConsistency:      cassandra.Consistency(cassandraReadConsistency),
+		WriteConcurrency:     cassandraWriteConcurrency,
+		WriteBufferSize:      cassandraWriteBufferSize,
+		WriteBatchSize:       cassandraWriteBatchSize,
+		ReadConcurrency:      cassandraReadConcurrency,
+		BucketSize:           cassandra.BucketSize(cassandraBucketSize),
+		DefaultTTL:           defaultTTL,
+		NamespaceTTLs:        namespaceTTLs,
+		CompactionStrategy:   cassandra.CompactionStrategy(cassandraCompactionStrategy),
+		CompactionWindowUnit: cassandraWindowUnit,
+		CompactionWindowSize: cassandraWindowSize,
+		Compression:          cassandra.Compression(cassandraCompression),
+		GCGraceSeconds:       cassandraGCGraceSeconds,
+	}
+	if err := cassandraOptions.Validate(); err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	log.Infof("using cassandra options: %s", cassandraOptions)
+	return cassandraOptions
+}
+
+// newCassandraDriver creates a (disconnected) Driver for the Cassandra cluster
+// given by a set of options.
+func newCassandraDriver(cassandraOptions *cassandra.Options) cassandra.Driver {
+	cluster, err := cassandra.NewClusterConfig(cassandraOptions)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	return cassandra.NewCQLDriver(cluster, cassandraOptions)
+}
+
+func newDiskLogStore() logstore.LogStore {
+	diskOptions := &disk.Options{
+		Directory:  diskDirectory,
+		SyncWrites: diskSyncWrites,
+	}
+	if err := diskOptions.Validate(); err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	log.Infof("using disk options: %s", diskOptions)
+	return disk.NewLogStore(diskOptions)
+}
+
+func newMemoryLogStore() logstore.LogStore {
+	memoryOptions := &memory.Options{
+		MaxEntries: memoryMaxEntries,
+	}
+	if err := memoryOptions.Validate(); err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	log.Infof("using memory options: %s", memoryOptions)
+	return memory.NewLogStore(memoryOptions)
+}
@@ -0,0 +1,63 @@
+package auth
+
+import "fmt"
+
+// Principal represents an authenticated client of the REST API.
+type Principal struct {
+	// Name is the user name of the principal. For example,
+	// `system:serviceaccount:logging:fluent-bit`.
+	Name string
+	// Groups are the groups that the principal is a member of.
+	Groups []string
+}
+
+func (p *Principal) String() string {
+	return fmt.Sprintf("%s (groups: %v)", p.Name, p.Groups)
+}
+
+// Authenticator authenticates clients by their bearer token.
+type Authenticator interface {
+	// Authenticate returns the Principal that a bearer token belongs to. If
+	// the token is not recognized, a nil Principal is returned. An error is
+	// returned if the token could not be checked.
+	Authenticate(token string) (*Principal, error)
+}
+
+// Authenticators is an Authenticator that tries each of a list of
+// Authenticators in turn until one of them recognizes a token.
+type Authenticators []Authenticator
+
+// Authenticate returns the Principal of the first Authenticator that
+// recognizes the token.
+func (a Authenticators) Authenticate(token string) (*Principal, error) {
+	for _, authenticator := range a {
+		principal, err := authenticator.Authenticate(token)
+		if err != nil {
+			return nil, err
+		}
+		if principal != nil {
+			return principal, nil
+		}
+	}
+	return nil, nil
+}
+
+// Verb is an action that a Principal can take on the log entries of a
+// namespace.
+type Verb string
+
+// Recognized verbs
+const (
+	// ReadVerb is used for queries.
+	ReadVerb Verb = "read"
+	// WriteVerb is used for writes.
+	WriteVerb Verb = "write"
+)
+
+// Authorizer decides on whether a Principal may read or write the log
+// entries of a namespace.
+type Authorizer interface {
+	// Authorize returns true if the Principal is allowed to perform the
+	// given action on the namespace.
+	Authorize(principal *Principal, verb Verb, namespace string) bool
+}
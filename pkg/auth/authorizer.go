@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+)
+
+// Rule grants a set of users and groups permission to perform some verbs on
+// the log entries of a set of namespaces.
+type Rule struct {
+	// Users are the names of principals that the rule applies to.
+	Users []string `json:"users"`
+	// Groups are the groups of principals that the rule applies to.
+	Groups []string `json:"groups"`
+	// Verbs are the granted verbs (`read`, `write` or `*` for both).
+	Verbs []Verb `json:"verbs"`
+	// Namespaces are the namespaces that the rule applies to. Entries are
+	// shell patterns, such as `team-a-*` or `*`.
+	Namespaces []string `json:"namespaces"`
+}
+
+// Validate ensures that the given Rule is valid.
+func (r *Rule) Validate() error {
+	if len(r.Users) == 0 && len(r.Groups) == 0 {
+		return fmt.Errorf("rule must apply to at least one user or group")
+	}
+	if len(r.Verbs) == 0 {
+		return fmt.Errorf("rule must grant at least one verb")
+	}
+	for _, verb := range r.Verbs {
+		if verb != ReadVerb && verb != WriteVerb && verb != "*" {
+			return fmt.Errorf("rule has unrecognized verb: %s", verb)
+		}
+	}
+	if len(r.Namespaces) == 0 {
+		return fmt.Errorf("rule must apply to at least one namespace")
+	}
+	for _, pattern := range r.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("rule has malformed namespace pattern: %s", pattern)
+		}
+	}
+	return nil
+}
+
+// appliesTo returns true if the rule applies to the given Principal.
+func (r *Rule) appliesTo(principal *Principal) bool {
+	for _, user := range r.Users {
+		if user == principal.Name {
+			return true
+		}
+	}
+	for _, group := range r.Groups {
+		for _, principalGroup := range principal.Groups {
+			if group == principalGroup {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// grants returns true if the rule grants the verb on the namespace.
+func (r *Rule) grants(verb Verb, namespace string) bool {
+	verbGranted := false
+	for _, ruleVerb := range r.Verbs {
+		if ruleVerb == verb || ruleVerb == "*" {
+			verbGranted = true
+		}
+	}
+	if !verbGranted {
+		return false
+	}
+	for _, pattern := range r.Namespaces {
+		if matched, _ := path.Match(pattern, namespace); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleAuthorizer is an Authorizer that only permits what is granted by any
+// of a list of Rules.
+type RuleAuthorizer struct {
+	rules []Rule
+}
+
+// NewRuleAuthorizer creates a RuleAuthorizer from a list of Rules.
+func NewRuleAuthorizer(rules []Rule) (*RuleAuthorizer, error) {
+	for i, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid authorization rule %d: %s", i, err)
+		}
+	}
+	return &RuleAuthorizer{rules: rules}, nil
+}
+
+// NewRuleAuthorizerFromFile creates a RuleAuthorizer from a policy file
+// holding a JSON array of Rules. For example,
+//
+//	[
+//	  {"users": ["fluent-bit"], "verbs": ["write"], "namespaces": ["*"]},
+//	  {"groups": ["team-a"], "verbs": ["read"], "namespaces": ["team-a-*"]}
+//	]
+func NewRuleAuthorizerFromFile(path string) (*RuleAuthorizer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read authorization policy: %s", err)
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse authorization policy: %s", err)
+	}
+	return NewRuleAuthorizer(rules)
+}
+
+// Authorize returns true if any Rule that applies to the Principal grants it
+// the verb on the namespace.
+func (a *RuleAuthorizer) Authorize(principal *Principal, verb Verb, namespace string) bool {
+	for i := range a.rules {
+		rule := &a.rules[i]
+		if rule.appliesTo(principal) && rule.grants(verb, namespace) {
+			return true
+		}
+	}
+	return false
+}
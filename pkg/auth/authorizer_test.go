@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A RuleAuthorizer should only permit what is granted by its rules.
+func TestRuleAuthorizer(t *testing.T) {
+	authorizer, err := NewRuleAuthorizer([]Rule{
+		{Users: []string{"fluent-bit"}, Verbs: []Verb{WriteVerb}, Namespaces: []string{"*"}},
+		{Groups: []string{"team-a"}, Verbs: []Verb{ReadVerb}, Namespaces: []string{"team-a-*"}},
+		{Users: []string{"admin"}, Verbs: []Verb{"*"}, Namespaces: []string{"*"}},
+	})
+	require.Nil(t, err)
+
+	fluentBit := &Principal{Name: "fluent-bit"}
+	alice := &Principal{Name: "alice", Groups: []string{"team-a"}}
+	admin := &Principal{Name: "admin"}
+	tests := []struct {
+		principal  *Principal
+		verb       Verb
+		namespace  string
+		authorized bool
+	}{
+		{principal: fluentBit, verb: WriteVerb, namespace: "default", authorized: true},
+		{principal: fluentBit, verb: ReadVerb, namespace: "default", authorized: false},
+		{principal: alice, verb: ReadVerb, namespace: "team-a-prod", authorized: true},
+		{principal: alice, verb: ReadVerb, namespace: "team-b-prod", authorized: false},
+		{principal: alice, verb: WriteVerb, namespace: "team-a-prod", authorized: false},
+		{principal: admin, verb: ReadVerb, namespace: "kube-system", authorized: true},
+		{principal: admin, verb: WriteVerb, namespace: "kube-system", authorized: true},
+	}
+
+	for _, test := range tests {
+		assert.Equalf(t, test.authorized, authorizer.Authorize(test.principal, test.verb, test.namespace),
+			"unexpected decision for %s to %s %s", test.principal.Name, test.verb, test.namespace)
+	}
+}
+
+// Invalid rules should be rejected.
+func TestRuleValidation(t *testing.T) {
+	tests := []struct {
+		rule                    Rule
+		expectedValidationError string
+	}{
+		{
+			rule:                    Rule{Verbs: []Verb{ReadVerb}, Namespaces: []string{"*"}},
+			expectedValidationError: "rule must apply to at least one user or group",
+		},
+		{
+			rule:                    Rule{Users: []string{"alice"}, Namespaces: []string{"*"}},
+			expectedValidationError: "rule must grant at least one verb",
+		},
+		{
+			rule:                    Rule{Users: []string{"alice"}, Verbs: []Verb{"delete"}, Namespaces: []string{"*"}},
+			expectedValidationError: "rule has unrecognized verb: delete",
+		},
+		{
+			rule:                    Rule{Users: []string{"alice"}, Verbs: []Verb{ReadVerb}},
+			expectedValidationError: "rule must apply to at least one namespace",
+		},
+		{
+			rule:                    Rule{Users: []string{"alice"}, Verbs: []Verb{ReadVerb}, Namespaces: []string{"team-["}},
+			expectedValidationError: "rule has malformed namespace pattern: team-[",
+		},
+	}
+
+	for _, test := range tests {
+		err := test.rule.Validate()
+		require.NotNilf(t, err, "expected rule to be invalid: %+v", test.rule)
+		assert.Equalf(t, test.expectedValidationError, err.Error(), "unexpected validation error")
+	}
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// StaticTokenAuthenticator authenticates clients against a fixed set of
+// bearer tokens.
+type StaticTokenAuthenticator struct {
+	tokens map[string]*Principal
+}
+
+// NewStaticTokenAuthenticator creates a StaticTokenAuthenticator from a map of
+// tokens to the Principals they belong to.
+func NewStaticTokenAuthenticator(tokens map[string]*Principal) *StaticTokenAuthenticator {
+	return &StaticTokenAuthenticator{tokens: tokens}
+}
+
+// NewStaticTokenAuthenticatorFromFile creates a StaticTokenAuthenticator from a
+// CSV token file of the same format as the Kubernetes API server's
+// `--token-auth-file`. That is, each line holds a token, a user name, a user
+// uid and an optional (quoted) comma-separated list of groups:
+//
+//	31ada4fd-adec-460c-809a-9e56ceb75269,fluent-bit,1,"writers,system"
+//
+// The user uid is ignored.
+func NewStaticTokenAuthenticatorFromFile(path string) (*StaticTokenAuthenticator, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open token file: %s", err)
+	}
+	defer file.Close()
+
+	tokens := make(map[string]*Principal)
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse token file: %s", err)
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("token file line %d: expected at least 3 fields, was: %d", line, len(record))
+		}
+		token, name := strings.TrimSpace(record[0]), strings.TrimSpace(record[1])
+		if token == "" || name == "" {
+			return nil, fmt.Errorf("token file line %d: token and user name must not be empty", line)
+		}
+		principal := &Principal{Name: name, Groups: []string{}}
+		if len(record) > 3 && record[3] != "" {
+			for _, group := range strings.Split(record[3], ",") {
+				principal.Groups = append(principal.Groups, strings.TrimSpace(group))
+			}
+		}
+		tokens[token] = principal
+	}
+
+	return NewStaticTokenAuthenticator(tokens), nil
+}
+
+// Authenticate returns the Principal that a token belongs to, or nil if the
+// token is not recognized.
+func (a *StaticTokenAuthenticator) Authenticate(token string) (*Principal, error) {
+	return a.tokens[token], nil
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Tokens in a token file should authenticate the principals they belong to.
+func TestStaticTokenAuthenticatorFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "tokens.csv")
+	content := "token1,fluent-bit,1,\"writers,system\"\n" +
+		"token2,alice,2\n"
+	require.Nil(t, ioutil.WriteFile(tokenFile, []byte(content), 0600))
+
+	authenticator, err := NewStaticTokenAuthenticatorFromFile(tokenFile)
+	require.Nilf(t, err, "unexpected error loading token file")
+
+	principal, err := authenticator.Authenticate("token1")
+	require.Nil(t, err)
+	assert.Equal(t, &Principal{Name: "fluent-bit", Groups: []string{"writers", "system"}}, principal)
+
+	principal, err = authenticator.Authenticate("token2")
+	require.Nil(t, err)
+	assert.Equal(t, &Principal{Name: "alice", Groups: []string{}}, principal)
+
+	principal, err = authenticator.Authenticate("unknown")
+	require.Nil(t, err)
+	assert.Nilf(t, principal, "expected unknown token to not be recognized")
+}
+
+// Malformed token files should be rejected.
+func TestStaticTokenAuthenticatorOnMalformedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		content       string
+		expectedError string
+	}{
+		{
+			content:       "token1,fluent-bit\n",
+			expectedError: "token file line 1: expected at least 3 fields, was: 2",
+		},
+		{
+			content:       "token1,fluent-bit,1\n,alice,2\n",
+			expectedError: "token file line 2: token and user name must not be empty",
+		},
+	}
+
+	for _, test := range tests {
+		tokenFile := filepath.Join(dir, "tokens.csv")
+		require.Nil(t, ioutil.WriteFile(tokenFile, []byte(test.content), 0600))
+		_, err := NewStaticTokenAuthenticatorFromFile(tokenFile)
+		require.NotNilf(t, err, "expected token file to be rejected: %q", test.content)
+		assert.Equalf(t, test.expectedError, err.Error(), "unexpected error")
+	}
+}
+
+// Authenticators should return the principal of the first authenticator that
+// recognizes a token.
+func TestAuthenticators(t *testing.T) {
+	authenticators := Authenticators{
+		NewStaticTokenAuthenticator(map[string]*Principal{"token1": {Name: "alice"}}),
+		NewStaticTokenAuthenticator(map[string]*Principal{"token1": {Name: "bob"}, "token2": {Name: "carol"}}),
+	}
+
+	principal, _ := authenticators.Authenticate("token1")
+	assert.Equal(t, "alice", principal.Name)
+	principal, _ = authenticators.Authenticate("token2")
+	assert.Equal(t, "carol", principal.Name)
+	principal, _ = authenticators.Authenticate("token3")
+	assert.Nil(t, principal)
+}
@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenReviewOptions describes how to reach a Kubernetes TokenReview
+// endpoint.
+type TokenReviewOptions struct {
+	// URL is the TokenReview endpoint. For example,
+	// `https://kubernetes.default.svc/apis/authentication.k8s.io/v1/tokenreviews`.
+	URL string
+	// CACertPath is the path to a PEM-encoded CA bundle used to verify the
+	// server certificate of the endpoint. If empty, the system roots are used.
+	CACertPath string
+	// TokenPath is the path to a file holding the bearer token that the log
+	// server uses to authenticate to the endpoint (typically a service
+	// account token). The file is re-read on every request, to pick up
+	// rotated tokens.
+	TokenPath string
+	// Timeout is the time limit for a TokenReview request.
+	Timeout time.Duration
+	// CacheTTL is the time for which a successful review is cached.
+	// A zero value disables caching.
+	CacheTTL time.Duration
+}
+
+// Validate ensures that the given TokenReviewOptions are valid.
+func (o *TokenReviewOptions) Validate() error {
+	if o.URL == "" {
+		return fmt.Errorf("invalid token review options: no URL given")
+	}
+	if !strings.HasPrefix(o.URL, "http://") && !strings.HasPrefix(o.URL, "https://") {
+		return fmt.Errorf("invalid token review options: URL must be a http or https URL")
+	}
+	if o.Timeout <= 0 {
+		return fmt.Errorf("invalid token review options: timeout must be positive")
+	}
+	if o.CacheTTL < 0 {
+		return fmt.Errorf("invalid token review options: cache TTL must be a non-negative value")
+	}
+	return nil
+}
+
+// tokenReview is the subset of the Kubernetes
+// `authentication.k8s.io/v1 TokenReview` resource used by the log server.
+type tokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       tokenReviewSpec   `json:"spec"`
+	Status     tokenReviewStatus `json:"status"`
+}
+
+type tokenReviewSpec struct {
+	Token string `json:"token"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool     `json:"authenticated"`
+	User          userInfo `json:"user"`
+	Error         string   `json:"error,omitempty"`
+}
+
+type userInfo struct {
+	Username string   `json:"username"`
+	Groups   []string `json:"groups"`
+}
+
+// cachedReview is a cached, successful token review.
+type cachedReview struct {
+	principal *Principal
+	expires   time.Time
+}
+
+// TokenReviewAuthenticator authenticates bearer tokens by submitting them to
+// a Kubernetes TokenReview endpoint.
+type TokenReviewAuthenticator struct {
+	options *TokenReviewOptions
+	client  *http.Client
+
+	// mutex protects cache
+	mutex sync.Mutex
+	// cache holds successful reviews by token
+	cache map[string]cachedReview
+}
+
+// NewTokenReviewAuthenticator creates a TokenReviewAuthenticator with the
+// given TokenReviewOptions.
+func NewTokenReviewAuthenticator(options *TokenReviewOptions) (*TokenReviewAuthenticator, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{}
+	if options.CACertPath != "" {
+		pem, err := ioutil.ReadFile(options.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token review CA bundle: %s", err)
+		}
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("failed to parse token review CA bundle: %s", options.CACertPath)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	return &TokenReviewAuthenticator{
+		options: options,
+		client: &http.Client{
+			Timeout:   options.Timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		cache: make(map[string]cachedReview),
+	}, nil
+}
+
+// Authenticate submits the token for review, and returns the Principal that
+// it belongs to if it was authenticated.
+func (a *TokenReviewAuthenticator) Authenticate(token string) (*Principal, error) {
+	if principal := a.cached(token); principal != nil {
+		return principal, nil
+	}
+
+	review, err := a.review(token)
+	if err != nil {
+		return nil, err
+	}
+	if !review.Status.Authenticated {
+		return nil, nil
+	}
+
+	principal := &Principal{Name: review.Status.User.Username, Groups: review.Status.User.Groups}
+	if principal.Groups == nil {
+		principal.Groups = []string{}
+	}
+	a.store(token, principal)
+	return principal, nil
+}
+
+// review submits a TokenReview for the given token.
+func (a *TokenReviewAuthenticator) review(token string) (*tokenReview, error) {
+	body, err := json.Marshal(tokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec:       tokenReviewSpec{Token: token},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal token review: %s", err)
+	}
+	req, err := http.NewRequest("POST", a.options.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token review request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.options.TokenPath != "" {
+		serviceToken, err := ioutil.ReadFile(a.options.TokenPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token review credentials: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(serviceToken)))
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token review request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("token review request failed: unexpected response code: %d", resp.StatusCode)
+	}
+
+	var review tokenReview
+	if err := json.NewDecoder(resp.Body).Decode(&review); err != nil {
+		return nil, fmt.Errorf("failed to parse token review response: %s", err)
+	}
+	return &review, nil
+}
+
+// cached returns the Principal of a cached, unexpired review of the token, or
+// nil if there is none.
+func (a *TokenReviewAuthenticator) cached(token string) *Principal {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	entry, ok := a.cache[token]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(a.cache, token)
+		return nil
+	}
+	return entry.principal
+}
+
+// store caches a successful review of a token.
+func (a *TokenReviewAuthenticator) store(token string, principal *Principal) {
+	if a.options.CacheTTL == 0 {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	// drop expired entries to keep the cache from growing unbounded
+	for cachedToken, entry := range a.cache {
+		if now.After(entry.expires) {
+			delete(a.cache, cachedToken)
+		}
+	}
+	a.cache[token] = cachedReview{principal: principal, expires: now.Add(a.options.CacheTTL)}
+}
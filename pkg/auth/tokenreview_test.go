@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTokenReviewServer starts a TokenReview endpoint that authenticates the
+// token "valid" as user "fluent-bit" and counts the reviews it receives.
+func fakeTokenReviewServer(t *testing.T, reviews *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*reviews++
+		assert.Equalf(t, "Bearer service-token", r.Header.Get("Authorization"), "unexpected credentials")
+
+		var review tokenReview
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&review))
+		assert.Equal(t, "TokenReview", review.Kind)
+		if review.Spec.Token == "valid" {
+			review.Status = tokenReviewStatus{
+				Authenticated: true,
+				User:          userInfo{Username: "fluent-bit", Groups: []string{"writers"}},
+			}
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(review)
+	}))
+}
+
+// The TokenReviewAuthenticator should authenticate tokens by submitting them
+// to the TokenReview endpoint, and cache successful reviews.
+func TestTokenReviewAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	tokenPath := filepath.Join(dir, "token")
+	require.Nil(t, ioutil.WriteFile(tokenPath, []byte("service-token\n"), 0600))
+
+	reviews := 0
+	server := fakeTokenReviewServer(t, &reviews)
+	defer server.Close()
+
+	authenticator, err := NewTokenReviewAuthenticator(&TokenReviewOptions{
+		URL:       server.URL,
+		TokenPath: tokenPath,
+		Timeout:   5 * time.Second,
+		CacheTTL:  1 * time.Minute,
+	})
+	require.Nil(t, err)
+
+	principal, err := authenticator.Authenticate("valid")
+	require.Nil(t, err)
+	assert.Equal(t, &Principal{Name: "fluent-bit", Groups: []string{"writers"}}, principal)
+	// second call should be served from cache
+	principal, err = authenticator.Authenticate("valid")
+	require.Nil(t, err)
+	assert.Equal(t, "fluent-bit", principal.Name)
+	assert.Equalf(t, 1, reviews, "expected successful review to be cached")
+
+	principal, err = authenticator.Authenticate("invalid")
+	require.Nil(t, err)
+	assert.Nilf(t, principal, "expected token to not be authenticated")
+}
+
+// An unreachable TokenReview endpoint should result in an error.
+func TestTokenReviewAuthenticatorOnUnreachableEndpoint(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	authenticator, err := NewTokenReviewAuthenticator(&TokenReviewOptions{URL: server.URL, Timeout: 5 * time.Second})
+	require.Nil(t, err)
+	_, err = authenticator.Authenticate("valid")
+	require.NotNilf(t, err, "expected review to fail")
+	assert.Equal(t, "token review request failed: unexpected response code: 500", err.Error())
+}
+
+// Verify the behavior of TokenReviewOptions.Validate()
+func TestTokenReviewOptionsValidation(t *testing.T) {
+	tests := []struct {
+		options                 TokenReviewOptions
+		expectedValidationError string
+	}{
+		{
+			options:                 TokenReviewOptions{URL: "https://kubernetes.default.svc", Timeout: time.Second},
+			expectedValidationError: "",
+		},
+		{
+			options:                 TokenReviewOptions{Timeout: time.Second},
+			expectedValidationError: "invalid token review options: no URL given",
+		},
+		{
+			options:                 TokenReviewOptions{URL: "kubernetes.default.svc", Timeout: time.Second},
+			expectedValidationError: "invalid token review options: URL must be a http or https URL",
+		},
+		{
+			options:                 TokenReviewOptions{URL: "https://kubernetes.default.svc"},
+			expectedValidationError: "invalid token review options: timeout must be positive",
+		},
+		{
+			options:                 TokenReviewOptions{URL: "https://kubernetes.default.svc", Timeout: time.Second, CacheTTL: -1},
+			expectedValidationError: "invalid token review options: cache TTL must be a non-negative value",
+		},
+	}
+
+	for _, test := range tests {
+		err := test.options.Validate()
+		if test.expectedValidationError == "" {
+			assert.Nilf(t, err, "expected options to be valid: %+v", test.options)
+		} else {
+			require.NotNilf(t, err, "expected options to be invalid: %+v", test.options)
+			assert.Equalf(t, test.expectedValidationError, err.Error(), "unexpected validation error")
+		}
+	}
+}
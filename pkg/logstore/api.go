@@ -1,7 +1,12 @@
 package logstore
 
 import (
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -68,19 +73,72 @@ func (l *LogEntry) Validate() error {
 	return nil
 }
 
+// EntryHash returns the entry hash of a log entry, which tells it apart from
+// other log entries of its pod container with the same timestamp. The hash is
+// computed from the content of the log entry, so that a log entry that is
+// written again (for instance, when a client retries a batch) overwrites
+// itself rather than being duplicated.
+func EntryHash(logEntry *LogEntry) int64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(logEntry.Stream))
+	hash.Write([]byte{0})
+	hash.Write([]byte(logEntry.Kubernetes.DockerID))
+	hash.Write([]byte{0})
+	hash.Write([]byte(logEntry.Log))
+	return int64(hash.Sum64())
+}
+
+// EntryBefore returns true if a log entry with time t1 and entry hash h1 is
+// ordered before one with time t2 and entry hash h2. LogStores order the log
+// entries of a pod container by time and, for equal times, by entry hash, so
+// that log entries with the same timestamp have a stable order.
+func EntryBefore(t1 time.Time, h1 int64, t2 time.Time, h2 int64) bool {
+	if !t1.Equal(t2) {
+		return t1.Before(t2)
+	}
+	return h1 < h2
+}
+
 // QueryResult contains a list of LogRows that matched a given query.
 type QueryResult struct {
 	LogRows []LogRow `json:"log_rows"`
+	// NextToken, when set, is an opaque continuation token that can be passed
+	// with an otherwise identical Query to fetch the next page of the result.
+	// It is only set for queries with a Limit.
+	NextToken string `json:"next_token,omitempty"`
 }
 
 // LogRow represents a single log entry in a QueryResult.
 type LogRow struct {
-	Time time.Time `json:"time"`
-	Log  string    `json:"log"`
+	Time   time.Time `json:"time"`
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	// PodName and ContainerName tag the row with its origin. They are only
+	// set in the result of a query that spans several containers (see
+	// Query.MultiContainer).
+	PodName       string `json:"pod_name,omitempty"`
+	ContainerName string `json:"container_name,omitempty"`
 }
 
 func (l *LogRow) String() string {
-	return fmt.Sprintf("%s: %s", l.Time, l.Log)
+	if l.PodName != "" {
+		return fmt.Sprintf("%s %s/%s [%s]: %s", l.Time, l.PodName, l.ContainerName, l.Stream, l.Log)
+	}
+	return fmt.Sprintf("%s [%s]: %s", l.Time, l.Stream, l.Log)
+}
+
+// SortRows sorts the merged LogRows of several containers by time. Rows with
+// identical timestamps are ordered by pod and container name.
+func SortRows(rows []LogRow) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		if !rows[i].Time.Equal(rows[j].Time) {
+			return rows[i].Time.Before(rows[j].Time)
+		}
+		if rows[i].PodName != rows[j].PodName {
+			return rows[i].PodName < rows[j].PodName
+		}
+		return rows[i].ContainerName < rows[j].ContainerName
+	})
 }
 
 // APIError represents an error that can be returned by the REST API.
@@ -92,6 +150,27 @@ type APIError struct {
 	Detail string `json:"detail"`
 }
 
+// WriteResult is the response to a `POST /write` with partial writes
+// enabled, which reports the log entries that were not stored.
+type WriteResult struct {
+	// Stored is the number of log entries that were stored (or, on
+	// asynchronous ingest, queued).
+	Stored int `json:"stored"`
+	// Failed holds the log entries that were not stored, ordered by index.
+	Failed []WriteFailure `json:"failed"`
+}
+
+// WriteFailure reports a log entry that was not stored.
+type WriteFailure struct {
+	// Index is the position of the log entry in the request.
+	Index int `json:"index"`
+	// Error describes why the log entry was not stored.
+	Error string `json:"error"`
+	// Retryable is true if the log entry is valid and may be stored if
+	// written again.
+	Retryable bool `json:"retryable"`
+}
+
 // APIStatus represents a JSON status message on `GET /write`
 type APIStatus struct {
 	Healthy bool `json:"healthy"`
@@ -104,6 +183,7 @@ type APIStatus struct {
 type LogStore interface {
 	LogWriter
 	LogQueryer
+	LogCatalog
 	// Connect runs the code necessary (if any) to set up a connection
 	// to the backing data store.
 	Connect() error
@@ -119,10 +199,66 @@ type LogStore interface {
 
 // LogWriter writes Kubernetes pod log entries to a backing datastore.
 type LogWriter interface {
-	// Write writes a collection of log entries to a backing store.
+	// Write writes a collection of log entries to a backing store. If only
+	// some of the log entries could be stored, a WriteError identifies the
+	// ones that were not, so that the caller can retry only those.
 	Write(entries []LogEntry) error
 }
 
+// EntryError reports that a single log entry could not be stored.
+type EntryError struct {
+	// Index is the position of the log entry in the written collection.
+	Index int
+	// Err describes why the log entry could not be stored.
+	Err error
+}
+
+// WriteError is returned by LogWriter.Write() when some of the written log
+// entries could not be stored. All other log entries were stored.
+type WriteError struct {
+	// Failures holds an EntryError for every log entry that could not be
+	// stored, ordered by index.
+	Failures []EntryError
+}
+
+// NewWriteError creates a WriteError from the errors of the log entries (by
+// index) that could not be stored.
+func NewWriteError(entryErrs map[int]error) WriteError {
+	failures := make([]EntryError, 0, len(entryErrs))
+	for index, err := range entryErrs {
+		failures = append(failures, EntryError{Index: index, Err: err})
+	}
+	sort.Slice(failures, func(i, j int) bool { return failures[i].Index < failures[j].Index })
+	return WriteError{Failures: failures}
+}
+
+func (e WriteError) Error() string {
+	if len(e.Failures) == 0 {
+		return "write failed"
+	}
+	first := e.Failures[0]
+	return fmt.Sprintf("failed to store %d log entries: entry %d: %s", len(e.Failures), first.Index, first.Err)
+}
+
+// Split divides the written log entries into those that were stored and
+// those that were not.
+func (e WriteError) Split(entries []LogEntry) (stored, failed []LogEntry) {
+	isFailed := make(map[int]bool, len(e.Failures))
+	for _, failure := range e.Failures {
+		isFailed[failure.Index] = true
+	}
+	stored = make([]LogEntry, 0, len(entries)-len(e.Failures))
+	failed = make([]LogEntry, 0, len(e.Failures))
+	for i, entry := range entries {
+		if isFailed[i] {
+			failed = append(failed, entry)
+		} else {
+			stored = append(stored, entry)
+		}
+	}
+	return stored, failed
+}
+
 // QueryError is used as an error return on invalid Query instances.
 type QueryError string
 
@@ -131,12 +267,48 @@ func (e QueryError) Error() string {
 }
 
 // Query represents a query for historical Kubernetes pod log entries.
+//
+// A Query either targets a single pod container, given by PodName and
+// ContainerName, or all containers in the namespace whose pod matches a
+// PodNamePrefix and/or a LabelSelector (optionally narrowed down to the
+// containers with a given ContainerName). The latter kind of query merges
+// the log rows of all matching containers by time.
 type Query struct {
-	Namespace     string    `json:"namespace"`
-	PodName       string    `json:"pod_name"`
-	ContainerName string    `json:"container_name"`
+	Namespace     string `json:"namespace"`
+	PodName       string `json:"pod_name"`
+	ContainerName string `json:"container_name"`
+	// PodNamePrefix, if given, selects all pods whose name starts with the
+	// given prefix.
+	PodNamePrefix string `json:"pod_name_prefix,omitempty"`
+	// LabelSelector, if given, selects all pods that carry the given labels.
+	// It is a comma-separated list of key=value pairs (see
+	// ParseLabelSelector).
+	LabelSelector string    `json:"label_selector,omitempty"`
 	StartTime     time.Time `json:"start_time"`
 	EndTime       time.Time `json:"end_time"`
+	// Contains, if given, only matches log entries whose message contains
+	// the given substring.
+	Contains string `json:"contains,omitempty"`
+	// Regex, if given, only matches log entries whose message matches the
+	// given regular expression (RE2 syntax).
+	Regex string `json:"regex,omitempty"`
+	// IgnoreCase makes Contains and Regex match case-insensitively.
+	IgnoreCase bool `json:"ignore_case,omitempty"`
+	// Stream, if given, only matches log entries written to the given output
+	// stream (`stdout` or `stderr`).
+	Stream string `json:"stream,omitempty"`
+	// Limit, if positive, is the maximum number of log rows to return. If
+	// more rows match, the QueryResult carries a NextToken.
+	Limit int `json:"limit,omitempty"`
+	// NextToken is the continuation token of a previous QueryResult, to
+	// resume the query where that result left off.
+	NextToken string `json:"next_token,omitempty"`
+	// Order is the order of the returned log rows: `asc` (oldest first,
+	// the default) or `desc` (newest first).
+	Order string `json:"order,omitempty"`
+	// Tail, if positive, only returns the Tail latest matching log rows
+	// (in the given Order).
+	Tail int `json:"tail,omitempty"`
 }
 
 // Validate checks the validity of a Query.
@@ -144,11 +316,17 @@ func (q *Query) Validate() error {
 	if q.Namespace == "" {
 		return QueryError("missing query parameter: namespace")
 	}
-	if q.PodName == "" {
-		return QueryError("missing query parameter: pod_name")
-	}
-	if q.ContainerName == "" {
-		return QueryError("missing query parameter: container_name")
+	if q.MultiContainer() {
+		if q.PodName != "" {
+			return QueryError("query parameter pod_name: cannot be combined with pod_name_prefix or label_selector")
+		}
+	} else {
+		if q.PodName == "" {
+			return QueryError("missing query parameter: pod_name")
+		}
+		if q.ContainerName == "" {
+			return QueryError("missing query parameter: container_name")
+		}
 	}
 	if q.StartTime.IsZero() {
 		return QueryError("missing query parameter: start_time")
@@ -160,16 +338,227 @@ func (q *Query) Validate() error {
 	if !q.StartTime.Before(q.EndTime) {
 		return QueryError("query time-interval: start_time must be earlier than end_time")
 	}
+	if q.Stream != "" && q.Stream != "stdout" && q.Stream != "stderr" {
+		return QueryError("query parameter stream: must be one of stdout and stderr")
+	}
+	if _, err := q.Filter(); err != nil {
+		return err
+	}
+	if q.Limit < 0 {
+		return QueryError("query parameter limit: must be a non-negative value")
+	}
+	if q.NextToken != "" && q.Limit == 0 {
+		return QueryError("query parameter next_token: requires a limit to be given")
+	}
+	if _, err := ParseLabelSelector(q.LabelSelector); err != nil {
+		return err
+	}
+	if q.MultiContainer() && q.Limit > 0 {
+		return QueryError("query parameter limit: not supported for queries by pod_name_prefix or label_selector")
+	}
+	if q.Order != "" && q.Order != "asc" && q.Order != "desc" {
+		return QueryError("query parameter order: must be one of asc and desc")
+	}
+	if q.Tail < 0 {
+		return QueryError("query parameter tail: must be a non-negative value")
+	}
+	if q.Limit > 0 && (q.Descending() || q.Tail > 0) {
+		return QueryError("query parameter limit: cannot be combined with order=desc or tail")
+	}
 	return nil
 }
 
+// Descending returns true if the Query asks for log rows newest first.
+func (q *Query) Descending() bool {
+	return q.Order == "desc"
+}
+
+// MultiContainer returns true if the Query selects pods by PodNamePrefix or
+// LabelSelector, rather than targeting a single pod container.
+func (q *Query) MultiContainer() bool {
+	return q.PodNamePrefix != "" || q.LabelSelector != ""
+}
+
+// MatchesContainer returns true if the given pod container (in the query's
+// namespace) is targeted by the Query, not considering its LabelSelector.
+func (q *Query) MatchesContainer(podName, containerName string) bool {
+	if !q.MultiContainer() {
+		return podName == q.PodName && containerName == q.ContainerName
+	}
+	if q.ContainerName != "" && containerName != q.ContainerName {
+		return false
+	}
+	return strings.HasPrefix(podName, q.PodNamePrefix)
+}
+
+// LabelSelector selects pods by their labels. A pod matches if it carries all
+// the labels of the selector.
+type LabelSelector map[string]string
+
+// ParseLabelSelector parses a LabelSelector from a comma-separated list of
+// key=value pairs, such as `app=nginx,tier=frontend`. An empty string yields
+// an empty selector, which matches any pod.
+func ParseLabelSelector(selector string) (LabelSelector, error) {
+	labels := LabelSelector{}
+	if selector == "" {
+		return labels, nil
+	}
+	for _, requirement := range strings.Split(selector, ",") {
+		parts := strings.SplitN(requirement, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" {
+			return nil, QueryError(fmt.Sprintf("query parameter label_selector: expected key=value, was: '%s'", requirement))
+		}
+		labels[key] = strings.TrimSpace(parts[1])
+	}
+	return labels, nil
+}
+
+// Matches returns true if the given pod labels satisfy the LabelSelector.
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	for key, value := range s {
+		if actual, ok := labels[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// LogFilter decides whether a LogRow matches the filters of a Query.
+type LogFilter func(row *LogRow) bool
+
+// Filter returns a LogFilter that matches the log rows that satisfy the
+// Stream, Contains, Regex and IgnoreCase fields of the Query. An error is
+// returned if the Regex is malformed.
+func (q *Query) Filter() (LogFilter, error) {
+	contains := q.Contains
+	if q.IgnoreCase {
+		contains = strings.ToLower(contains)
+	}
+	var regex *regexp.Regexp
+	if q.Regex != "" {
+		expr := q.Regex
+		if q.IgnoreCase {
+			expr = "(?i)" + expr
+		}
+		var err error
+		regex, err = regexp.Compile(expr)
+		if err != nil {
+			return nil, QueryError(fmt.Sprintf("query parameter regex: %s", err))
+		}
+	}
+
+	return func(row *LogRow) bool {
+		if q.Stream != "" && row.Stream != q.Stream {
+			return false
+		}
+		if contains != "" {
+			haystack := row.Log
+			if q.IgnoreCase {
+				haystack = strings.ToLower(haystack)
+			}
+			if !strings.Contains(haystack, contains) {
+				return false
+			}
+		}
+		if regex != nil && !regex.MatchString(row.Log) {
+			return false
+		}
+		return true
+	}, nil
+}
+
 func (q *Query) String() string {
-	return fmt.Sprintf(`{"Namespace": "%s", "PodName": "%s", "Container": "%s", "StartTime": "%s", "EndTime": "%s"}`,
-		q.Namespace, q.PodName, q.ContainerName, q.StartTime.Format(time.RFC3339Nano), q.EndTime.Format(time.RFC3339Nano))
+	return fmt.Sprintf(`{"Namespace": "%s", "PodName": "%s", "Container": "%s", "PodNamePrefix": "%s", "LabelSelector": "%s", "StartTime": "%s", "EndTime": "%s", "Contains": "%s", "Regex": "%s", "IgnoreCase": %v, "Stream": "%s", "Limit": %d, "NextToken": "%s", "Order": "%s", "Tail": %d}`,
+		q.Namespace, q.PodName, q.ContainerName, q.PodNamePrefix, q.LabelSelector, q.StartTime.Format(time.RFC3339Nano), q.EndTime.Format(time.RFC3339Nano),
+		q.Contains, q.Regex, q.IgnoreCase, q.Stream, q.Limit, q.NextToken, q.Order, q.Tail)
+}
+
+// LogRowHandler is called with every LogRow of a streamed query. Returning an
+// error aborts the query.
+type LogRowHandler func(row *LogRow) error
+
+// errTailCollected stops the scan of a Tail query once enough rows have been
+// collected.
+var errTailCollected = errors.New("tail collected")
+
+// OrderedScan passes the log rows of a query to a handler in the order that
+// the query asks for (see Query.Order and Query.Tail), given a scan function
+// that passes the matching log rows to a handler either oldest first or
+// newest first. A Tail query is scanned newest first and the scan is stopped
+// once Tail rows have been collected. It is intended to implement QueryStream.
+func OrderedScan(query *Query, scan func(descending bool, handler LogRowHandler) error, handler LogRowHandler) error {
+	if query.Tail == 0 {
+		return scan(query.Descending(), handler)
+	}
+
+	rows := make([]LogRow, 0)
+	err := scan(true, func(row *LogRow) error {
+		rows = append(rows, *row)
+		if len(rows) == query.Tail {
+			return errTailCollected
+		}
+		return nil
+	})
+	if err != nil && err != errTailCollected {
+		return err
+	}
+	if !query.Descending() {
+		ReverseRows(rows)
+	}
+	for i := range rows {
+		if err := handler(&rows[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CollectRows runs a streamed query and collects its log rows into a
+// QueryResult.
+func CollectRows(query *Query, queryStream func(query *Query, handler LogRowHandler) error) (*QueryResult, error) {
+	result := &QueryResult{LogRows: make([]LogRow, 0)}
+	err := queryStream(query, func(row *LogRow) error {
+		result.LogRows = append(result.LogRows, *row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ReverseRows reverses the order of a collection of LogRows.
+func ReverseRows(rows []LogRow) {
+	for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+		rows[i], rows[j] = rows[j], rows[i]
+	}
 }
 
 // LogQueryer queries a backing datastore for historical Kubernetes pod log entries.
 type LogQueryer interface {
 	// Query runs a for historical log entries.
 	Query(query *Query) (*QueryResult, error)
+
+	// QueryStream runs a query for historical log entries, and passes each
+	// matching log row (in the order of the query) to a handler as soon as
+	// it has been fetched from the backing datastore, rather than collecting
+	// the entire result in memory (except for the rows of a Tail query).
+	// Pagination (Limit and NextToken) is not supported. If the handler
+	// returns an error, the query is aborted and that error is returned.
+	QueryStream(query *Query, handler LogRowHandler) error
+}
+
+// LogCatalog lists the namespaces, pods and containers that have log entries
+// within a time interval. Backing datastores that organize log entries by date
+// may answer at date granularity, that is, they may include the containers
+// that only have log entries on the first or last date of the interval but
+// outside of the interval itself. Names are returned in sorted order.
+type LogCatalog interface {
+	// Namespaces lists the namespaces with log entries.
+	Namespaces(start, end time.Time) ([]string, error)
+	// Pods lists the pods with log entries in a namespace.
+	Pods(namespace string, start, end time.Time) ([]string, error)
+	// Containers lists the containers with log entries of a pod.
+	Containers(namespace, podName string, start, end time.Time) ([]string, error)
 }
@@ -1,6 +1,9 @@
 package logstore
 
 import (
+	"encoding/base64"
+	"fmt"
+	"math"
 	"testing"
 	"time"
 
@@ -165,6 +168,79 @@ func TestQueryValidation(t *testing.T) {
 			},
 			expectedValidationErr: "query time-interval: start_time must be earlier than end_time",
 		},
+		{
+			query: &Query{
+				Namespace:     "default",
+				PodName:       "nginx-deployment-abcde",
+				ContainerName: "nginx",
+				StartTime:     time.Now(),
+				EndTime:       time.Now().Add(1 * time.Minute),
+				Regex:         "status=(5",
+			},
+			expectedValidationErr: "query parameter regex: error parsing regexp: missing closing ): `status=(5`",
+		},
+		{
+			query: &Query{
+				Namespace:     "default",
+				PodName:       "nginx-deployment-abcde",
+				ContainerName: "nginx",
+				StartTime:     time.Now(),
+				EndTime:       time.Now().Add(1 * time.Minute),
+				Stream:        "stdin",
+			},
+			expectedValidationErr: "query parameter stream: must be one of stdout and stderr",
+		},
+		{
+			query: &Query{
+				Namespace:     "default",
+				PodName:       "nginx-deployment-abcde",
+				ContainerName: "nginx",
+				StartTime:     time.Now(),
+				EndTime:       time.Now().Add(1 * time.Minute),
+				Limit:         -1,
+			},
+			expectedValidationErr: "query parameter limit: must be a non-negative value",
+		},
+		{
+			query: &Query{
+				Namespace:     "default",
+				PodName:       "nginx-deployment-abcde",
+				ContainerName: "nginx",
+				StartTime:     time.Now(),
+				EndTime:       time.Now().Add(1 * time.Minute),
+				NextToken:     "abc",
+			},
+			expectedValidationErr: "query parameter next_token: requires a limit to be given",
+		},
+		{
+			query: &Query{
+				Namespace:     "default",
+				PodName:       "nginx-deployment-abcde",
+				PodNamePrefix: "nginx-deployment-",
+				StartTime:     time.Now(),
+				EndTime:       time.Now().Add(1 * time.Minute),
+			},
+			expectedValidationErr: "query parameter pod_name: cannot be combined with pod_name_prefix or label_selector",
+		},
+		{
+			query: &Query{
+				Namespace:     "default",
+				LabelSelector: "app=nginx,tier",
+				StartTime:     time.Now(),
+				EndTime:       time.Now().Add(1 * time.Minute),
+			},
+			expectedValidationErr: "query parameter label_selector: expected key=value, was: 'tier'",
+		},
+		{
+			query: &Query{
+				Namespace:     "default",
+				LabelSelector: "app=nginx",
+				StartTime:     time.Now(),
+				EndTime:       time.Now().Add(1 * time.Minute),
+				Limit:         10,
+			},
+			expectedValidationErr: "query parameter limit: not supported for queries by pod_name_prefix or label_selector",
+		},
 	}
 
 	for _, test := range tests {
@@ -182,4 +258,155 @@ func TestQueryValidation(t *testing.T) {
 		EndTime:       time.Now().Add(1 * time.Second),
 	}
 	assert.Nilf(t, validQuery.Validate(), "expected query validation to succeed")
+
+	// validate a valid query across containers (container name is optional)
+	validQuery = &Query{
+		Namespace:     "default",
+		LabelSelector: "app=nginx",
+		StartTime:     time.Now(),
+		EndTime:       time.Now().Add(1 * time.Second),
+	}
+	assert.Nilf(t, validQuery.Validate(), "expected query validation to succeed")
+}
+
+// Verify that Query.MatchesContainer() and the LabelSelector select the
+// expected pod containers.
+func TestQueryMatchesContainer(t *testing.T) {
+	tests := []struct {
+		query         Query
+		podName       string
+		containerName string
+		labels        map[string]string
+		matches       bool
+	}{
+		// single container query
+		{query: Query{PodName: "nginx-abcde", ContainerName: "nginx"}, podName: "nginx-abcde", containerName: "nginx", matches: true},
+		{query: Query{PodName: "nginx-abcde", ContainerName: "nginx"}, podName: "nginx-abcde", containerName: "sidecar", matches: false},
+		{query: Query{PodName: "nginx-abcde", ContainerName: "nginx"}, podName: "nginx-fghij", containerName: "nginx", matches: false},
+		// pod name prefix: all containers unless a container name is given
+		{query: Query{PodNamePrefix: "nginx-"}, podName: "nginx-abcde", containerName: "sidecar", matches: true},
+		{query: Query{PodNamePrefix: "nginx-"}, podName: "redis-abcde", containerName: "redis", matches: false},
+		{query: Query{PodNamePrefix: "nginx-", ContainerName: "nginx"}, podName: "nginx-abcde", containerName: "sidecar", matches: false},
+		// label selector: all given labels must match
+		{query: Query{LabelSelector: "app=nginx"}, podName: "nginx-abcde", containerName: "nginx",
+			labels: map[string]string{"app": "nginx", "tier": "frontend"}, matches: true},
+		{query: Query{LabelSelector: "app=nginx, tier=backend"}, podName: "nginx-abcde", containerName: "nginx",
+			labels: map[string]string{"app": "nginx", "tier": "frontend"}, matches: false},
+		{query: Query{LabelSelector: "app=nginx"}, podName: "nginx-abcde", containerName: "nginx", matches: false},
+	}
+
+	for _, test := range tests {
+		selector, err := ParseLabelSelector(test.query.LabelSelector)
+		require.Nilf(t, err, "unexpected error")
+		matches := test.query.MatchesContainer(test.podName, test.containerName) && selector.Matches(test.labels)
+		assert.Equalf(t, test.matches, matches, "unexpected match of %s/%s for query %s",
+			test.podName, test.containerName, &test.query)
+	}
+}
+
+// SortRows should order rows by time and then by pod and container.
+func TestSortRows(t *testing.T) {
+	t0 := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	rows := []LogRow{
+		{Time: t0.Add(time.Second), PodName: "a", ContainerName: "c1", Log: "3"},
+		{Time: t0, PodName: "b", ContainerName: "c1", Log: "2"},
+		{Time: t0, PodName: "a", ContainerName: "c2", Log: "1"},
+		{Time: t0, PodName: "a", ContainerName: "c1", Log: "0"},
+	}
+	SortRows(rows)
+	messages := []string{}
+	for _, row := range rows {
+		messages = append(messages, row.Log)
+	}
+	assert.Equalf(t, []string{"0", "1", "2", "3"}, messages, "unexpected row order")
+}
+
+// Verify that Query.Filter() matches log rows according to the Stream,
+// Contains, Regex and IgnoreCase fields.
+func TestQueryFilter(t *testing.T) {
+	tests := []struct {
+		query   Query
+		stream  string
+		message string
+		matches bool
+	}{
+		// no filters: everything matches
+		{query: Query{}, message: "anything", matches: true},
+		{query: Query{Contains: "error"}, message: "an error occurred", matches: true},
+		{query: Query{Contains: "error"}, message: "an ERROR occurred", matches: false},
+		{query: Query{Contains: "error", IgnoreCase: true}, message: "an ERROR occurred", matches: true},
+		{query: Query{Regex: "^GET /[a-z]+ 200$"}, message: "GET /index 200", matches: true},
+		{query: Query{Regex: "^GET /[a-z]+ 200$"}, message: "get /index 200", matches: false},
+		{query: Query{Regex: "^GET /[a-z]+ 200$", IgnoreCase: true}, message: "get /index 200", matches: true},
+		// both filters must match
+		{query: Query{Contains: "index", Regex: "50[0-9]"}, message: "GET /index 200", matches: false},
+		{query: Query{Contains: "index", Regex: "50[0-9]"}, message: "GET /index 503", matches: true},
+		{query: Query{Stream: "stderr"}, stream: "stderr", message: "panic", matches: true},
+		{query: Query{Stream: "stderr"}, stream: "stdout", message: "panic", matches: false},
+		{query: Query{Stream: "stderr", Contains: "panic"}, stream: "stderr", message: "exiting", matches: false},
+	}
+
+	for _, test := range tests {
+		filter, err := test.query.Filter()
+		require.Nilf(t, err, "unexpected error")
+		row := &LogRow{Stream: test.stream, Log: test.message}
+		assert.Equalf(t, test.matches, filter(row), "unexpected match of %s for query %s", row, &test.query)
+	}
+}
+
+// Verify that a WriteError orders its failures by index, and splits the
+// written log entries into stored and failed ones.
+func TestWriteError(t *testing.T) {
+	entries := []LogEntry{{Log: "event 0"}, {Log: "event 1"}, {Log: "event 2"}, {Log: "event 3"}}
+	err := NewWriteError(map[int]error{
+		3: fmt.Errorf("write timeout"),
+		1: fmt.Errorf("connection refused"),
+	})
+
+	assert.Equalf(t, []EntryError{
+		{Index: 1, Err: fmt.Errorf("connection refused")},
+		{Index: 3, Err: fmt.Errorf("write timeout")},
+	}, err.Failures, "unexpected failures")
+	assert.Equalf(t, "failed to store 2 log entries: entry 1: connection refused", err.Error(), "unexpected error message")
+
+	stored, failed := err.Split(entries)
+	assert.Equalf(t, []LogEntry{entries[0], entries[2]}, stored, "unexpected stored entries")
+	assert.Equalf(t, []LogEntry{entries[1], entries[3]}, failed, "unexpected failed entries")
+}
+
+// Log entries should only get the same entry hash if they have the same
+// content, so that retried writes are idempotent but distinct log entries with
+// equal timestamps are kept.
+func TestEntryHash(t *testing.T) {
+	entry := LogEntry{Log: "event 1", Stream: "stdout"}
+	retried := LogEntry{Log: "event 1", Stream: "stdout"}
+	assert.Equalf(t, EntryHash(&entry), EntryHash(&retried), "expected equal log entries to have equal hashes")
+
+	other := LogEntry{Log: "event 2", Stream: "stdout"}
+	assert.NotEqualf(t, EntryHash(&entry), EntryHash(&other), "expected distinct messages to have distinct hashes")
+	stderr := LogEntry{Log: "event 1", Stream: "stderr"}
+	assert.NotEqualf(t, EntryHash(&entry), EntryHash(&stderr), "expected distinct streams to have distinct hashes")
+}
+
+// A continuation token should decode into the time and entry hash that it was
+// encoded from, and a token without an entry hash should resume after all log
+// entries with its time.
+func TestEntryToken(t *testing.T) {
+	lastTime := time.Date(2018, 1, 1, 12, 0, 0, 1, time.UTC)
+
+	decodedTime, decodedHash, err := DecodeEntryToken(EncodeEntryToken(lastTime, -42))
+	require.Nilf(t, err, "decode not expected to fail")
+	assert.Truef(t, lastTime.Equal(decodedTime), "unexpected time: %s", decodedTime)
+	assert.Equalf(t, int64(-42), decodedHash, "unexpected entry hash")
+
+	timeOnly := base64.RawURLEncoding.EncodeToString([]byte(lastTime.Format(time.RFC3339Nano)))
+	decodedTime, decodedHash, err = DecodeEntryToken(timeOnly)
+	require.Nilf(t, err, "decode not expected to fail")
+	assert.Truef(t, lastTime.Equal(decodedTime), "unexpected time: %s", decodedTime)
+	assert.Equalf(t, int64(math.MaxInt64), decodedHash, "expected no log entry with the same time to follow")
+
+	for _, token := range []string{"%%%", base64.RawURLEncoding.EncodeToString([]byte("yesterday 1"))} {
+		_, _, err = DecodeEntryToken(token)
+		assert.Equalf(t, QueryError("query parameter next_token: malformed token"), err, "expected malformed token")
+	}
 }
@@ -0,0 +1,169 @@
+package cassandra
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/elastisys/kube-insight-logserver/pkg/log"
+	"github.com/elastisys/kube-insight-logserver/pkg/logstore"
+)
+
+// copyPageSize is the number of source log table partitions that are listed
+// at a time when copying a log table.
+const copyPageSize = 100
+
+// CopyLogTable copies the log entries of another log table in the keyspace
+// into the log table of the LogStore, and records them in its catalog tables.
+// It is the migration path from the log table created by schema version 1
+// (named by LogTableName), whose primary key lacks the entry hash, to the one
+// created by schema version 4. Log entries keep their remaining time-to-live,
+// and since the copy overwrites log entries that were copied before, an
+// interrupted copy can simply be started over. Both log tables must have the
+// same bucket size. Returns the number of copied log entries. The LogStore
+// must be connected.
+func (c *LogStore) CopyLogTable(from string) (int, error) {
+	if from == c.logTableName() {
+		return 0, fmt.Errorf("cannot copy log table %s.%s into itself", c.options.Keyspace, from)
+	}
+	rows, err := c.driver.Query(c.tableOptionsQuery(), c.options.Keyspace, from)
+	if err != nil {
+		return 0, QueryError{message: "failed to read source log table options", cause: err}
+	}
+	if len(rows) == 0 {
+		return 0, fmt.Errorf("log table %s.%s not found", c.options.Keyspace, from)
+	}
+	if err := c.verifyBucketSize(rows[0]); err != nil {
+		return 0, fmt.Errorf("cannot copy log table %s.%s: %s", c.options.Keyspace, from, err)
+	}
+
+	copied := 0
+	// catalogued holds the keys of the pod containers and namespaces that
+	// have been recorded in the catalog tables
+	catalogued := make(map[partitionKey]bool)
+	// the partitions are listed a page at a time, since a log table may have
+	// more of them than fit in memory
+	var pageState []byte
+	for {
+		partitions, nextPageState, err := c.driver.QueryPage(c.partitionsQuery(from), copyPageSize, pageState)
+		if err != nil {
+			return copied, QueryError{message: "failed to read source log table partitions", cause: err}
+		}
+		for _, partition := range partitions {
+			n, err := c.copyPartition(from, partition, catalogued)
+			copied += n
+			if err != nil {
+				return copied, err
+			}
+			log.Debugf("copied %d log entries of %s/%s/%s", n,
+				partition["namespace"], partition["pod_name"], partition["container_name"])
+		}
+		if len(nextPageState) == 0 {
+			return copied, nil
+		}
+		pageState = nextPageState
+	}
+}
+
+// copyPartition copies the log entries of a log table partition into the log
+// table of the LogStore, in batches of at most WriteBatchSize inserts, and
+// records the pod container and namespace of the log entries on each date in
+// the catalog tables, unless already catalogued. Log entries without a
+// time-to-live are given the one that log entries of their namespace are
+// written with.
+func (c *LogStore) copyPartition(from string, partition map[string]interface{}, catalogued map[partitionKey]bool) (int, error) {
+	namespace, _ := partition["namespace"].(string)
+	podName, _ := partition["pod_name"].(string)
+	containerName, _ := partition["container_name"].(string)
+
+	copied := 0
+	batch := make([]CQLStatement, 0, c.options.WriteBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := c.driver.ExecuteBatch(batch); err != nil {
+			return InsertError{err}
+		}
+		copied += len(batch)
+		batch = make([]CQLStatement, 0, c.options.WriteBatchSize)
+		return nil
+	}
+
+	err := c.driver.QueryIter(func(row map[string]interface{}) error {
+		logEntry := logstore.LogEntry{Kubernetes: logstore.KubernetesMetadata{
+			Namespace: namespace, PodName: podName, ContainerName: containerName}}
+		logEntry.Time, _ = row["time"].(time.Time)
+		logEntry.Log, _ = row["message"].(string)
+		logEntry.Stream, _ = row["stream"].(string)
+		logEntry.Kubernetes.PodID, _ = row["pod_id"].(string)
+		logEntry.Kubernetes.DockerID, _ = row["docker_id"].(string)
+		logEntry.Kubernetes.Host, _ = row["host"].(string)
+		logEntry.Kubernetes.Labels, _ = row["labels"].(map[string]string)
+		// the time-to-live of a log entry that never expires is null, which
+		// the driver scans as zero
+		ttl, _ := row["ttl"].(int)
+		if ttl <= 0 {
+			ttl = c.ttl(namespace)
+		}
+
+		if err := c.catalogCopy(&logEntry, catalogued); err != nil {
+			return err
+		}
+		batch = append(batch, c.insertWithTTL(&logEntry, ttl))
+		if len(batch) < c.options.WriteBatchSize {
+			return nil
+		}
+		return flush()
+	}, c.copyQuery(from), namespace, podName, containerName, partition[c.bucketColumn()])
+	if err != nil {
+		if _, ok := err.(InsertError); ok {
+			return copied, err
+		}
+		return copied, QueryError{message: "failed to read source log table", cause: err}
+	}
+	return copied, flush()
+}
+
+// catalogCopy records the pod container and namespace of a copied log entry in
+// the catalog tables, unless they are already recorded for its date.
+func (c *LogStore) catalogCopy(logEntry *logstore.LogEntry, catalogued map[partitionKey]bool) error {
+	podMeta := logEntry.Kubernetes
+	date := logEntry.Time.Format("2006-01-02")
+	containerKey := partitionKey{
+		namespace: podMeta.Namespace, podName: podMeta.PodName, containerName: podMeta.ContainerName, date: date}
+	namespaceKey := partitionKey{namespace: podMeta.Namespace, date: date}
+
+	inserts := make([]CQLStatement, 0, 2)
+	if !catalogued[containerKey] {
+		inserts = append(inserts, c.containerInsert(logEntry))
+	}
+	if !catalogued[namespaceKey] {
+		inserts = append(inserts, c.namespaceInsert(logEntry))
+	}
+	for _, insert := range inserts {
+		if err := c.driver.Execute(insert.Statement, insert.Placeholders...); err != nil {
+			return InsertError{err}
+		}
+	}
+	catalogued[containerKey] = true
+	catalogued[namespaceKey] = true
+	return nil
+}
+
+// partitionsQuery returns the statement used to list the partitions of a log
+// table.
+func (c *LogStore) partitionsQuery(table string) string {
+	return "SELECT DISTINCT namespace, pod_name, container_name, " + c.bucketColumn() + " " +
+		"FROM " + c.options.Keyspace + "." + table
+}
+
+// copyQuery returns the statement used to read the log entries (and their
+// remaining time-to-live) of a log table partition.
+func (c *LogStore) copyQuery(table string) string {
+	return "SELECT time, message, stream, pod_id, docker_id, host, labels, TTL(message) AS ttl " +
+		"FROM " + c.options.Keyspace + "." + table + " WHERE " +
+		"(namespace=?) AND " +
+		"(pod_name=?) AND " +
+		"(container_name=?) AND " +
+		"(" + c.bucketColumn() + "=?)"
+}
@@ -0,0 +1,139 @@
+package cassandra
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elastisys/kube-insight-logserver/pkg/logstore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// copiedRow returns the row of a log entry as read from the source log table.
+// The time-to-live of a log entry that never expires is read as zero.
+func copiedRow(logEntry logstore.LogEntry, ttl int) map[string]interface{} {
+	return map[string]interface{}{
+		"time":      logEntry.Time,
+		"message":   logEntry.Log,
+		"stream":    logEntry.Stream,
+		"pod_id":    logEntry.Kubernetes.PodID,
+		"docker_id": logEntry.Kubernetes.DockerID,
+		"host":      logEntry.Kubernetes.Host,
+		"labels":    logEntry.Kubernetes.Labels,
+		"ttl":       ttl,
+	}
+}
+
+// copiedInsert returns the expected insert statement of a copied log entry.
+func copiedInsert(logStore *LogStore, logEntry logstore.LogEntry, ttl int) CQLStatement {
+	return CQLStatement{Statement: logStore.insertStatement(), Placeholders: withTTL(insertPlaceholders(logEntry), ttl)}
+}
+
+// withTTL replaces the time-to-live (the last placeholder) of expected insert
+// statement placeholders.
+func withTTL(placeholders []interface{}, ttl int) []interface{} {
+	placeholders[len(placeholders)-1] = ttl
+	return placeholders
+}
+
+// Verify that LogStore.CopyLogTable() copies the log entries of every
+// partition of the source log table in batches, keeps their remaining
+// time-to-live and records them in the catalog tables. The partitions should
+// be listed a page at a time, and log entries without a time-to-live should
+// get the configured one.
+func TestCopyLogTable(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	opts := options()
+	opts.WriteBatchSize = 2
+	opts.DefaultTTL = 7 * 24 * time.Hour
+	logStore := NewLogStore(mockCQLDriver, opts)
+	logStore.now = func() time.Time { return MustParse("2018-01-01T12:00:00.000Z") }
+	defaultTTL := 7 * 24 * 3600
+
+	logEntries := []logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T12:00:00.000Z"), "event 1"),
+		logEntry(MustParse("2018-01-01T12:00:00.000Z"), "event 2"),
+		logEntry(MustParse("2018-01-01T12:01:00.000Z"), "event 3"),
+		logEntry(MustParse("2018-01-02T12:00:00.000Z"), "event 4"),
+	}
+
+	//
+	// set up mock expectations
+	//
+	var emptyPlaceholders []interface{}
+	mockCQLDriver.On("Query", logStore.tableOptionsQuery(), []interface{}{"keyspace", "legacy"}).Return(
+		CQLRows{{"comment": "bucket_size=1d"}}, nil)
+	date1 := MustParse("2018-01-01T00:00:00.000Z")
+	date2 := MustParse("2018-01-02T00:00:00.000Z")
+	// the partitions are listed a page at a time
+	mockCQLDriver.On("QueryPage", logStore.partitionsQuery("legacy"), copyPageSize, []byte(nil), emptyPlaceholders).Return(
+		CQLRows{{"namespace": "default", "pod_name": "nginx-deployment-abcde", "container_name": "nginx", "date": date1}},
+		[]byte("page 2"), nil)
+	mockCQLDriver.On("QueryPage", logStore.partitionsQuery("legacy"), copyPageSize, []byte("page 2"), emptyPlaceholders).Return(
+		CQLRows{{"namespace": "default", "pod_name": "nginx-deployment-abcde", "container_name": "nginx", "date": date2}},
+		[]byte(nil), nil)
+	mockCQLDriver.On("QueryIter", logStore.copyQuery("legacy"),
+		[]interface{}{"default", "nginx-deployment-abcde", "nginx", date1}).Return(
+		CQLRows{copiedRow(logEntries[0], 3600), copiedRow(logEntries[1], 3600), copiedRow(logEntries[2], 60)}, nil)
+	mockCQLDriver.On("QueryIter", logStore.copyQuery("legacy"),
+		[]interface{}{"default", "nginx-deployment-abcde", "nginx", date2}).Return(
+		CQLRows{copiedRow(logEntries[3], 0)}, nil)
+	// the pod container and namespace should be catalogued once per date,
+	// with the time-to-live counted from the end of the date
+	for _, catalog := range []struct {
+		first     logstore.LogEntry
+		remaining int
+	}{{logEntries[0], 12 * 3600}, {logEntries[3], 36 * 3600}} {
+		mockCQLDriver.On("Execute", logStore.containerInsertStatement(),
+			withTTL(containerInsertPlaceholders(catalog.first), defaultTTL+catalog.remaining)).Return(nil).Once()
+		mockCQLDriver.On("Execute", logStore.namespaceInsertStatement(),
+			withTTL(namespaceInsertPlaceholders(catalog.first), defaultTTL+catalog.remaining)).Return(nil).Once()
+	}
+	// log entries should be inserted in batches of (at most) two
+	mockCQLDriver.On("ExecuteBatch", []CQLStatement{
+		copiedInsert(logStore, logEntries[0], 3600), copiedInsert(logStore, logEntries[1], 3600),
+	}).Return(nil)
+	mockCQLDriver.On("ExecuteBatch", []CQLStatement{copiedInsert(logStore, logEntries[2], 60)}).Return(nil)
+	// a log entry that never expires (read with a time-to-live of zero) should get the configured time-to-live
+	mockCQLDriver.On("ExecuteBatch", []CQLStatement{copiedInsert(logStore, logEntries[3], defaultTTL)}).Return(nil)
+
+	//
+	// make call
+	//
+	copied, err := logStore.CopyLogTable("legacy")
+	require.Nilf(t, err, "copy not expected to fail")
+	assert.Equalf(t, 4, copied, "unexpected number of copied log entries")
+
+	// verify that expected calls were made
+	mockCQLDriver.AssertExpectations(t)
+}
+
+// LogStore.CopyLogTable() should refuse to copy a log table with a different
+// bucket size, or a log table into itself.
+func TestCopyLogTableOnIncompatibleTable(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	logStore := NewLogStore(mockCQLDriver, options())
+
+	//
+	// set up mock expectations
+	//
+	mockCQLDriver.On("Query", logStore.tableOptionsQuery(), []interface{}{"keyspace", "legacy"}).Return(
+		CQLRows{{"comment": "bucket_size=1h"}}, nil)
+
+	//
+	// make calls
+	//
+	_, err := logStore.CopyLogTable("legacy")
+	require.NotNilf(t, err, "expected copy to fail")
+	assert.Equalf(t, "cannot copy log table keyspace.legacy: "+
+		"log table was created with bucket size 1h, but bucket size 1d is configured", err.Error(),
+		"unexpected error")
+
+	_, err = logStore.CopyLogTable("logtable_hashed")
+	require.NotNilf(t, err, "expected copy to fail")
+	assert.Equalf(t, "cannot copy log table keyspace.logtable_hashed into itself", err.Error(), "unexpected error")
+
+	// verify that expected calls were made
+	mockCQLDriver.AssertExpectations(t)
+}
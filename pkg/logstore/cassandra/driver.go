@@ -2,6 +2,8 @@ package cassandra
 
 import (
 	"fmt"
+	"io/ioutil"
+	"strings"
 
 	"github.com/elastisys/kube-insight-logserver/pkg/log"
 	"github.com/gocql/gocql"
@@ -11,6 +13,17 @@ import (
 // map of column key-value pairs.
 type CQLRows []map[string]interface{}
 
+// CQLRowHandler is called with every row of a CQL query passed to
+// Driver.QueryIter(). Returning an error aborts the query.
+type CQLRowHandler func(row map[string]interface{}) error
+
+// CQLStatement is a CQL statement together with the values of its
+// placeholders.
+type CQLStatement struct {
+	Statement    string
+	Placeholders []interface{}
+}
+
 // Driver is a simplified Cassandra driver interface intended to be used
 // by the Cassandra LogStore.
 type Driver interface {
@@ -32,10 +45,37 @@ type Driver interface {
 	// will fail.
 	Execute(statement string, placeholders ...interface{}) error
 
+	// ExecuteBatch runs a collection of data modification (INSERT) statements
+	// against cassandra as a single unlogged batch, which saves round-trips
+	// when the statements target the same partition.
+	// Note: if Connect() hasn't been successfully called, this call will fail.
+	ExecuteBatch(statements []CQLStatement) error
+
+	// ExecuteCAS runs a conditional data modification (INSERT ... IF NOT
+	// EXISTS, UPDATE/DELETE ... IF) statement against cassandra as a
+	// lightweight transaction, and returns true if it was applied.
+	// Note: if Connect() hasn't been successfully called, this call will fail.
+	ExecuteCAS(statement string, placeholders ...interface{}) (bool, error)
+
 	// Query runs a SELECT query statement against cassandra. The caller is
 	// responsible for closing the returned iterator.
 	// Note: if Connect() hasn't been successfully called, this call will fail.
 	Query(query string, placeholders ...interface{}) (CQLRows, error)
+
+	// QueryPage runs a SELECT query statement against cassandra, but only
+	// fetches a single page of (at most) pageSize rows. The page to fetch is
+	// given by a page state, as returned by a previous call (an empty page
+	// state fetches the first page). Along with the rows, the page state of
+	// the next page is returned, which is empty when there are no more pages.
+	// Note: if Connect() hasn't been successfully called, this call will fail.
+	QueryPage(query string, pageSize int, pageState []byte, placeholders ...interface{}) (CQLRows, []byte, error)
+
+	// QueryIter runs a SELECT query statement against cassandra, and passes
+	// each result row to a handler as it is fetched. Pages are fetched as
+	// needed, so only a page of rows at a time is held in memory. If the
+	// handler returns an error, the query is aborted and the error returned.
+	// Note: if Connect() hasn't been successfully called, this call will fail.
+	QueryIter(handler CQLRowHandler, query string, placeholders ...interface{}) error
 }
 
 // CQLDriver is capable of connecting to Cassandra and running queries/DML
@@ -45,12 +85,70 @@ type CQLDriver struct {
 	cluster *gocql.ClusterConfig
 	// session: will be nil before Connect() is called.
 	session *gocql.Session
+	// writeConsistency is the consistency level of executed statements.
+	writeConsistency gocql.Consistency
+	// readConsistency is the consistency level of queries.
+	readConsistency gocql.Consistency
+}
+
+// NewClusterConfig creates Cassandra cluster settings for a CQLDriver from a
+// set of (validated) Options. An error is returned if a password file is
+// given that cannot be read.
+func NewClusterConfig(options *Options) (*gocql.ClusterConfig, error) {
+	cluster := gocql.NewCluster(options.Hosts...)
+	cluster.Port = options.CQLPort
+	cluster.Consistency = gocql.One
+
+	var hostPolicy gocql.HostSelectionPolicy
+	switch options.HostSelectionPolicy {
+	case DCAwareRoundRobinPolicy:
+		hostPolicy = gocql.DCAwareRoundRobinPolicy(options.LocalDC)
+	default:
+		hostPolicy = gocql.RoundRobinHostPolicy()
+	}
+	if options.TokenAware {
+		hostPolicy = gocql.TokenAwareHostPolicy(hostPolicy)
+	}
+	cluster.PoolConfig.HostSelectionPolicy = hostPolicy
+
+	if options.Username != "" {
+		password := options.Password
+		if options.PasswordFile != "" {
+			passwordBytes, err := ioutil.ReadFile(options.PasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read cassandra password file: %s", err)
+			}
+			// ignore any trailing newline
+			password = strings.TrimRight(string(passwordBytes), "\r\n")
+		}
+		cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: options.Username,
+			Password: password,
+		}
+	}
+
+	if options.EnableTLS {
+		cluster.SslOpts = &gocql.SslOptions{
+			CaPath:                 options.TLSCACertPath,
+			CertPath:               options.TLSCertPath,
+			KeyPath:                options.TLSKeyPath,
+			EnableHostVerification: options.TLSVerifyHostname,
+		}
+	}
+
+	return cluster, nil
 }
 
-// NewCQLDriver creates a new disconnected CQLDriver. Before use, call
-// Connect().
-func NewCQLDriver(clusterConfig *gocql.ClusterConfig) *CQLDriver {
-	return &CQLDriver{cluster: clusterConfig, session: nil}
+// NewCQLDriver creates a new disconnected CQLDriver, which applies the
+// read/write consistency levels of the given (validated) Options to every
+// statement. Before use, call Connect().
+func NewCQLDriver(clusterConfig *gocql.ClusterConfig, options *Options) *CQLDriver {
+	return &CQLDriver{
+		cluster:          clusterConfig,
+		session:          nil,
+		writeConsistency: options.WriteConsistency.level(),
+		readConsistency:  options.ReadConsistency.level(),
+	}
 }
 
 // Connect connects the driver to the Cassandra node(s) it has been
@@ -99,10 +197,49 @@ func (d *CQLDriver) Execute(statement string, placeholders ...interface{}) error
 			statement, placeholders)
 	}
 
-	stmt := d.session.Query(statement, placeholders...)
+	stmt := d.session.Query(statement, placeholders...).Consistency(d.writeConsistency)
 	return stmt.Exec()
 }
 
+// ExecuteBatch runs a collection of data modification (INSERT) statements
+// against cassandra as a single unlogged batch, which saves round-trips when
+// the statements target the same partition.
+// Note: if Connect() hasn't been successfully called, this call will fail.
+func (d *CQLDriver) ExecuteBatch(statements []CQLStatement) error {
+	if d.session == nil {
+		return fmt.Errorf("cannot execute batch: not connected to cassandra")
+	}
+
+	if log.Level() >= log.TraceLevel {
+		log.Tracef("executing batch of %d statements: %#v", len(statements), statements)
+	}
+
+	batch := d.session.NewBatch(gocql.UnloggedBatch)
+	batch.SetConsistency(d.writeConsistency)
+	for _, stmt := range statements {
+		batch.Query(stmt.Statement, stmt.Placeholders...)
+	}
+	return d.session.ExecuteBatch(batch)
+}
+
+// ExecuteCAS runs a conditional data modification statement against
+// cassandra as a lightweight transaction, and returns true if it was applied.
+// Note: if Connect() hasn't been successfully called, this call will fail.
+func (d *CQLDriver) ExecuteCAS(statement string, placeholders ...interface{}) (bool, error) {
+	if d.session == nil {
+		return false, fmt.Errorf("cannot execute statement: not connected to cassandra")
+	}
+
+	if log.Level() >= log.TraceLevel {
+		log.Tracef("executing conditional statement: %s\nwith placeholders: %#v",
+			statement, placeholders)
+	}
+
+	stmt := d.session.Query(statement, placeholders...).Consistency(d.writeConsistency)
+	// the current values of a row are returned when the condition fails
+	return stmt.MapScanCAS(make(map[string]interface{}))
+}
+
 // Query runs a SELECT query statement against cassandra. Note: if
 // Connect() hasn't been successfully called, this call will fail.
 func (d *CQLDriver) Query(query string, placeholders ...interface{}) (CQLRows, error) {
@@ -115,7 +252,7 @@ func (d *CQLDriver) Query(query string, placeholders ...interface{}) (CQLRows, e
 			query, placeholders)
 
 	}
-	iter := d.session.Query(query, placeholders...).Iter()
+	iter := d.session.Query(query, placeholders...).Consistency(d.readConsistency).Iter()
 	rows, err := iter.SliceMap()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get result rows: %s", err)
@@ -129,3 +266,59 @@ func (d *CQLDriver) Query(query string, placeholders ...interface{}) (CQLRows, e
 
 	return CQLRows(rows), nil
 }
+
+// QueryPage runs a SELECT query statement against cassandra, and fetches a
+// single page of the result.
+func (d *CQLDriver) QueryPage(query string, pageSize int, pageState []byte, placeholders ...interface{}) (CQLRows, []byte, error) {
+	if d.session == nil {
+		return nil, nil, fmt.Errorf("cannot execute query: not connected to cassandra")
+	}
+
+	if log.Level() >= log.TraceLevel {
+		log.Tracef("executing query (page size %d): %s\nwith placeholders: %#v",
+			pageSize, query, placeholders)
+	}
+	// note: setting a page state disables automatic fetching of later pages
+	iter := d.session.Query(query, placeholders...).Consistency(d.readConsistency).
+		PageSize(pageSize).PageState(pageState).Iter()
+	rows, err := iter.SliceMap()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get result rows: %s", err)
+	}
+	nextPageState := iter.PageState()
+
+	if err := iter.Close(); err != nil {
+		return nil, nil, fmt.Errorf("query execution failed: %s", err)
+	}
+
+	return CQLRows(rows), nextPageState, nil
+}
+
+// QueryIter runs a SELECT query statement against cassandra, and passes each
+// result row to a handler.
+func (d *CQLDriver) QueryIter(handler CQLRowHandler, query string, placeholders ...interface{}) error {
+	if d.session == nil {
+		return fmt.Errorf("cannot execute query: not connected to cassandra")
+	}
+
+	if log.Level() >= log.TraceLevel {
+		log.Tracef("executing query: %s\nwith placeholders: %#v",
+			query, placeholders)
+	}
+	iter := d.session.Query(query, placeholders...).Consistency(d.readConsistency).Iter()
+	for {
+		row := make(map[string]interface{})
+		if !iter.MapScan(row) {
+			break
+		}
+		if err := handler(row); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("query execution failed: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package cassandra
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/gocql/gocql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mustNewClusterConfig calls NewClusterConfig and fails the test on error.
+func mustNewClusterConfig(t *testing.T, opts *Options) *gocql.ClusterConfig {
+	cluster, err := NewClusterConfig(opts)
+	require.Nilf(t, err, "unexpected error creating cluster config")
+	return cluster
+}
+
+// Verify that NewClusterConfig applies connection settings and the host
+// selection policy from the given Options.
+func TestNewClusterConfig(t *testing.T) {
+	opts := options()
+	opts.CQLPort = 9142
+	opts.HostSelectionPolicy = RoundRobinPolicy
+	cluster := mustNewClusterConfig(t, opts)
+	assert.Equalf(t, opts.Hosts, cluster.Hosts, "unexpected hosts")
+	assert.Equalf(t, 9142, cluster.Port, "unexpected port")
+	assert.IsTypef(t, gocql.RoundRobinHostPolicy(), cluster.PoolConfig.HostSelectionPolicy,
+		"expected round-robin host selection policy")
+
+	opts.HostSelectionPolicy = DCAwareRoundRobinPolicy
+	opts.LocalDC = "dc1"
+	cluster = mustNewClusterConfig(t, opts)
+	assert.IsTypef(t, gocql.DCAwareRoundRobinPolicy("dc1"), cluster.PoolConfig.HostSelectionPolicy,
+		"expected dc-aware host selection policy")
+
+	opts.TokenAware = true
+	cluster = mustNewClusterConfig(t, opts)
+	assert.IsTypef(t, gocql.TokenAwareHostPolicy(gocql.RoundRobinHostPolicy()), cluster.PoolConfig.HostSelectionPolicy,
+		"expected token-aware host selection policy")
+}
+
+// Verify that NewCQLDriver picks up the read/write consistency levels from the
+// given Options.
+func TestNewCQLDriverConsistency(t *testing.T) {
+	opts := options()
+	opts.WriteConsistency = "LOCAL_QUORUM"
+	opts.ReadConsistency = "local_one"
+	driver := NewCQLDriver(mustNewClusterConfig(t, opts), opts)
+	assert.Equalf(t, gocql.LocalQuorum, driver.writeConsistency, "unexpected write consistency")
+	assert.Equalf(t, gocql.LocalOne, driver.readConsistency, "unexpected read consistency")
+}
+
+// Verify that NewClusterConfig sets up password authentication and TLS when
+// the given Options dictate so.
+func TestNewClusterConfigWithAuthAndTLS(t *testing.T) {
+	opts := options()
+	cluster := mustNewClusterConfig(t, opts)
+	assert.Nilf(t, cluster.Authenticator, "expected no authenticator by default")
+	assert.Nilf(t, cluster.SslOpts, "expected no TLS by default")
+
+	opts.Username = "cassandra"
+	opts.Password = "secret"
+	opts.EnableTLS = true
+	opts.TLSCACertPath = "/etc/cassandra/ca.pem"
+	opts.TLSCertPath = "/etc/cassandra/client.pem"
+	opts.TLSKeyPath = "/etc/cassandra/client-key.pem"
+	opts.TLSVerifyHostname = true
+	cluster = mustNewClusterConfig(t, opts)
+	assert.Equalf(t, gocql.PasswordAuthenticator{Username: "cassandra", Password: "secret"},
+		cluster.Authenticator, "unexpected authenticator")
+	expectedSslOpts := &gocql.SslOptions{
+		CaPath:                 "/etc/cassandra/ca.pem",
+		CertPath:               "/etc/cassandra/client.pem",
+		KeyPath:                "/etc/cassandra/client-key.pem",
+		EnableHostVerification: true,
+	}
+	assert.Equalf(t, expectedSslOpts, cluster.SslOpts, "unexpected TLS options")
+}
+
+// Verify that NewClusterConfig reads the password from a password file, and
+// fails if the password file cannot be read.
+func TestNewClusterConfigWithPasswordFile(t *testing.T) {
+	passwordFile, err := ioutil.TempFile("", "cassandra-password")
+	require.Nil(t, err)
+	defer os.Remove(passwordFile.Name())
+	passwordFile.WriteString("secret\n")
+	passwordFile.Close()
+
+	opts := options()
+	opts.Username = "cassandra"
+	opts.PasswordFile = passwordFile.Name()
+	cluster := mustNewClusterConfig(t, opts)
+	assert.Equalf(t, gocql.PasswordAuthenticator{Username: "cassandra", Password: "secret"},
+		cluster.Authenticator, "unexpected authenticator")
+
+	opts.PasswordFile = passwordFile.Name() + ".missing"
+	_, err = NewClusterConfig(opts)
+	assert.NotNilf(t, err, "expected missing password file to fail")
+}
+
+// Options.String() should not reveal the password.
+func TestOptionsStringRedactsPassword(t *testing.T) {
+	opts := options()
+	opts.Username = "cassandra"
+	opts.Password = "secret"
+	assert.NotContainsf(t, opts.String(), "secret", "expected password to be redacted")
+	assert.Equalf(t, "secret", opts.Password, "expected options to be left untouched")
+}
@@ -2,6 +2,9 @@ package cassandra
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/elastisys/kube-insight-logserver/pkg/log"
@@ -42,16 +45,69 @@ type LogStore struct {
 	driver     Driver
 	options    *Options
 	writerPool *writerPool
+	readerPool *readerPool
+
+	// The statements that are executed repeatedly are built once, so that
+	// every execution uses the identical statement string. The driver does
+	// not prepare them explicitly: gocql prepares a statement with
+	// placeholders on each host the first time it is executed there, and
+	// caches the prepared statement keyed on the statement string.
+
+	// insertCQL is the statement used to insert log entries.
+	insertCQL string
+	// logQueryCQL is the statement used to query log entries.
+	logQueryCQL string
+	// logQueryDescCQL is the statement used to query log entries
+	// newest first.
+	logQueryDescCQL string
+	// containerInsertCQL is the statement used to record the pod
+	// containers that have log entries on a given date.
+	containerInsertCQL string
+	// containerQueryCQL is the statement used to look up the pod
+	// containers in a namespace that have log entries on a given date.
+	containerQueryCQL string
+	// namespaceInsertCQL is the statement used to record the
+	// namespaces that have log entries on a given date.
+	namespaceInsertCQL string
+	// namespaceQueryCQL is the statement used to look up the
+	// namespaces that have log entries on a given date.
+	namespaceQueryCQL string
+
+	// now returns the current time. It is used to compute the time-to-live
+	// of catalog table entries.
+	now func() time.Time
+
+	// catalogMutex protects catalogued.
+	catalogMutex sync.Mutex
+	// catalogued holds the keys of the partitions (and, keyed without pod
+	// and container, the namespaces on each date) that are known to be
+	// recorded in the catalog tables.
+	catalogued map[partitionKey]struct{}
 }
 
+// maxCatalogued is the maximum number of partitions that a LogStore keeps
+// track of as catalogued.
+const maxCatalogued = 100000
+
 // NewLogStore creates a new Cassandra LogStore using the specified Driver and
 // Options.
 func NewLogStore(driver Driver, options *Options) *LogStore {
-	return &LogStore{
+	logStore := &LogStore{
 		driver:     driver,
 		options:    options,
 		writerPool: newWriterPool(driver, options.WriteConcurrency, options.WriteBufferSize),
+		readerPool: newReaderPool(options.ReadConcurrency),
+		catalogued: make(map[partitionKey]struct{}),
+		now:        time.Now,
 	}
+	logStore.insertCQL = logStore.buildInsertStatement()
+	logStore.logQueryCQL = logStore.buildLogQueryStatement("ASC")
+	logStore.logQueryDescCQL = logStore.buildLogQueryStatement("DESC")
+	logStore.containerInsertCQL = logStore.buildContainerInsertStatement()
+	logStore.containerQueryCQL = logStore.buildContainerQueryStatement()
+	logStore.namespaceInsertCQL = logStore.buildNamespaceInsertStatement()
+	logStore.namespaceQueryCQL = logStore.buildNamespaceQueryStatement()
+	return logStore
 }
 
 // Connect connects the LogStore to the Cassandra cluster.
@@ -62,12 +118,31 @@ func (c *LogStore) Connect() error {
 		return err
 	}
 
-	return c.createSchemaIfNotExists()
+	if _, err := newMigrator(c).Migrate(); err != nil {
+		return err
+	}
+
+	if err := c.verifyLogTable(); err != nil {
+		return SchemaError{message: "incompatible log table", cause: err}
+	}
+
+	uncopied, err := c.legacyTableUncopied()
+	if err != nil {
+		log.Warnf("failed to check log table %s.%s for log entries to copy: %s",
+			c.options.Keyspace, c.options.LogTableName, err)
+	} else if uncopied {
+		log.Errorf("log table %s.%s holds log entries, but log table %s.%s is empty: "+
+			"log entries written before schema version 4 are not found by queries until they are copied with: "+
+			"migrate --copy-from=%s",
+			c.options.Keyspace, c.options.LogTableName, c.options.Keyspace, c.logTableName(), c.options.LogTableName)
+	}
+	return nil
 }
 
 // Disconnect disconnects the LogStore from the Cassandra cluster.
 func (c *LogStore) Disconnect() error {
 	c.writerPool.stop()
+	c.readerPool.stop()
 	log.Infof("disconnecting from cassandra ...")
 	return c.driver.Close()
 }
@@ -77,82 +152,371 @@ func (c *LogStore) Ready() (bool, error) {
 	return c.driver.Reachable()
 }
 
+// Write inserts a collection of log entries into Cassandra. If some inserts
+// fail, a logstore.WriteError identifies the log entries that were not
+// (fully) stored.
 func (c *LogStore) Write(entries []logstore.LogEntry) error {
 
-	// add log entry inserts to writer pool queue (executed asynchronously)
-	resultChannels := make([]writeResultChan, len(entries))
-	for i, logEntry := range entries {
-		resultChannels[i] = c.insert(&logEntry)
+	// add log entry insert batches to writer pool queue (executed
+	// asynchronously)
+	batches, uncatalogued := c.insertBatches(entries)
+	resultChannels := make([]writeResultChan, len(batches))
+	for i, batch := range batches {
+		resultChannels[i] = c.writerPool.write(batch.inserts)
 	}
 
-	// await completion of all inserts
-	for _, resultChannel := range resultChannels {
+	// await completion of all inserts (also on failure, since the log
+	// entries and the catalog tables must not be left half-written
+	// unnoticed while this call returns)
+	entryErrs := make(map[int]error)
+	for i, resultChannel := range resultChannels {
 		err := <-resultChannel
-		if err != nil {
-			return InsertError{err}
+		if err == nil {
+			continue
+		}
+		for _, index := range batches[i].entries {
+			if _, ok := entryErrs[index]; !ok {
+				entryErrs[index] = InsertError{err}
+			}
 		}
 	}
+	if len(entryErrs) > 0 {
+		return logstore.NewWriteError(entryErrs)
+	}
 
+	c.markCatalogued(uncatalogued)
 	return nil
 }
 
 // Query performs a query for historical log records against Cassandra.
 func (c *LogStore) Query(query *logstore.Query) (*logstore.QueryResult, error) {
 	// break into sub-queries if query interval spans date border(s)
-	splitter := &querySplitter{query}
+	splitter := &querySplitter{Query: query, bucketSize: c.options.BucketSize}
 	subQueries := splitter.Split()
+	filter, err := query.Filter()
+	if err != nil {
+		return nil, err
+	}
 
-	logRows := make([]logstore.LogRow, 0)
-	for i, subQuery := range subQueries {
+	if query.Descending() || query.Tail > 0 {
+		return logstore.CollectRows(query, c.QueryStream)
+	}
+	if query.Limit > 0 {
+		return c.queryPage(query, subQueries, filter)
+	}
+	// run the sub-queries concurrently on the reader pool
+	queries := make([]func() ([]logstore.LogRow, error), len(subQueries))
+	for i := range subQueries {
+		i, subQuery := i, subQueries[i]
+		queries[i] = func() ([]logstore.LogRow, error) {
+			if log.Level() >= log.TraceLevel {
+				log.Tracef("running subquery %d out of %d: %s", (i + 1), len(subQueries), subQuery)
+			}
+			if query.MultiContainer() {
+				return c.executeContainersQuery(subQuery, filter)
+			}
+			return c.executeQuery(subQuery, filter)
+		}
+	}
+	logRows, err := c.readerPool.queryAll(queries)
+	if err != nil {
+		return nil, QueryError{"query execution", err}
+	}
+
+	return &logstore.QueryResult{LogRows: logRows}, nil
+}
+
+// QueryStream performs a query for historical log records against Cassandra,
+// and passes each matching row to a handler as it is fetched, in the order of
+// the query. A descending or tail query runs its sub-queries newest first, so
+// that a tail query can stop as soon as it has collected enough rows.
+func (c *LogStore) QueryStream(query *logstore.Query, handler logstore.LogRowHandler) error {
+	splitter := &querySplitter{Query: query, bucketSize: c.options.BucketSize}
+	subQueries := splitter.Split()
+	filter, err := query.Filter()
+	if err != nil {
+		return err
+	}
+
+	return logstore.OrderedScan(query, func(descending bool, handler logstore.LogRowHandler) error {
+		return c.scan(query, subQueries, filter, descending, handler)
+	}, handler)
+}
+
+// scan runs the sub-queries of a query, either oldest first or newest first,
+// and passes each matching row to a handler.
+func (c *LogStore) scan(query *logstore.Query, subQueries []*logstore.Query, filter logstore.LogFilter,
+	descending bool, handler logstore.LogRowHandler) error {
+	statement := c.logQueryStatement()
+	if descending {
+		statement = c.logQueryDescStatement()
+	}
+
+	for i := range subQueries {
+		subQuery := subQueries[i]
+		if descending {
+			subQuery = subQueries[len(subQueries)-1-i]
+		}
 		if log.Level() >= log.TraceLevel {
-			log.Tracef("running subquery %d out of %d: %s", (i + 1), len(subQueries), subQuery)
+			log.Tracef("streaming subquery %d out of %d: %s", (i + 1), len(subQueries), subQuery)
+		}
+		if query.MultiContainer() {
+			// the rows of a day need to be merged before being passed on
+			rows, err := c.executeContainersQuery(subQuery, filter)
+			if err != nil {
+				return QueryError{"query execution", err}
+			}
+			if descending {
+				logstore.ReverseRows(rows)
+			}
+			for i := range rows {
+				if err := handler(&rows[i]); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		// keep handler errors apart from query errors
+		var handlerErr error
+		bucket := c.options.BucketSize.bucket(subQuery.StartTime)
+		err := c.driver.QueryIter(func(result map[string]interface{}) error {
+			row := c.logRow(result)
+			if !filter(&row) {
+				return nil
+			}
+			handlerErr = handler(&row)
+			return handlerErr
+		}, statement,
+			subQuery.Namespace, subQuery.PodName, subQuery.ContainerName, bucket, subQuery.StartTime, subQuery.EndTime)
+		if handlerErr != nil {
+			return handlerErr
 		}
-		rows, err := c.executeQuery(subQuery)
 		if err != nil {
-			return nil, QueryError{"query execution", err}
+			return QueryError{"query execution", err}
 		}
-		logRows = append(logRows, rows...)
 	}
 
-	return &logstore.QueryResult{LogRows: logRows}, nil
+	return nil
 }
 
-func (c *LogStore) executeQuery(query *logstore.Query) ([]logstore.LogRow, error) {
-	date := query.StartTime.Format("2006-01-02")
+// queryPage returns (at most) query.Limit rows of a paginated query, starting
+// where the query's NextToken left off. If there may be more rows, the result
+// carries a NextToken that resumes the query after the returned rows.
+func (c *LogStore) queryPage(query *logstore.Query, subQueries []*logstore.Query, filter logstore.LogFilter) (*logstore.QueryResult, error) {
+	// find the sub-query to resume
+	first, pageState := 0, []byte(nil)
+	if query.NextToken != "" {
+		token, err := decodePageToken(query.NextToken)
+		if err != nil {
+			return nil, err
+		}
+		first = -1
+		for i, subQuery := range subQueries {
+			if c.options.BucketSize.bucketName(subQuery.StartTime) == token.Date {
+				first = i
+				break
+			}
+		}
+		if first < 0 {
+			return nil, logstore.QueryError("query parameter next_token: token does not belong to query interval")
+		}
+		pageState = token.PageState
+	}
+
+	result := &logstore.QueryResult{LogRows: make([]logstore.LogRow, 0)}
+	for i := first; i < len(subQueries); i++ {
+		subQuery := subQueries[i]
+		if log.Level() >= log.TraceLevel {
+			log.Tracef("running subquery %d out of %d: %s", (i + 1), len(subQueries), subQuery)
+		}
+		// fetch pages until the limit is reached or the sub-query is
+		// exhausted. since rows are filtered after being fetched, a page may
+		// yield fewer rows than requested.
+		for {
+			remaining := query.Limit - len(result.LogRows)
+			rows, nextPageState, err := c.executeQueryPage(subQuery, filter, remaining, pageState)
+			if err != nil {
+				return nil, QueryError{"query execution", err}
+			}
+			result.LogRows = append(result.LogRows, rows...)
+			pageState = nextPageState
+			if len(pageState) == 0 {
+				break
+			}
+			if len(result.LogRows) == query.Limit {
+				token := pageToken{Date: c.options.BucketSize.bucketName(subQuery.StartTime), PageState: pageState}
+				result.NextToken = token.encode()
+				return result, nil
+			}
+		}
+
+		if len(result.LogRows) == query.Limit && i+1 < len(subQueries) {
+			token := pageToken{Date: c.options.BucketSize.bucketName(subQueries[i+1].StartTime)}
+			result.NextToken = token.encode()
+			return result, nil
+		}
+	}
+
+	return result, nil
+}
+
+// executeQuery runs a single-day (sub-)query and returns the rows whose
+// message matches the filter.
+func (c *LogStore) executeQuery(query *logstore.Query, filter logstore.LogFilter) ([]logstore.LogRow, error) {
+	bucket := c.options.BucketSize.bucket(query.StartTime)
 	results, err := c.driver.Query(c.logQueryStatement(),
-		query.Namespace, query.PodName, query.ContainerName, date, query.StartTime, query.EndTime)
+		query.Namespace, query.PodName, query.ContainerName, bucket, query.StartTime, query.EndTime)
 	if err != nil {
 		return nil, err
 	}
+	return c.logRows(results, filter), nil
+}
+
+// executeContainersQuery runs a single-bucket (sub-)query across all
+// containers selected by a multi-container query. The containers are looked
+// up in the container table (for every date that the bucket covers) and their
+// rows are tagged with their origin and merged by time.
+func (c *LogStore) executeContainersQuery(query *logstore.Query, filter logstore.LogFilter) ([]logstore.LogRow, error) {
+	selector, err := logstore.ParseLabelSelector(query.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	containers := make(CQLRows, 0)
+	seen := make(map[partitionKey]bool)
+	for _, day := range (timePeriod{start: query.StartTime, end: query.EndTime}).divideByDays() {
+		rows, err := c.driver.Query(c.containerQueryStatement(), query.Namespace, day.start.Format("2006-01-02"))
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			key := partitionKey{podName: row["pod_name"].(string), containerName: row["container_name"].(string)}
+			if !seen[key] {
+				seen[key] = true
+				containers = append(containers, row)
+			}
+		}
+	}
 
 	logRows := make([]logstore.LogRow, 0)
-	for _, logRow := range results {
-		var time = logRow["time"].(time.Time)
-		var log = logRow["message"].(string)
-		logRows = append(logRows, logstore.LogRow{Time: time, Log: log})
+	for _, container := range containers {
+		podName := container["pod_name"].(string)
+		containerName := container["container_name"].(string)
+		labels, _ := container["labels"].(map[string]string)
+		if !query.MatchesContainer(podName, containerName) || !selector.Matches(labels) {
+			continue
+		}
+		containerQuery := *query
+		containerQuery.PodName, containerQuery.ContainerName = podName, containerName
+		rows, err := c.executeQuery(&containerQuery, filter)
+		if err != nil {
+			return nil, err
+		}
+		for i := range rows {
+			rows[i].PodName, rows[i].ContainerName = podName, containerName
+		}
+		logRows = append(logRows, rows...)
 	}
+	logstore.SortRows(logRows)
 
 	return logRows, nil
 }
 
-func (c *LogStore) createSchemaIfNotExists() error {
-	if err := c.createKeyspaceIfNotExists(); err != nil {
-		return SchemaError{message: "failed to create keyspace", cause: err}
+// Namespaces lists the namespaces with log entries on any date of the
+// interval [start, end], as recorded in the namespace table.
+func (c *LogStore) Namespaces(start, end time.Time) ([]string, error) {
+	return c.catalog(start, end, func(date string) (CQLRows, error) {
+		return c.driver.Query(c.namespaceQueryStatement(), date)
+	}, func(row map[string]interface{}) (string, bool) {
+		return row["namespace"].(string), true
+	})
+}
+
+// Pods lists the pods of a namespace with log entries on any date of the
+// interval [start, end], as recorded in the container table.
+func (c *LogStore) Pods(namespace string, start, end time.Time) ([]string, error) {
+	return c.catalog(start, end, func(date string) (CQLRows, error) {
+		return c.driver.Query(c.containerQueryStatement(), namespace, date)
+	}, func(row map[string]interface{}) (string, bool) {
+		return row["pod_name"].(string), true
+	})
+}
+
+// Containers lists the containers of a pod with log entries on any date of the
+// interval [start, end], as recorded in the container table.
+func (c *LogStore) Containers(namespace, podName string, start, end time.Time) ([]string, error) {
+	return c.catalog(start, end, func(date string) (CQLRows, error) {
+		return c.driver.Query(c.containerQueryStatement(), namespace, date)
+	}, func(row map[string]interface{}) (string, bool) {
+		return row["container_name"].(string), row["pod_name"].(string) == podName
+	})
+}
+
+// catalog runs a catalog table query for every date of the interval [start,
+// end] and collects the (sorted, distinct) names that a name function returns
+// for the result rows. Rows for which the name function returns false are
+// skipped.
+func (c *LogStore) catalog(start, end time.Time, query func(date string) (CQLRows, error),
+	name func(row map[string]interface{}) (string, bool)) ([]string, error) {
+
+	names := make(map[string]struct{})
+	for _, day := range (timePeriod{start: start.UTC(), end: end.UTC()}).divideByDays() {
+		rows, err := query(day.start.Format("2006-01-02"))
+		if err != nil {
+			return nil, QueryError{"catalog query", err}
+		}
+		for _, row := range rows {
+			if n, ok := name(row); ok {
+				names[n] = struct{}{}
+			}
+		}
 	}
 
-	if err := c.createTableIfNotExists(); err != nil {
-		return SchemaError{message: "failed to create log table", cause: err}
+	sorted := make([]string, 0, len(names))
+	for n := range names {
+		sorted = append(sorted, n)
 	}
+	sort.Strings(sorted)
+	return sorted, nil
+}
 
-	return nil
+// executeQueryPage fetches a single page of (at most) pageSize rows of a
+// single-day (sub-)query and returns the rows whose message matches the
+// filter, together with the page state of the next page.
+func (c *LogStore) executeQueryPage(query *logstore.Query, filter logstore.LogFilter, pageSize int, pageState []byte) ([]logstore.LogRow, []byte, error) {
+	bucket := c.options.BucketSize.bucket(query.StartTime)
+	results, nextPageState, err := c.driver.QueryPage(c.logQueryStatement(), pageSize, pageState,
+		query.Namespace, query.PodName, query.ContainerName, bucket, query.StartTime, query.EndTime)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.logRows(results, filter), nextPageState, nil
 }
 
-func (c *LogStore) createKeyspaceIfNotExists() error {
-	return c.driver.Execute(c.keyspaceDeclaration())
+// logRows converts query result rows into the LogRows that match the filter.
+func (c *LogStore) logRows(results CQLRows, filter logstore.LogFilter) []logstore.LogRow {
+	logRows := make([]logstore.LogRow, 0)
+	for _, result := range results {
+		row := c.logRow(result)
+		if !filter(&row) {
+			continue
+		}
+		logRows = append(logRows, row)
+	}
+
+	return logRows
 }
 
-func (c *LogStore) createTableIfNotExists() error {
-	return c.driver.Execute(c.tableDeclaration())
+// logRow converts a query result row into a LogRow.
+func (c *LogStore) logRow(result map[string]interface{}) logstore.LogRow {
+	var time = result["time"].(time.Time)
+	var log = result["message"].(string)
+	// stream may be missing from rows written by old clients
+	var stream, _ = result["stream"].(string)
+	return logstore.LogRow{Time: time, Log: log, Stream: stream}
+}
+
+func (c *LogStore) createKeyspaceIfNotExists() error {
+	return c.driver.Execute(c.keyspaceDeclaration())
 }
 
 func (c *LogStore) keyspaceDeclaration() string {
@@ -169,12 +533,76 @@ func (c *LogStore) keyspaceDeclaration() string {
 		c.options.Keyspace, replicationSpec)
 }
 
+// logTableName returns the name of the log table that log entries are
+// written to and read from. The log table is keyed by pod container, time and
+// entry hash, and is created by schema version 4. It replaces the log table
+// created by schema version 1 (named by LogTableName), which is keyed by pod
+// container and time only and whose log entries can be copied into it with
+// CopyLogTable.
+func (c *LogStore) logTableName() string {
+	return c.options.LogTableName + "_hashed"
+}
+
+// tableDeclaration returns the declaration of the log table (see
+// logTableName).
 func (c *LogStore) tableDeclaration() string {
 	const LogTableTemplate string = `CREATE TABLE IF NOT EXISTS %s.%s (
 	namespace text,
 	pod_name text,
 	container_name text,
-	date date,
+	%s %s,
+	time timestamp,
+	entry_hash bigint,
+	message text,
+	stream text,
+	pod_id text,
+	docker_id text,
+	host text,	
+	labels map<text,text>,
+	PRIMARY KEY ((namespace, pod_name, container_name, %s), time, entry_hash) )
+WITH CLUSTERING ORDER BY (time DESC, entry_hash ASC) AND comment = '%s%s'
+AND %s`
+
+	bucketType := "date"
+	if c.options.BucketSize.subDay() {
+		bucketType = "timestamp"
+	}
+	return fmt.Sprintf(LogTableTemplate, c.options.Keyspace, c.logTableName(),
+		c.bucketColumn(), bucketType, c.bucketColumn(), bucketSizeComment, c.options.BucketSize,
+		c.tableOptions().cql())
+}
+
+// legacyTableUncopied returns true if the log table created by schema version
+// 1 holds log entries while the log table in use (created by schema version
+// 4) holds none, which means that the log entries of a server that predates
+// schema version 4 have not yet been copied (see CopyLogTable).
+func (c *LogStore) legacyTableUncopied() (bool, error) {
+	rows, err := c.driver.Query(c.anyRowQuery(c.logTableName()))
+	if err != nil || len(rows) > 0 {
+		return false, err
+	}
+	rows, err = c.driver.Query(c.anyRowQuery(c.options.LogTableName))
+	if err != nil {
+		return false, err
+	}
+	return len(rows) > 0, nil
+}
+
+// anyRowQuery returns the statement used to check whether a log table holds
+// any log entries.
+func (c *LogStore) anyRowQuery(table string) string {
+	return "SELECT namespace FROM " + c.options.Keyspace + "." + table + " LIMIT 1"
+}
+
+// legacyTableDeclaration returns the declaration of the log table created by
+// schema version 1, which is keyed by pod container and time only, so that
+// log entries of a pod container with equal timestamps overwrite each other.
+func (c *LogStore) legacyTableDeclaration() string {
+	const LogTableTemplate string = `CREATE TABLE IF NOT EXISTS %s.%s (
+	namespace text,
+	pod_name text,
+	container_name text,
+	%s %s,
 	time timestamp,
 	message text,
 	stream text,
@@ -182,35 +610,433 @@ func (c *LogStore) tableDeclaration() string {
 	docker_id text,
 	host text,	
 	labels map<text,text>,
-	PRIMARY KEY ((namespace, pod_name, container_name, date), time) )
-WITH CLUSTERING ORDER BY (time DESC)`
+	PRIMARY KEY ((namespace, pod_name, container_name, %s), time) )
+WITH CLUSTERING ORDER BY (time DESC) AND comment = '%s%s'
+AND %s`
+
+	bucketType := "date"
+	if c.options.BucketSize.subDay() {
+		bucketType = "timestamp"
+	}
+	return fmt.Sprintf(LogTableTemplate, c.options.Keyspace, c.options.LogTableName,
+		c.bucketColumn(), bucketType, c.bucketColumn(), bucketSizeComment, c.options.BucketSize,
+		c.tableOptions().cql())
+}
+
+// bucketColumn returns the name of the log table column that holds the
+// partition bucket: the date for buckets of a day or longer, and the start
+// time for shorter buckets.
+func (c *LogStore) bucketColumn() string {
+	if c.options.BucketSize.subDay() {
+		return "bucket"
+	}
+	return "date"
+}
+
+// bucketSizeComment is the prefix of the log table comment that records the
+// bucket size that the table was created with.
+const bucketSizeComment = "bucket_size="
+
+// verifyLogTable reads the options of the log table, which may have existed
+// before, from the schema tables. It ensures that the log table was created
+// with the configured bucket size, and warns about table options that differ
+// from the configured ones (which are only applied when the table is
+// created).
+func (c *LogStore) verifyLogTable() error {
+	rows, err := c.driver.Query(c.tableOptionsQuery(), c.options.Keyspace, c.logTableName())
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return fmt.Errorf("log table %s.%s not found", c.options.Keyspace, c.logTableName())
+	}
+	if err := c.verifyBucketSize(rows[0]); err != nil {
+		return err
+	}
+
+	configured := c.tableOptions()
+	if drift := configured.drift(rows[0]); len(drift) > 0 {
+		log.Warnf("options of log table %s.%s differ from the configured ones: %s. "+
+			"To apply the configured options, run: ALTER TABLE %s.%s WITH %s",
+			c.options.Keyspace, c.logTableName(), strings.Join(drift, "; "),
+			c.options.Keyspace, c.logTableName(), configured.cql())
+	}
+	return nil
+}
+
+// verifyBucketSize ensures that the log table was created with the
+// configured bucket size, by reading it from the table comment. Tables
+// without a bucket size in their comment predate configurable bucket sizes,
+// and use daily buckets.
+func (c *LogStore) verifyBucketSize(table map[string]interface{}) error {
+	comment, _ := table["comment"].(string)
+	tableBucketSize := DailyBuckets
+	if strings.HasPrefix(comment, bucketSizeComment) {
+		tableBucketSize = BucketSize(strings.TrimPrefix(comment, bucketSizeComment))
+	}
+	if tableBucketSize != c.options.BucketSize {
+		return fmt.Errorf("log table was created with bucket size %s, but bucket size %s is configured",
+			tableBucketSize, c.options.BucketSize)
+	}
+	return nil
+}
+
+// tableOptionsQuery returns the statement used to read the options of a table.
+func (c *LogStore) tableOptionsQuery() string {
+	return "SELECT comment, compaction, compression, default_time_to_live, gc_grace_seconds " +
+		"FROM system_schema.tables WHERE (keyspace_name=?) AND (table_name=?)"
+}
+
+// containerTableName returns the name of the container table, a catalog table
+// which records the pod containers (and their labels) that have log entries
+// in each namespace on each date. It allows queries across containers to find
+// the log table partitions to read, and clients to discover pods and
+// containers.
+func (c *LogStore) containerTableName() string {
+	return c.options.LogTableName + "_containers"
+}
+
+func (c *LogStore) containerTableDeclaration() string {
+	const ContainerTableTemplate string = `CREATE TABLE IF NOT EXISTS %s.%s (
+	namespace text,
+	date date,
+	pod_name text,
+	container_name text,
+	labels map<text,text>,
+	PRIMARY KEY ((namespace, date), pod_name, container_name) )`
+
+	return fmt.Sprintf(ContainerTableTemplate, c.options.Keyspace, c.containerTableName())
+}
+
+// namespaceTableName returns the name of the namespace table, a catalog table
+// which records the namespaces that have log entries on each date.
+func (c *LogStore) namespaceTableName() string {
+	return c.options.LogTableName + "_namespaces"
+}
+
+func (c *LogStore) namespaceTableDeclaration() string {
+	const NamespaceTableTemplate string = `CREATE TABLE IF NOT EXISTS %s.%s (
+	date date,
+	namespace text,
+	PRIMARY KEY ((date), namespace) )`
 
-	return fmt.Sprintf(LogTableTemplate, c.options.Keyspace, c.options.LogTableName)
+	return fmt.Sprintf(NamespaceTableTemplate, c.options.Keyspace, c.namespaceTableName())
 }
 
+// logQueryStatement returns the statement used to query log entries.
 func (c *LogStore) logQueryStatement() string {
-	return "SELECT time, message " +
-		"FROM " + c.options.Keyspace + "." + c.options.LogTableName + " WHERE" +
+	return c.logQueryCQL
+}
+
+// logQueryDescStatement returns the statement used to query log entries
+// newest first.
+func (c *LogStore) logQueryDescStatement() string {
+	return c.logQueryDescCQL
+}
+
+func (c *LogStore) buildLogQueryStatement(order string) string {
+	return "SELECT time, message, stream " +
+		"FROM " + c.options.Keyspace + "." + c.logTableName() + " WHERE" +
 		"(namespace=?) AND " +
 		"(pod_name=?) AND " +
 		"(container_name=?) AND " +
-		"(date=?) AND " +
+		"(" + c.bucketColumn() + "=?) AND " +
 		"(time >= ?) AND " +
 		"(time <= ?) " +
-		"ORDER BY time ASC"
+		"ORDER BY time " + order
 }
 
+// insertStatement returns the statement used to insert log entries.
 func (c *LogStore) insertStatement() string {
-	return "INSERT INTO " + c.options.Keyspace + "." + c.options.LogTableName + " " +
-		"(namespace, pod_name, container_name, date, time, message, stream, pod_id, docker_id, host, labels) " +
-		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	return c.insertCQL
+}
+
+func (c *LogStore) buildInsertStatement() string {
+	return "INSERT INTO " + c.options.Keyspace + "." + c.logTableName() + " " +
+		"(namespace, pod_name, container_name, " + c.bucketColumn() + ", time, entry_hash, message, stream, pod_id, docker_id, host, labels) " +
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) " +
+		"USING TTL ?"
 }
 
-func (c *LogStore) insert(logEntry *logstore.LogEntry) writeResultChan {
+// containerInsertStatement returns the statement used to record a pod
+// container in the container table.
+func (c *LogStore) containerInsertStatement() string {
+	return c.containerInsertCQL
+}
+
+func (c *LogStore) buildContainerInsertStatement() string {
+	return "INSERT INTO " + c.options.Keyspace + "." + c.containerTableName() + " " +
+		"(namespace, date, pod_name, container_name, labels) " +
+		"VALUES (?, ?, ?, ?, ?) " +
+		"USING TTL ?"
+}
+
+// containerQueryStatement returns the statement used to look up the pod
+// containers of a namespace on a given date.
+func (c *LogStore) containerQueryStatement() string {
+	return c.containerQueryCQL
+}
+
+func (c *LogStore) buildContainerQueryStatement() string {
+	return "SELECT pod_name, container_name, labels " +
+		"FROM " + c.options.Keyspace + "." + c.containerTableName() + " WHERE " +
+		"(namespace=?) AND " +
+		"(date=?)"
+}
+
+// namespaceInsertStatement returns the statement used to record a namespace
+// in the namespace table.
+func (c *LogStore) namespaceInsertStatement() string {
+	return c.namespaceInsertCQL
+}
+
+func (c *LogStore) buildNamespaceInsertStatement() string {
+	return "INSERT INTO " + c.options.Keyspace + "." + c.namespaceTableName() + " " +
+		"(date, namespace) " +
+		"VALUES (?, ?) " +
+		"USING TTL ?"
+}
+
+// namespaceQueryStatement returns the statement used to look up the
+// namespaces on a given date.
+func (c *LogStore) namespaceQueryStatement() string {
+	return c.namespaceQueryCQL
+}
+
+func (c *LogStore) buildNamespaceQueryStatement() string {
+	return "SELECT namespace " +
+		"FROM " + c.options.Keyspace + "." + c.namespaceTableName() + " WHERE " +
+		"(date=?)"
+}
+
+func (c *LogStore) insert(logEntry *logstore.LogEntry) CQLStatement {
+	return c.insertWithTTL(logEntry, c.ttl(logEntry.Kubernetes.Namespace))
+}
+
+// insertWithTTL returns the statement that inserts a log entry with a given
+// time-to-live (in seconds).
+func (c *LogStore) insertWithTTL(logEntry *logstore.LogEntry, ttl int) CQLStatement {
 	podMeta := logEntry.Kubernetes
+	bucket := c.options.BucketSize.bucket(logEntry.Time)
+
+	return CQLStatement{
+		Statement: c.insertStatement(),
+		Placeholders: []interface{}{
+			podMeta.Namespace, podMeta.PodName, podMeta.ContainerName, bucket, logEntry.Time, logstore.EntryHash(logEntry),
+			logEntry.Log, logEntry.Stream, podMeta.PodID, podMeta.DockerID, podMeta.Host, podMeta.Labels,
+			ttl,
+		},
+	}
+}
+
+// ttl returns the time-to-live (in seconds) to insert the log entries of a
+// namespace with. Zero means that entries never expire.
+func (c *LogStore) ttl(namespace string) int {
+	return int(c.options.NamespaceTTLs.ttl(namespace, c.options.DefaultTTL) / time.Second)
+}
+
+// catalogTTL returns the time-to-live (in seconds) to record a namespace (or
+// one of its pod containers) on the date of a log entry with. A catalog
+// table entry is only written with the first log entry of the date, so it is
+// kept for the time-to-live of the namespace counted from the end of the
+// date, to outlive the log entries written later that day. Zero means that
+// entries never expire.
+func (c *LogStore) catalogTTL(namespace string, date time.Time) int {
+	ttl := c.ttl(namespace)
+	if ttl == 0 {
+		return 0
+	}
+	y, m, d := date.Date()
+	endOfDate := time.Date(y, m, d+1, 0, 0, 0, 0, date.Location())
+	if remaining := endOfDate.Sub(c.now()); remaining > 0 {
+		ttl += int(remaining / time.Second)
+	}
+	return ttl
+}
+
+// partitionKey identifies the Cassandra partition that a log entry is stored
+// in. The bucket is left out for the keys of catalog table entries, which are
+// kept by date.
+type partitionKey struct {
+	namespace     string
+	podName       string
+	containerName string
+	date          string
+	bucket        string
+}
+
+// pendingInsert is an insert together with the (indices of the) log entries
+// that are not fully stored unless it succeeds.
+type pendingInsert struct {
+	statement CQLStatement
+	entries   []int
+}
+
+// insertBatch is a batch of inserts together with the (indices of the) log
+// entries that are not fully stored unless it succeeds.
+type insertBatch struct {
+	inserts []CQLStatement
+	entries []int
+}
+
+// insertBatches groups the inserts for a collection of log entries by
+// partition and divides each group into batches of at most WriteBatchSize
+// inserts. Batches are returned in the order in which their partitions first
+// appear among the log entries. They are followed by batches that record the
+// partitions that are not yet known to be catalogued in the catalog tables
+// (grouped by catalog table partition). The keys of those partitions are
+// returned as well, to be marked as catalogued once written. A catalog insert
+// is pending for all log entries of the pod container (or namespace) that it
+// records, since they cannot be found through the catalog without it.
+func (c *LogStore) insertBatches(entries []logstore.LogEntry) ([]insertBatch, []partitionKey) {
+	partitionInserts := make(map[partitionKey][]pendingInsert)
+	partitionOrder := make([]partitionKey, 0)
+	// container table partitions are keyed on namespace and date, namespace
+	// table partitions on date, and hold the keys of the pod containers and
+	// namespaces to catalog
+	containerInserts := make(map[partitionKey][]partitionKey)
+	containerOrder := make([]partitionKey, 0)
+	namespaceInserts := make(map[string][]partitionKey)
+	dateOrder := make([]string, 0)
+	// the log entries (and the first of them) of each pod container and
+	// namespace on a date
+	catalogEntries := make(map[partitionKey][]int)
+	firstEntry := make(map[partitionKey]int)
+	uncatalogued := make([]partitionKey, 0)
+	seen := make(map[partitionKey]bool)
+	for i := range entries {
+		logEntry := &entries[i]
+		key := partitionKey{
+			namespace:     logEntry.Kubernetes.Namespace,
+			podName:       logEntry.Kubernetes.PodName,
+			containerName: logEntry.Kubernetes.ContainerName,
+			date:          logEntry.Time.Format("2006-01-02"),
+			bucket:        c.options.BucketSize.bucketName(logEntry.Time),
+		}
+		containerKey := partitionKey{
+			namespace: key.namespace, podName: key.podName, containerName: key.containerName, date: key.date}
+		namespaceKey := partitionKey{namespace: key.namespace, date: key.date}
+		catalogEntries[containerKey] = append(catalogEntries[containerKey], i)
+		catalogEntries[namespaceKey] = append(catalogEntries[namespaceKey], i)
+		if _, ok := partitionInserts[key]; !ok {
+			partitionOrder = append(partitionOrder, key)
+
+			if !seen[containerKey] && !c.isCatalogued(containerKey) {
+				uncatalogued = append(uncatalogued, containerKey)
+				firstEntry[containerKey] = i
+				if _, ok := containerInserts[namespaceKey]; !ok {
+					containerOrder = append(containerOrder, namespaceKey)
+				}
+				containerInserts[namespaceKey] = append(containerInserts[namespaceKey], containerKey)
+			}
+			if !seen[namespaceKey] && !c.isCatalogued(namespaceKey) {
+				uncatalogued = append(uncatalogued, namespaceKey)
+				firstEntry[namespaceKey] = i
+				if _, ok := namespaceInserts[key.date]; !ok {
+					dateOrder = append(dateOrder, key.date)
+				}
+				namespaceInserts[key.date] = append(namespaceInserts[key.date], namespaceKey)
+			}
+			seen[containerKey] = true
+			seen[namespaceKey] = true
+		}
+		partitionInserts[key] = append(partitionInserts[key], pendingInsert{c.insert(logEntry), []int{i}})
+	}
+
+	batches := make([]insertBatch, 0)
+	for _, key := range partitionOrder {
+		batches = append(batches, c.splitBatch(partitionInserts[key])...)
+	}
+	for _, namespaceKey := range containerOrder {
+		inserts := make([]pendingInsert, 0)
+		for _, containerKey := range containerInserts[namespaceKey] {
+			insert := c.containerInsert(&entries[firstEntry[containerKey]])
+			inserts = append(inserts, pendingInsert{insert, catalogEntries[containerKey]})
+		}
+		batches = append(batches, c.splitBatch(inserts)...)
+	}
+	for _, date := range dateOrder {
+		inserts := make([]pendingInsert, 0)
+		for _, namespaceKey := range namespaceInserts[date] {
+			insert := c.namespaceInsert(&entries[firstEntry[namespaceKey]])
+			inserts = append(inserts, pendingInsert{insert, catalogEntries[namespaceKey]})
+		}
+		batches = append(batches, c.splitBatch(inserts)...)
+	}
+	return batches, uncatalogued
+}
+
+// isCatalogued returns true if a log table partition (or, for a key without
+// pod and container, a namespace on a date) is known to be recorded in the
+// catalog tables.
+func (c *LogStore) isCatalogued(key partitionKey) bool {
+	c.catalogMutex.Lock()
+	defer c.catalogMutex.Unlock()
+
+	_, ok := c.catalogued[key]
+	return ok
+}
+
+// markCatalogued records that partitions have been written to the catalog
+// tables, so that they are not written again on every write. The record is
+// bounded in size: when full, it is reset, which only causes some partitions
+// to be catalogued again.
+func (c *LogStore) markCatalogued(keys []partitionKey) {
+	c.catalogMutex.Lock()
+	defer c.catalogMutex.Unlock()
+
+	if len(c.catalogued)+len(keys) > maxCatalogued {
+		c.catalogued = make(map[partitionKey]struct{})
+	}
+	for _, key := range keys {
+		c.catalogued[key] = struct{}{}
+	}
+}
+
+// splitBatch divides the inserts for a partition into batches of at most
+// WriteBatchSize inserts.
+func (c *LogStore) splitBatch(inserts []pendingInsert) []insertBatch {
+	batches := make([]insertBatch, 0)
+	for len(inserts) > 0 {
+		n := len(inserts)
+		if n > c.options.WriteBatchSize {
+			n = c.options.WriteBatchSize
+		}
+		batch := insertBatch{inserts: make([]CQLStatement, 0, n), entries: make([]int, 0, n)}
+		for _, insert := range inserts[:n] {
+			batch.inserts = append(batch.inserts, insert.statement)
+			batch.entries = append(batch.entries, insert.entries...)
+		}
+		batches = append(batches, batch)
+		inserts = inserts[n:]
+	}
+	return batches
+}
+
+// namespaceInsert returns the statement that records the namespace of a log
+// entry in the namespace table.
+func (c *LogStore) namespaceInsert(logEntry *logstore.LogEntry) CQLStatement {
 	date := logEntry.Time.Format("2006-01-02")
 
-	return c.writerPool.write(c.insertStatement(),
-		podMeta.Namespace, podMeta.PodName, podMeta.ContainerName, date, logEntry.Time,
-		logEntry.Log, logEntry.Stream, podMeta.PodID, podMeta.DockerID, podMeta.Host, podMeta.Labels)
+	return CQLStatement{
+		Statement: c.namespaceInsertStatement(),
+		Placeholders: []interface{}{
+			date, logEntry.Kubernetes.Namespace, c.catalogTTL(logEntry.Kubernetes.Namespace, logEntry.Time),
+		},
+	}
+}
+
+// containerInsert returns the statement that records the pod container of a
+// log entry in the container table.
+func (c *LogStore) containerInsert(logEntry *logstore.LogEntry) CQLStatement {
+	podMeta := logEntry.Kubernetes
+	date := logEntry.Time.Format("2006-01-02")
+
+	return CQLStatement{
+		Statement: c.containerInsertStatement(),
+		Placeholders: []interface{}{
+			podMeta.Namespace, date, podMeta.PodName, podMeta.ContainerName, podMeta.Labels,
+			c.catalogTTL(podMeta.Namespace, logEntry.Time),
+		},
+	}
 }
@@ -44,6 +44,16 @@ func (m *MockedCQLDriver) Execute(statement string, placeholders ...interface{})
 	return args.Error(0)
 }
 
+func (m *MockedCQLDriver) ExecuteBatch(statements []CQLStatement) error {
+	args := m.Called(statements)
+	return args.Error(0)
+}
+
+func (m *MockedCQLDriver) ExecuteCAS(statement string, placeholders ...interface{}) (bool, error) {
+	args := m.Called(statement, placeholders)
+	return args.Bool(0), args.Error(1)
+}
+
 func (m *MockedCQLDriver) Query(query string, placeholders ...interface{}) (CQLRows, error) {
 	args := m.Called(query, placeholders)
 	if args.Get(0) == nil {
@@ -52,6 +62,28 @@ func (m *MockedCQLDriver) Query(query string, placeholders ...interface{}) (CQLR
 	return args.Get(0).(CQLRows), args.Error(1)
 }
 
+func (m *MockedCQLDriver) QueryPage(query string, pageSize int, pageState []byte, placeholders ...interface{}) (CQLRows, []byte, error) {
+	args := m.Called(query, pageSize, pageState, placeholders)
+	if args.Get(0) == nil {
+		return nil, nil, args.Error(2)
+	}
+	nextPageState, _ := args.Get(1).([]byte)
+	return args.Get(0).(CQLRows), nextPageState, args.Error(2)
+}
+
+func (m *MockedCQLDriver) QueryIter(handler CQLRowHandler, query string, placeholders ...interface{}) error {
+	args := m.Called(query, placeholders)
+	// feed the given rows to the handler
+	if rows, ok := args.Get(0).(CQLRows); ok {
+		for _, row := range rows {
+			if err := handler(row); err != nil {
+				return err
+			}
+		}
+	}
+	return args.Error(1)
+}
+
 func options() *Options {
 	return &Options{
 		Hosts:               []string{"localhost"},
@@ -61,6 +93,12 @@ func options() *Options {
 		ReplicationStrategy: "",
 		ReplicationFactors:  map[string]int{"cluster": 3},
 		WriteConcurrency:    4,
+		WriteBatchSize:      50,
+		ReadConcurrency:     4,
+		BucketSize:          DailyBuckets,
+		CompactionStrategy:  TimeWindowCompaction,
+		Compression:         LZ4Compression,
+		GCGraceSeconds:      864000,
 	}
 }
 
@@ -75,11 +113,16 @@ func TestLogStoreConnect(t *testing.T) {
 	//
 	// LogStore should connect to Cassandra
 	mockCQLDriver.On("Connect").Return(nil)
+	// LogStore should create keyspace and apply all schema migrations
+	expectSchemaMigration(mockCQLDriver, logStore)
+	// LogStore should verify the bucket size of the log table
+	mockCQLDriver.On("Query", logStore.tableOptionsQuery(), []interface{}{"keyspace", "logtable_hashed"}).Return(
+		CQLRows{{"comment": "bucket_size=1d"}}, nil)
+	// LogStore should check for log entries left to copy from the log table
+	// of schema version 1
 	var emptyPlaceholders []interface{}
-	// LogStore should create keyspace if it doesn't exist already
-	mockCQLDriver.On("Execute", logStore.keyspaceDeclaration(), emptyPlaceholders).Return(nil)
-	// LogStore should create log table if it doesn't exist already
-	mockCQLDriver.On("Execute", logStore.tableDeclaration(), emptyPlaceholders).Return(nil)
+	mockCQLDriver.On("Query", logStore.anyRowQuery("logtable_hashed"), emptyPlaceholders).Return(CQLRows{}, nil)
+	mockCQLDriver.On("Query", logStore.anyRowQuery("logtable"), emptyPlaceholders).Return(CQLRows{}, nil)
 
 	//
 	// make call
@@ -112,11 +155,16 @@ func TestLogStoreConnectWithNetworkTopologyStrategy(t *testing.T) {
 	//
 	// LogStore should connect to Cassandra
 	mockCQLDriver.On("Connect").Return(nil)
+	// LogStore should create keyspace and apply all schema migrations
+	expectSchemaMigration(mockCQLDriver, logStore)
+	// LogStore should verify the bucket size of the log table
+	mockCQLDriver.On("Query", logStore.tableOptionsQuery(), []interface{}{"keyspace", "logtable_hashed"}).Return(
+		CQLRows{{"comment": "bucket_size=1d"}}, nil)
+	// LogStore should check for log entries left to copy from the log table
+	// of schema version 1
 	var emptyPlaceholders []interface{}
-	// LogStore should create keyspace if it doesn't exist already
-	mockCQLDriver.On("Execute", logStore.keyspaceDeclaration(), emptyPlaceholders).Return(nil)
-	// LogStore should create log table if it doesn't exist already
-	mockCQLDriver.On("Execute", logStore.tableDeclaration(), emptyPlaceholders).Return(nil)
+	mockCQLDriver.On("Query", logStore.anyRowQuery("logtable_hashed"), emptyPlaceholders).Return(CQLRows{}, nil)
+	mockCQLDriver.On("Query", logStore.anyRowQuery("logtable"), emptyPlaceholders).Return(CQLRows{}, nil)
 
 	//
 	// make call
@@ -214,24 +262,114 @@ func TestLogStoreOnTableCreateError(t *testing.T) {
 	// LogStore should connect to Cassandra
 	mockCQLDriver.On("Connect").Return(nil)
 	var emptyPlaceholders []interface{}
-	// LogStore should create keyspace
-	mockCQLDriver.On("Execute", logStore.keyspaceDeclaration(), emptyPlaceholders).Return(nil)
+	// LogStore should create keyspace and take the schema lock
+	expectSchemaLock(mockCQLDriver, logStore, CQLRows{})
 	// driver will fail log table creation
 	driverErr := fmt.Errorf("internal error")
-	mockCQLDriver.On("Execute", logStore.tableDeclaration(), emptyPlaceholders).Return(driverErr)
+	mockCQLDriver.On("Execute", logStore.legacyTableDeclaration(), emptyPlaceholders).Return(driverErr)
 
 	//
 	// make call
 	//
 	err := logStore.Connect()
-	expectedErr := SchemaError{message: "failed to create log table", cause: driverErr}
+	expectedErr := SchemaError{message: "migration 1: create log table failed", cause: driverErr}
 	require.Equalf(t, expectedErr, err, "expected connect to fail with schema creation error")
-	require.Equalf(t, "schema creation failed: failed to create log table: internal error", err.Error(), "unexpected error message")
+	require.Equalf(t, "schema creation failed: migration 1: create log table failed: internal error", err.Error(), "unexpected error message")
 
 	// verify that expected calls were made
 	mockCQLDriver.AssertExpectations(t)
 }
 
+// Verify that LogStore.Connect(..) returns a SchemaError on failure to create
+// the container table.
+func TestLogStoreOnContainerTableCreateError(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	logStore := NewLogStore(mockCQLDriver, options())
+
+	//
+	// set up mock expectations
+	//
+
+	mockCQLDriver.On("Connect").Return(nil)
+	var emptyPlaceholders []interface{}
+	// the log table was created by an earlier migration
+	expectSchemaLock(mockCQLDriver, logStore, CQLRows{{"version": 1}})
+	// driver will fail container table creation
+	driverErr := fmt.Errorf("internal error")
+	mockCQLDriver.On("Execute", logStore.containerTableDeclaration(), emptyPlaceholders).Return(driverErr)
+
+	//
+	// make call
+	//
+	err := logStore.Connect()
+	expectedErr := SchemaError{message: "migration 2: create container catalog table failed", cause: driverErr}
+	require.Equalf(t, expectedErr, err, "expected connect to fail with schema creation error")
+
+	// verify that expected calls were made
+	mockCQLDriver.AssertExpectations(t)
+}
+
+// Verify that LogStore.Connect(..) refuses to use a log table that was
+// created with another bucket size than the configured one. A log table
+// without a recorded bucket size uses daily buckets.
+func TestLogStoreConnectOnBucketSizeMismatch(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	opts := options()
+	opts.BucketSize = HourlyBuckets
+	logStore := NewLogStore(mockCQLDriver, opts)
+
+	assert.Containsf(t, logStore.tableDeclaration(), "bucket timestamp",
+		"expected hourly buckets to be keyed on a timestamp")
+	assert.Containsf(t, logStore.tableDeclaration(), "comment = 'bucket_size=1h'",
+		"expected table declaration to record the bucket size")
+
+	//
+	// set up mock expectations
+	//
+	mockCQLDriver.On("Connect").Return(nil)
+	expectSchemaMigration(mockCQLDriver, logStore)
+	// the table already existed, and predates configurable bucket sizes
+	mockCQLDriver.On("Query", logStore.tableOptionsQuery(), []interface{}{"keyspace", "logtable_hashed"}).Return(
+		CQLRows{{"comment": ""}}, nil)
+
+	//
+	// make call
+	//
+	err := logStore.Connect()
+	expectedErr := SchemaError{message: "incompatible log table",
+		cause: fmt.Errorf("log table was created with bucket size 1d, but bucket size 1h is configured")}
+	require.Equalf(t, expectedErr, err, "expected connect to fail with schema error")
+
+	// verify that expected calls were made
+	mockCQLDriver.AssertExpectations(t)
+}
+
+// Log entries of the log table of schema version 1 should be reported as left
+// to copy only if the log table in use is empty.
+func TestLegacyTableUncopied(t *testing.T) {
+	var emptyPlaceholders []interface{}
+	tests := []struct {
+		rows           CQLRows
+		legacyRows     CQLRows
+		expectUncopied bool
+	}{
+		{rows: CQLRows{}, legacyRows: CQLRows{}, expectUncopied: false},
+		{rows: CQLRows{}, legacyRows: CQLRows{{"namespace": "default"}}, expectUncopied: true},
+		{rows: CQLRows{{"namespace": "default"}}, legacyRows: CQLRows{{"namespace": "default"}}, expectUncopied: false},
+	}
+	for _, test := range tests {
+		mockCQLDriver := new(MockedCQLDriver)
+		logStore := NewLogStore(mockCQLDriver, options())
+		mockCQLDriver.On("Query", logStore.anyRowQuery("logtable_hashed"), emptyPlaceholders).Return(test.rows, nil)
+		mockCQLDriver.On("Query", logStore.anyRowQuery("logtable"), emptyPlaceholders).Return(test.legacyRows, nil)
+
+		uncopied, err := logStore.legacyTableUncopied()
+		require.Nilf(t, err, "check not expected to fail")
+		assert.Equalf(t, test.expectUncopied, uncopied, "unexpected result for %d/%d log table rows",
+			len(test.rows), len(test.legacyRows))
+	}
+}
+
 // Verify that LogStore.Ready(..) queries the Driver.
 func TestLogStoreReadyProbeOnSuccess(t *testing.T) {
 	mockCQLDriver := new(MockedCQLDriver)
@@ -293,8 +431,8 @@ func TestLogStoreQuery(t *testing.T) {
 
 	// query result
 	queryResult := CQLRows([]map[string]interface{}{
-		{"time": MustParse("2018-01-01T12:30:00.000Z"), "message": "event 1"},
-		{"time": MustParse("2018-01-01T13:00:00.000Z"), "message": "event 2"},
+		{"time": MustParse("2018-01-01T12:30:00.000Z"), "message": "event 1", "stream": "stdout"},
+		{"time": MustParse("2018-01-01T13:00:00.000Z"), "message": "event 2", "stream": "stderr"},
 	})
 	queryDate := query.StartTime.Format("2006-01-02")
 	expectedPlaceholders := []interface{}{
@@ -308,8 +446,58 @@ func TestLogStoreQuery(t *testing.T) {
 	results, err := logStore.Query(query)
 	assert.Nil(t, err, "expected error return to be nil")
 	expectedRows := []logstore.LogRow{
-		logstore.LogRow{Time: MustParse("2018-01-01T12:30:00.000Z"), Log: "event 1"},
-		logstore.LogRow{Time: MustParse("2018-01-01T13:00:00.000Z"), Log: "event 2"},
+		logstore.LogRow{Time: MustParse("2018-01-01T12:30:00.000Z"), Log: "event 1", Stream: "stdout"},
+		logstore.LogRow{Time: MustParse("2018-01-01T13:00:00.000Z"), Log: "event 2", Stream: "stderr"},
+	}
+	assert.Truef(t, reflect.DeepEqual(expectedRows, results.LogRows),
+		"unexpected result set: expected: %#v, was: %#v", expectedRows, results.LogRows)
+
+	// verify that expected calls were made
+	mockCQLDriver.AssertExpectations(t)
+}
+
+// Verify that LogStore.Query(..) only returns the rows whose message matches
+// the filters of the query.
+func TestLogStoreQueryWithFilter(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	logStore := NewLogStore(mockCQLDriver, options())
+
+	query := &api.Query{
+		Namespace:     "ns",
+		PodName:       "pod",
+		ContainerName: "container",
+		StartTime:     MustParse("2018-01-01T12:00:00.000Z"),
+		EndTime:       MustParse("2018-01-01T14:00:00.000Z"),
+		Contains:      "error",
+		Regex:         "status=5[0-9]{2}",
+		IgnoreCase:    true,
+		Stream:        "stderr",
+	}
+	//
+	// set up mock expectations
+	//
+
+	queryResult := CQLRows([]map[string]interface{}{
+		{"time": MustParse("2018-01-01T12:30:00.000Z"), "message": "ERROR: status=503", "stream": "stderr"},
+		{"time": MustParse("2018-01-01T12:40:00.000Z"), "message": "error: status=404", "stream": "stderr"},
+		{"time": MustParse("2018-01-01T12:50:00.000Z"), "message": "info: status=500", "stream": "stderr"},
+		{"time": MustParse("2018-01-01T12:55:00.000Z"), "message": "error: status=502", "stream": "stdout"},
+		{"time": MustParse("2018-01-01T13:00:00.000Z"), "message": "Error: STATUS=500", "stream": "stderr"},
+	})
+	queryDate := query.StartTime.Format("2006-01-02")
+	expectedPlaceholders := []interface{}{
+		query.Namespace, query.PodName, query.ContainerName, queryDate, query.StartTime, query.EndTime,
+	}
+	mockCQLDriver.On("Query", logStore.logQueryStatement(), expectedPlaceholders).Return(queryResult, nil)
+
+	//
+	// make call
+	//
+	results, err := logStore.Query(query)
+	assert.Nil(t, err, "expected error return to be nil")
+	expectedRows := []logstore.LogRow{
+		logstore.LogRow{Time: MustParse("2018-01-01T12:30:00.000Z"), Log: "ERROR: status=503", Stream: "stderr"},
+		logstore.LogRow{Time: MustParse("2018-01-01T13:00:00.000Z"), Log: "Error: STATUS=500", Stream: "stderr"},
 	}
 	assert.Truef(t, reflect.DeepEqual(expectedRows, results.LogRows),
 		"unexpected result set: expected: %#v, was: %#v", expectedRows, results.LogRows)
@@ -385,6 +573,141 @@ func TestLogStoreQueryThatCrossesDateBorder(t *testing.T) {
 	mockCQLDriver.AssertExpectations(t)
 }
 
+// The sub-queries of a query that spans several days should run concurrently,
+// but their rows should still be returned in time order, regardless of the
+// order in which the sub-queries complete.
+func TestLogStoreQueryRunsSubQueriesConcurrently(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	logStore := NewLogStore(mockCQLDriver, options())
+	query := &api.Query{
+		Namespace:     "ns",
+		PodName:       "pod",
+		ContainerName: "container",
+		StartTime:     MustParse("2018-01-01T12:00:00.000Z"),
+		EndTime:       MustParse("2018-01-03T12:00:00.000Z"),
+	}
+	placeholders := func(date, start, end string) []interface{} {
+		return []interface{}{"ns", "pod", "container", date, MustParse(start), MustParse(end)}
+	}
+
+	//
+	// set up mock expectations
+	//
+	// the earliest sub-queries complete last
+	mockCQLDriver.On("Query", logStore.logQueryStatement(),
+		placeholders("2018-01-01", "2018-01-01T12:00:00.000Z", "2018-01-01T23:59:59.999999999Z")).Return(
+		CQLRows{{"time": MustParse("2018-01-01T13:00:00Z"), "message": "day 1"}}, nil).After(100 * time.Millisecond)
+	mockCQLDriver.On("Query", logStore.logQueryStatement(),
+		placeholders("2018-01-02", "2018-01-02T00:00:00.000Z", "2018-01-02T23:59:59.999999999Z")).Return(
+		CQLRows{{"time": MustParse("2018-01-02T13:00:00Z"), "message": "day 2"}}, nil).After(50 * time.Millisecond)
+	mockCQLDriver.On("Query", logStore.logQueryStatement(),
+		placeholders("2018-01-03", "2018-01-03T00:00:00.000Z", "2018-01-03T12:00:00.000Z")).Return(
+		CQLRows{{"time": MustParse("2018-01-03T11:00:00Z"), "message": "day 3"}}, nil)
+
+	//
+	// make call
+	//
+	start := time.Now()
+	result, err := logStore.Query(query)
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, []string{"day 1", "day 2", "day 3"}, messages(result.LogRows), "unexpected result order")
+	assert.Truef(t, time.Since(start) < 150*time.Millisecond, "expected sub-queries to run concurrently")
+
+	// verify that expected calls were made
+	mockCQLDriver.AssertExpectations(t)
+}
+
+// A query should fail as soon as one of its sub-queries fails, without waiting
+// for the sub-queries that are still running.
+func TestLogStoreQueryFailsFastOnSubQueryError(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	logStore := NewLogStore(mockCQLDriver, options())
+	query := &api.Query{
+		Namespace:     "ns",
+		PodName:       "pod",
+		ContainerName: "container",
+		StartTime:     MustParse("2018-01-01T12:00:00.000Z"),
+		EndTime:       MustParse("2018-01-02T12:00:00.000Z"),
+	}
+
+	//
+	// set up mock expectations
+	//
+	driverErr := fmt.Errorf("connection refused")
+	mockCQLDriver.On("Query", logStore.logQueryStatement(), []interface{}{
+		"ns", "pod", "container", "2018-01-01",
+		MustParse("2018-01-01T12:00:00.000Z"), MustParse("2018-01-01T23:59:59.999999999Z"),
+	}).Return(nil, driverErr)
+	mockCQLDriver.On("Query", logStore.logQueryStatement(), []interface{}{
+		"ns", "pod", "container", "2018-01-02",
+		MustParse("2018-01-02T00:00:00.000Z"), MustParse("2018-01-02T12:00:00.000Z"),
+	}).Return(CQLRows{}, nil).After(time.Second)
+
+	//
+	// make call
+	//
+	start := time.Now()
+	_, err := logStore.Query(query)
+	assert.Equalf(t, QueryError{"query execution", driverErr}, err, "unexpected error")
+	assert.Truef(t, time.Since(start) < 500*time.Millisecond, "expected query to fail fast")
+}
+
+// Verify that a query by label selector (or pod name prefix) looks up the
+// containers of each date in the container table, queries the partition of
+// every selected container and merges their rows by time.
+func TestLogStoreQueryAcrossContainers(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	logStore := NewLogStore(mockCQLDriver, options())
+
+	query := &api.Query{
+		Namespace:     "ns",
+		LabelSelector: "app=nginx",
+		PodNamePrefix: "nginx-",
+		StartTime:     MustParse("2018-01-01T12:00:00.000Z"),
+		EndTime:       MustParse("2018-01-01T14:00:00.000Z"),
+	}
+	//
+	// set up mock expectations
+	//
+	nginxLabels := map[string]string{"app": "nginx"}
+	mockCQLDriver.On("Query", logStore.containerQueryStatement(), []interface{}{"ns", "2018-01-01"}).Return(
+		CQLRows([]map[string]interface{}{
+			{"pod_name": "nginx-abcde", "container_name": "nginx", "labels": nginxLabels},
+			{"pod_name": "nginx-abcde", "container_name": "sidecar", "labels": nginxLabels},
+			// wrong labels
+			{"pod_name": "nginx-fghij", "container_name": "nginx", "labels": map[string]string{"app": "nginx-canary"}},
+			// wrong pod name prefix
+			{"pod_name": "web-abcde", "container_name": "nginx", "labels": nginxLabels},
+		}), nil)
+	placeholders := func(podName, containerName string) []interface{} {
+		return []interface{}{"ns", podName, containerName, "2018-01-01", query.StartTime, query.EndTime}
+	}
+	mockCQLDriver.On("Query", logStore.logQueryStatement(), placeholders("nginx-abcde", "nginx")).Return(
+		CQLRows([]map[string]interface{}{
+			{"time": MustParse("2018-01-01T12:30:00.000Z"), "message": "event 1", "stream": "stdout"},
+			{"time": MustParse("2018-01-01T13:30:00.000Z"), "message": "event 3", "stream": "stdout"},
+		}), nil)
+	mockCQLDriver.On("Query", logStore.logQueryStatement(), placeholders("nginx-abcde", "sidecar")).Return(
+		CQLRows([]map[string]interface{}{
+			{"time": MustParse("2018-01-01T13:00:00.000Z"), "message": "event 2", "stream": "stderr"},
+		}), nil)
+
+	//
+	// make call
+	//
+	results, err := logStore.Query(query)
+	require.Nilf(t, err, "expected error return to be nil")
+	expectedRows := []logstore.LogRow{
+		{Time: MustParse("2018-01-01T12:30:00.000Z"), Log: "event 1", Stream: "stdout", PodName: "nginx-abcde", ContainerName: "nginx"},
+		{Time: MustParse("2018-01-01T13:00:00.000Z"), Log: "event 2", Stream: "stderr", PodName: "nginx-abcde", ContainerName: "sidecar"},
+		{Time: MustParse("2018-01-01T13:30:00.000Z"), Log: "event 3", Stream: "stdout", PodName: "nginx-abcde", ContainerName: "nginx"},
+	}
+	assert.Equalf(t, expectedRows, results.LogRows, "unexpected result set")
+
+	// verify that expected calls were made
+	mockCQLDriver.AssertExpectations(t)
+}
+
 // On Driver.Query() error, LogStore should return a QueryError.
 func TestLogStoreQueryOnError(t *testing.T) {
 	mockCQLDriver := new(MockedCQLDriver)
@@ -420,6 +743,230 @@ func TestLogStoreQueryOnError(t *testing.T) {
 	mockCQLDriver.AssertExpectations(t)
 }
 
+// A query with a limit should fetch pages of (at most) the remaining number
+// of rows, and hand out a continuation token that resumes the query where it
+// left off: within a sub-query (by page state) or at the next sub-query.
+func TestLogStoreQueryWithLimit(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	logStore := NewLogStore(mockCQLDriver, options())
+
+	// query spans a date border
+	query := &api.Query{
+		Namespace:     "ns",
+		PodName:       "pod",
+		ContainerName: "container",
+		StartTime:     MustParse("2018-01-01T12:00:00.000Z"),
+		EndTime:       MustParse("2018-01-02T12:00:00.000Z"),
+		Limit:         3,
+	}
+	day1Placeholders := []interface{}{
+		"ns", "pod", "container", "2018-01-01",
+		MustParse("2018-01-01T12:00:00.000Z"), MustParse("2018-01-01T23:59:59.999999999Z"),
+	}
+	day2Placeholders := []interface{}{
+		"ns", "pod", "container", "2018-01-02",
+		MustParse("2018-01-02T00:00:00.000Z"), MustParse("2018-01-02T12:00:00.000Z"),
+	}
+	row := func(isoTime, message string) map[string]interface{} {
+		return map[string]interface{}{"time": MustParse(isoTime), "message": message, "stream": "stdout"}
+	}
+
+	//
+	// set up mock expectations
+	//
+
+	// first page: two pages of the first day fill up the limit
+	mockCQLDriver.On("QueryPage", logStore.logQueryStatement(), 3, []byte(nil), day1Placeholders).Return(
+		CQLRows{row("2018-01-01T12:00:00Z", "event 1"), row("2018-01-01T13:00:00Z", "event 2")}, []byte("p1"), nil)
+	mockCQLDriver.On("QueryPage", logStore.logQueryStatement(), 1, []byte("p1"), day1Placeholders).Return(
+		CQLRows{row("2018-01-01T14:00:00Z", "event 3")}, []byte("p2"), nil)
+	// second page: remainder of first day and all of second day
+	mockCQLDriver.On("QueryPage", logStore.logQueryStatement(), 3, []byte("p2"), day1Placeholders).Return(
+		CQLRows{row("2018-01-01T15:00:00Z", "event 4")}, nil, nil)
+	mockCQLDriver.On("QueryPage", logStore.logQueryStatement(), 2, []byte(nil), day2Placeholders).Return(
+		CQLRows{row("2018-01-02T01:00:00Z", "event 5")}, nil, nil)
+
+	//
+	// make calls
+	//
+	result, err := logStore.Query(query)
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, []string{"event 1", "event 2", "event 3"}, messages(result.LogRows), "unexpected first page")
+	require.NotEmptyf(t, result.NextToken, "expected a continuation token")
+	token, err := decodePageToken(result.NextToken)
+	require.Nilf(t, err, "unexpected error decoding token")
+	assert.Equalf(t, &pageToken{Date: "2018-01-01", PageState: []byte("p2")}, token, "unexpected token")
+
+	query.NextToken = result.NextToken
+	result, err = logStore.Query(query)
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, []string{"event 4", "event 5"}, messages(result.LogRows), "unexpected second page")
+	assert.Emptyf(t, result.NextToken, "expected no continuation token on last page")
+
+	// verify that expected calls were made
+	mockCQLDriver.AssertExpectations(t)
+}
+
+// A continuation token that is malformed or that does not belong to the
+// query should be rejected as an invalid query.
+func TestLogStoreQueryWithInvalidNextToken(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	logStore := NewLogStore(mockCQLDriver, options())
+
+	query := &api.Query{Namespace: "ns", PodName: "pod", ContainerName: "container",
+		StartTime: MustParse("2018-01-01T12:00:00.000Z"), EndTime: MustParse("2018-01-01T14:00:00.000Z"),
+		Limit: 10, NextToken: "garbage"}
+	_, err := logStore.Query(query)
+	assert.Equalf(t, api.QueryError("query parameter next_token: malformed token"), err, "unexpected error")
+
+	query.NextToken = (&pageToken{Date: "2018-02-01"}).encode()
+	_, err = logStore.Query(query)
+	assert.Equalf(t, api.QueryError("query parameter next_token: token does not belong to query interval"), err, "unexpected error")
+}
+
+// LogStore.QueryStream(..) should pass the matching rows of every sub-query,
+// in order, to the handler.
+func TestLogStoreQueryStream(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	logStore := NewLogStore(mockCQLDriver, options())
+
+	// query spans a date border
+	query := &api.Query{
+		Namespace:     "ns",
+		PodName:       "pod",
+		ContainerName: "container",
+		StartTime:     MustParse("2018-01-01T23:00:00.000Z"),
+		EndTime:       MustParse("2018-01-02T01:00:00.000Z"),
+		Stream:        "stderr",
+	}
+	row := func(isoTime, message, stream string) map[string]interface{} {
+		return map[string]interface{}{"time": MustParse(isoTime), "message": message, "stream": stream}
+	}
+
+	//
+	// set up mock expectations
+	//
+	mockCQLDriver.On("QueryIter", logStore.logQueryStatement(), []interface{}{
+		"ns", "pod", "container", "2018-01-01",
+		MustParse("2018-01-01T23:00:00.000Z"), MustParse("2018-01-01T23:59:59.999999999Z"),
+	}).Return(CQLRows{
+		row("2018-01-01T23:10:00Z", "event 1", "stderr"),
+		row("2018-01-01T23:20:00Z", "event 2", "stdout"),
+	}, nil)
+	mockCQLDriver.On("QueryIter", logStore.logQueryStatement(), []interface{}{
+		"ns", "pod", "container", "2018-01-02",
+		MustParse("2018-01-02T00:00:00.000Z"), MustParse("2018-01-02T01:00:00.000Z"),
+	}).Return(CQLRows{
+		row("2018-01-02T00:10:00Z", "event 3", "stderr"),
+	}, nil)
+
+	//
+	// make call
+	//
+	streamed := make([]logstore.LogRow, 0)
+	err := logStore.QueryStream(query, func(row *logstore.LogRow) error {
+		streamed = append(streamed, *row)
+		return nil
+	})
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, []string{"event 1", "event 3"}, messages(streamed), "unexpected streamed rows")
+
+	// verify that expected calls were made
+	mockCQLDriver.AssertExpectations(t)
+}
+
+// A tail query should run its sub-queries newest first with the descending
+// query statement, stop once enough rows are collected, and return the rows
+// oldest first.
+func TestLogStoreQueryTail(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	logStore := NewLogStore(mockCQLDriver, options())
+
+	// query spans a date border
+	query := &api.Query{
+		Namespace:     "ns",
+		PodName:       "pod",
+		ContainerName: "container",
+		StartTime:     MustParse("2018-01-01T23:00:00.000Z"),
+		EndTime:       MustParse("2018-01-02T01:00:00.000Z"),
+		Tail:          2,
+	}
+	row := func(isoTime, message string) map[string]interface{} {
+		return map[string]interface{}{"time": MustParse(isoTime), "message": message, "stream": "stdout"}
+	}
+
+	//
+	// set up mock expectations
+	//
+	mockCQLDriver.On("QueryIter", logStore.logQueryDescStatement(), []interface{}{
+		"ns", "pod", "container", "2018-01-02",
+		MustParse("2018-01-02T00:00:00.000Z"), MustParse("2018-01-02T01:00:00.000Z"),
+	}).Return(CQLRows{
+		row("2018-01-02T00:10:00Z", "event 3"),
+	}, nil)
+	mockCQLDriver.On("QueryIter", logStore.logQueryDescStatement(), []interface{}{
+		"ns", "pod", "container", "2018-01-01",
+		MustParse("2018-01-01T23:00:00.000Z"), MustParse("2018-01-01T23:59:59.999999999Z"),
+	}).Return(CQLRows{
+		row("2018-01-01T23:20:00Z", "event 2"),
+		row("2018-01-01T23:10:00Z", "event 1"),
+	}, nil)
+
+	//
+	// make calls
+	//
+	result, err := logStore.Query(query)
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, []string{"event 2", "event 3"}, messages(result.LogRows), "unexpected tail rows")
+
+	query.Order = "desc"
+	result, err = logStore.Query(query)
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, []string{"event 3", "event 2"}, messages(result.LogRows), "unexpected tail rows")
+
+	// verify that expected calls were made
+	mockCQLDriver.AssertExpectations(t)
+}
+
+// A handler error should abort LogStore.QueryStream(..) and be returned as is,
+// whereas a driver error should be returned as a QueryError.
+func TestLogStoreQueryStreamOnError(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	logStore := NewLogStore(mockCQLDriver, options())
+
+	query := &api.Query{Namespace: "ns", PodName: "pod", ContainerName: "container",
+		StartTime: MustParse("2018-01-01T12:00:00.000Z"), EndTime: MustParse("2018-01-01T14:00:00.000Z")}
+	placeholders := []interface{}{"ns", "pod", "container", "2018-01-01", query.StartTime, query.EndTime}
+
+	// set up mock expectations
+	mockCQLDriver.On("QueryIter", logStore.logQueryStatement(), placeholders).Return(CQLRows{
+		{"time": MustParse("2018-01-01T12:10:00Z"), "message": "event 1"},
+	}, fmt.Errorf("connection refused")).Once()
+	mockCQLDriver.On("QueryIter", logStore.logQueryStatement(), placeholders).Return(CQLRows{
+		{"time": MustParse("2018-01-01T12:10:00Z"), "message": "event 1"},
+	}, nil).Once()
+
+	// make calls
+	err := logStore.QueryStream(query, func(row *logstore.LogRow) error { return nil })
+	assert.Equalf(t, QueryError{"query execution", fmt.Errorf("connection refused")}, err, "unexpected error")
+
+	handlerErr := fmt.Errorf("broken pipe")
+	err = logStore.QueryStream(query, func(row *logstore.LogRow) error { return handlerErr })
+	assert.Equalf(t, handlerErr, err, "expected handler error to be returned")
+
+	// verify that expected calls were made
+	mockCQLDriver.AssertExpectations(t)
+}
+
+// messages returns the log messages of a collection of LogRows.
+func messages(logRows []logstore.LogRow) []string {
+	messages := make([]string, 0)
+	for _, logRow := range logRows {
+		messages = append(messages, logRow.Log)
+	}
+	return messages
+}
+
 func logEntry(timestamp time.Time, message string) logstore.LogEntry {
 	return logstore.LogEntry{
 		Date: float64(timestamp.UnixNano() / 1.0e9),
@@ -427,7 +974,7 @@ func logEntry(timestamp time.Time, message string) logstore.LogEntry {
 			DockerID: "e4b0b3eb8c25a73351c5cfeb37a9d64736584c640f21010443fe2e7e5b9c085b",
 			Labels: map[string]string{
 				"pod-template-generation": "1",
-				"app": "nginx",
+				"app":                     "nginx",
 			},
 			Host:          "worker0",
 			PodName:       "nginx-deployment-abcde",
@@ -448,14 +995,55 @@ func TestInsertStatement(t *testing.T) {
 
 	assert.Equalf(t,
 		fmt.Sprintf("INSERT INTO %s.%s "+
-			"(namespace, pod_name, container_name, date, time, message, stream, pod_id, docker_id, host, labels) "+
-			"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", options().Keyspace, options().LogTableName),
+			"(namespace, pod_name, container_name, date, time, entry_hash, message, stream, pod_id, docker_id, host, labels) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) USING TTL ?", options().Keyspace, options().LogTableName+"_hashed"),
 		logStore.insertStatement(),
 		"unexepected insert statement",
 	)
 }
 
+// insertPlaceholders returns the expected insert statement placeholders for a
+// log entry.
+func insertPlaceholders(logEntry logstore.LogEntry) []interface{} {
+	return []interface{}{
+		logEntry.Kubernetes.Namespace,
+		logEntry.Kubernetes.PodName,
+		logEntry.Kubernetes.ContainerName,
+		logEntry.Time.Format("2006-01-02"),
+		logEntry.Time,
+		logstore.EntryHash(&logEntry),
+		logEntry.Log,
+		logEntry.Stream,
+		logEntry.Kubernetes.PodID,
+		logEntry.Kubernetes.DockerID,
+		logEntry.Kubernetes.Host,
+		logEntry.Kubernetes.Labels,
+		0,
+	}
+}
+
+// containerInsertPlaceholders returns the expected container table insert
+// statement placeholders for a log entry.
+func containerInsertPlaceholders(logEntry logstore.LogEntry) []interface{} {
+	return []interface{}{
+		logEntry.Kubernetes.Namespace,
+		logEntry.Time.Format("2006-01-02"),
+		logEntry.Kubernetes.PodName,
+		logEntry.Kubernetes.ContainerName,
+		logEntry.Kubernetes.Labels,
+		0,
+	}
+}
+
+// namespaceInsertPlaceholders returns the expected namespace table insert
+// statement placeholders for a log entry.
+func namespaceInsertPlaceholders(logEntry logstore.LogEntry) []interface{} {
+	return []interface{}{logEntry.Time.Format("2006-01-02"), logEntry.Kubernetes.Namespace, 0}
+}
+
 // Verify that LogStore.Write() sends expected insert statements to the backend.
+// Since all log entries belong to the same partition, they should be sent as
+// a single batch, followed by a single insert into each catalog table.
 func TestLogStoreWrite(t *testing.T) {
 	mockCQLDriver := new(MockedCQLDriver)
 	logStore := NewLogStore(mockCQLDriver, options())
@@ -470,24 +1058,188 @@ func TestLogStoreWrite(t *testing.T) {
 	// set up mock expectations
 	//
 
-	// one insert should be executed per log entry
+	// one batch should be executed, holding one insert per log entry
+	expectedBatch := make([]CQLStatement, 0)
 	for _, logEntry := range logEntries {
-		// LogStore should create keyspace if it doesn't exist already
+		expectedBatch = append(expectedBatch,
+			CQLStatement{Statement: logStore.insertStatement(), Placeholders: insertPlaceholders(logEntry)})
+	}
+	mockCQLDriver.On("ExecuteBatch", expectedBatch).Return(nil)
+	mockCQLDriver.On("Execute", logStore.containerInsertStatement(), containerInsertPlaceholders(logEntries[0])).Return(nil)
+	mockCQLDriver.On("Execute", logStore.namespaceInsertStatement(), namespaceInsertPlaceholders(logEntries[0])).Return(nil)
+
+	//
+	// make call
+	//
+	err := logStore.Write(logEntries)
+	assert.Nilf(t, err, "unexpected error return: %s", err)
+
+	// the partition is now catalogued: a second write should only insert
+	// the log entries
+	err = logStore.Write(logEntries)
+	assert.Nilf(t, err, "unexpected error return: %s", err)
+	mockCQLDriver.AssertNumberOfCalls(t, "ExecuteBatch", 2)
+	mockCQLDriver.AssertNumberOfCalls(t, "Execute", 2)
+
+	// verify that expected calls were made
+	mockCQLDriver.AssertExpectations(t)
+}
+
+// With sub-day buckets, log entries should be inserted into (and queried
+// from) the partition of their bucket, whereas catalog tables are still kept
+// by date.
+func TestLogStoreWriteAndQueryWithHourlyBuckets(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	opts := options()
+	opts.BucketSize = HourlyBuckets
+	logStore := NewLogStore(mockCQLDriver, opts)
+
+	logEntries := []logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T12:59:00.000Z"), "event 1"),
+		logEntry(MustParse("2018-01-01T13:01:00.000Z"), "event 2"),
+	}
+	bucketPlaceholders := func(logEntry logstore.LogEntry, bucket time.Time) []interface{} {
+		placeholders := insertPlaceholders(logEntry)
+		placeholders[3] = bucket
+		return placeholders
+	}
+
+	//
+	// set up mock expectations
+	//
+	// one partition per hour, but one catalog entry per date
+	mockCQLDriver.On("Execute", logStore.insertStatement(),
+		bucketPlaceholders(logEntries[0], MustParse("2018-01-01T12:00:00.000Z"))).Return(nil)
+	mockCQLDriver.On("Execute", logStore.insertStatement(),
+		bucketPlaceholders(logEntries[1], MustParse("2018-01-01T13:00:00.000Z"))).Return(nil)
+	mockCQLDriver.On("Execute", logStore.containerInsertStatement(), containerInsertPlaceholders(logEntries[0])).Return(nil)
+	mockCQLDriver.On("Execute", logStore.namespaceInsertStatement(), namespaceInsertPlaceholders(logEntries[0])).Return(nil)
+	mockCQLDriver.On("Query", logStore.logQueryStatement(), []interface{}{
+		"default", "nginx-deployment-abcde", "nginx", MustParse("2018-01-01T12:00:00.000Z"),
+		MustParse("2018-01-01T12:30:00.000Z"), MustParse("2018-01-01T12:59:59.999999999Z"),
+	}).Return(CQLRows{{"time": MustParse("2018-01-01T12:59:00.000Z"), "message": "event 1"}}, nil)
+	mockCQLDriver.On("Query", logStore.logQueryStatement(), []interface{}{
+		"default", "nginx-deployment-abcde", "nginx", MustParse("2018-01-01T13:00:00.000Z"),
+		MustParse("2018-01-01T13:00:00.000Z"), MustParse("2018-01-01T13:30:00.000Z"),
+	}).Return(CQLRows{{"time": MustParse("2018-01-01T13:01:00.000Z"), "message": "event 2"}}, nil)
+
+	//
+	// make calls
+	//
+	err := logStore.Write(logEntries)
+	require.Nilf(t, err, "unexpected write error")
+
+	result, err := logStore.Query(&api.Query{
+		Namespace:     "default",
+		PodName:       "nginx-deployment-abcde",
+		ContainerName: "nginx",
+		StartTime:     MustParse("2018-01-01T12:30:00.000Z"),
+		EndTime:       MustParse("2018-01-01T13:30:00.000Z"),
+	})
+	require.Nilf(t, err, "unexpected query error")
+	assert.Equalf(t, []string{"event 1", "event 2"}, messages(result.LogRows), "unexpected query result")
+
+	// verify that expected calls were made
+	mockCQLDriver.AssertExpectations(t)
+}
+
+// Log entries should be inserted with the time-to-live of their namespace,
+// and their catalog table entries with that time-to-live counted from the end
+// of the date. The log table should be declared with a compaction strategy
+// for expiring time series.
+func TestLogStoreWriteWithTTL(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	opts := options()
+	opts.DefaultTTL = 14 * 24 * time.Hour
+	opts.NamespaceTTLs = NamespaceTTLs{"kube-system": 7 * 24 * time.Hour}
+	logStore := NewLogStore(mockCQLDriver, opts)
+	logStore.now = func() time.Time { return MustParse("2018-01-01T18:00:00.000Z") }
+
+	assert.Containsf(t, logStore.tableDeclaration(), "compaction = { 'class': 'TimeWindowCompactionStrategy', "+
+		"'compaction_window_size': '1', 'compaction_window_unit': 'DAYS' }",
+		"expected log table to use TimeWindowCompactionStrategy with daily windows")
+
+	systemEntry := logEntry(MustParse("2018-01-01T12:00:00.000Z"), "system event")
+	systemEntry.Kubernetes.Namespace = "kube-system"
+	defaultEntry := logEntry(MustParse("2018-01-01T12:00:00.000Z"), "event")
+	withTTL := func(placeholders []interface{}, ttl time.Duration) []interface{} {
+		placeholders[len(placeholders)-1] = int(ttl / time.Second)
+		return placeholders
+	}
+
+	//
+	// set up mock expectations
+	//
+	for _, entry := range []struct {
+		logEntry logstore.LogEntry
+		ttl      time.Duration
+	}{{systemEntry, 7 * 24 * time.Hour}, {defaultEntry, 14 * 24 * time.Hour}} {
 		mockCQLDriver.On("Execute", logStore.insertStatement(),
-			[]interface{}{
-				logEntry.Kubernetes.Namespace,
-				logEntry.Kubernetes.PodName,
-				logEntry.Kubernetes.ContainerName,
-				logEntry.Time.Format("2006-01-02"),
-				logEntry.Time,
-				logEntry.Log,
-				logEntry.Stream,
-				logEntry.Kubernetes.PodID,
-				logEntry.Kubernetes.DockerID,
-				logEntry.Kubernetes.Host,
-				logEntry.Kubernetes.Labels,
-			}).Return(nil)
+			withTTL(insertPlaceholders(entry.logEntry), entry.ttl)).Return(nil)
+		// the date ends six hours from now
+		mockCQLDriver.On("Execute", logStore.containerInsertStatement(),
+			withTTL(containerInsertPlaceholders(entry.logEntry), entry.ttl+6*time.Hour)).Return(nil)
 	}
+	// both namespaces are recorded in the same namespace table partition
+	mockCQLDriver.On("ExecuteBatch", []CQLStatement{
+		{Statement: logStore.namespaceInsertStatement(),
+			Placeholders: withTTL(namespaceInsertPlaceholders(systemEntry), 7*24*time.Hour+6*time.Hour)},
+		{Statement: logStore.namespaceInsertStatement(),
+			Placeholders: withTTL(namespaceInsertPlaceholders(defaultEntry), 14*24*time.Hour+6*time.Hour)},
+	}).Return(nil)
+
+	//
+	// make call
+	//
+	err := logStore.Write([]logstore.LogEntry{systemEntry, defaultEntry})
+	assert.Nilf(t, err, "unexpected error return: %s", err)
+
+	// verify that expected calls were made
+	mockCQLDriver.AssertExpectations(t)
+}
+
+// Verify that LogStore.Write() groups inserts into one batch per partition and
+// that batches never grow beyond WriteBatchSize. A batch of a single insert
+// should be sent as a regular statement.
+func TestLogStoreWriteBatchesByPartition(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	opts := options()
+	opts.WriteBatchSize = 2
+	logStore := NewLogStore(mockCQLDriver, opts)
+
+	otherContainerEntry := logEntry(MustParse("2018-01-01T12:00:30.000Z"), "sidecar event")
+	otherContainerEntry.Kubernetes.ContainerName = "sidecar"
+	logEntries := []logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T12:00:00.000Z"), "event 1"),
+		otherContainerEntry,
+		logEntry(MustParse("2018-01-01T12:01:00.000Z"), "event 2"),
+		// different date, and hence, different partition
+		logEntry(MustParse("2018-01-02T12:00:00.000Z"), "day 2, event 1"),
+		logEntry(MustParse("2018-01-01T12:02:00.000Z"), "event 3"),
+	}
+	insert := func(logEntry logstore.LogEntry) CQLStatement {
+		return CQLStatement{Statement: logStore.insertStatement(), Placeholders: insertPlaceholders(logEntry)}
+	}
+
+	//
+	// set up mock expectations
+	//
+
+	// first partition is split into a batch of two and a single insert
+	mockCQLDriver.On("ExecuteBatch", []CQLStatement{insert(logEntries[0]), insert(logEntries[2])}).Return(nil)
+	mockCQLDriver.On("Execute", logStore.insertStatement(), insertPlaceholders(logEntries[4])).Return(nil)
+	// remaining partitions only hold a single insert each
+	mockCQLDriver.On("Execute", logStore.insertStatement(), insertPlaceholders(logEntries[1])).Return(nil)
+	mockCQLDriver.On("Execute", logStore.insertStatement(), insertPlaceholders(logEntries[3])).Return(nil)
+	// every written partition is recorded in the container table, which is
+	// partitioned by namespace and date
+	mockCQLDriver.On("ExecuteBatch", []CQLStatement{
+		{Statement: logStore.containerInsertStatement(), Placeholders: containerInsertPlaceholders(logEntries[0])},
+		{Statement: logStore.containerInsertStatement(), Placeholders: containerInsertPlaceholders(logEntries[1])},
+	}).Return(nil)
+	mockCQLDriver.On("Execute", logStore.containerInsertStatement(), containerInsertPlaceholders(logEntries[3])).Return(nil)
+	mockCQLDriver.On("Execute", logStore.namespaceInsertStatement(), namespaceInsertPlaceholders(logEntries[0])).Return(nil)
+	mockCQLDriver.On("Execute", logStore.namespaceInsertStatement(), namespaceInsertPlaceholders(logEntries[3])).Return(nil)
 
 	//
 	// make call
@@ -547,23 +1299,137 @@ func TestLogStoreWriteOnError(t *testing.T) {
 			logEntries[0].Kubernetes.ContainerName,
 			logEntries[0].Time.Format("2006-01-02"),
 			logEntries[0].Time,
+			logstore.EntryHash(&logEntries[0]),
 			logEntries[0].Log,
 			logEntries[0].Stream,
 			logEntries[0].Kubernetes.PodID,
 			logEntries[0].Kubernetes.DockerID,
 			logEntries[0].Kubernetes.Host,
 			logEntries[0].Kubernetes.Labels,
+			0,
 		}).Return(driverErr)
+	mockCQLDriver.On("Execute", logStore.containerInsertStatement(), containerInsertPlaceholders(logEntries[0])).Return(nil)
+	mockCQLDriver.On("Execute", logStore.namespaceInsertStatement(), namespaceInsertPlaceholders(logEntries[0])).Return(nil)
 
 	//
 	// make call
 	//
 	err := logStore.Write(logEntries)
-	expectedErr := InsertError{driverErr}
+	expectedErr := logstore.WriteError{Failures: []logstore.EntryError{{Index: 0, Err: InsertError{driverErr}}}}
 	assert.Equalf(t, expectedErr, err, "expected write to fail")
-	assert.Equalf(t, "insert failed: connection refused", err.Error(),
+	assert.Equalf(t, "failed to store 1 log entries: entry 0: insert failed: connection refused", err.Error(),
 		"unexpected error message")
 
 	// verify that expected calls were made
 	mockCQLDriver.AssertExpectations(t)
 }
+
+// Verify that LogStore.Write() awaits all inserts when some of them fail, and
+// reports the log entries that were not stored by index. A failed catalog
+// insert fails all log entries of the pod containers that it records.
+func TestLogStoreWriteOnPartialFailure(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	logStore := NewLogStore(mockCQLDriver, options())
+
+	// three pod containers, in two namespaces
+	entry0 := logEntry(MustParse("2018-01-01T12:00:00.000Z"), "event 0")
+	entry1 := logEntry(MustParse("2018-01-01T12:01:00.000Z"), "event 1")
+	entry1.Kubernetes.PodName = "nginx-deployment-fghij"
+	entry2 := logEntry(MustParse("2018-01-01T12:02:00.000Z"), "event 2")
+	entry2.Kubernetes.Namespace = "kube-system"
+	logEntries := []logstore.LogEntry{entry0, entry1, entry2}
+
+	//
+	// set up mock expectations
+	//
+
+	// the insert of the second log entry fails
+	insertErr := fmt.Errorf("write timeout")
+	mockCQLDriver.On("Execute", logStore.insertStatement(), insertPlaceholders(entry0)).Return(nil)
+	mockCQLDriver.On("Execute", logStore.insertStatement(), insertPlaceholders(entry1)).Return(insertErr)
+	mockCQLDriver.On("Execute", logStore.insertStatement(), insertPlaceholders(entry2)).Return(nil)
+	mockCQLDriver.On("ExecuteBatch", []CQLStatement{
+		{Statement: logStore.containerInsertStatement(), Placeholders: containerInsertPlaceholders(entry0)},
+		{Statement: logStore.containerInsertStatement(), Placeholders: containerInsertPlaceholders(entry1)},
+	}).Return(nil)
+	// the third log entry's pod container cannot be catalogued
+	catalogErr := fmt.Errorf("connection refused")
+	mockCQLDriver.On("Execute", logStore.containerInsertStatement(), containerInsertPlaceholders(entry2)).Return(catalogErr)
+	mockCQLDriver.On("ExecuteBatch", []CQLStatement{
+		{Statement: logStore.namespaceInsertStatement(), Placeholders: namespaceInsertPlaceholders(entry0)},
+		{Statement: logStore.namespaceInsertStatement(), Placeholders: namespaceInsertPlaceholders(entry2)},
+	}).Return(nil)
+
+	//
+	// make call
+	//
+	err := logStore.Write(logEntries)
+	expectedErr := logstore.WriteError{Failures: []logstore.EntryError{
+		{Index: 1, Err: InsertError{insertErr}},
+		{Index: 2, Err: InsertError{catalogErr}},
+	}}
+	require.Equalf(t, expectedErr, err, "expected write to partially fail")
+	stored, failed := expectedErr.Split(logEntries)
+	assert.Equalf(t, []logstore.LogEntry{entry0}, stored, "unexpected stored entries")
+	assert.Equalf(t, []logstore.LogEntry{entry1, entry2}, failed, "unexpected failed entries")
+
+	// verify that expected calls were made
+	mockCQLDriver.AssertExpectations(t)
+}
+
+// Verify that the catalog lists the namespaces, pods and containers recorded
+// in the catalog tables for every date of a time interval.
+func TestLogStoreCatalog(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	logStore := NewLogStore(mockCQLDriver, options())
+
+	start, end := MustParse("2018-01-01T12:00:00.000Z"), MustParse("2018-01-02T12:00:00.000Z")
+
+	//
+	// set up mock expectations
+	//
+	mockCQLDriver.On("Query", logStore.namespaceQueryStatement(), []interface{}{"2018-01-01"}).Return(
+		CQLRows([]map[string]interface{}{{"namespace": "kube-system"}, {"namespace": "default"}}), nil)
+	mockCQLDriver.On("Query", logStore.namespaceQueryStatement(), []interface{}{"2018-01-02"}).Return(
+		CQLRows([]map[string]interface{}{{"namespace": "default"}}), nil)
+	mockCQLDriver.On("Query", logStore.containerQueryStatement(), []interface{}{"default", "2018-01-01"}).Return(
+		CQLRows([]map[string]interface{}{
+			{"pod_name": "nginx-abcde", "container_name": "nginx"},
+			{"pod_name": "nginx-abcde", "container_name": "sidecar"},
+		}), nil)
+	mockCQLDriver.On("Query", logStore.containerQueryStatement(), []interface{}{"default", "2018-01-02"}).Return(
+		CQLRows([]map[string]interface{}{
+			{"pod_name": "nginx-abcde", "container_name": "nginx"},
+			{"pod_name": "nginx-fghij", "container_name": "nginx"},
+		}), nil)
+
+	//
+	// make calls
+	//
+	namespaces, err := logStore.Namespaces(start, end)
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, []string{"default", "kube-system"}, namespaces, "unexpected namespaces")
+
+	pods, err := logStore.Pods("default", start, end)
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, []string{"nginx-abcde", "nginx-fghij"}, pods, "unexpected pods")
+
+	containers, err := logStore.Containers("default", "nginx-abcde", start, end)
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, []string{"nginx", "sidecar"}, containers, "unexpected containers")
+
+	// verify that expected calls were made
+	mockCQLDriver.AssertExpectations(t)
+}
+
+// On Driver.Query() error, the catalog should return a QueryError.
+func TestLogStoreCatalogOnError(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	logStore := NewLogStore(mockCQLDriver, options())
+
+	driverErr := fmt.Errorf("connection refused")
+	mockCQLDriver.On("Query", logStore.namespaceQueryStatement(), []interface{}{"2018-01-01"}).Return(nil, driverErr)
+
+	_, err := logStore.Namespaces(MustParse("2018-01-01T12:00:00.000Z"), MustParse("2018-01-01T13:00:00.000Z"))
+	assert.Equalf(t, QueryError{"catalog query", driverErr}, err, "unexpected error")
+}
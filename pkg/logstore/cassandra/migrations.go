@@ -0,0 +1,276 @@
+package cassandra
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/elastisys/kube-insight-logserver/pkg/log"
+)
+
+// Migration is a numbered change to the Cassandra schema of the LogStore.
+// Migrations are applied in order of version, and each migration is applied
+// once per keyspace and log table.
+type Migration struct {
+	// Version is the schema version that the migration brings the schema to.
+	Version int
+	// Description briefly describes the schema change.
+	Description string
+	// statements returns the CQL statements that make up the migration.
+	statements func(c *LogStore) []string
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%d: %s", m.Version, m.Description)
+}
+
+// migrations is the ordered list of schema migrations. Migrations must never
+// be changed or removed once released: changes to the schema are made by
+// appending a migration with the next version. The first migrations create
+// tables that existed before schema migrations were introduced, and are
+// therefore idempotent. The primary key of a table cannot be altered, so a
+// change to it is made by a migration that creates a new table, and the log
+// entries of the old one are copied into it (see CopyLogTable).
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "create log table",
+		statements:  func(c *LogStore) []string { return []string{c.legacyTableDeclaration()} },
+	},
+	{
+		Version:     2,
+		Description: "create container catalog table",
+		statements:  func(c *LogStore) []string { return []string{c.containerTableDeclaration()} },
+	},
+	{
+		Version:     3,
+		Description: "create namespace catalog table",
+		statements:  func(c *LogStore) []string { return []string{c.namespaceTableDeclaration()} },
+	},
+	{
+		Version:     4,
+		Description: "create log table keyed by entry hash",
+		statements:  func(c *LogStore) []string { return []string{c.tableDeclaration()} },
+	},
+}
+
+// schemaLockName is the name of the lock row in the schema lock table.
+const schemaLockName = "migrations"
+
+// Migrator applies pending schema migrations to the keyspace of a LogStore.
+// Concurrent Migrators (such as those of several server replicas that start
+// at the same time) are serialized by a lock, which is held while migrations
+// are applied. The lock is a row in the schema lock table that is inserted
+// and deleted with lightweight transactions, and expires after a while in
+// case its holder fails to release it.
+type Migrator struct {
+	// store is the LogStore whose schema is migrated. It is only used for its
+	// driver, options and schema declarations.
+	store *LogStore
+	// owner identifies the Migrator as the holder of the lock.
+	owner string
+	// lockTTL is the time after which a lock that was never released
+	// expires.
+	lockTTL time.Duration
+	// lockPollInterval is the time to wait between attempts to acquire the
+	// lock while it is held by another Migrator.
+	lockPollInterval time.Duration
+}
+
+// NewMigrator creates a Migrator for the keyspace and log table given by a
+// set of (validated) Options. The Driver must be connected before use.
+func NewMigrator(driver Driver, options *Options) *Migrator {
+	return newMigrator(&LogStore{driver: driver, options: options})
+}
+
+func newMigrator(store *LogStore) *Migrator {
+	hostname, _ := os.Hostname()
+	return &Migrator{
+		store:            store,
+		owner:            fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+		lockTTL:          5 * time.Minute,
+		lockPollInterval: 2 * time.Second,
+	}
+}
+
+// Pending returns the migrations that have not yet been applied, in the order
+// that they would be applied. It does not modify the schema.
+func (m *Migrator) Pending() ([]Migration, error) {
+	rows, err := m.store.driver.Query(m.tableExistsQuery(), m.store.options.Keyspace, m.schemaVersionTableName())
+	if err != nil {
+		return nil, SchemaError{message: "failed to read schema version", cause: err}
+	}
+	if len(rows) == 0 {
+		// the schema has never been migrated
+		return migrations, nil
+	}
+
+	applied, err := m.appliedVersions()
+	if err != nil {
+		return nil, SchemaError{message: "failed to read schema version", cause: err}
+	}
+	return pendingMigrations(applied), nil
+}
+
+// Migrate creates the keyspace if it does not exist, and applies all pending
+// migrations while holding the schema lock. The applied migrations are
+// returned.
+func (m *Migrator) Migrate() ([]Migration, error) {
+	if err := m.store.createKeyspaceIfNotExists(); err != nil {
+		return nil, SchemaError{message: "failed to create keyspace", cause: err}
+	}
+	if err := m.store.driver.Execute(m.schemaVersionTableDeclaration()); err != nil {
+		return nil, SchemaError{message: "failed to create schema version table", cause: err}
+	}
+	if err := m.store.driver.Execute(m.schemaLockTableDeclaration()); err != nil {
+		return nil, SchemaError{message: "failed to create schema lock table", cause: err}
+	}
+
+	if err := m.lock(); err != nil {
+		return nil, SchemaError{message: "failed to acquire schema lock", cause: err}
+	}
+	defer m.unlock()
+
+	// read the schema version while holding the lock, since another replica
+	// may have applied migrations while we waited for it
+	applied, err := m.appliedVersions()
+	if err != nil {
+		return nil, SchemaError{message: "failed to read schema version", cause: err}
+	}
+
+	pending := pendingMigrations(applied)
+	for _, migration := range pending {
+		log.Infof("applying schema migration %s ...", migration)
+		for _, statement := range migration.statements(m.store) {
+			if err := m.store.driver.Execute(statement); err != nil {
+				return nil, SchemaError{message: fmt.Sprintf("migration %s failed", migration), cause: err}
+			}
+		}
+		err := m.store.driver.Execute(m.schemaVersionInsertStatement(),
+			migration.Version, migration.Description, time.Now().UTC())
+		if err != nil {
+			return nil, SchemaError{message: fmt.Sprintf("failed to record migration %s", migration), cause: err}
+		}
+	}
+	return pending, nil
+}
+
+// appliedVersions reads the versions of the migrations that have been
+// applied from the schema version table.
+func (m *Migrator) appliedVersions() (map[int]bool, error) {
+	rows, err := m.store.driver.Query(m.schemaVersionQuery())
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]bool)
+	for _, row := range rows {
+		version, _ := row["version"].(int)
+		if version > migrations[len(migrations)-1].Version {
+			log.Warnf("schema version %d was applied by a newer server version", version)
+		}
+		applied[version] = true
+	}
+	return applied, nil
+}
+
+// pendingMigrations returns the migrations whose versions are not among the
+// applied ones.
+func pendingMigrations(applied map[int]bool) []Migration {
+	pending := make([]Migration, 0)
+	for _, migration := range migrations {
+		if !applied[migration.Version] {
+			pending = append(pending, migration)
+		}
+	}
+	return pending
+}
+
+// lock acquires the schema lock, waiting for it to be released (or to
+// expire) if it is held by another Migrator.
+func (m *Migrator) lock() error {
+	// a lock that is never released expires after lockTTL, so waiting any
+	// longer than that means that the lock keeps being re-acquired
+	deadline := time.Now().Add(m.lockTTL + m.lockPollInterval)
+	for {
+		acquired, err := m.store.driver.ExecuteCAS(m.schemaLockInsertStatement(),
+			schemaLockName, m.owner, int(m.lockTTL/time.Second))
+		if err != nil {
+			return err
+		}
+		if acquired {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for schema lock held by another server")
+		}
+		log.Infof("waiting for schema lock held by another server ...")
+		time.Sleep(m.lockPollInterval)
+	}
+}
+
+// unlock releases the schema lock. A failure to release the lock is only
+// logged, since the lock expires eventually.
+func (m *Migrator) unlock() {
+	released, err := m.store.driver.ExecuteCAS(m.schemaLockDeleteStatement(), schemaLockName, m.owner)
+	if err != nil {
+		log.Warnf("failed to release schema lock (it expires in %s): %s", m.lockTTL, err)
+	} else if !released {
+		log.Warnf("schema lock expired before it was released")
+	}
+}
+
+// schemaVersionTableName returns the name of the schema version table, which
+// records the migrations that have been applied.
+func (m *Migrator) schemaVersionTableName() string {
+	return m.store.options.LogTableName + "_schema_version"
+}
+
+func (m *Migrator) schemaVersionTableDeclaration() string {
+	const SchemaVersionTableTemplate string = `CREATE TABLE IF NOT EXISTS %s.%s (
+	version int,
+	description text,
+	applied_at timestamp,
+	PRIMARY KEY (version) )`
+
+	return fmt.Sprintf(SchemaVersionTableTemplate, m.store.options.Keyspace, m.schemaVersionTableName())
+}
+
+func (m *Migrator) schemaVersionQuery() string {
+	return fmt.Sprintf("SELECT version FROM %s.%s", m.store.options.Keyspace, m.schemaVersionTableName())
+}
+
+func (m *Migrator) schemaVersionInsertStatement() string {
+	return fmt.Sprintf("INSERT INTO %s.%s (version, description, applied_at) VALUES (?, ?, ?)",
+		m.store.options.Keyspace, m.schemaVersionTableName())
+}
+
+// schemaLockTableName returns the name of the schema lock table, which holds
+// the lock that serializes migrations.
+func (m *Migrator) schemaLockTableName() string {
+	return m.store.options.LogTableName + "_schema_lock"
+}
+
+func (m *Migrator) schemaLockTableDeclaration() string {
+	const SchemaLockTableTemplate string = `CREATE TABLE IF NOT EXISTS %s.%s (
+	name text,
+	owner text,
+	PRIMARY KEY (name) )`
+
+	return fmt.Sprintf(SchemaLockTableTemplate, m.store.options.Keyspace, m.schemaLockTableName())
+}
+
+func (m *Migrator) schemaLockInsertStatement() string {
+	return fmt.Sprintf("INSERT INTO %s.%s (name, owner) VALUES (?, ?) IF NOT EXISTS USING TTL ?",
+		m.store.options.Keyspace, m.schemaLockTableName())
+}
+
+func (m *Migrator) schemaLockDeleteStatement() string {
+	return fmt.Sprintf("DELETE FROM %s.%s WHERE name = ? IF owner = ?",
+		m.store.options.Keyspace, m.schemaLockTableName())
+}
+
+// tableExistsQuery returns the statement used to look up a table in the
+// schema tables.
+func (m *Migrator) tableExistsQuery() string {
+	return "SELECT table_name FROM system_schema.tables WHERE (keyspace_name=?) AND (table_name=?)"
+}
@@ -0,0 +1,200 @@
+package cassandra
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// expectSchemaLock sets up mock expectations for a Migrator of the given
+// LogStore to create the keyspace and its bookkeeping tables, take and
+// release the schema lock, and read the given applied schema versions.
+func expectSchemaLock(mockCQLDriver *MockedCQLDriver, logStore *LogStore, appliedVersions CQLRows) {
+	migrator := newMigrator(logStore)
+	var emptyPlaceholders []interface{}
+	mockCQLDriver.On("Execute", logStore.keyspaceDeclaration(), emptyPlaceholders).Return(nil)
+	mockCQLDriver.On("Execute", migrator.schemaVersionTableDeclaration(), emptyPlaceholders).Return(nil)
+	mockCQLDriver.On("Execute", migrator.schemaLockTableDeclaration(), emptyPlaceholders).Return(nil)
+	mockCQLDriver.On("ExecuteCAS", migrator.schemaLockInsertStatement(),
+		[]interface{}{schemaLockName, migrator.owner, 300}).Return(true, nil)
+	mockCQLDriver.On("Query", migrator.schemaVersionQuery(), emptyPlaceholders).Return(appliedVersions, nil)
+	mockCQLDriver.On("ExecuteCAS", migrator.schemaLockDeleteStatement(),
+		[]interface{}{schemaLockName, migrator.owner}).Return(true, nil)
+}
+
+// expectMigrations sets up mock expectations for the given migrations to be
+// applied and recorded in the schema version table.
+func expectMigrations(mockCQLDriver *MockedCQLDriver, logStore *LogStore, applied []Migration) {
+	migrator := newMigrator(logStore)
+	var emptyPlaceholders []interface{}
+	for _, migration := range applied {
+		for _, statement := range migration.statements(logStore) {
+			mockCQLDriver.On("Execute", statement, emptyPlaceholders).Return(nil)
+		}
+		version := migration.Version
+		mockCQLDriver.On("Execute", migrator.schemaVersionInsertStatement(), mock.MatchedBy(
+			func(placeholders []interface{}) bool { return len(placeholders) > 0 && placeholders[0] == version })).Return(nil)
+	}
+}
+
+// expectSchemaMigration sets up mock expectations for all schema migrations to
+// be applied to an empty keyspace.
+func expectSchemaMigration(mockCQLDriver *MockedCQLDriver, logStore *LogStore) {
+	expectSchemaLock(mockCQLDriver, logStore, CQLRows{})
+	expectMigrations(mockCQLDriver, logStore, migrations)
+}
+
+// Verify that the migrations are numbered in order, starting at one.
+func TestMigrationVersions(t *testing.T) {
+	for i, migration := range migrations {
+		assert.Equalf(t, i+1, migration.Version, "unexpected version of migration %s", migration)
+	}
+}
+
+// The log table created by schema version 1 must keep its primary key, and
+// the one keyed by entry hash must be created by a later migration under a
+// name of its own.
+func TestLogTableMigrations(t *testing.T) {
+	logStore := NewLogStore(new(MockedCQLDriver), options())
+
+	assert.Equalf(t, []string{logStore.legacyTableDeclaration()}, migrations[0].statements(logStore),
+		"unexpected statements of migration 1")
+	assert.Containsf(t, logStore.legacyTableDeclaration(), "CREATE TABLE IF NOT EXISTS keyspace.logtable (",
+		"unexpected name of log table of schema version 1")
+	assert.Containsf(t, logStore.legacyTableDeclaration(), "PRIMARY KEY ((namespace, pod_name, container_name, date), time) )",
+		"unexpected primary key of log table of schema version 1")
+
+	assert.Equalf(t, []string{logStore.tableDeclaration()}, migrations[3].statements(logStore),
+		"unexpected statements of migration 4")
+	assert.Containsf(t, logStore.tableDeclaration(), "CREATE TABLE IF NOT EXISTS keyspace.logtable_hashed (",
+		"unexpected name of log table of schema version 4")
+	assert.Containsf(t, logStore.tableDeclaration(), "PRIMARY KEY ((namespace, pod_name, container_name, date), time, entry_hash) )",
+		"unexpected primary key of log table of schema version 4")
+}
+
+// Verify that Migrator.Migrate() only applies the migrations that have not
+// already been applied, and records them in the schema version table.
+func TestMigratorMigrate(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	logStore := NewLogStore(mockCQLDriver, options())
+
+	//
+	// set up mock expectations
+	//
+	expectSchemaLock(mockCQLDriver, logStore, CQLRows{{"version": 1}})
+	expectMigrations(mockCQLDriver, logStore, migrations[1:])
+
+	//
+	// make call
+	//
+	applied, err := newMigrator(logStore).Migrate()
+	require.Nilf(t, err, "migrate not expected to return error")
+	assert.Equalf(t, []int{2, 3, 4}, versions(applied), "unexpected applied migrations")
+
+	// verify that expected calls were made
+	mockCQLDriver.AssertExpectations(t)
+	mockCQLDriver.AssertNotCalled(t, "Execute", logStore.legacyTableDeclaration(), []interface{}(nil))
+}
+
+// Verify that Migrator.Migrate() waits for the schema lock while it is held
+// by another server, and reads the schema version only once it holds the
+// lock.
+func TestMigratorMigrateWaitsForLock(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	logStore := NewLogStore(mockCQLDriver, options())
+	migrator := newMigrator(logStore)
+	migrator.lockPollInterval = 10 * time.Millisecond
+
+	//
+	// set up mock expectations
+	//
+	// the lock is held by another server on the first attempt
+	mockCQLDriver.On("ExecuteCAS", migrator.schemaLockInsertStatement(),
+		[]interface{}{schemaLockName, migrator.owner, 300}).Return(false, nil).Once()
+	// ... which applied all migrations before releasing it
+	expectSchemaLock(mockCQLDriver, logStore, CQLRows{{"version": 1}, {"version": 2}, {"version": 3}, {"version": 4}})
+
+	//
+	// make call
+	//
+	applied, err := migrator.Migrate()
+	require.Nilf(t, err, "migrate not expected to return error")
+	assert.Equalf(t, []int{}, versions(applied), "expected no migrations to be applied")
+
+	// verify that expected calls were made
+	mockCQLDriver.AssertExpectations(t)
+	mockCQLDriver.AssertNumberOfCalls(t, "ExecuteCAS", 3)
+}
+
+// Verify that Migrator.Migrate() gives up waiting for the schema lock when it
+// is never released.
+func TestMigratorMigrateOnLockTimeout(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	logStore := NewLogStore(mockCQLDriver, options())
+	migrator := newMigrator(logStore)
+	migrator.lockTTL = 30 * time.Millisecond
+	migrator.lockPollInterval = 10 * time.Millisecond
+
+	//
+	// set up mock expectations
+	//
+	var emptyPlaceholders []interface{}
+	mockCQLDriver.On("Execute", logStore.keyspaceDeclaration(), emptyPlaceholders).Return(nil)
+	mockCQLDriver.On("Execute", migrator.schemaVersionTableDeclaration(), emptyPlaceholders).Return(nil)
+	mockCQLDriver.On("Execute", migrator.schemaLockTableDeclaration(), emptyPlaceholders).Return(nil)
+	mockCQLDriver.On("ExecuteCAS", migrator.schemaLockInsertStatement(),
+		[]interface{}{schemaLockName, migrator.owner, 0}).Return(false, nil)
+
+	//
+	// make call
+	//
+	_, err := migrator.Migrate()
+	expectedErr := SchemaError{message: "failed to acquire schema lock",
+		cause: fmt.Errorf("timed out waiting for schema lock held by another server")}
+	require.Equalf(t, expectedErr, err, "expected migrate to fail with schema error")
+
+	// verify that expected calls were made
+	mockCQLDriver.AssertExpectations(t)
+	mockCQLDriver.AssertNotCalled(t, "Query", migrator.schemaVersionQuery(), emptyPlaceholders)
+}
+
+// Verify that Migrator.Pending() lists all migrations for a keyspace that has
+// never been migrated, and otherwise the ones that have not been applied.
+func TestMigratorPending(t *testing.T) {
+	mockCQLDriver := new(MockedCQLDriver)
+	logStore := NewLogStore(mockCQLDriver, options())
+	migrator := newMigrator(logStore)
+
+	// no schema version table
+	mockCQLDriver.On("Query", migrator.tableExistsQuery(), []interface{}{"keyspace", "logtable_schema_version"}).
+		Return(CQLRows{}, nil).Once()
+	pending, err := migrator.Pending()
+	require.Nilf(t, err, "pending not expected to return error")
+	assert.Equalf(t, []int{1, 2, 3, 4}, versions(pending), "unexpected pending migrations")
+
+	// some migrations applied
+	mockCQLDriver.On("Query", migrator.tableExistsQuery(), []interface{}{"keyspace", "logtable_schema_version"}).
+		Return(CQLRows{{"table_name": "logtable_schema_version"}}, nil).Once()
+	mockCQLDriver.On("Query", migrator.schemaVersionQuery(), []interface{}(nil)).
+		Return(CQLRows{{"version": 1}, {"version": 2}}, nil).Once()
+	pending, err = migrator.Pending()
+	require.Nilf(t, err, "pending not expected to return error")
+	assert.Equalf(t, []int{3, 4}, versions(pending), "unexpected pending migrations")
+
+	// verify that expected calls were made
+	mockCQLDriver.AssertExpectations(t)
+	mockCQLDriver.AssertNotCalled(t, "Execute", mock.Anything, mock.Anything)
+}
+
+// versions returns the versions of a list of migrations.
+func versions(migrations []Migration) []int {
+	versions := make([]int, 0, len(migrations))
+	for _, migration := range migrations {
+		versions = append(versions, migration.Version)
+	}
+	return versions
+}
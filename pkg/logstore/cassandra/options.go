@@ -6,6 +6,10 @@ import (
 	"fmt"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
 )
 
 // ReplicationStrategy represents a replication strategy, which is
@@ -33,6 +37,158 @@ func (r ReplicationStrategy) Validate() error {
 	}
 }
 
+// HostSelectionPolicy represents the policy that the driver uses to select
+// the Cassandra node(s) that a statement is sent to.
+type HostSelectionPolicy string
+
+// Valid host selection policies
+const (
+	// RoundRobinPolicy spreads statements evenly over all nodes.
+	RoundRobinPolicy HostSelectionPolicy = "RoundRobin"
+	// DCAwareRoundRobinPolicy spreads statements evenly over the nodes of
+	// the local datacenter and only falls back to other datacenters when no
+	// local node is available.
+	DCAwareRoundRobinPolicy HostSelectionPolicy = "DCAwareRoundRobin"
+)
+
+func (p HostSelectionPolicy) String() string {
+	return string(p)
+}
+
+// Validate ensures that the given HostSelectionPolicy is recognized.
+func (p HostSelectionPolicy) Validate() error {
+	switch p {
+	case RoundRobinPolicy, DCAwareRoundRobinPolicy:
+		return nil
+	default:
+		return fmt.Errorf("invalid host selection policy: must be one of %s",
+			[]HostSelectionPolicy{RoundRobinPolicy, DCAwareRoundRobinPolicy})
+	}
+}
+
+// BucketSize represents the time span of log entries that are stored in a
+// single partition of the log table (for each pod container). Small buckets
+// keep the partitions of chatty containers small, whereas large buckets avoid
+// lots of tiny partitions for quiet containers.
+type BucketSize string
+
+// Valid bucket sizes
+const (
+	HourlyBuckets    BucketSize = "1h"
+	SixHourlyBuckets BucketSize = "6h"
+	DailyBuckets     BucketSize = "1d"
+	WeeklyBuckets    BucketSize = "7d"
+)
+
+var bucketDurations = map[BucketSize]time.Duration{
+	HourlyBuckets:    time.Hour,
+	SixHourlyBuckets: 6 * time.Hour,
+	DailyBuckets:     24 * time.Hour,
+	WeeklyBuckets:    7 * 24 * time.Hour,
+}
+
+func (b BucketSize) String() string {
+	return string(b)
+}
+
+// Validate ensures that the given BucketSize is recognized.
+func (b BucketSize) Validate() error {
+	if _, ok := bucketDurations[b]; !ok {
+		return fmt.Errorf("invalid bucket size: must be one of %s",
+			[]BucketSize{HourlyBuckets, SixHourlyBuckets, DailyBuckets, WeeklyBuckets})
+	}
+	return nil
+}
+
+// Duration returns the time span of a bucket.
+func (b BucketSize) Duration() time.Duration {
+	return bucketDurations[b]
+}
+
+// CompactionStrategy represents the compaction strategy of the log table.
+type CompactionStrategy string
+
+// Valid compaction strategies
+const (
+	// TimeWindowCompaction compacts SSTables per time window, which suits
+	// append-only time series that expire.
+	TimeWindowCompaction CompactionStrategy = "TimeWindowCompactionStrategy"
+	// SizeTieredCompaction is Cassandra's default compaction strategy.
+	SizeTieredCompaction CompactionStrategy = "SizeTieredCompactionStrategy"
+	// LeveledCompaction favors reads over writes.
+	LeveledCompaction CompactionStrategy = "LeveledCompactionStrategy"
+)
+
+func (s CompactionStrategy) String() string {
+	return string(s)
+}
+
+// Validate ensures that the given CompactionStrategy is recognized.
+func (s CompactionStrategy) Validate() error {
+	switch s {
+	case TimeWindowCompaction, SizeTieredCompaction, LeveledCompaction:
+		return nil
+	default:
+		return fmt.Errorf("invalid compaction strategy: must be one of %s",
+			[]CompactionStrategy{TimeWindowCompaction, SizeTieredCompaction, LeveledCompaction})
+	}
+}
+
+// Valid compaction window units of TimeWindowCompaction
+var compactionWindowUnits = []string{"MINUTES", "HOURS", "DAYS"}
+
+// Compression represents the compressor used for the SSTables of the log
+// table.
+type Compression string
+
+// Valid compressions
+const (
+	LZ4Compression     Compression = "LZ4Compressor"
+	SnappyCompression  Compression = "SnappyCompressor"
+	DeflateCompression Compression = "DeflateCompressor"
+	NoCompression      Compression = "none"
+)
+
+func (c Compression) String() string {
+	return string(c)
+}
+
+// Validate ensures that the given Compression is recognized.
+func (c Compression) Validate() error {
+	switch c {
+	case LZ4Compression, SnappyCompression, DeflateCompression, NoCompression:
+		return nil
+	default:
+		return fmt.Errorf("invalid compression: must be one of %s",
+			[]Compression{LZ4Compression, SnappyCompression, DeflateCompression, NoCompression})
+	}
+}
+
+// Consistency represents a Cassandra consistency level, such as ONE, QUORUM or
+// LOCAL_QUORUM, that determines how many replicas need to acknowledge a read
+// or write for it to succeed.
+type Consistency string
+
+func (c Consistency) String() string {
+	return string(c)
+}
+
+// Validate ensures that the given Consistency is a recognized consistency
+// level.
+func (c Consistency) Validate() error {
+	if _, err := gocql.ParseConsistencyWrapper(string(c)); err != nil {
+		return fmt.Errorf("invalid consistency level: %s: must be one of %s", c,
+			[]gocql.Consistency{gocql.Any, gocql.One, gocql.Two, gocql.Three, gocql.Quorum,
+				gocql.All, gocql.LocalQuorum, gocql.EachQuorum, gocql.LocalOne})
+	}
+	return nil
+}
+
+// level returns the gocql representation of a (valid) Consistency.
+func (c Consistency) level() gocql.Consistency {
+	return gocql.ParseConsistency(string(c))
+}
+
 // ReplicationFactorMap represents the replication factors to use for
 // each cluster datacenter for a keyspace with NetworkTopologyStrategy
 // replication strategy.
@@ -40,8 +196,8 @@ type ReplicationFactorMap map[string]int
 
 // NewReplicationFactorMap parses a ReplicationFactorMap from a JSON string.
 // An example replication factor map is
-//    {"dc1":3,"dc2":2}
 //
+//	{"dc1":3,"dc2":2}
 func NewReplicationFactorMap(asJSON string) (ReplicationFactorMap, error) {
 	m := make(map[string]int)
 	err := json.Unmarshal([]byte(asJSON), &m)
@@ -52,7 +208,8 @@ func NewReplicationFactorMap(asJSON string) (ReplicationFactorMap, error) {
 }
 
 // String returns the ReplicationFactorMap as a string of form
-//     'datacenter1': 2, 'datacenter2': 3, 'datacenter3': 4
+//
+//	'datacenter1': 2, 'datacenter2': 3, 'datacenter3': 4
 func (r ReplicationFactorMap) String() string {
 	// sort keys for deterministic output order
 	keys := make([]string, 0)
@@ -80,6 +237,97 @@ func (r ReplicationFactorMap) JSON() string {
 	return string(b)
 }
 
+// maxTTL is the longest time-to-live that Cassandra accepts (20 years).
+const maxTTL = 630720000 * time.Second
+
+// ParseTTL parses a time-to-live, which is either a Go duration (such as
+// "12h") or a number of days (such as "90d"). A time-to-live of zero means
+// that log entries never expire.
+func ParseTTL(ttl string) (time.Duration, error) {
+	if strings.HasSuffix(ttl, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(ttl, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse ttl: %s", ttl)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	duration, err := time.ParseDuration(ttl)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse ttl: %s", ttl)
+	}
+	return duration, nil
+}
+
+// validateTTL ensures that a time-to-live is accepted by Cassandra.
+func validateTTL(ttl time.Duration) error {
+	if ttl < 0 || ttl > maxTTL {
+		return fmt.Errorf("must be in range [0s,%s]", maxTTL)
+	}
+	if ttl%time.Second != 0 {
+		return fmt.Errorf("must be a whole number of seconds")
+	}
+	return nil
+}
+
+// NamespaceTTLs holds the time-to-live of the log entries of namespaces that
+// override the default time-to-live. Keys are namespace names, or namespace
+// name prefixes when ending with '*'.
+type NamespaceTTLs map[string]time.Duration
+
+// NewNamespaceTTLs parses NamespaceTTLs from a JSON string, where each
+// time-to-live is given in a form accepted by ParseTTL. An example is
+//
+//	{"kube-system":"7d","prod-*":"90d"}
+func NewNamespaceTTLs(asJSON string) (NamespaceTTLs, error) {
+	m := make(map[string]string)
+	err := json.Unmarshal([]byte(asJSON), &m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse namespace ttl map: %s", err)
+	}
+	ttls := make(NamespaceTTLs)
+	for namespace, ttlString := range m {
+		ttl, err := ParseTTL(ttlString)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse namespace ttl map: %s", err)
+		}
+		ttls[namespace] = ttl
+	}
+	return ttls, nil
+}
+
+// ttl returns the time-to-live of the log entries of a namespace: the
+// override for the namespace name if there is one, or else the override for
+// the longest matching namespace prefix, or else the default time-to-live.
+func (t NamespaceTTLs) ttl(namespace string, defaultTTL time.Duration) time.Duration {
+	if ttl, ok := t[namespace]; ok {
+		return ttl
+	}
+	ttl, longestPrefix := defaultTTL, -1
+	for pattern, patternTTL := range t {
+		if !strings.HasSuffix(pattern, "*") {
+			continue
+		}
+		prefix := strings.TrimSuffix(pattern, "*")
+		if strings.HasPrefix(namespace, prefix) && len(prefix) > longestPrefix {
+			ttl, longestPrefix = patternTTL, len(prefix)
+		}
+	}
+	return ttl
+}
+
+// JSON returns the NamespaceTTLs as a JSON encoded string.
+func (t NamespaceTTLs) JSON() string {
+	m := make(map[string]string)
+	for namespace, ttl := range t {
+		m[namespace] = ttl.String()
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
 // OptionError is returned when an invalid set of Cassandra Options are supplied.
 type OptionError struct {
 	Message string
@@ -97,8 +345,9 @@ type Options struct {
 	// Keyspace is the keyspace that contains the log table. This
 	// keyspace will be created if it does not exist.
 	Keyspace string
-	// LogTableName is the name to use for the log table. This
-	// keyspace will be created if it does not exist.
+	// LogTableName is the name of the log table created by schema version
+	// 1. It also prefixes the names of the other tables of the LogStore,
+	// such as the log table created by schema version 4 (<name>_hashed).
 	LogTableName string
 	// ReplicationStrategy is the replication strategy to use
 	// if the keyspace does not exist and needs to be created.
@@ -109,12 +358,86 @@ type Options struct {
 	// with key `cluster`.
 	ReplicationFactors ReplicationFactorMap
 
+	// HostSelectionPolicy is the policy used to pick the node(s) to send a
+	// statement to.
+	HostSelectionPolicy HostSelectionPolicy
+	// LocalDC is the name of the local datacenter. Required by the
+	// DCAwareRoundRobinPolicy.
+	LocalDC string
+	// TokenAware, when true, makes the driver send statements directly to
+	// a replica node that owns the partition that is being read/written
+	// (among the nodes offered by HostSelectionPolicy).
+	TokenAware bool
+
+	// Username is the user to authenticate as with Cassandra's
+	// PasswordAuthenticator. If empty, no authentication is performed.
+	Username string
+	// Password is the password to authenticate with. Mutually exclusive
+	// with PasswordFile.
+	Password string
+	// PasswordFile is the path to a file holding the password to
+	// authenticate with. Mutually exclusive with Password.
+	PasswordFile string
+
+	// EnableTLS makes the driver connect to Cassandra over TLS.
+	EnableTLS bool
+	// TLSCACertPath is the path to a PEM-encoded CA certificate bundle used
+	// to verify the certificates of Cassandra nodes. If empty, the system's
+	// root CAs are used.
+	TLSCACertPath string
+	// TLSCertPath is the path to a PEM-encoded client certificate to present
+	// to Cassandra nodes. Must be given together with TLSKeyPath.
+	TLSCertPath string
+	// TLSKeyPath is the path to the PEM-encoded private key of the client
+	// certificate. Must be given together with TLSCertPath.
+	TLSKeyPath string
+	// TLSVerifyHostname, when true, verifies that the certificate of a
+	// Cassandra node is signed by a trusted CA and is valid for its
+	// hostname. If false, node certificates are not verified at all.
+	TLSVerifyHostname bool
+
+	// WriteConsistency is the consistency level used for inserts.
+	WriteConsistency Consistency
+	// ReadConsistency is the consistency level used for queries.
+	ReadConsistency Consistency
+
 	// WriteConcurrency specifies the number of goroutines to use to process
 	// Cassandra insert statements (to increase write throughput).
 	WriteConcurrency int
-	// WriteBufferSize controls the maxiumum number of inserts that can be
-	// queued up before additional writes will block.
+	// WriteBufferSize controls the maxiumum number of inserts (or insert
+	// batches) that can be queued up before additional writes will block.
 	WriteBufferSize int
+	// WriteBatchSize is the maximum number of inserts to send in a single
+	// unlogged batch. Only inserts that target the same partition are
+	// batched together. A value of 1 disables batching.
+	WriteBatchSize int
+	// BucketSize is the time span of log entries that are stored in a single
+	// partition of the log table. It is recorded with the log table when the
+	// table is created and cannot be changed afterwards.
+	BucketSize BucketSize
+	// DefaultTTL is the time-to-live of stored log entries, after which
+	// Cassandra expires them. Zero means that log entries never expire.
+	DefaultTTL time.Duration
+	// NamespaceTTLs overrides the DefaultTTL for the log entries of certain
+	// namespaces.
+	NamespaceTTLs NamespaceTTLs
+	// CompactionStrategy is the compaction strategy of the log table.
+	CompactionStrategy CompactionStrategy
+	// CompactionWindowUnit is the unit (MINUTES, HOURS or DAYS) of the
+	// CompactionWindowSize of TimeWindowCompaction.
+	CompactionWindowUnit string
+	// CompactionWindowSize is the number of CompactionWindowUnits per time
+	// window of TimeWindowCompaction. Zero makes the time windows match the
+	// BucketSize.
+	CompactionWindowSize int
+	// Compression is the compressor of the log table.
+	Compression Compression
+	// GCGraceSeconds is the gc_grace_seconds of the log table: the time to
+	// keep tombstones before they are garbage collected.
+	GCGraceSeconds int
+	// ReadConcurrency specifies the number of goroutines to use to run the
+	// (single-day) sub-queries of a query concurrently.
+	ReadConcurrency int
 }
 
 // Validate ensures that the given Options are valid.
@@ -153,10 +476,80 @@ func (opts *Options) Validate() error {
 	if opts.WriteBufferSize <= 0 {
 		return &OptionError{"WriteBufferSize must be a positive value"}
 	}
+	if opts.WriteBatchSize <= 0 {
+		return &OptionError{"WriteBatchSize must be a positive value"}
+	}
+	if opts.ReadConcurrency <= 0 {
+		return &OptionError{"ReadConcurrency must be a positive value"}
+	}
+	if err := opts.BucketSize.Validate(); err != nil {
+		return &OptionError{err.Error()}
+	}
+	if err := validateTTL(opts.DefaultTTL); err != nil {
+		return &OptionError{"DefaultTTL " + err.Error()}
+	}
+	for namespace, ttl := range opts.NamespaceTTLs {
+		if err := validateTTL(ttl); err != nil {
+			return &OptionError{fmt.Sprintf("TTL of namespace %s %s", namespace, err)}
+		}
+	}
+	if err := opts.CompactionStrategy.Validate(); err != nil {
+		return &OptionError{err.Error()}
+	}
+	if opts.CompactionWindowSize < 0 {
+		return &OptionError{"CompactionWindowSize must be a non-negative value"}
+	}
+	if opts.CompactionWindowSize > 0 {
+		validUnit := false
+		for _, unit := range compactionWindowUnits {
+			validUnit = validUnit || opts.CompactionWindowUnit == unit
+		}
+		if !validUnit {
+			return &OptionError{fmt.Sprintf("CompactionWindowUnit must be one of %s", compactionWindowUnits)}
+		}
+	}
+	if err := opts.Compression.Validate(); err != nil {
+		return &OptionError{err.Error()}
+	}
+	if opts.GCGraceSeconds < 0 {
+		return &OptionError{"GCGraceSeconds must be a non-negative value"}
+	}
+	if err := opts.HostSelectionPolicy.Validate(); err != nil {
+		return &OptionError{err.Error()}
+	}
+	if opts.HostSelectionPolicy == DCAwareRoundRobinPolicy && opts.LocalDC == "" {
+		return &OptionError{"for DCAwareRoundRobin, a local datacenter must be given"}
+	}
+	if err := opts.WriteConsistency.Validate(); err != nil {
+		return &OptionError{"write consistency: " + err.Error()}
+	}
+	if err := opts.ReadConsistency.Validate(); err != nil {
+		return &OptionError{"read consistency: " + err.Error()}
+	}
+	if opts.Password != "" && opts.PasswordFile != "" {
+		return &OptionError{"password and password file are mutually exclusive"}
+	}
+	hasPassword := opts.Password != "" || opts.PasswordFile != ""
+	if opts.Username == "" && hasPassword {
+		return &OptionError{"a password requires a username to be given"}
+	}
+	if opts.Username != "" && !hasPassword {
+		return &OptionError{"a username requires a password or password file to be given"}
+	}
+	if !opts.EnableTLS && (opts.TLSCACertPath != "" || opts.TLSCertPath != "" || opts.TLSKeyPath != "") {
+		return &OptionError{"TLS certificates given but TLS is not enabled"}
+	}
+	if (opts.TLSCertPath == "") != (opts.TLSKeyPath == "") {
+		return &OptionError{"a TLS client certificate and key must be given together"}
+	}
 
 	return nil
 }
 
 func (opts *Options) String() string {
-	return fmt.Sprintf("%+v", *opts)
+	redacted := *opts
+	if redacted.Password != "" {
+		redacted.Password = "<redacted>"
+	}
+	return fmt.Sprintf("%+v", redacted)
 }
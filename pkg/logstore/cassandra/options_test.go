@@ -3,8 +3,10 @@ package cassandra
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // Verify the behavior of Options.Validate()
@@ -168,6 +170,108 @@ func TestOptionValidation(t *testing.T) {
 			isValid:                 false,
 			expectedValidationError: "invalid cassandra options: WriteConcurrency must be a positive value",
 		},
+		{
+			// unknown host selection policy
+			options: Options{
+				Hosts:               []string{"localhost"},
+				CQLPort:             9042,
+				Keyspace:            "ks",
+				LogTableName:        "log",
+				ReplicationStrategy: SimpleStrategy,
+				ReplicationFactors: map[string]int{
+					"cluster": 3,
+				},
+				HostSelectionPolicy: HostSelectionPolicy("Random"),
+				WriteConcurrency:    1,
+				WriteBufferSize:     1024,
+				WriteBatchSize:      50,
+				ReadConcurrency:     4,
+				BucketSize:          DailyBuckets,
+				CompactionStrategy:  TimeWindowCompaction,
+				Compression:         LZ4Compression,
+				GCGraceSeconds:      864000,
+			},
+			isValid:                 false,
+			expectedValidationError: "invalid cassandra options: invalid host selection policy: must be one of [RoundRobin DCAwareRoundRobin]",
+		},
+		{
+			// missing local datacenter for DCAwareRoundRobin
+			options: Options{
+				Hosts:               []string{"localhost"},
+				CQLPort:             9042,
+				Keyspace:            "ks",
+				LogTableName:        "log",
+				ReplicationStrategy: NetworkTopologyStrategy,
+				ReplicationFactors: map[string]int{
+					"dc1": 3,
+					"dc2": 3,
+				},
+				HostSelectionPolicy: DCAwareRoundRobinPolicy,
+				WriteConcurrency:    1,
+				WriteBufferSize:     1024,
+				WriteBatchSize:      50,
+				ReadConcurrency:     4,
+				BucketSize:          DailyBuckets,
+				CompactionStrategy:  TimeWindowCompaction,
+				Compression:         LZ4Compression,
+				GCGraceSeconds:      864000,
+			},
+			isValid:                 false,
+			expectedValidationError: "invalid cassandra options: for DCAwareRoundRobin, a local datacenter must be given",
+		},
+		{
+			// unknown write consistency
+			options: Options{
+				Hosts:               []string{"localhost"},
+				CQLPort:             9042,
+				Keyspace:            "ks",
+				LogTableName:        "log",
+				ReplicationStrategy: SimpleStrategy,
+				ReplicationFactors: map[string]int{
+					"cluster": 3,
+				},
+				HostSelectionPolicy: RoundRobinPolicy,
+				WriteConsistency:    "MOST",
+				ReadConsistency:     "ONE",
+				WriteConcurrency:    1,
+				WriteBufferSize:     1024,
+				WriteBatchSize:      50,
+				ReadConcurrency:     4,
+				BucketSize:          DailyBuckets,
+				CompactionStrategy:  TimeWindowCompaction,
+				Compression:         LZ4Compression,
+				GCGraceSeconds:      864000,
+			},
+			isValid: false,
+			expectedValidationError: "invalid cassandra options: write consistency: invalid consistency level: MOST: " +
+				"must be one of [ANY ONE TWO THREE QUORUM ALL LOCAL_QUORUM EACH_QUORUM LOCAL_ONE]",
+		},
+		{
+			// missing read consistency
+			options: Options{
+				Hosts:               []string{"localhost"},
+				CQLPort:             9042,
+				Keyspace:            "ks",
+				LogTableName:        "log",
+				ReplicationStrategy: SimpleStrategy,
+				ReplicationFactors: map[string]int{
+					"cluster": 3,
+				},
+				HostSelectionPolicy: RoundRobinPolicy,
+				WriteConsistency:    "ONE",
+				WriteConcurrency:    1,
+				WriteBufferSize:     1024,
+				WriteBatchSize:      50,
+				ReadConcurrency:     4,
+				BucketSize:          DailyBuckets,
+				CompactionStrategy:  TimeWindowCompaction,
+				Compression:         LZ4Compression,
+				GCGraceSeconds:      864000,
+			},
+			isValid: false,
+			expectedValidationError: "invalid cassandra options: read consistency: invalid consistency level: : " +
+				"must be one of [ANY ONE TWO THREE QUORUM ALL LOCAL_QUORUM EACH_QUORUM LOCAL_ONE]",
+		},
 		{
 			// invalid WriteBufferSize
 			options: Options{
@@ -186,9 +290,8 @@ func TestOptionValidation(t *testing.T) {
 			isValid:                 false,
 			expectedValidationError: "invalid cassandra options: WriteBufferSize must be a positive value",
 		},
-
 		{
-			// valid
+			// invalid WriteBatchSize
 			options: Options{
 				Hosts:               []string{"localhost"},
 				CQLPort:             9042,
@@ -201,6 +304,359 @@ func TestOptionValidation(t *testing.T) {
 				},
 				WriteConcurrency: 1,
 				WriteBufferSize:  1024,
+				WriteBatchSize:   0,
+			},
+			isValid:                 false,
+			expectedValidationError: "invalid cassandra options: WriteBatchSize must be a positive value",
+		},
+		{
+			// invalid ReadConcurrency
+			options: Options{
+				Hosts:               []string{"localhost"},
+				CQLPort:             9042,
+				Keyspace:            "ks",
+				LogTableName:        "log",
+				ReplicationStrategy: NetworkTopologyStrategy,
+				ReplicationFactors: map[string]int{
+					"dc1": 3,
+					"dc2": 3,
+				},
+				WriteConcurrency: 1,
+				WriteBufferSize:  1024,
+				WriteBatchSize:   50,
+				ReadConcurrency:  0,
+			},
+			isValid:                 false,
+			expectedValidationError: "invalid cassandra options: ReadConcurrency must be a positive value",
+		},
+		{
+			// invalid BucketSize
+			options: Options{
+				Hosts:               []string{"localhost"},
+				CQLPort:             9042,
+				Keyspace:            "ks",
+				LogTableName:        "log",
+				ReplicationStrategy: NetworkTopologyStrategy,
+				ReplicationFactors: map[string]int{
+					"dc1": 3,
+					"dc2": 3,
+				},
+				WriteConcurrency: 1,
+				WriteBufferSize:  1024,
+				WriteBatchSize:   50,
+				ReadConcurrency:  4,
+				BucketSize:       "2d",
+			},
+			isValid:                 false,
+			expectedValidationError: "invalid cassandra options: invalid bucket size: must be one of [1h 6h 1d 7d]",
+		},
+		{
+			// negative DefaultTTL
+			options: Options{
+				Hosts:               []string{"localhost"},
+				CQLPort:             9042,
+				Keyspace:            "ks",
+				LogTableName:        "log",
+				ReplicationStrategy: NetworkTopologyStrategy,
+				ReplicationFactors: map[string]int{
+					"dc1": 3,
+					"dc2": 3,
+				},
+				WriteConcurrency:   1,
+				WriteBufferSize:    1024,
+				WriteBatchSize:     50,
+				ReadConcurrency:    4,
+				BucketSize:         DailyBuckets,
+				CompactionStrategy: TimeWindowCompaction,
+				Compression:        LZ4Compression,
+				GCGraceSeconds:     864000,
+				DefaultTTL:         -1 * time.Hour,
+			},
+			isValid:                 false,
+			expectedValidationError: "invalid cassandra options: DefaultTTL must be in range [0s,175200h0m0s]",
+		},
+		{
+			// namespace TTL longer than Cassandra accepts
+			options: Options{
+				Hosts:               []string{"localhost"},
+				CQLPort:             9042,
+				Keyspace:            "ks",
+				LogTableName:        "log",
+				ReplicationStrategy: NetworkTopologyStrategy,
+				ReplicationFactors: map[string]int{
+					"dc1": 3,
+					"dc2": 3,
+				},
+				WriteConcurrency:   1,
+				WriteBufferSize:    1024,
+				WriteBatchSize:     50,
+				ReadConcurrency:    4,
+				BucketSize:         DailyBuckets,
+				CompactionStrategy: TimeWindowCompaction,
+				Compression:        LZ4Compression,
+				GCGraceSeconds:     864000,
+				NamespaceTTLs:      NamespaceTTLs{"prod-*": 100 * 365 * 24 * time.Hour},
+			},
+			isValid:                 false,
+			expectedValidationError: "invalid cassandra options: TTL of namespace prod-* must be in range [0s,175200h0m0s]",
+		},
+		{
+			// unknown compaction strategy
+			options: Options{
+				Hosts:               []string{"localhost"},
+				CQLPort:             9042,
+				Keyspace:            "ks",
+				LogTableName:        "log",
+				ReplicationStrategy: NetworkTopologyStrategy,
+				ReplicationFactors: map[string]int{
+					"dc1": 3,
+					"dc2": 3,
+				},
+				WriteConcurrency:   1,
+				WriteBufferSize:    1024,
+				WriteBatchSize:     50,
+				ReadConcurrency:    4,
+				BucketSize:         DailyBuckets,
+				CompactionStrategy: "DateTieredCompactionStrategy",
+				Compression:        LZ4Compression,
+			},
+			isValid:                 false,
+			expectedValidationError: "invalid cassandra options: invalid compaction strategy: must be one of [TimeWindowCompactionStrategy SizeTieredCompactionStrategy LeveledCompactionStrategy]",
+		},
+		{
+			// compaction window size without a valid unit
+			options: Options{
+				Hosts:               []string{"localhost"},
+				CQLPort:             9042,
+				Keyspace:            "ks",
+				LogTableName:        "log",
+				ReplicationStrategy: NetworkTopologyStrategy,
+				ReplicationFactors: map[string]int{
+					"dc1": 3,
+					"dc2": 3,
+				},
+				WriteConcurrency:     1,
+				WriteBufferSize:      1024,
+				WriteBatchSize:       50,
+				ReadConcurrency:      4,
+				BucketSize:           DailyBuckets,
+				CompactionStrategy:   TimeWindowCompaction,
+				CompactionWindowUnit: "WEEKS",
+				CompactionWindowSize: 1,
+				Compression:          LZ4Compression,
+			},
+			isValid:                 false,
+			expectedValidationError: "invalid cassandra options: CompactionWindowUnit must be one of [MINUTES HOURS DAYS]",
+		},
+		{
+			// unknown compression
+			options: Options{
+				Hosts:               []string{"localhost"},
+				CQLPort:             9042,
+				Keyspace:            "ks",
+				LogTableName:        "log",
+				ReplicationStrategy: NetworkTopologyStrategy,
+				ReplicationFactors: map[string]int{
+					"dc1": 3,
+					"dc2": 3,
+				},
+				WriteConcurrency:   1,
+				WriteBufferSize:    1024,
+				WriteBatchSize:     50,
+				ReadConcurrency:    4,
+				BucketSize:         DailyBuckets,
+				CompactionStrategy: TimeWindowCompaction,
+				Compression:        "BrotliCompressor",
+			},
+			isValid:                 false,
+			expectedValidationError: "invalid cassandra options: invalid compression: must be one of [LZ4Compressor SnappyCompressor DeflateCompressor none]",
+		},
+		{
+			// negative gc grace seconds
+			options: Options{
+				Hosts:               []string{"localhost"},
+				CQLPort:             9042,
+				Keyspace:            "ks",
+				LogTableName:        "log",
+				ReplicationStrategy: NetworkTopologyStrategy,
+				ReplicationFactors: map[string]int{
+					"dc1": 3,
+					"dc2": 3,
+				},
+				WriteConcurrency:   1,
+				WriteBufferSize:    1024,
+				WriteBatchSize:     50,
+				ReadConcurrency:    4,
+				BucketSize:         DailyBuckets,
+				CompactionStrategy: TimeWindowCompaction,
+				Compression:        LZ4Compression,
+				GCGraceSeconds:     -1,
+			},
+			isValid:                 false,
+			expectedValidationError: "invalid cassandra options: GCGraceSeconds must be a non-negative value",
+		},
+
+		{
+			// password without username
+			options: Options{
+				Hosts:               []string{"localhost"},
+				CQLPort:             9042,
+				Keyspace:            "ks",
+				LogTableName:        "log",
+				ReplicationStrategy: SimpleStrategy,
+				ReplicationFactors: map[string]int{
+					"cluster": 3,
+				},
+				HostSelectionPolicy: RoundRobinPolicy,
+				WriteConsistency:    "ONE",
+				ReadConsistency:     "ONE",
+				Password:            "secret",
+				WriteConcurrency:    1,
+				WriteBufferSize:     1024,
+				WriteBatchSize:      50,
+				ReadConcurrency:     4,
+				BucketSize:          DailyBuckets,
+				CompactionStrategy:  TimeWindowCompaction,
+				Compression:         LZ4Compression,
+				GCGraceSeconds:      864000,
+			},
+			isValid:                 false,
+			expectedValidationError: "invalid cassandra options: a password requires a username to be given",
+		},
+		{
+			// both password and password file
+			options: Options{
+				Hosts:               []string{"localhost"},
+				CQLPort:             9042,
+				Keyspace:            "ks",
+				LogTableName:        "log",
+				ReplicationStrategy: SimpleStrategy,
+				ReplicationFactors: map[string]int{
+					"cluster": 3,
+				},
+				HostSelectionPolicy: RoundRobinPolicy,
+				WriteConsistency:    "ONE",
+				ReadConsistency:     "ONE",
+				Username:            "cassandra",
+				Password:            "secret",
+				PasswordFile:        "/etc/cassandra/password",
+				WriteConcurrency:    1,
+				WriteBufferSize:     1024,
+				WriteBatchSize:      50,
+				ReadConcurrency:     4,
+				BucketSize:          DailyBuckets,
+				CompactionStrategy:  TimeWindowCompaction,
+				Compression:         LZ4Compression,
+				GCGraceSeconds:      864000,
+			},
+			isValid:                 false,
+			expectedValidationError: "invalid cassandra options: password and password file are mutually exclusive",
+		},
+		{
+			// username without password
+			options: Options{
+				Hosts:               []string{"localhost"},
+				CQLPort:             9042,
+				Keyspace:            "ks",
+				LogTableName:        "log",
+				ReplicationStrategy: SimpleStrategy,
+				ReplicationFactors: map[string]int{
+					"cluster": 3,
+				},
+				HostSelectionPolicy: RoundRobinPolicy,
+				WriteConsistency:    "ONE",
+				ReadConsistency:     "ONE",
+				Username:            "cassandra",
+				WriteConcurrency:    1,
+				WriteBufferSize:     1024,
+				WriteBatchSize:      50,
+				ReadConcurrency:     4,
+				BucketSize:          DailyBuckets,
+				CompactionStrategy:  TimeWindowCompaction,
+				Compression:         LZ4Compression,
+				GCGraceSeconds:      864000,
+			},
+			isValid:                 false,
+			expectedValidationError: "invalid cassandra options: a username requires a password or password file to be given",
+		},
+		{
+			// TLS certificates without TLS enabled
+			options: Options{
+				Hosts:               []string{"localhost"},
+				CQLPort:             9042,
+				Keyspace:            "ks",
+				LogTableName:        "log",
+				ReplicationStrategy: SimpleStrategy,
+				ReplicationFactors: map[string]int{
+					"cluster": 3,
+				},
+				HostSelectionPolicy: RoundRobinPolicy,
+				WriteConsistency:    "ONE",
+				ReadConsistency:     "ONE",
+				TLSCACertPath:       "/etc/cassandra/ca.pem",
+				WriteConcurrency:    1,
+				WriteBufferSize:     1024,
+				WriteBatchSize:      50,
+				ReadConcurrency:     4,
+				BucketSize:          DailyBuckets,
+				CompactionStrategy:  TimeWindowCompaction,
+				Compression:         LZ4Compression,
+				GCGraceSeconds:      864000,
+			},
+			isValid:                 false,
+			expectedValidationError: "invalid cassandra options: TLS certificates given but TLS is not enabled",
+		},
+		{
+			// TLS client certificate without key
+			options: Options{
+				Hosts:               []string{"localhost"},
+				CQLPort:             9042,
+				Keyspace:            "ks",
+				LogTableName:        "log",
+				ReplicationStrategy: SimpleStrategy,
+				ReplicationFactors: map[string]int{
+					"cluster": 3,
+				},
+				HostSelectionPolicy: RoundRobinPolicy,
+				WriteConsistency:    "ONE",
+				ReadConsistency:     "ONE",
+				EnableTLS:           true,
+				TLSCertPath:         "/etc/cassandra/client.pem",
+				WriteConcurrency:    1,
+				WriteBufferSize:     1024,
+				WriteBatchSize:      50,
+				ReadConcurrency:     4,
+				BucketSize:          DailyBuckets,
+				CompactionStrategy:  TimeWindowCompaction,
+				Compression:         LZ4Compression,
+				GCGraceSeconds:      864000,
+			},
+			isValid:                 false,
+			expectedValidationError: "invalid cassandra options: a TLS client certificate and key must be given together",
+		},
+		{
+			// valid
+			options: Options{
+				Hosts:               []string{"localhost"},
+				CQLPort:             9042,
+				Keyspace:            "ks",
+				LogTableName:        "log",
+				ReplicationStrategy: NetworkTopologyStrategy,
+				ReplicationFactors: map[string]int{
+					"dc1": 3,
+					"dc2": 3,
+				},
+				HostSelectionPolicy: RoundRobinPolicy,
+				WriteConsistency:    "LOCAL_QUORUM",
+				ReadConsistency:     "local_one",
+				WriteConcurrency:    1,
+				WriteBufferSize:     1024,
+				WriteBatchSize:      50,
+				ReadConcurrency:     4,
+				BucketSize:          DailyBuckets,
+				CompactionStrategy:  TimeWindowCompaction,
+				Compression:         LZ4Compression,
+				GCGraceSeconds:      864000,
 			},
 			isValid:                 true,
 			expectedValidationError: "",
@@ -216,8 +672,17 @@ func TestOptionValidation(t *testing.T) {
 				ReplicationFactors: map[string]int{
 					"cluster": 3,
 				},
-				WriteConcurrency: 1,
-				WriteBufferSize:  1024,
+				HostSelectionPolicy: RoundRobinPolicy,
+				WriteConsistency:    "LOCAL_QUORUM",
+				ReadConsistency:     "local_one",
+				WriteConcurrency:    1,
+				WriteBufferSize:     1024,
+				WriteBatchSize:      50,
+				ReadConcurrency:     4,
+				BucketSize:          DailyBuckets,
+				CompactionStrategy:  TimeWindowCompaction,
+				Compression:         LZ4Compression,
+				GCGraceSeconds:      864000,
 			},
 			isValid:                 true,
 			expectedValidationError: "",
@@ -277,3 +742,43 @@ func TestReplicationFactorsFromJsonOnError(t *testing.T) {
 		t.Errorf("unexpected error: expected: %s, was: %s", expectedErr, err)
 	}
 }
+
+// Tests the ParseTTL function with Go durations and numbers of days.
+func TestParseTTL(t *testing.T) {
+	tests := []struct {
+		ttl         string
+		expectedTTL time.Duration
+		expectedErr string
+	}{
+		{ttl: "0", expectedTTL: 0},
+		{ttl: "12h", expectedTTL: 12 * time.Hour},
+		{ttl: "90d", expectedTTL: 90 * 24 * time.Hour},
+		{ttl: "ninety days", expectedErr: "failed to parse ttl: ninety days"},
+		{ttl: "xd", expectedErr: "failed to parse ttl: xd"},
+	}
+	for _, test := range tests {
+		ttl, err := ParseTTL(test.ttl)
+		if test.expectedErr != "" {
+			assert.EqualErrorf(t, err, test.expectedErr, "unexpected error for ttl %s", test.ttl)
+			continue
+		}
+		assert.Nilf(t, err, "unexpected error for ttl %s", test.ttl)
+		assert.Equalf(t, test.expectedTTL, ttl, "unexpected ttl for %s", test.ttl)
+	}
+}
+
+// The time-to-live of a namespace should be its own override, or else the
+// override of its longest matching prefix, or else the default time-to-live.
+func TestNamespaceTTLs(t *testing.T) {
+	ttls, err := NewNamespaceTTLs(`{"kube-system": "7d", "prod-*": "90d", "prod-eu-*": "30d"}`)
+	require.Nilf(t, err, "unexpected parse error")
+
+	defaultTTL := 14 * 24 * time.Hour
+	assert.Equal(t, 7*24*time.Hour, ttls.ttl("kube-system", defaultTTL))
+	assert.Equal(t, 90*24*time.Hour, ttls.ttl("prod-us-shop", defaultTTL))
+	assert.Equal(t, 30*24*time.Hour, ttls.ttl("prod-eu-shop", defaultTTL))
+	assert.Equal(t, defaultTTL, ttls.ttl("staging", defaultTTL))
+
+	_, err = NewNamespaceTTLs(`{"kube-system": "a week"}`)
+	assert.EqualErrorf(t, err, "failed to parse namespace ttl map: failed to parse ttl: a week", "unexpected error")
+}
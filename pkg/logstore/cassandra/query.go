@@ -1,6 +1,8 @@
 package cassandra
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"time"
 
 	"github.com/elastisys/kube-insight-logserver/pkg/logstore"
@@ -18,64 +20,125 @@ func (p timePeriod) String() string {
 
 // divideByDays takes a timePeriod and breaks it into sub-timePeriods
 // on every date border. For instance, the time-period
-//   ["2018-10-10T23:00:00Z", "2018-10-12T01:00:00Z"]
+//
+//	["2018-10-10T23:00:00Z", "2018-10-12T01:00:00Z"]
+//
 // would be divided into
-//   [
-//     ["2018-10-10T23:00:00Z", "2018-10-10T23:59:59.999999999Z"],
-//     ["2018-10-11T00:00:00Z", "2018-10-11T23:59:59.999999999Z"],
-//     ["2018-10-12T00:00:00Z", "2018-10-12T01:00:00Z"]
-//   ]
+//
+//	[
+//	  ["2018-10-10T23:00:00Z", "2018-10-10T23:59:59.999999999Z"],
+//	  ["2018-10-11T00:00:00Z", "2018-10-11T23:59:59.999999999Z"],
+//	  ["2018-10-12T00:00:00Z", "2018-10-12T01:00:00Z"]
+//	]
 func (p timePeriod) divideByDays() []timePeriod {
-	// time-period does not cross any date borders
-	if date(p.start) == date(p.end) {
+	return p.divideBy(24 * time.Hour)
+}
+
+// divideBy takes a timePeriod and breaks it into sub-timePeriods on every
+// bucket border, where buckets of the given span are aligned to zero time
+// (which means that days start at midnight UTC and weeks start on Mondays).
+func (p timePeriod) divideBy(span time.Duration) []timePeriod {
+	// time-period does not cross any bucket borders
+	if p.start.Truncate(span) == p.end.Truncate(span) {
 		return []timePeriod{p}
 	}
 
-	dayPeriods := make([]timePeriod, 0)
+	periods := make([]timePeriod, 0)
 	t := p.start
-	for date(t).Before(date(p.end)) {
-		dayStart := t
-		dayEnd := date(t).Add(24 * time.Hour).Add(-1 * time.Nanosecond)
-		dayPeriods = append(dayPeriods, timePeriod{dayStart, dayEnd})
+	for t.Truncate(span).Before(p.end.Truncate(span)) {
+		periodStart := t
+		periodEnd := t.Truncate(span).Add(span).Add(-1 * time.Nanosecond)
+		periods = append(periods, timePeriod{periodStart, periodEnd})
+
+		t = t.Truncate(span).Add(span)
+	}
+	// add period for remaining bucket
+	periods = append(periods, timePeriod{p.end.Truncate(span), p.end})
 
-		t = date(t).Add(24 * time.Hour)
+	return periods
+}
+
+// bucket returns the value of the partition key column of the log table
+// partition (bucket) that a point in time falls into. Buckets of a day or
+// longer are keyed by their start date (YYYY-MM-DD), shorter buckets by their
+// start time.
+func (b BucketSize) bucket(t time.Time) interface{} {
+	if b.subDay() {
+		return t.UTC().Truncate(b.Duration())
 	}
-	// add period for remaining day
-	dayPeriods = append(dayPeriods, timePeriod{date(p.end), p.end})
+	return t.UTC().Truncate(b.Duration()).Format("2006-01-02")
+}
 
-	return dayPeriods
+// bucketName returns a string that identifies the bucket that a point in
+// time falls into.
+func (b BucketSize) bucketName(t time.Time) string {
+	if b.subDay() {
+		return t.UTC().Truncate(b.Duration()).Format(time.RFC3339)
+	}
+	return t.UTC().Truncate(b.Duration()).Format("2006-01-02")
 }
 
-// date returns a Time that is truncated down to the date (year-month-day)
-// with all other time fields zeroed.
-func date(t time.Time) time.Time {
-	return t.Truncate(24 * time.Hour)
+// subDay returns true for bucket sizes shorter than a day. The log table
+// partitions of such buckets are keyed on a timestamp rather than a date.
+func (b BucketSize) subDay() bool {
+	return b.Duration() < 24*time.Hour
 }
 
 // querySplitter builds a range of queries divided into sub-queries for each
-// day that the query interval spans. The querySplitter assumes that its
+// bucket that the query interval spans. The querySplitter assumes that its
 // wrapped Query is valid.
 type querySplitter struct {
 	*logstore.Query
+	bucketSize BucketSize
 }
 
-// Build constructs the queries necessary to fetch the log entries requested
-// by a QueryBuilder. This includes validating inputs and breaking the query
-// into multiple sub-queries in case the time interval spans date borders.
+// Split constructs the queries necessary to fetch the log entries requested
+// by a Query, by breaking the query into multiple sub-queries in case the time
+// interval spans bucket borders.
 func (s *querySplitter) Split() (subQueries []*logstore.Query) {
 	subQueries = make([]*logstore.Query, 0)
 
-	// divide into separate queries for each day that the query interval covers
-	queryDays := timePeriod{start: s.StartTime, end: s.EndTime}.divideByDays()
-	for _, queryDay := range queryDays {
-		subQueries = append(subQueries, &logstore.Query{
-			Namespace:     s.Namespace,
-			PodName:       s.PodName,
-			ContainerName: s.ContainerName,
-			StartTime:     queryDay.start,
-			EndTime:       queryDay.end,
-		})
+	// divide into separate queries for each bucket that the query interval
+	// covers
+	queryBuckets := timePeriod{start: s.StartTime, end: s.EndTime}.divideBy(s.bucketSize.Duration())
+	for _, queryBucket := range queryBuckets {
+		subQuery := *s.Query
+		subQuery.StartTime = queryBucket.start
+		subQuery.EndTime = queryBucket.end
+		subQueries = append(subQueries, &subQuery)
 	}
 
 	return subQueries
 }
+
+// pageToken is the decoded form of the opaque continuation token handed out
+// to clients of a paginated query. It records where to resume the query: the
+// bucket of the sub-query and the gocql page state within that sub-query.
+type pageToken struct {
+	// Date identifies the bucket of the sub-query to resume (for daily
+	// buckets, its date as YYYY-MM-DD).
+	Date string `json:"date"`
+	// PageState is the page state of the next page of the sub-query. Empty
+	// means that the sub-query is to be run from its beginning.
+	PageState []byte `json:"page_state,omitempty"`
+}
+
+// encode encodes the pageToken into an opaque continuation token.
+func (t *pageToken) encode() string {
+	bytes, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+// decodePageToken decodes a continuation token created by pageToken.encode().
+// A logstore.QueryError is returned for a malformed token.
+func decodePageToken(token string) (*pageToken, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, logstore.QueryError("query parameter next_token: malformed token")
+	}
+	var decoded pageToken
+	if err := json.Unmarshal(bytes, &decoded); err != nil {
+		return nil, logstore.QueryError("query parameter next_token: malformed token")
+	}
+	return &decoded, nil
+}
@@ -139,7 +139,7 @@ func TestQuerySplitter(t *testing.T) {
 		},
 	}
 	for _, test := range tests {
-		splitter := &querySplitter{test.query}
+		splitter := &querySplitter{Query: test.query, bucketSize: DailyBuckets}
 		subQueries := splitter.Split()
 		if !queriesEqual(test.expectedSplit, subQueries) {
 			t.Errorf("unexpected query split: expected %v, was: %v", test.expectedSplit, subQueries)
@@ -147,6 +147,75 @@ func TestQuerySplitter(t *testing.T) {
 	}
 }
 
+// Verify that querySplitter.Split() splits queries on the borders of the
+// configured bucket size, with weeks starting on Mondays.
+func TestQuerySplitterWithBucketSize(t *testing.T) {
+	tests := []struct {
+		bucketSize    BucketSize
+		query         *logstore.Query
+		expectedSplit []*logstore.Query
+	}{
+		{
+			bucketSize: HourlyBuckets,
+			query:      query(MustParse("2018-01-01T10:30:00.000Z"), MustParse("2018-01-01T12:15:00.000Z")),
+			expectedSplit: []*logstore.Query{
+				query(MustParse("2018-01-01T10:30:00.000Z"), MustParse("2018-01-01T10:59:59.999999999Z")),
+				query(MustParse("2018-01-01T11:00:00.000Z"), MustParse("2018-01-01T11:59:59.999999999Z")),
+				query(MustParse("2018-01-01T12:00:00.000Z"), MustParse("2018-01-01T12:15:00.000Z")),
+			},
+		},
+		{
+			bucketSize: SixHourlyBuckets,
+			query:      query(MustParse("2018-01-01T05:00:00.000Z"), MustParse("2018-01-01T07:00:00.000Z")),
+			expectedSplit: []*logstore.Query{
+				query(MustParse("2018-01-01T05:00:00.000Z"), MustParse("2018-01-01T05:59:59.999999999Z")),
+				query(MustParse("2018-01-01T06:00:00.000Z"), MustParse("2018-01-01T07:00:00.000Z")),
+			},
+		},
+		{
+			// 2018-01-08 is a Monday
+			bucketSize: WeeklyBuckets,
+			query:      query(MustParse("2018-01-03T12:00:00.000Z"), MustParse("2018-01-09T12:00:00.000Z")),
+			expectedSplit: []*logstore.Query{
+				query(MustParse("2018-01-03T12:00:00.000Z"), MustParse("2018-01-07T23:59:59.999999999Z")),
+				query(MustParse("2018-01-08T00:00:00.000Z"), MustParse("2018-01-09T12:00:00.000Z")),
+			},
+		},
+	}
+	for _, test := range tests {
+		splitter := &querySplitter{Query: test.query, bucketSize: test.bucketSize}
+		subQueries := splitter.Split()
+		if !queriesEqual(test.expectedSplit, subQueries) {
+			t.Errorf("unexpected query split for bucket size %s: expected %v, was: %v",
+				test.bucketSize, test.expectedSplit, subQueries)
+		}
+	}
+}
+
+// Verify the partition key values and names of the buckets that points in
+// time fall into.
+func TestBucketSizeBucket(t *testing.T) {
+	tests := []struct {
+		bucketSize   BucketSize
+		time         time.Time
+		expected     interface{}
+		expectedName string
+	}{
+		{HourlyBuckets, MustParse("2018-01-03T10:30:00Z"),
+			MustParse("2018-01-03T10:00:00Z"), "2018-01-03T10:00:00Z"},
+		{SixHourlyBuckets, MustParse("2018-01-03T10:30:00Z"),
+			MustParse("2018-01-03T06:00:00Z"), "2018-01-03T06:00:00Z"},
+		{DailyBuckets, MustParse("2018-01-03T10:30:00Z"), "2018-01-03", "2018-01-03"},
+		{WeeklyBuckets, MustParse("2018-01-03T10:30:00Z"), "2018-01-01", "2018-01-01"},
+	}
+	for _, test := range tests {
+		assert.Equalf(t, test.expected, test.bucketSize.bucket(test.time),
+			"unexpected bucket for bucket size %s", test.bucketSize)
+		assert.Equalf(t, test.expectedName, test.bucketSize.bucketName(test.time),
+			"unexpected bucket name for bucket size %s", test.bucketSize)
+	}
+}
+
 func newMap(json string) ReplicationFactorMap {
 	m, _ := NewReplicationFactorMap(json)
 	return m
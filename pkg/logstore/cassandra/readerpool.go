@@ -0,0 +1,143 @@
+package cassandra
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/elastisys/kube-insight-logserver/pkg/log"
+	"github.com/elastisys/kube-insight-logserver/pkg/logstore"
+)
+
+// readResult is the outcome of a sub-query: the fetched rows or an error.
+type readResult struct {
+	// index is the position of the sub-query among the queries of a
+	// queryAll() call.
+	index int
+	rows  []logstore.LogRow
+	err   error
+}
+
+// readResultChan is a return value channel that the sub-queries of a
+// queryAll() call use to asynchronously return their results to the caller,
+// in the order that they complete.
+type readResultChan chan readResult
+
+// errPoolStopped is returned for sub-queries that were not started since the
+// readerPool has been stopped.
+var errPoolStopped = fmt.Errorf("query rejected: readerPool has been stopped")
+
+// readerPool executes the (single-day) sub-queries of a query concurrently.
+// It is the read-side counterpart of the writerPool: it bounds the number of
+// sub-queries that are in flight against Cassandra at any one time, by
+// having every sub-query hold one of a fixed number of slots while it runs.
+type readerPool struct {
+	// slots holds a token for every sub-query in flight.
+	slots chan struct{}
+	// mutex protects stopped, and is held while sub-queries are started.
+	mutex   sync.Mutex
+	stopped bool
+	// running tracks the sub-queries in flight, which stop() waits for.
+	running sync.WaitGroup
+}
+
+// newReaderPool creates a new readerPool that runs (at most) a given number
+// of sub-queries at a time.
+func newReaderPool(numReaders int) *readerPool {
+	return &readerPool{slots: make(chan struct{}, numReaders)}
+}
+
+// stop rejects any further sub-queries and waits for those in flight to
+// complete.
+func (pool *readerPool) stop() {
+	log.Debugf("stopping cassandra readers ...")
+	pool.mutex.Lock()
+	pool.stopped = true
+	pool.mutex.Unlock()
+	pool.running.Wait()
+}
+
+// queryAll runs a set of queries concurrently and returns their rows
+// concatenated in the order of the queries. On the first error, queries that
+// have not yet been started are cancelled and the error is returned without
+// waiting for the queries that are still in flight.
+func (pool *readerPool) queryAll(queries []func() ([]logstore.LogRow, error)) ([]logstore.LogRow, error) {
+	pool.mutex.Lock()
+	stopped := pool.stopped
+	pool.mutex.Unlock()
+	if stopped {
+		return nil, errPoolStopped
+	}
+
+	// cancelChan is closed by the first query that fails (before it gives
+	// up its slot), or once queryAll returns
+	cancelChan := make(chan struct{})
+	var cancelOnce sync.Once
+	cancel := func() { cancelOnce.Do(func() { close(cancelChan) }) }
+	defer cancel()
+
+	// start the queries from a separate goroutine, since acquiring a slot
+	// blocks while all slots are taken. the result channel has room for all
+	// results, so that no query blocks once queryAll has returned.
+	resultChan := make(readResultChan, len(queries))
+	go func() {
+		for i, query := range queries {
+			select {
+			case pool.slots <- struct{}{}:
+			case <-cancelChan:
+				return
+			}
+			select {
+			case <-cancelChan:
+				<-pool.slots
+				return
+			default:
+			}
+			if !pool.run(i, query, cancel, resultChan) {
+				resultChan <- readResult{index: i, err: errPoolStopped}
+				return
+			}
+		}
+	}()
+
+	// collect the results as they complete, and reassemble them in the
+	// order of the queries
+	results := make([][]logstore.LogRow, len(queries))
+	for range queries {
+		result := <-resultChan
+		if result.err != nil {
+			return nil, result.err
+		}
+		results[result.index] = result.rows
+	}
+	rows := make([]logstore.LogRow, 0)
+	for _, result := range results {
+		rows = append(rows, result...)
+	}
+	return rows, nil
+}
+
+// run starts a query, which calls cancel if it fails, in a goroutine of its
+// own that passes the result (tagged with the index of the query) on to a
+// channel. The caller must hold a slot, which is given up when the query
+// completes. Returns false, and gives up the slot, if the pool has been
+// stopped.
+func (pool *readerPool) run(index int, query func() ([]logstore.LogRow, error), cancel func(), resultChan readResultChan) bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.stopped {
+		<-pool.slots
+		return false
+	}
+
+	pool.running.Add(1)
+	go func() {
+		defer pool.running.Done()
+		rows, err := query()
+		if err != nil {
+			cancel()
+		}
+		<-pool.slots
+		resultChan <- readResult{index: index, rows: rows, err: err}
+	}()
+	return true
+}
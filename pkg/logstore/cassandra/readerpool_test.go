@@ -0,0 +1,116 @@
+package cassandra
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elastisys/kube-insight-logserver/pkg/logstore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rowsQuery returns a query that counts its executions and returns a single
+// row holding a message, or an error.
+func rowsQuery(executions *int32, message string, err error) func() ([]logstore.LogRow, error) {
+	return func() ([]logstore.LogRow, error) {
+		atomic.AddInt32(executions, 1)
+		if err != nil {
+			return nil, err
+		}
+		return []logstore.LogRow{{Log: message}}, nil
+	}
+}
+
+// On the first error, readerPool.queryAll() should return the error and the
+// queries that were not yet started should never be started.
+func TestReaderPoolCancelsQueuedQueriesOnError(t *testing.T) {
+	pool := newReaderPool(1)
+
+	var executions int32
+	queryErr := fmt.Errorf("connection refused")
+	queries := []func() ([]logstore.LogRow, error){
+		rowsQuery(&executions, "day 1", nil),
+		rowsQuery(&executions, "", queryErr),
+		rowsQuery(&executions, "day 3", nil),
+		rowsQuery(&executions, "day 4", nil),
+	}
+	_, err := pool.queryAll(queries)
+	assert.Equalf(t, queryErr, err, "unexpected error")
+
+	pool.stop()
+	assert.Equalf(t, int32(2), atomic.LoadInt32(&executions), "expected queued queries to be cancelled")
+}
+
+// readerPool.queryAll() should return the first error as soon as it occurs,
+// without waiting for earlier queries that are still in flight, and otherwise
+// return the rows in the order of the queries, whatever order the queries
+// complete in.
+func TestReaderPoolReturnsFirstErrorWithoutWaiting(t *testing.T) {
+	pool := newReaderPool(2)
+	defer pool.stop()
+
+	// slowQuery returns a query that completes once released
+	slowQuery := func(release chan struct{}) func() ([]logstore.LogRow, error) {
+		return func() ([]logstore.LogRow, error) {
+			<-release
+			return []logstore.LogRow{{Log: "day 1"}}, nil
+		}
+	}
+	release := make(chan struct{})
+	var executions int32
+	queryErr := fmt.Errorf("connection refused")
+	resultChan := make(chan error, 1)
+	go func() {
+		_, err := pool.queryAll([]func() ([]logstore.LogRow, error){slowQuery(release), rowsQuery(&executions, "", queryErr)})
+		resultChan <- err
+	}()
+	select {
+	case err := <-resultChan:
+		assert.Equalf(t, queryErr, err, "unexpected error")
+	case <-time.After(time.Second):
+		t.Fatalf("expected error to be returned while an earlier query is in flight")
+	}
+	close(release)
+
+	release = make(chan struct{})
+	go func(release chan struct{}) {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}(release)
+	rows, err := pool.queryAll([]func() ([]logstore.LogRow, error){slowQuery(release), rowsQuery(&executions, "day 2", nil)})
+	require.Nilf(t, err, "query not expected to fail")
+	assert.Equalf(t, []logstore.LogRow{{Log: "day 1"}, {Log: "day 2"}}, rows, "expected rows in query order")
+}
+
+// readerPool.stop() should wait for the queries in flight, after which
+// queryAll() should be rejected.
+func TestReaderPoolStop(t *testing.T) {
+	pool := newReaderPool(2)
+
+	started := make(chan struct{})
+	var completed int32
+	slowQuery := func() ([]logstore.LogRow, error) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&completed, 1)
+		return []logstore.LogRow{{Log: "day 1"}}, nil
+	}
+	resultChan := make(chan error, 1)
+	go func() {
+		_, err := pool.queryAll([]func() ([]logstore.LogRow, error){slowQuery})
+		resultChan <- err
+	}()
+
+	<-started
+	pool.stop()
+	assert.Equalf(t, int32(1), atomic.LoadInt32(&completed), "expected stop to wait for query in flight")
+	require.Nilf(t, <-resultChan, "query in flight not expected to fail")
+
+	var executions int32
+	_, err := pool.queryAll([]func() ([]logstore.LogRow, error){rowsQuery(&executions, "day 1", nil)})
+	assert.Equalf(t, errPoolStopped, err, "expected query to be rejected after stop")
+	assert.Equalf(t, int32(0), atomic.LoadInt32(&executions), "expected query not to run after stop")
+}
@@ -0,0 +1,122 @@
+package cassandra
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tableOptions are the configurable options of the log table, which are set
+// when the table is created and compared against those of an existing table.
+type tableOptions struct {
+	compaction     map[string]string
+	compression    map[string]string
+	defaultTTL     int
+	gcGraceSeconds int
+}
+
+// tableOptions returns the log table options dictated by the Options.
+func (c *LogStore) tableOptions() tableOptions {
+	compaction := map[string]string{"class": c.options.CompactionStrategy.String()}
+	if c.options.CompactionStrategy == TimeWindowCompaction {
+		unit, size := c.options.CompactionWindowUnit, c.options.CompactionWindowSize
+		if size == 0 {
+			// time windows match the partition buckets
+			unit, size = "DAYS", int(c.options.BucketSize.Duration()/(24*time.Hour))
+			if c.options.BucketSize.subDay() {
+				unit, size = "HOURS", int(c.options.BucketSize.Duration()/time.Hour)
+			}
+		}
+		compaction["compaction_window_unit"] = unit
+		compaction["compaction_window_size"] = strconv.Itoa(size)
+	}
+
+	compression := map[string]string{"class": c.options.Compression.String()}
+	if c.options.Compression == NoCompression {
+		compression = map[string]string{"enabled": "false"}
+	}
+
+	return tableOptions{
+		compaction:     compaction,
+		compression:    compression,
+		defaultTTL:     int(c.options.DefaultTTL / time.Second),
+		gcGraceSeconds: c.options.GCGraceSeconds,
+	}
+}
+
+// cql renders the tableOptions as the options of a CREATE TABLE or ALTER
+// TABLE statement.
+func (o tableOptions) cql() string {
+	return fmt.Sprintf("compaction = %s AND compression = %s AND default_time_to_live = %d AND gc_grace_seconds = %d",
+		cqlMap(o.compaction), cqlMap(o.compression), o.defaultTTL, o.gcGraceSeconds)
+}
+
+// drift compares the tableOptions against the options of an existing table
+// (as read from system_schema.tables) and describes each option that
+// differs. Only the settings that are configured are compared, and class
+// names are compared without their package.
+func (o tableOptions) drift(table map[string]interface{}) []string {
+	drift := make([]string, 0)
+
+	compaction, _ := table["compaction"].(map[string]string)
+	if !mapSettingsEqual(o.compaction, compaction) {
+		drift = append(drift, fmt.Sprintf("compaction is %s, configured %s", cqlMap(compaction), cqlMap(o.compaction)))
+	}
+	compression, _ := table["compression"].(map[string]string)
+	if !mapSettingsEqual(o.compression, compression) {
+		drift = append(drift, fmt.Sprintf("compression is %s, configured %s", cqlMap(compression), cqlMap(o.compression)))
+	}
+	defaultTTL, _ := table["default_time_to_live"].(int)
+	if defaultTTL != o.defaultTTL {
+		drift = append(drift, fmt.Sprintf("default_time_to_live is %d, configured %d", defaultTTL, o.defaultTTL))
+	}
+	gcGraceSeconds, _ := table["gc_grace_seconds"].(int)
+	if gcGraceSeconds != o.gcGraceSeconds {
+		drift = append(drift, fmt.Sprintf("gc_grace_seconds is %d, configured %d", gcGraceSeconds, o.gcGraceSeconds))
+	}
+
+	return drift
+}
+
+// mapSettingsEqual returns true if all configured settings of a map-valued
+// table option (such as compaction) have the same value in an existing
+// table's option.
+func mapSettingsEqual(configured, actual map[string]string) bool {
+	for key, value := range configured {
+		actualValue, ok := actual[key]
+		if !ok {
+			return false
+		}
+		if key == "class" {
+			// Cassandra reports fully qualified class names
+			actualValue = actualValue[strings.LastIndex(actualValue, ".")+1:]
+		}
+		if actualValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// cqlMap renders a map as a CQL map literal, with sorted keys.
+func cqlMap(m map[string]string) string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("{")
+	for i, key := range keys {
+		if i != 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString(" '" + key + "': '" + m[key] + "'")
+	}
+	buf.WriteString(" }")
+	return buf.String()
+}
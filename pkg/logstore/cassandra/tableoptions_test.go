@@ -0,0 +1,94 @@
+package cassandra
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Verify that the configured table options are rendered as CQL table options,
+// with TimeWindowCompaction windows that follow the bucket size unless given.
+func TestTableOptionsCQL(t *testing.T) {
+	tests := []struct {
+		configure   func(opts *Options)
+		expectedCQL string
+	}{
+		{
+			configure: func(opts *Options) {},
+			expectedCQL: "compaction = { 'class': 'TimeWindowCompactionStrategy', 'compaction_window_size': '1', " +
+				"'compaction_window_unit': 'DAYS' } AND compression = { 'class': 'LZ4Compressor' } " +
+				"AND default_time_to_live = 0 AND gc_grace_seconds = 864000",
+		},
+		{
+			configure: func(opts *Options) {
+				opts.BucketSize = SixHourlyBuckets
+				opts.DefaultTTL = 30 * 24 * time.Hour
+				opts.GCGraceSeconds = 3600
+			},
+			expectedCQL: "compaction = { 'class': 'TimeWindowCompactionStrategy', 'compaction_window_size': '6', " +
+				"'compaction_window_unit': 'HOURS' } AND compression = { 'class': 'LZ4Compressor' } " +
+				"AND default_time_to_live = 2592000 AND gc_grace_seconds = 3600",
+		},
+		{
+			configure: func(opts *Options) {
+				opts.CompactionWindowUnit, opts.CompactionWindowSize = "MINUTES", 30
+				opts.Compression = NoCompression
+			},
+			expectedCQL: "compaction = { 'class': 'TimeWindowCompactionStrategy', 'compaction_window_size': '30', " +
+				"'compaction_window_unit': 'MINUTES' } AND compression = { 'enabled': 'false' } " +
+				"AND default_time_to_live = 0 AND gc_grace_seconds = 864000",
+		},
+		{
+			configure: func(opts *Options) {
+				opts.CompactionStrategy = LeveledCompaction
+				opts.Compression = SnappyCompression
+			},
+			expectedCQL: "compaction = { 'class': 'LeveledCompactionStrategy' } " +
+				"AND compression = { 'class': 'SnappyCompressor' } " +
+				"AND default_time_to_live = 0 AND gc_grace_seconds = 864000",
+		},
+	}
+	for _, test := range tests {
+		opts := options()
+		test.configure(opts)
+		logStore := NewLogStore(new(MockedCQLDriver), opts)
+		assert.Equalf(t, test.expectedCQL, logStore.tableOptions().cql(), "unexpected table options")
+	}
+}
+
+// Verify that differences between the configured table options and those of
+// an existing table are detected. Class names are reported fully qualified by
+// Cassandra, and settings that are not configured are ignored.
+func TestTableOptionsDrift(t *testing.T) {
+	logStore := NewLogStore(new(MockedCQLDriver), options())
+	configured := logStore.tableOptions()
+
+	table := map[string]interface{}{
+		"compaction": map[string]string{
+			"class":                  "org.apache.cassandra.db.compaction.TimeWindowCompactionStrategy",
+			"compaction_window_size": "1",
+			"compaction_window_unit": "DAYS",
+			"max_threshold":          "32",
+		},
+		"compression": map[string]string{
+			"class":              "org.apache.cassandra.io.compress.LZ4Compressor",
+			"chunk_length_in_kb": "64",
+		},
+		"default_time_to_live": 0,
+		"gc_grace_seconds":     864000,
+	}
+	assert.Equalf(t, []string{}, configured.drift(table), "expected no drift")
+
+	// a table created before table options were configurable
+	table["compaction"] = map[string]string{
+		"class": "org.apache.cassandra.db.compaction.SizeTieredCompactionStrategy",
+	}
+	table["gc_grace_seconds"] = 3600
+	assert.Equalf(t, []string{
+		"compaction is { 'class': 'org.apache.cassandra.db.compaction.SizeTieredCompactionStrategy' }, " +
+			"configured { 'class': 'TimeWindowCompactionStrategy', 'compaction_window_size': '1', " +
+			"'compaction_window_unit': 'DAYS' }",
+		"gc_grace_seconds is 3600, configured 864000",
+	}, configured.drift(table), "unexpected drift")
+}
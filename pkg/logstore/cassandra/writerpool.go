@@ -6,20 +6,14 @@ import (
 	"github.com/elastisys/kube-insight-logserver/pkg/log"
 )
 
-// cqlInsert represents a single CQL cqlInsert statement with placeholders.
-type cqlInsert struct {
-	insertStatement string
-	placeholders    []interface{}
-}
-
 // writeResultChan is a return value channel that a writer uses to
 // asynchronously return the insert return value to the caller.
 type writeResultChan chan error
 
-// insertOperation is a single CQL insert statement (bundled with a return value
-// channel) that is read from the work channel by writers.
+// insertOperation is a batch of one or more CQL insert statements (bundled with
+// a return value channel) that is read from the work channel by writers.
 type insertOperation struct {
-	insert     *cqlInsert
+	inserts    []CQLStatement
 	resultChan writeResultChan
 }
 
@@ -47,9 +41,9 @@ func (w *writer) start() {
 	for {
 		select {
 		case op := <-w.workChan:
-			// execute insert and send result back to caller on result channel
-			op.resultChan <- w.cassandraDriver.Execute(
-				op.insert.insertStatement, op.insert.placeholders...)
+			// execute insert(s) and send result back to caller on result
+			// channel
+			op.resultChan <- w.execute(op.inserts)
 		case <-w.stopChan:
 			// told to stop, so exit
 			return
@@ -57,13 +51,22 @@ func (w *writer) start() {
 	}
 }
 
+// execute runs a single insert as a regular statement and multiple inserts as
+// an unlogged batch.
+func (w *writer) execute(inserts []CQLStatement) error {
+	if len(inserts) == 1 {
+		return w.cassandraDriver.Execute(inserts[0].Statement, inserts[0].Placeholders...)
+	}
+	return w.cassandraDriver.ExecuteBatch(inserts)
+}
+
 // stop will stop the writer from processing any more insert operations.
 func (w *writer) stop() {
 	close(w.stopChan)
 }
 
-// writerPool represents a pool of writer goroutines that accept Cassandra
-// insert statements and execute them. The use of multiple writers can speed up
+// writerPool represents a pool of writer goroutines that accept (batches of)
+// Cassandra insert statements and execute them. The use of multiple writers can speed up
 // large insert batches quite considerably.
 type writerPool struct {
 	// cassandraDriver is a Cassandra Driver assumed to be in a connected state.
@@ -118,12 +121,13 @@ func (pool *writerPool) stop() {
 	pool.started = false
 }
 
-// write executes an insert statement against cassandra in an asynchronous
-// manner. The method will not block but will return immediately when the
-// request has been queued. The returned channel can be used by the caller to
-// check for completion (and to check the result -- an error is returned if the
-// write failed).
-func (pool *writerPool) write(insertStatement string, placeholders ...interface{}) writeResultChan {
+// write executes a batch of insert statements against cassandra in an
+// asynchronous manner. A batch holding more than one insert is executed as an
+// unlogged batch, so all inserts should target the same partition. The method
+// will not block but will return immediately when the request has been queued.
+// The returned channel can be used by the caller to check for completion (and
+// to check the result -- an error is returned if the write failed).
+func (pool *writerPool) write(inserts []CQLStatement) writeResultChan {
 	resultChan := make(writeResultChan, 1)
 	if !pool.started {
 		resultChan <- fmt.Errorf("write rejected: writerPool has been stopped")
@@ -131,10 +135,7 @@ func (pool *writerPool) write(insertStatement string, placeholders ...interface{
 	}
 
 	insertRequest := insertOperation{
-		insert: &cqlInsert{
-			insertStatement: insertStatement,
-			placeholders:    placeholders,
-		},
+		inserts:    inserts,
 		resultChan: resultChan,
 	}
 	pool.workChan <- insertRequest
@@ -0,0 +1,425 @@
+package disk
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/elastisys/kube-insight-logserver/pkg/log"
+	"github.com/elastisys/kube-insight-logserver/pkg/logstore"
+)
+
+// LogStore is an embedded, file-backed implementation of the LogStore API,
+// intended for single-node installations where running a Cassandra cluster
+// is not worth the cost. Log entries are stored in append-only segments, one
+// per namespace, pod, container and (UTC) date, laid out as
+//
+//	<directory>/<namespace>/<pod>/<container>/<date>.log
+//	<directory>/<namespace>/<pod>/<container>/<date>.idx
+//
+// where the .log file holds the log entries and the .idx file is a time index
+// into it. Since all state is kept on disk, stored log entries survive
+// restarts. Query semantics are the same as for the Cassandra LogStore.
+type LogStore struct {
+	options *Options
+
+	// mutex serializes writes and allows concurrent queries.
+	mutex sync.RWMutex
+	// connected is true between calls to Connect() and Disconnect().
+	connected bool
+}
+
+// NewLogStore creates a new on-disk LogStore using the specified Options.
+func NewLogStore(options *Options) *LogStore {
+	return &LogStore{options: options}
+}
+
+// Connect creates the LogStore directory, unless it already exists.
+func (d *LogStore) Connect() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	log.Infof("using on-disk log store under %s ...", d.options.Directory)
+	if err := os.MkdirAll(d.options.Directory, 0755); err != nil {
+		return fmt.Errorf("failed to create log store directory: %s", err)
+	}
+	d.connected = true
+	return nil
+}
+
+// Disconnect makes the LogStore reject any further writes and queries.
+func (d *LogStore) Disconnect() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.connected = false
+	return nil
+}
+
+// Ready returns true if the LogStore has been connected and its directory is
+// accessible.
+func (d *LogStore) Ready() (bool, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if !d.connected {
+		return false, fmt.Errorf("on-disk log store is not connected")
+	}
+	stat, err := os.Stat(d.options.Directory)
+	if err != nil {
+		return false, fmt.Errorf("log store directory is not accessible: %s", err)
+	}
+	if !stat.IsDir() {
+		return false, fmt.Errorf("log store directory is not a directory: %s", d.options.Directory)
+	}
+	return true, nil
+}
+
+// Write appends a collection of log entries to their respective segments.
+func (d *LogStore) Write(entries []logstore.LogEntry) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if !d.connected {
+		return fmt.Errorf("write rejected: on-disk log store is not connected")
+	}
+
+	// group entries by segment to write each segment's files once
+	segmentEntries := make(map[segmentKey][]logstore.LogEntry)
+	segmentIndices := make(map[segmentKey][]int)
+	segmentOrder := make([]segmentKey, 0)
+	for i, entry := range entries {
+		key := segmentKeyOf(&entry)
+		if _, ok := segmentEntries[key]; !ok {
+			segmentOrder = append(segmentOrder, key)
+		}
+		segmentEntries[key] = append(segmentEntries[key], entry)
+		segmentIndices[key] = append(segmentIndices[key], i)
+	}
+
+	// a segment that cannot be written fails its entries, not the others
+	entryErrs := make(map[int]error)
+	for _, key := range segmentOrder {
+		path, err := key.path(d.options.Directory)
+		if err == nil {
+			err = newSegment(path).append(segmentEntries[key], d.options.SyncWrites)
+		}
+		if err != nil {
+			for _, index := range segmentIndices[key] {
+				entryErrs[index] = err
+			}
+		}
+	}
+	if len(entryErrs) > 0 {
+		return logstore.NewWriteError(entryErrs)
+	}
+
+	return nil
+}
+
+// Query returns the stored log entries that match a given query, ordered by
+// time (newest first for a descending query).
+func (d *LogStore) Query(query *logstore.Query) (*logstore.QueryResult, error) {
+	if query.Descending() || query.Tail > 0 {
+		return logstore.CollectRows(query, d.QueryStream)
+	}
+
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if !d.connected {
+		return nil, fmt.Errorf("query rejected: on-disk log store is not connected")
+	}
+
+	filter, err := query.Filter()
+	if err != nil {
+		return nil, err
+	}
+
+	start, end := query.StartTime.UTC(), query.EndTime.UTC()
+	if query.MultiContainer() {
+		result := &logstore.QueryResult{LogRows: make([]logstore.LogRow, 0)}
+		for day := start.Truncate(24 * time.Hour); !day.After(end); day = day.Add(24 * time.Hour) {
+			rows, err := d.readContainerSegments(query, filter, day, start, end)
+			if err != nil {
+				return nil, err
+			}
+			result.LogRows = append(result.LogRows, rows...)
+		}
+		return result, nil
+	}
+
+	// when resuming a query, skip everything up to the last returned entry
+	var lastTime time.Time
+	var lastHash int64
+	if query.NextToken != "" {
+		lastTime, lastHash, err = logstore.DecodeEntryToken(query.NextToken)
+		if err != nil {
+			return nil, err
+		}
+		if lastTime.After(start) {
+			start = lastTime
+		}
+	}
+
+	result := &logstore.QueryResult{LogRows: make([]logstore.LogRow, 0)}
+	// visit the segment of every date that the query interval covers
+	var scanned *logstore.LogEntry
+	for day := start.Truncate(24 * time.Hour); !day.After(end); day = day.Add(24 * time.Hour) {
+		entries, err := d.readSegment(query, day, start, end)
+		if err != nil {
+			return nil, err
+		}
+		for i := range entries {
+			entry := &entries[i]
+			if query.NextToken != "" && !logstore.EntryBefore(lastTime, lastHash, entry.Time, logstore.EntryHash(entry)) {
+				continue
+			}
+			if query.Limit > 0 && len(result.LogRows) == query.Limit {
+				result.NextToken = logstore.EncodeEntryToken(scanned.Time, logstore.EntryHash(scanned))
+				return result, nil
+			}
+			scanned = entry
+			row := logstore.LogRow{Time: entry.Time, Log: entry.Log, Stream: entry.Stream}
+			if !filter(&row) {
+				continue
+			}
+			result.LogRows = append(result.LogRows, row)
+		}
+	}
+
+	return result, nil
+}
+
+// QueryStream passes the stored log entries that match a given query, in the
+// order of the query, to a handler. Segments are read one date at a time (in
+// reverse date order for a descending or tail query), and the LogStore is only
+// locked while reading a segment, so that writes are not blocked by a slow
+// handler.
+func (d *LogStore) QueryStream(query *logstore.Query, handler logstore.LogRowHandler) error {
+	filter, err := query.Filter()
+	if err != nil {
+		return err
+	}
+
+	return logstore.OrderedScan(query, func(descending bool, handler logstore.LogRowHandler) error {
+		return d.scan(query, filter, descending, handler)
+	}, handler)
+}
+
+// scan passes the stored log entries that match a query to a handler, either
+// oldest first or newest first.
+func (d *LogStore) scan(query *logstore.Query, filter logstore.LogFilter, descending bool, handler logstore.LogRowHandler) error {
+	start, end := query.StartTime.UTC(), query.EndTime.UTC()
+	days := make([]time.Time, 0)
+	for day := start.Truncate(24 * time.Hour); !day.After(end); day = day.Add(24 * time.Hour) {
+		days = append(days, day)
+	}
+	for i := range days {
+		day := days[i]
+		if descending {
+			day = days[len(days)-1-i]
+		}
+
+		d.mutex.RLock()
+		if !d.connected {
+			d.mutex.RUnlock()
+			return fmt.Errorf("query rejected: on-disk log store is not connected")
+		}
+		var rows []logstore.LogRow
+		var err error
+		if query.MultiContainer() {
+			rows, err = d.readContainerSegments(query, filter, day, start, end)
+		} else {
+			rows, err = d.readSegmentRows(query, filter, day, start, end)
+		}
+		d.mutex.RUnlock()
+		if err != nil {
+			return err
+		}
+
+		if descending {
+			logstore.ReverseRows(rows)
+		}
+		for i := range rows {
+			if err := handler(&rows[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// readSegmentRows reads the rows in the interval [start, end] that match the
+// filter from the segment of the queried container for the given date. Must be
+// called with the mutex held.
+func (d *LogStore) readSegmentRows(query *logstore.Query, filter logstore.LogFilter, day, start, end time.Time) ([]logstore.LogRow, error) {
+	entries, err := d.readSegment(query, day, start, end)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]logstore.LogRow, 0, len(entries))
+	for _, entry := range entries {
+		row := logstore.LogRow{Time: entry.Time, Log: entry.Log, Stream: entry.Stream}
+		if !filter(&row) {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// Namespaces lists the namespaces with a segment for any date in the interval
+// [start, end].
+func (d *LogStore) Namespaces(start, end time.Time) ([]string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if !d.connected {
+		return nil, fmt.Errorf("query rejected: on-disk log store is not connected")
+	}
+	namespaces, err := listNamespaces(d.options.Directory)
+	if err != nil {
+		return nil, err
+	}
+	return d.catalog(namespaces, start, end, func(key segmentKey) (string, bool) {
+		return key.namespace, true
+	})
+}
+
+// Pods lists the pods of a namespace with a segment for any date in the
+// interval [start, end].
+func (d *LogStore) Pods(namespace string, start, end time.Time) ([]string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if !d.connected {
+		return nil, fmt.Errorf("query rejected: on-disk log store is not connected")
+	}
+	return d.catalog([]string{namespace}, start, end, func(key segmentKey) (string, bool) {
+		return key.podName, true
+	})
+}
+
+// Containers lists the containers of a pod with a segment for any date in
+// the interval [start, end].
+func (d *LogStore) Containers(namespace, podName string, start, end time.Time) ([]string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if !d.connected {
+		return nil, fmt.Errorf("query rejected: on-disk log store is not connected")
+	}
+	return d.catalog([]string{namespace}, start, end, func(key segmentKey) (string, bool) {
+		return key.containerName, key.podName == podName
+	})
+}
+
+// catalog collects the (sorted, distinct) names that a name function returns
+// for the containers in the given namespaces that have a segment for any date
+// in the interval [start, end]. Containers for which the name function returns
+// false are skipped. Must be called with the mutex held.
+func (d *LogStore) catalog(namespaces []string, start, end time.Time, name func(key segmentKey) (string, bool)) ([]string, error) {
+	start, end = start.UTC(), end.UTC()
+	names := make(map[string]struct{})
+	for _, namespace := range namespaces {
+		containers, err := listContainers(d.options.Directory, namespace)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range containers {
+			n, ok := name(key)
+			if !ok {
+				continue
+			}
+			if _, found := names[n]; found {
+				continue
+			}
+			for day := start.Truncate(24 * time.Hour); !day.After(end); day = day.Add(24 * time.Hour) {
+				key.date = day.Format("2006-01-02")
+				path, err := key.path(d.options.Directory)
+				if err != nil {
+					return nil, err
+				}
+				if newSegment(path).exists() {
+					names[n] = struct{}{}
+					break
+				}
+			}
+		}
+	}
+
+	sorted := make([]string, 0, len(names))
+	for n := range names {
+		sorted = append(sorted, n)
+	}
+	sort.Strings(sorted)
+	return sorted, nil
+}
+
+// readSegment reads the entries in the interval [start, end] from the segment
+// of the queried container for the given date. Must be called with the mutex
+// held.
+func (d *LogStore) readSegment(query *logstore.Query, day, start, end time.Time) ([]logstore.LogEntry, error) {
+	key := segmentKey{
+		namespace:     query.Namespace,
+		podName:       query.PodName,
+		containerName: query.ContainerName,
+		date:          day.Format("2006-01-02"),
+	}
+	path, err := key.path(d.options.Directory)
+	if err != nil {
+		return nil, err
+	}
+	return newSegment(path).read(start, end)
+}
+
+// readContainerSegments reads the rows in the interval [start, end] from the
+// segments, for the given date, of all containers selected by a
+// multi-container query. The rows are tagged with their pod and container and
+// are merged by time. Must be called with the mutex held.
+func (d *LogStore) readContainerSegments(query *logstore.Query, filter logstore.LogFilter, day, start, end time.Time) ([]logstore.LogRow, error) {
+	selector, err := logstore.ParseLabelSelector(query.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := listContainers(d.options.Directory, query.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]logstore.LogRow, 0)
+	for _, key := range containers {
+		if !query.MatchesContainer(key.podName, key.containerName) {
+			continue
+		}
+		key.date = day.Format("2006-01-02")
+		path, err := key.path(d.options.Directory)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := newSegment(path).read(start, end)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !selector.Matches(entry.Kubernetes.Labels) {
+				continue
+			}
+			row := logstore.LogRow{
+				Time: entry.Time, Log: entry.Log, Stream: entry.Stream,
+				PodName: key.podName, ContainerName: key.containerName,
+			}
+			if !filter(&row) {
+				continue
+			}
+			rows = append(rows, row)
+		}
+	}
+	logstore.SortRows(rows)
+
+	return rows, nil
+}
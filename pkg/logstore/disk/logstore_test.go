@@ -0,0 +1,520 @@
+package disk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elastisys/kube-insight-logserver/pkg/logstore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func MustParse(isoTime string) time.Time {
+	t, _ := time.Parse(time.RFC3339, isoTime)
+	return t
+}
+
+func logEntry(timestamp time.Time, message string) logstore.LogEntry {
+	return logstore.LogEntry{
+		Date: float64(timestamp.UnixNano() / 1.0e9),
+		Kubernetes: logstore.KubernetesMetadata{
+			PodName:       "nginx-deployment-abcde",
+			ContainerName: "nginx",
+			Namespace:     "default",
+		},
+		Log:    message,
+		Stream: "stdout",
+		Time:   timestamp,
+	}
+}
+
+func query(startTime, endTime time.Time) *logstore.Query {
+	return &logstore.Query{
+		Namespace:     "default",
+		PodName:       "nginx-deployment-abcde",
+		ContainerName: "nginx",
+		StartTime:     startTime,
+		EndTime:       endTime,
+	}
+}
+
+// tempDir creates a temporary log store directory. The caller is responsible
+// for removing it.
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "disk-logstore-test")
+	require.Nilf(t, err, "failed to create temp dir")
+	return dir
+}
+
+func connectedLogStore(t *testing.T, dir string) *LogStore {
+	logStore := NewLogStore(&Options{Directory: dir})
+	require.Nilf(t, logStore.Connect(), "connect not expected to fail")
+	return logStore
+}
+
+// Verify the behavior of Options.Validate()
+func TestOptionValidation(t *testing.T) {
+	assert.Nilf(t, (&Options{Directory: "/var/lib/logs"}).Validate(), "expected options to be valid")
+
+	err := (&Options{}).Validate()
+	require.NotNilf(t, err, "expected options without directory to be invalid")
+	assert.Equalf(t, "invalid disk options: no directory given", err.Error(), "unexpected validation error")
+}
+
+// Connect should create the log store directory and make the LogStore ready.
+func TestLogStoreConnect(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	storeDir := filepath.Join(dir, "logs")
+
+	logStore := NewLogStore(&Options{Directory: storeDir})
+	ready, _ := logStore.Ready()
+	assert.False(t, ready, "expected LogStore not to be ready before connect")
+
+	require.Nil(t, logStore.Connect())
+	ready, err := logStore.Ready()
+	assert.True(t, ready, "expected LogStore to be ready after connect")
+	assert.Nil(t, err, "expected no error after connect")
+	_, err = os.Stat(storeDir)
+	assert.Nilf(t, err, "expected log store directory to be created")
+
+	require.Nil(t, logStore.Disconnect())
+	assert.NotNil(t, logStore.Write([]logstore.LogEntry{}), "expected write to fail after disconnect")
+}
+
+// Log entries should be returned in time order and the query interval bounds
+// are inclusive.
+func TestLogStoreQuery(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	logStore := connectedLogStore(t, dir)
+
+	require.Nil(t, logStore.Write([]logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T12:02:00Z"), "event 3"),
+		logEntry(MustParse("2018-01-01T12:00:00Z"), "event 1"),
+	}))
+	require.Nil(t, logStore.Write([]logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T12:03:00Z"), "event 4"),
+		logEntry(MustParse("2018-01-01T12:01:00Z"), "event 2"),
+	}))
+
+	result, err := logStore.Query(query(MustParse("2018-01-01T12:01:00Z"), MustParse("2018-01-01T12:03:00Z")))
+	require.Nilf(t, err, "unexpected query error")
+	expectedRows := []logstore.LogRow{
+		{Time: MustParse("2018-01-01T12:01:00Z"), Log: "event 2", Stream: "stdout"},
+		{Time: MustParse("2018-01-01T12:02:00Z"), Log: "event 3", Stream: "stdout"},
+		{Time: MustParse("2018-01-01T12:03:00Z"), Log: "event 4", Stream: "stdout"},
+	}
+	assert.Equalf(t, expectedRows, result.LogRows, "unexpected query result")
+
+	// no segment for date: should return an empty result
+	result, err = logStore.Query(query(MustParse("2018-02-01T12:00:00Z"), MustParse("2018-02-01T13:00:00Z")))
+	require.Nilf(t, err, "unexpected query error")
+	assert.Equalf(t, []logstore.LogRow{}, result.LogRows, "expected empty query result")
+}
+
+// A log entry that cannot be written to its segment should be reported by
+// index, while the other log entries are stored.
+func TestLogStoreWriteOnPartialFailure(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	logStore := connectedLogStore(t, dir)
+
+	illegal := logEntry(MustParse("2018-01-01T12:01:00Z"), "event 2")
+	illegal.Kubernetes.PodName = ".."
+	err := logStore.Write([]logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T12:00:00Z"), "event 1"),
+		illegal,
+	})
+	expectedErr := logstore.WriteError{Failures: []logstore.EntryError{
+		{Index: 1, Err: fmt.Errorf("illegal segment path element: '..'")},
+	}}
+	require.Equalf(t, expectedErr, err, "expected write to partially fail")
+
+	result, err := logStore.Query(query(MustParse("2018-01-01T12:00:00Z"), MustParse("2018-01-01T13:00:00Z")))
+	require.Nilf(t, err, "unexpected query error")
+	require.Lenf(t, result.LogRows, 1, "unexpected query result")
+	assert.Equalf(t, "event 1", result.LogRows[0].Log, "unexpected query result")
+}
+
+// A query with a limit should be resumable, also across date borders, via
+// the continuation token of its result.
+func TestLogStoreQueryWithLimit(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	logStore := connectedLogStore(t, dir)
+
+	require.Nil(t, logStore.Write([]logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T22:00:00Z"), "event 1"),
+		logEntry(MustParse("2018-01-01T23:00:00Z"), "event 2"),
+		logEntry(MustParse("2018-01-02T01:00:00Z"), "event 3"),
+		logEntry(MustParse("2018-01-02T02:00:00Z"), "event 4"),
+		logEntry(MustParse("2018-01-02T03:00:00Z"), "event 5"),
+	}))
+
+	q := query(MustParse("2018-01-01T00:00:00Z"), MustParse("2018-01-03T00:00:00Z"))
+	q.Limit = 2
+	pages := [][]string{}
+	for {
+		result, err := logStore.Query(q)
+		require.Nilf(t, err, "unexpected query error")
+		page := []string{}
+		for _, row := range result.LogRows {
+			page = append(page, row.Log)
+		}
+		pages = append(pages, page)
+		if result.NextToken == "" {
+			break
+		}
+		q.NextToken = result.NextToken
+	}
+	assert.Equalf(t, [][]string{{"event 1", "event 2"}, {"event 3", "event 4"}, {"event 5"}}, pages, "unexpected pages")
+
+	q.NextToken = "garbage"
+	_, err := logStore.Query(q)
+	assert.Equalf(t, logstore.QueryError("query parameter next_token: malformed token"), err, "unexpected error")
+}
+
+// QueryStream should pass the matching entries of every date to the handler,
+// in time order, and stop on handler error.
+func TestLogStoreQueryStream(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	logStore := connectedLogStore(t, dir)
+
+	require.Nil(t, logStore.Write([]logstore.LogEntry{
+		logEntry(MustParse("2018-01-02T01:00:00Z"), "event 3"),
+		logEntry(MustParse("2018-01-01T23:00:00Z"), "event 2"),
+		logEntry(MustParse("2018-01-01T22:00:00Z"), "event 1"),
+	}))
+
+	q := query(MustParse("2018-01-01T00:00:00Z"), MustParse("2018-01-03T00:00:00Z"))
+	streamed := []string{}
+	err := logStore.QueryStream(q, func(row *logstore.LogRow) error {
+		streamed = append(streamed, row.Log)
+		return nil
+	})
+	require.Nilf(t, err, "unexpected query error")
+	assert.Equalf(t, []string{"event 1", "event 2", "event 3"}, streamed, "unexpected streamed rows")
+
+	handlerErr := fmt.Errorf("broken pipe")
+	streamed = []string{}
+	err = logStore.QueryStream(q, func(row *logstore.LogRow) error {
+		streamed = append(streamed, row.Log)
+		return handlerErr
+	})
+	assert.Equalf(t, handlerErr, err, "expected handler error to be returned")
+	assert.Equalf(t, []string{"event 1"}, streamed, "expected stream to stop on handler error")
+}
+
+// A query by pod name prefix or label selector should merge the entries of all
+// selected containers, on every date, by time and tag each row with its origin.
+func TestLogStoreQueryAcrossContainers(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	logStore := connectedLogStore(t, dir)
+
+	containerEntry := func(podName, containerName string, labels map[string]string, timestamp time.Time, message string) logstore.LogEntry {
+		entry := logEntry(timestamp, message)
+		entry.Kubernetes.PodName, entry.Kubernetes.ContainerName = podName, containerName
+		entry.Kubernetes.Labels = labels
+		return entry
+	}
+	nginxLabels := map[string]string{"app": "nginx"}
+	require.Nil(t, logStore.Write([]logstore.LogEntry{
+		containerEntry("nginx-abcde", "nginx", nginxLabels, MustParse("2018-01-01T23:00:00Z"), "event 1"),
+		containerEntry("nginx-abcde", "sidecar", nginxLabels, MustParse("2018-01-02T01:00:00Z"), "event 3"),
+		containerEntry("nginx-fghij", "nginx", nginxLabels, MustParse("2018-01-01T23:30:00Z"), "event 2"),
+		containerEntry("redis-abcde", "redis", map[string]string{"app": "redis"}, MustParse("2018-01-01T23:10:00Z"), "redis event"),
+	}))
+
+	q := &logstore.Query{
+		Namespace:     "default",
+		LabelSelector: "app=nginx",
+		StartTime:     MustParse("2018-01-01T00:00:00Z"),
+		EndTime:       MustParse("2018-01-03T00:00:00Z"),
+	}
+	result, err := logStore.Query(q)
+	require.Nilf(t, err, "unexpected query error")
+	expectedRows := []logstore.LogRow{
+		{Time: MustParse("2018-01-01T23:00:00Z"), Log: "event 1", Stream: "stdout", PodName: "nginx-abcde", ContainerName: "nginx"},
+		{Time: MustParse("2018-01-01T23:30:00Z"), Log: "event 2", Stream: "stdout", PodName: "nginx-fghij", ContainerName: "nginx"},
+		{Time: MustParse("2018-01-02T01:00:00Z"), Log: "event 3", Stream: "stdout", PodName: "nginx-abcde", ContainerName: "sidecar"},
+	}
+	assert.Equalf(t, expectedRows, result.LogRows, "unexpected query result")
+
+	streamed := []logstore.LogRow{}
+	err = logStore.QueryStream(q, func(row *logstore.LogRow) error {
+		streamed = append(streamed, *row)
+		return nil
+	})
+	require.Nilf(t, err, "unexpected query error")
+	assert.Equalf(t, expectedRows, streamed, "unexpected streamed rows")
+
+	// unknown namespace: should return an empty result
+	q.Namespace = "kube-system"
+	result, err = logStore.Query(q)
+	require.Nilf(t, err, "unexpected query error")
+	assert.Equalf(t, []logstore.LogRow{}, result.LogRows, "expected empty query result")
+}
+
+// The catalog should list the namespaces, pods and containers with a segment
+// on any date of a time interval.
+func TestLogStoreCatalog(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	logStore := connectedLogStore(t, dir)
+
+	sidecar := logEntry(MustParse("2018-01-01T12:00:00Z"), "sidecar event")
+	sidecar.Kubernetes.ContainerName = "sidecar"
+	nextDay := logEntry(MustParse("2018-01-02T12:00:00Z"), "next day event")
+	nextDay.Kubernetes.PodName = "nginx-deployment-fghij"
+	otherNamespace := logEntry(MustParse("2018-01-01T12:00:00Z"), "dns event")
+	otherNamespace.Kubernetes.Namespace = "kube-system"
+	otherNamespace.Kubernetes.PodName = "coredns-abcde"
+	require.Nil(t, logStore.Write([]logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T12:00:00Z"), "event 1"), sidecar, nextDay, otherNamespace,
+	}))
+
+	start, end := MustParse("2018-01-01T00:00:00Z"), MustParse("2018-01-01T23:00:00Z")
+	namespaces, err := logStore.Namespaces(start, end)
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, []string{"default", "kube-system"}, namespaces, "unexpected namespaces")
+
+	pods, err := logStore.Pods("default", start, end)
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, []string{"nginx-deployment-abcde"}, pods, "unexpected pods")
+	pods, err = logStore.Pods("default", start, MustParse("2018-01-02T01:00:00Z"))
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, []string{"nginx-deployment-abcde", "nginx-deployment-fghij"}, pods, "unexpected pods")
+
+	containers, err := logStore.Containers("default", "nginx-deployment-abcde", start, end)
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, []string{"nginx", "sidecar"}, containers, "unexpected containers")
+
+	pods, err = logStore.Pods("unknown", start, end)
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, []string{}, pods, "expected no pods")
+}
+
+// A query that spans date borders should visit the segment of every date.
+func TestLogStoreQueryThatCrossesDateBorder(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	logStore := connectedLogStore(t, dir)
+
+	require.Nil(t, logStore.Write([]logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T23:59:59Z"), "day 1"),
+		logEntry(MustParse("2018-01-02T12:00:00Z"), "day 2"),
+		logEntry(MustParse("2018-01-03T00:00:01Z"), "day 3"),
+		logEntry(MustParse("2018-01-03T00:01:00Z"), "day 3, after end"),
+	}))
+
+	result, err := logStore.Query(query(MustParse("2018-01-01T23:00:00Z"), MustParse("2018-01-03T00:00:01Z")))
+	require.Nilf(t, err, "unexpected query error")
+	expectedRows := []logstore.LogRow{
+		{Time: MustParse("2018-01-01T23:59:59Z"), Log: "day 1", Stream: "stdout"},
+		{Time: MustParse("2018-01-02T12:00:00Z"), Log: "day 2", Stream: "stdout"},
+		{Time: MustParse("2018-01-03T00:00:01Z"), Log: "day 3", Stream: "stdout"},
+	}
+	assert.Equalf(t, expectedRows, result.LogRows, "unexpected query result")
+}
+
+// A descending or tail query should read segments newest first, also across
+// date borders.
+func TestLogStoreQueryLatest(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	logStore := connectedLogStore(t, dir)
+
+	require.Nil(t, logStore.Write([]logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T23:59:58Z"), "event 1"),
+		logEntry(MustParse("2018-01-01T23:59:59Z"), "noise"),
+		logEntry(MustParse("2018-01-02T12:00:00Z"), "event 2"),
+		logEntry(MustParse("2018-01-03T00:00:01Z"), "event 3"),
+	}))
+
+	tests := []struct {
+		order    string
+		tail     int
+		expected []string
+	}{
+		{order: "desc", expected: []string{"event 3", "event 2", "event 1"}},
+		{tail: 2, expected: []string{"event 2", "event 3"}},
+		{order: "desc", tail: 2, expected: []string{"event 3", "event 2"}},
+		{tail: 10, expected: []string{"event 1", "event 2", "event 3"}},
+	}
+	for _, test := range tests {
+		q := query(MustParse("2018-01-01T00:00:00Z"), MustParse("2018-01-04T00:00:00Z"))
+		q.Contains = "event"
+		q.Order, q.Tail = test.order, test.tail
+		result, err := logStore.Query(q)
+		require.Nilf(t, err, "unexpected query error")
+		messages := []string{}
+		for _, row := range result.LogRows {
+			messages = append(messages, row.Log)
+		}
+		assert.Equalf(t, test.expected, messages, "unexpected result for order=%s, tail=%d", test.order, test.tail)
+	}
+}
+
+// Stored log entries should survive a restart. A later write of a log entry
+// with the same timestamp and content should overwrite the earlier one, while
+// one with the same timestamp but different content should be kept as well.
+func TestLogStoreSurvivesRestart(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	logStore := connectedLogStore(t, dir)
+	require.Nil(t, logStore.Write([]logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T12:00:00Z"), "event 1"),
+		logEntry(MustParse("2018-01-01T12:01:00Z"), "event 2"),
+	}))
+	require.Nil(t, logStore.Disconnect())
+
+	logStore = connectedLogStore(t, dir)
+	require.Nil(t, logStore.Write([]logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T12:01:00Z"), "event 2"),
+		logEntry(MustParse("2018-01-01T12:01:00Z"), "event 3"),
+	}))
+
+	result, err := logStore.Query(query(MustParse("2018-01-01T00:00:00Z"), MustParse("2018-01-01T23:00:00Z")))
+	require.Nilf(t, err, "unexpected query error")
+	require.Equalf(t, 3, len(result.LogRows), "unexpected number of log rows")
+	assert.Equalf(t, logstore.LogRow{Time: MustParse("2018-01-01T12:00:00Z"), Log: "event 1", Stream: "stdout"},
+		result.LogRows[0], "unexpected first log row")
+	assert.ElementsMatchf(t, []logstore.LogRow{
+		{Time: MustParse("2018-01-01T12:01:00Z"), Log: "event 2", Stream: "stdout"},
+		{Time: MustParse("2018-01-01T12:01:00Z"), Log: "event 3", Stream: "stdout"},
+	}, result.LogRows[1:], "unexpected log rows with the same timestamp")
+}
+
+// A page boundary that falls between log entries with the same timestamp
+// should neither skip nor repeat any of them.
+func TestLogStoreQueryWithLimitOnSameTime(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	logStore := connectedLogStore(t, dir)
+
+	require.Nil(t, logStore.Write([]logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T12:00:00Z"), "event 1"),
+		logEntry(MustParse("2018-01-01T12:00:00Z"), "event 2"),
+		logEntry(MustParse("2018-01-01T12:00:00Z"), "event 3"),
+		logEntry(MustParse("2018-01-01T12:01:00Z"), "event 4"),
+	}))
+
+	q := query(MustParse("2018-01-01T00:00:00Z"), MustParse("2018-01-01T23:00:00Z"))
+	all, err := logStore.Query(q)
+	require.Nilf(t, err, "unexpected query error")
+	require.Equalf(t, 4, len(all.LogRows), "unexpected number of log rows")
+
+	q.Limit = 2
+	paged := make([]logstore.LogRow, 0)
+	for {
+		result, err := logStore.Query(q)
+		require.Nilf(t, err, "unexpected query error")
+		paged = append(paged, result.LogRows...)
+		if result.NextToken == "" {
+			break
+		}
+		q.NextToken = result.NextToken
+	}
+	assert.Equalf(t, all.LogRows, paged, "expected pages to hold all log rows in order")
+}
+
+// Index entries that point past the end of the data file (for example, after
+// a crash between writing the data and index files) should be ignored.
+func TestLogStoreIgnoresTornWrites(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	logStore := connectedLogStore(t, dir)
+
+	require.Nil(t, logStore.Write([]logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T12:00:00Z"), "event 1"),
+		logEntry(MustParse("2018-01-01T12:01:00Z"), "event 2"),
+	}))
+
+	// chop off the last data file entry
+	dataPath := filepath.Join(dir, "default", "nginx-deployment-abcde", "nginx", "2018-01-01.log")
+	stat, err := os.Stat(dataPath)
+	require.Nil(t, err)
+	require.Nil(t, os.Truncate(dataPath, stat.Size()-1))
+
+	result, err := logStore.Query(query(MustParse("2018-01-01T00:00:00Z"), MustParse("2018-01-01T23:00:00Z")))
+	require.Nilf(t, err, "unexpected query error")
+	expectedRows := []logstore.LogRow{
+		{Time: MustParse("2018-01-01T12:00:00Z"), Log: "event 1", Stream: "stdout"},
+	}
+	assert.Equalf(t, expectedRows, result.LogRows, "unexpected query result")
+}
+
+// A partially written index entry (for example, after a crash while writing
+// the index file) should be cut off before more log entries are appended, so
+// that later index entries stay aligned.
+func TestLogStoreRepairsTornIndex(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	logStore := connectedLogStore(t, dir)
+
+	require.Nil(t, logStore.Write([]logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T12:00:00Z"), "event 1"),
+		logEntry(MustParse("2018-01-01T12:01:00Z"), "event 2"),
+	}))
+
+	// chop off part of the last index entry
+	indexPath := filepath.Join(dir, "default", "nginx-deployment-abcde", "nginx", "2018-01-01.idx")
+	stat, err := os.Stat(indexPath)
+	require.Nil(t, err)
+	require.Nil(t, os.Truncate(indexPath, stat.Size()-10))
+
+	require.Nil(t, logStore.Write([]logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T12:02:00Z"), "event 3"),
+	}))
+	stat, err = os.Stat(indexPath)
+	require.Nil(t, err)
+	assert.Equalf(t, int64(2*indexEntrySize), stat.Size(), "expected torn index entry to be cut off")
+
+	result, err := logStore.Query(query(MustParse("2018-01-01T00:00:00Z"), MustParse("2018-01-01T23:00:00Z")))
+	require.Nilf(t, err, "unexpected query error")
+	expectedRows := []logstore.LogRow{
+		{Time: MustParse("2018-01-01T12:00:00Z"), Log: "event 1", Stream: "stdout"},
+		{Time: MustParse("2018-01-01T12:02:00Z"), Log: "event 3", Stream: "stdout"},
+	}
+	assert.Equalf(t, expectedRows, result.LogRows, "unexpected query result")
+}
+
+// Index entries that point past the end of the data file should be cut off
+// before more log entries are appended, rather than end up pointing at them.
+func TestLogStoreRepairsDanglingIndexEntries(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	logStore := connectedLogStore(t, dir)
+
+	require.Nil(t, logStore.Write([]logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T12:00:00Z"), "event 1"),
+		logEntry(MustParse("2018-01-01T12:01:00Z"), "event 2"),
+	}))
+
+	// chop off the last data file entry
+	dataPath := filepath.Join(dir, "default", "nginx-deployment-abcde", "nginx", "2018-01-01.log")
+	stat, err := os.Stat(dataPath)
+	require.Nil(t, err)
+	require.Nil(t, os.Truncate(dataPath, stat.Size()-1))
+
+	require.Nil(t, logStore.Write([]logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T12:02:00Z"), "event 3"),
+	}))
+
+	result, err := logStore.Query(query(MustParse("2018-01-01T00:00:00Z"), MustParse("2018-01-01T23:00:00Z")))
+	require.Nilf(t, err, "unexpected query error")
+	expectedRows := []logstore.LogRow{
+		{Time: MustParse("2018-01-01T12:00:00Z"), Log: "event 1", Stream: "stdout"},
+		{Time: MustParse("2018-01-01T12:02:00Z"), Log: "event 3", Stream: "stdout"},
+	}
+	assert.Equalf(t, expectedRows, result.LogRows, "unexpected query result")
+}
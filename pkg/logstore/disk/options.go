@@ -0,0 +1,36 @@
+package disk
+
+import "fmt"
+
+// OptionError is returned when an invalid set of on-disk LogStore Options
+// are supplied.
+type OptionError struct {
+	Message string
+}
+
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("invalid disk options: %s", e.Message)
+}
+
+// Options describes on-disk LogStore options.
+type Options struct {
+	// Directory is the root directory under which segment files are stored.
+	// It will be created if it does not exist.
+	Directory string
+	// SyncWrites, when true, causes every write to be flushed to stable
+	// storage (fsync) before it is acknowledged. This trades write
+	// throughput for durability in case of a machine crash.
+	SyncWrites bool
+}
+
+// Validate ensures that the given Options are valid.
+func (opts *Options) Validate() error {
+	if opts.Directory == "" {
+		return &OptionError{"no directory given"}
+	}
+	return nil
+}
+
+func (opts *Options) String() string {
+	return fmt.Sprintf("%+v", *opts)
+}
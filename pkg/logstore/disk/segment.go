@@ -0,0 +1,337 @@
+package disk
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/elastisys/kube-insight-logserver/pkg/logstore"
+)
+
+const (
+	// segmentSuffix is the file name suffix of segment data files.
+	segmentSuffix = ".log"
+	// indexSuffix is the file name suffix of segment index files.
+	indexSuffix = ".idx"
+	// indexEntrySize is the size in bytes of an encoded indexEntry.
+	indexEntrySize = 24
+)
+
+// segmentKey identifies the segment that holds the log entries of a single
+// pod container for a single (UTC) date.
+type segmentKey struct {
+	namespace     string
+	podName       string
+	containerName string
+	date          string
+}
+
+func segmentKeyOf(entry *logstore.LogEntry) segmentKey {
+	return segmentKey{
+		namespace:     entry.Kubernetes.Namespace,
+		podName:       entry.Kubernetes.PodName,
+		containerName: entry.Kubernetes.ContainerName,
+		date:          entry.Time.UTC().Format("2006-01-02"),
+	}
+}
+
+// path returns the path (sans file suffix) of the segment under a given root
+// directory: <root>/<namespace>/<pod>/<container>/<date>.
+func (k segmentKey) path(rootDir string) (string, error) {
+	elems := []string{rootDir}
+	for _, name := range []string{k.namespace, k.podName, k.containerName, k.date} {
+		if name == "" || name == "." || name == ".." {
+			return "", fmt.Errorf("illegal segment path element: '%s'", name)
+		}
+		elems = append(elems, url.PathEscape(name))
+	}
+	return filepath.Join(elems...), nil
+}
+
+// listNamespaces returns the namespaces that have segments under a given root
+// directory.
+func listNamespaces(rootDir string) ([]string, error) {
+	namespaceDirs, err := ioutil.ReadDir(rootDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %s", err)
+	}
+	namespaces := make([]string, 0)
+	for _, namespaceDir := range namespaceDirs {
+		namespace, err := url.PathUnescape(namespaceDir.Name())
+		if !namespaceDir.IsDir() || err != nil {
+			continue
+		}
+		namespaces = append(namespaces, namespace)
+	}
+	return namespaces, nil
+}
+
+// listContainers returns the (date-less) segment keys of all pod containers
+// that have segments in a namespace under a given root directory.
+func listContainers(rootDir, namespace string) ([]segmentKey, error) {
+	if namespace == "" || namespace == "." || namespace == ".." {
+		return nil, fmt.Errorf("illegal segment path element: '%s'", namespace)
+	}
+	namespaceDir := filepath.Join(rootDir, url.PathEscape(namespace))
+	podDirs, err := ioutil.ReadDir(namespaceDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []segmentKey{}, nil
+		}
+		return nil, fmt.Errorf("failed to list pods of namespace: %s", err)
+	}
+
+	keys := make([]segmentKey, 0)
+	for _, podDir := range podDirs {
+		podName, err := url.PathUnescape(podDir.Name())
+		if !podDir.IsDir() || err != nil {
+			continue
+		}
+		containerDirs, err := ioutil.ReadDir(filepath.Join(namespaceDir, podDir.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list containers of pod: %s", err)
+		}
+		for _, containerDir := range containerDirs {
+			containerName, err := url.PathUnescape(containerDir.Name())
+			if !containerDir.IsDir() || err != nil {
+				continue
+			}
+			keys = append(keys, segmentKey{namespace: namespace, podName: podName, containerName: containerName})
+		}
+	}
+	return keys, nil
+}
+
+// indexEntry is a segment's time index record for a single log entry. It
+// locates the encoded log entry in the segment data file.
+type indexEntry struct {
+	// time is the log entry timestamp in nanoseconds since the epoch.
+	time int64
+	// offset is the position of the encoded log entry in the data file.
+	offset int64
+	// length is the size in bytes of the encoded log entry.
+	length int64
+}
+
+// inside returns true if the index entry locates a log entry within a data
+// file of the given size.
+func (e *indexEntry) inside(dataSize int64) bool {
+	return e.offset >= 0 && e.length > 0 && e.offset <= dataSize-e.length
+}
+
+func (e *indexEntry) marshal(buf []byte) {
+	binary.BigEndian.PutUint64(buf[0:8], uint64(e.time))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(e.offset))
+	binary.BigEndian.PutUint64(buf[16:24], uint64(e.length))
+}
+
+func (e *indexEntry) unmarshal(buf []byte) {
+	e.time = int64(binary.BigEndian.Uint64(buf[0:8]))
+	e.offset = int64(binary.BigEndian.Uint64(buf[8:16]))
+	e.length = int64(binary.BigEndian.Uint64(buf[16:24]))
+}
+
+// segment is an append-only pair of files holding the log entries of a
+// single pod container for a single date. Log entries are appended, as JSON,
+// to a data file in arrival order and every appended entry is recorded in an
+// index file that allows the entries within a time interval to be located
+// without scanning the data file.
+//
+// The data file is always written before the index file. Should the process
+// crash between the two, index entries that point past the end of the data
+// file are ignored, and data that is never indexed is simply not visible.
+// Before appending, the index file is repaired: a partially written index
+// entry, and index entries that point past the end of the data file, are cut
+// off, so that later index entries are aligned and do not point at data that
+// is appended later.
+type segment struct {
+	dataPath  string
+	indexPath string
+}
+
+func newSegment(path string) *segment {
+	return &segment{dataPath: path + segmentSuffix, indexPath: path + indexSuffix}
+}
+
+// append writes a collection of log entries to the segment, creating its
+// files if necessary. If sync is true, the files are flushed to stable storage
+// before returning.
+func (s *segment) append(entries []logstore.LogEntry, sync bool) error {
+	if err := os.MkdirAll(filepath.Dir(s.dataPath), 0755); err != nil {
+		return fmt.Errorf("failed to create segment directory: %s", err)
+	}
+
+	dataFile, err := os.OpenFile(s.dataPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open segment data file: %s", err)
+	}
+	defer dataFile.Close()
+	stat, err := dataFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat segment data file: %s", err)
+	}
+
+	indexFile, err := os.OpenFile(s.indexPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open segment index file: %s", err)
+	}
+	defer indexFile.Close()
+	indexSize, err := repairIndex(indexFile, stat.Size())
+	if err != nil {
+		return err
+	}
+
+	offset := stat.Size()
+	data := make([]byte, 0)
+	index := make([]byte, len(entries)*indexEntrySize)
+	for i, entry := range entries {
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to encode log entry: %s", err)
+		}
+		encoded = append(encoded, '\n')
+		data = append(data, encoded...)
+
+		indexEntry := indexEntry{time: entry.Time.UnixNano(), offset: offset, length: int64(len(encoded))}
+		indexEntry.marshal(index[i*indexEntrySize:])
+		offset += int64(len(encoded))
+	}
+
+	if _, err := dataFile.Write(data); err != nil {
+		return fmt.Errorf("failed to write segment data file: %s", err)
+	}
+	if sync {
+		if err := dataFile.Sync(); err != nil {
+			return fmt.Errorf("failed to sync segment data file: %s", err)
+		}
+	}
+
+	if _, err := indexFile.WriteAt(index, indexSize); err != nil {
+		return fmt.Errorf("failed to write segment index file: %s", err)
+	}
+	if sync {
+		if err := indexFile.Sync(); err != nil {
+			return fmt.Errorf("failed to sync segment index file: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// repairIndex cuts off a partially written index entry at the end of an index
+// file, as well as trailing index entries that point past the end of the data
+// file (of a given size), which are left behind when a write is interrupted.
+// Returns the size of the repaired index file.
+func repairIndex(indexFile *os.File, dataSize int64) (int64, error) {
+	stat, err := indexFile.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat segment index file: %s", err)
+	}
+
+	size := stat.Size() - stat.Size()%indexEntrySize
+	buf := make([]byte, indexEntrySize)
+	for size > 0 {
+		if _, err := indexFile.ReadAt(buf, size-indexEntrySize); err != nil {
+			return 0, fmt.Errorf("failed to read segment index file: %s", err)
+		}
+		var e indexEntry
+		e.unmarshal(buf)
+		if e.inside(dataSize) {
+			break
+		}
+		size -= indexEntrySize
+	}
+
+	if size != stat.Size() {
+		if err := indexFile.Truncate(size); err != nil {
+			return 0, fmt.Errorf("failed to repair segment index file: %s", err)
+		}
+	}
+	return size, nil
+}
+
+// exists returns true if the segment has been written to.
+func (s *segment) exists() bool {
+	_, err := os.Stat(s.indexPath)
+	return err == nil
+}
+
+// read returns the segment's log entries with a timestamp in the (inclusive)
+// interval [start, end], ordered by time and entry hash. Just like for a
+// Cassandra partition, there can only be one entry per timestamp and entry
+// hash (see logstore.EntryHash): if several entries share both, the one
+// appended last wins. A segment that does not exist is treated as empty.
+func (s *segment) read(start, end time.Time) ([]logstore.LogEntry, error) {
+	indexBytes, err := ioutil.ReadFile(s.indexPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []logstore.LogEntry{}, nil
+		}
+		return nil, fmt.Errorf("failed to read segment index file: %s", err)
+	}
+
+	dataFile, err := os.Open(s.dataPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open segment data file: %s", err)
+	}
+	defer dataFile.Close()
+	stat, err := dataFile.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat segment data file: %s", err)
+	}
+
+	// collect matching index entries, in the order they were appended
+	matches := make([]indexEntry, 0)
+	startNanos, endNanos := start.UnixNano(), end.UnixNano()
+	for i := 0; i+indexEntrySize <= len(indexBytes); i += indexEntrySize {
+		var e indexEntry
+		e.unmarshal(indexBytes[i:])
+		if !e.inside(stat.Size()) {
+			// torn write: data never made it to disk
+			continue
+		}
+		if e.time >= startNanos && e.time <= endNanos {
+			matches = append(matches, e)
+		}
+	}
+
+	// the entry hash is only known once a log entry is decoded: for each
+	// timestamp and entry hash, keep the log entry appended last
+	latest := make(map[entryKey]int)
+	entries := make([]logstore.LogEntry, 0, len(matches))
+	for _, e := range matches {
+		buf := make([]byte, e.length)
+		if _, err := dataFile.ReadAt(buf, e.offset); err != nil {
+			return nil, fmt.Errorf("failed to read segment data file: %s", err)
+		}
+		var entry logstore.LogEntry
+		if err := json.Unmarshal(buf, &entry); err != nil {
+			return nil, fmt.Errorf("failed to decode log entry at offset %d: %s", e.offset, err)
+		}
+		key := entryKey{time: e.time, hash: logstore.EntryHash(&entry)}
+		if i, ok := latest[key]; ok {
+			entries[i] = entry
+			continue
+		}
+		latest[key] = len(entries)
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return logstore.EntryBefore(entries[i].Time, logstore.EntryHash(&entries[i]),
+			entries[j].Time, logstore.EntryHash(&entries[j]))
+	})
+	return entries, nil
+}
+
+// entryKey identifies a log entry within a segment.
+type entryKey struct {
+	time int64
+	hash int64
+}
@@ -0,0 +1,315 @@
+package memory
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/elastisys/kube-insight-logserver/pkg/log"
+	"github.com/elastisys/kube-insight-logserver/pkg/logstore"
+)
+
+// containerKey identifies the log stream of a single pod container.
+type containerKey struct {
+	namespace     string
+	podName       string
+	containerName string
+}
+
+// LogStore is an in-memory implementation of the LogStore API. It is
+// primarily intended for local development and testing, where running a
+// Cassandra cluster is impractical. Its semantics follow those of the
+// Cassandra LogStore: log entries are keyed on namespace, pod and container
+// and are ordered by time and entry hash (see logstore.EntryHash), a log entry
+// overwrites any prior entry for the same container with an identical
+// timestamp and entry hash, and query intervals include both the start and
+// end time.
+type LogStore struct {
+	options *Options
+
+	// mutex protects the fields below from concurrent access.
+	mutex sync.RWMutex
+	// connected is true between calls to Connect() and Disconnect().
+	connected bool
+	// entries holds the stored log entries for each container, sorted by
+	// time (oldest first) and entry hash.
+	entries map[containerKey][]logstore.LogEntry
+}
+
+// NewLogStore creates a new in-memory LogStore using the specified Options.
+func NewLogStore(options *Options) *LogStore {
+	return &LogStore{
+		options: options,
+		entries: make(map[containerKey][]logstore.LogEntry),
+	}
+}
+
+// Connect prepares the LogStore for use. Any log entries written prior to an
+// earlier Disconnect() are retained.
+func (m *LogStore) Connect() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	log.Infof("using in-memory log store (max entries per container: %d)", m.options.MaxEntries)
+	m.connected = true
+	return nil
+}
+
+// Disconnect makes the LogStore reject any further writes and queries.
+func (m *LogStore) Disconnect() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.connected = false
+	return nil
+}
+
+// Ready returns true if the LogStore has been connected.
+func (m *LogStore) Ready() (bool, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if !m.connected {
+		return false, fmt.Errorf("in-memory log store is not connected")
+	}
+	return true, nil
+}
+
+// Write stores a collection of log entries in memory.
+func (m *LogStore) Write(entries []logstore.LogEntry) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.connected {
+		return fmt.Errorf("write rejected: in-memory log store is not connected")
+	}
+
+	for _, entry := range entries {
+		key := keyOf(&entry)
+		m.entries[key] = m.evict(insertSorted(m.entries[key], entry))
+	}
+
+	return nil
+}
+
+// Query returns the stored log entries that match a given query, ordered by
+// time (newest first for a descending query).
+func (m *LogStore) Query(query *logstore.Query) (*logstore.QueryResult, error) {
+	if query.Descending() || query.Tail > 0 {
+		return logstore.CollectRows(query, m.QueryStream)
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if !m.connected {
+		return nil, fmt.Errorf("query rejected: in-memory log store is not connected")
+	}
+
+	filter, err := query.Filter()
+	if err != nil {
+		return nil, err
+	}
+
+	if query.MultiContainer() {
+		return m.queryContainers(query, filter)
+	}
+
+	key := containerKey{query.Namespace, query.PodName, query.ContainerName}
+	entries := m.entries[key]
+
+	// find first entry that is not earlier than the query start time (or,
+	// when resuming a query, that is later than the last returned entry)
+	first := sort.Search(len(entries), func(i int) bool {
+		return !entries[i].Time.Before(query.StartTime)
+	})
+	if query.NextToken != "" {
+		lastTime, lastHash, err := logstore.DecodeEntryToken(query.NextToken)
+		if err != nil {
+			return nil, err
+		}
+		first = sort.Search(len(entries), func(i int) bool {
+			return !entries[i].Time.Before(query.StartTime) &&
+				logstore.EntryBefore(lastTime, lastHash, entries[i].Time, logstore.EntryHash(&entries[i]))
+		})
+	}
+
+	result := &logstore.QueryResult{LogRows: make([]logstore.LogRow, 0)}
+	for i := first; i < len(entries) && !entries[i].Time.After(query.EndTime); i++ {
+		if query.Limit > 0 && len(result.LogRows) == query.Limit {
+			result.NextToken = logstore.EncodeEntryToken(entries[i-1].Time, logstore.EntryHash(&entries[i-1]))
+			break
+		}
+		row := logstore.LogRow{Time: entries[i].Time, Log: entries[i].Log, Stream: entries[i].Stream}
+		if !filter(&row) {
+			continue
+		}
+		result.LogRows = append(result.LogRows, row)
+	}
+
+	return result, nil
+}
+
+// queryContainers returns the stored log entries of all containers that are
+// selected by a multi-container query, merged by time.
+func (m *LogStore) queryContainers(query *logstore.Query, filter logstore.LogFilter) (*logstore.QueryResult, error) {
+	selector, err := logstore.ParseLabelSelector(query.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &logstore.QueryResult{LogRows: make([]logstore.LogRow, 0)}
+	for key, entries := range m.entries {
+		if key.namespace != query.Namespace || !query.MatchesContainer(key.podName, key.containerName) {
+			continue
+		}
+		first := sort.Search(len(entries), func(i int) bool {
+			return !entries[i].Time.Before(query.StartTime)
+		})
+		for i := first; i < len(entries) && !entries[i].Time.After(query.EndTime); i++ {
+			if !selector.Matches(entries[i].Kubernetes.Labels) {
+				continue
+			}
+			row := logstore.LogRow{
+				Time: entries[i].Time, Log: entries[i].Log, Stream: entries[i].Stream,
+				PodName: key.podName, ContainerName: key.containerName,
+			}
+			if !filter(&row) {
+				continue
+			}
+			result.LogRows = append(result.LogRows, row)
+		}
+	}
+	logstore.SortRows(result.LogRows)
+
+	return result, nil
+}
+
+// QueryStream passes the stored log entries that match a given query, in the
+// order of the query, to a handler. The matching entries are collected up
+// front, so that writes are not blocked by a slow handler.
+func (m *LogStore) QueryStream(query *logstore.Query, handler logstore.LogRowHandler) error {
+	unordered := *query
+	unordered.Limit, unordered.NextToken, unordered.Order, unordered.Tail = 0, "", "", 0
+	result, err := m.Query(&unordered)
+	if err != nil {
+		return err
+	}
+
+	rows := result.LogRows
+	return logstore.OrderedScan(query, func(descending bool, handler logstore.LogRowHandler) error {
+		for i := range rows {
+			row := &rows[i]
+			if descending {
+				row = &rows[len(rows)-1-i]
+			}
+			if err := handler(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, handler)
+}
+
+// Namespaces lists the namespaces with log entries in the interval [start,
+// end].
+func (m *LogStore) Namespaces(start, end time.Time) ([]string, error) {
+	return m.catalog(start, end, func(key containerKey) (string, bool) {
+		return key.namespace, true
+	})
+}
+
+// Pods lists the pods of a namespace with log entries in the interval [start,
+// end].
+func (m *LogStore) Pods(namespace string, start, end time.Time) ([]string, error) {
+	return m.catalog(start, end, func(key containerKey) (string, bool) {
+		return key.podName, key.namespace == namespace
+	})
+}
+
+// Containers lists the containers of a pod with log entries in the interval
+// [start, end].
+func (m *LogStore) Containers(namespace, podName string, start, end time.Time) ([]string, error) {
+	return m.catalog(start, end, func(key containerKey) (string, bool) {
+		return key.containerName, key.namespace == namespace && key.podName == podName
+	})
+}
+
+// catalog collects the (sorted, distinct) names that a name function returns
+// for the containers with log entries in the interval [start, end]. Containers
+// for which the name function returns false are skipped.
+func (m *LogStore) catalog(start, end time.Time, name func(key containerKey) (string, bool)) ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if !m.connected {
+		return nil, fmt.Errorf("query rejected: in-memory log store is not connected")
+	}
+
+	names := make(map[string]struct{})
+	for key, entries := range m.entries {
+		n, ok := name(key)
+		if !ok {
+			continue
+		}
+		first := sort.Search(len(entries), func(i int) bool {
+			return !entries[i].Time.Before(start)
+		})
+		if first < len(entries) && !entries[first].Time.After(end) {
+			names[n] = struct{}{}
+		}
+	}
+	return sortedNames(names), nil
+}
+
+// sortedNames returns the names of a set in sorted order.
+func sortedNames(set map[string]struct{}) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// evict drops the oldest log entries from a container's entries to keep it
+// within the retention cap.
+func (m *LogStore) evict(entries []logstore.LogEntry) []logstore.LogEntry {
+	if m.options.MaxEntries == 0 || len(entries) <= m.options.MaxEntries {
+		return entries
+	}
+
+	excess := len(entries) - m.options.MaxEntries
+	// copy rather than re-slice to allow evicted entries to be garbage
+	// collected
+	n := copy(entries, entries[excess:])
+	return entries[:n]
+}
+
+// insertSorted inserts a log entry into a slice of entries sorted by time and
+// entry hash. An existing entry with the same timestamp and entry hash is
+// overwritten.
+func insertSorted(entries []logstore.LogEntry, entry logstore.LogEntry) []logstore.LogEntry {
+	hash := logstore.EntryHash(&entry)
+	i := sort.Search(len(entries), func(i int) bool {
+		return !logstore.EntryBefore(entries[i].Time, logstore.EntryHash(&entries[i]), entry.Time, hash)
+	})
+	if i < len(entries) && entries[i].Time.Equal(entry.Time) && logstore.EntryHash(&entries[i]) == hash {
+		entries[i] = entry
+		return entries
+	}
+
+	entries = append(entries, logstore.LogEntry{})
+	copy(entries[i+1:], entries[i:])
+	entries[i] = entry
+	return entries
+}
+
+func keyOf(entry *logstore.LogEntry) containerKey {
+	return containerKey{
+		namespace:     entry.Kubernetes.Namespace,
+		podName:       entry.Kubernetes.PodName,
+		containerName: entry.Kubernetes.ContainerName,
+	}
+}
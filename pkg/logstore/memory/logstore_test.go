@@ -0,0 +1,406 @@
+package memory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elastisys/kube-insight-logserver/pkg/logstore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func MustParse(isoTime string) time.Time {
+	t, _ := time.Parse(time.RFC3339, isoTime)
+	return t
+}
+
+func logEntry(podName string, timestamp time.Time, message string) logstore.LogEntry {
+	return logstore.LogEntry{
+		Date: float64(timestamp.UnixNano() / 1.0e9),
+		Kubernetes: logstore.KubernetesMetadata{
+			PodName:       podName,
+			ContainerName: "nginx",
+			Namespace:     "default",
+		},
+		Log:    message,
+		Stream: "stdout",
+		Time:   timestamp,
+	}
+}
+
+func query(podName string, startTime, endTime time.Time) *logstore.Query {
+	return &logstore.Query{
+		Namespace:     "default",
+		PodName:       podName,
+		ContainerName: "nginx",
+		StartTime:     startTime,
+		EndTime:       endTime,
+	}
+}
+
+// connectedLogStore returns a connected LogStore with the given options.
+func connectedLogStore(t *testing.T, options *Options) *LogStore {
+	logStore := NewLogStore(options)
+	require.Nilf(t, logStore.Connect(), "connect not expected to fail")
+	return logStore
+}
+
+// Verify the behavior of Options.Validate()
+func TestOptionValidation(t *testing.T) {
+	assert.Nilf(t, (&Options{MaxEntries: 0}).Validate(), "expected zero MaxEntries to be valid")
+	assert.Nilf(t, (&Options{MaxEntries: 10}).Validate(), "expected positive MaxEntries to be valid")
+
+	err := (&Options{MaxEntries: -1}).Validate()
+	require.NotNilf(t, err, "expected negative MaxEntries to be invalid")
+	assert.Equalf(t, "invalid memory options: MaxEntries must be a non-negative value", err.Error(),
+		"unexpected validation error")
+}
+
+// The LogStore should only be ready (and accept writes and queries) while
+// connected.
+func TestLogStoreReady(t *testing.T) {
+	logStore := NewLogStore(&Options{})
+
+	ready, err := logStore.Ready()
+	assert.False(t, ready, "expected LogStore not to be ready before connect")
+	assert.NotNil(t, err, "expected an error before connect")
+	assert.NotNil(t, logStore.Write([]logstore.LogEntry{}), "expected write to fail before connect")
+
+	require.Nil(t, logStore.Connect())
+	ready, err = logStore.Ready()
+	assert.True(t, ready, "expected LogStore to be ready after connect")
+	assert.Nil(t, err, "expected no error after connect")
+
+	require.Nil(t, logStore.Disconnect())
+	ready, _ = logStore.Ready()
+	assert.False(t, ready, "expected LogStore not to be ready after disconnect")
+	_, err = logStore.Query(query("nginx-abcde", MustParse("2018-01-01T12:00:00Z"), MustParse("2018-01-01T13:00:00Z")))
+	assert.NotNil(t, err, "expected query to fail after disconnect")
+}
+
+// Log entries should be returned in time order regardless of the order in
+// which they were written, and the query interval bounds are inclusive.
+func TestLogStoreQuery(t *testing.T) {
+	logStore := connectedLogStore(t, &Options{})
+
+	err := logStore.Write([]logstore.LogEntry{
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:02:00Z"), "event 3"),
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:00:00Z"), "event 1"),
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:03:00Z"), "event 4"),
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:01:00Z"), "event 2"),
+		// different pod: should not be returned
+		logEntry("nginx-fghij", MustParse("2018-01-01T12:01:00Z"), "other pod"),
+	})
+	require.Nilf(t, err, "unexpected write error")
+
+	result, err := logStore.Query(query("nginx-abcde", MustParse("2018-01-01T12:01:00Z"), MustParse("2018-01-01T12:03:00Z")))
+	require.Nilf(t, err, "unexpected query error")
+	expectedRows := []logstore.LogRow{
+		{Time: MustParse("2018-01-01T12:01:00Z"), Log: "event 2", Stream: "stdout"},
+		{Time: MustParse("2018-01-01T12:02:00Z"), Log: "event 3", Stream: "stdout"},
+		{Time: MustParse("2018-01-01T12:03:00Z"), Log: "event 4", Stream: "stdout"},
+	}
+	assert.Equalf(t, expectedRows, result.LogRows, "unexpected query result")
+
+	// query for which there are no log entries should return an empty result
+	result, err = logStore.Query(query("nginx-abcde", MustParse("2018-01-02T12:00:00Z"), MustParse("2018-01-02T13:00:00Z")))
+	require.Nilf(t, err, "unexpected query error")
+	assert.Equalf(t, []logstore.LogRow{}, result.LogRows, "expected empty query result")
+}
+
+// Only log entries whose message matches the query filters should be
+// returned.
+func TestLogStoreQueryWithFilter(t *testing.T) {
+	logStore := connectedLogStore(t, &Options{})
+
+	err := logStore.Write([]logstore.LogEntry{
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:00:00Z"), "GET /index.html 200"),
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:01:00Z"), "GET /missing.html 404"),
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:02:00Z"), "get /INDEX.html 503"),
+	})
+	require.Nilf(t, err, "unexpected write error")
+
+	q := query("nginx-abcde", MustParse("2018-01-01T12:00:00Z"), MustParse("2018-01-01T13:00:00Z"))
+	q.Contains = "index"
+	q.IgnoreCase = true
+	result, err := logStore.Query(q)
+	require.Nilf(t, err, "unexpected query error")
+	assert.Equalf(t, []logstore.LogRow{
+		{Time: MustParse("2018-01-01T12:00:00Z"), Log: "GET /index.html 200", Stream: "stdout"},
+		{Time: MustParse("2018-01-01T12:02:00Z"), Log: "get /INDEX.html 503", Stream: "stdout"},
+	}, result.LogRows, "unexpected query result")
+
+	q.Regex = " [45][0-9]{2}$"
+	result, err = logStore.Query(q)
+	require.Nilf(t, err, "unexpected query error")
+	assert.Equalf(t, []logstore.LogRow{
+		{Time: MustParse("2018-01-01T12:02:00Z"), Log: "get /INDEX.html 503", Stream: "stdout"},
+	}, result.LogRows, "unexpected query result")
+}
+
+// A query with a limit should be resumable via the continuation token of its
+// result. Filtered out entries should not count towards the limit.
+func TestLogStoreQueryWithLimit(t *testing.T) {
+	logStore := connectedLogStore(t, &Options{})
+
+	err := logStore.Write([]logstore.LogEntry{
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:00:00Z"), "event 1"),
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:01:00Z"), "noise"),
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:02:00Z"), "event 2"),
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:03:00Z"), "event 3"),
+	})
+	require.Nilf(t, err, "unexpected write error")
+
+	q := query("nginx-abcde", MustParse("2018-01-01T12:00:00Z"), MustParse("2018-01-01T13:00:00Z"))
+	q.Contains = "event"
+	q.Limit = 2
+	result, err := logStore.Query(q)
+	require.Nilf(t, err, "unexpected query error")
+	assert.Equalf(t, []logstore.LogRow{
+		{Time: MustParse("2018-01-01T12:00:00Z"), Log: "event 1", Stream: "stdout"},
+		{Time: MustParse("2018-01-01T12:02:00Z"), Log: "event 2", Stream: "stdout"},
+	}, result.LogRows, "unexpected first page")
+	require.NotEmptyf(t, result.NextToken, "expected a continuation token")
+
+	q.NextToken = result.NextToken
+	result, err = logStore.Query(q)
+	require.Nilf(t, err, "unexpected query error")
+	assert.Equalf(t, []logstore.LogRow{
+		{Time: MustParse("2018-01-01T12:03:00Z"), Log: "event 3", Stream: "stdout"},
+	}, result.LogRows, "unexpected second page")
+	assert.Emptyf(t, result.NextToken, "expected no continuation token on last page")
+}
+
+// A query by pod name prefix or label selector should merge the entries of all
+// selected containers by time and tag each row with its origin.
+func TestLogStoreQueryAcrossContainers(t *testing.T) {
+	logStore := connectedLogStore(t, &Options{})
+
+	withLabels := func(entry logstore.LogEntry, labels map[string]string) logstore.LogEntry {
+		entry.Kubernetes.Labels = labels
+		return entry
+	}
+	nginxLabels := map[string]string{"app": "nginx"}
+	sidecar := withLabels(logEntry("nginx-abcde", MustParse("2018-01-01T12:01:00Z"), "sidecar event"), nginxLabels)
+	sidecar.Kubernetes.ContainerName = "sidecar"
+	err := logStore.Write([]logstore.LogEntry{
+		withLabels(logEntry("nginx-abcde", MustParse("2018-01-01T12:00:00Z"), "event 1"), nginxLabels),
+		withLabels(logEntry("nginx-fghij", MustParse("2018-01-01T12:02:00Z"), "event 2"), nginxLabels),
+		sidecar,
+		withLabels(logEntry("redis-abcde", MustParse("2018-01-01T12:00:30Z"), "redis event"), map[string]string{"app": "redis"}),
+	})
+	require.Nilf(t, err, "unexpected write error")
+
+	q := &logstore.Query{
+		Namespace:     "default",
+		LabelSelector: "app=nginx",
+		StartTime:     MustParse("2018-01-01T12:00:00Z"),
+		EndTime:       MustParse("2018-01-01T13:00:00Z"),
+	}
+	result, err := logStore.Query(q)
+	require.Nilf(t, err, "unexpected query error")
+	assert.Equalf(t, []logstore.LogRow{
+		{Time: MustParse("2018-01-01T12:00:00Z"), Log: "event 1", Stream: "stdout", PodName: "nginx-abcde", ContainerName: "nginx"},
+		{Time: MustParse("2018-01-01T12:01:00Z"), Log: "sidecar event", Stream: "stdout", PodName: "nginx-abcde", ContainerName: "sidecar"},
+		{Time: MustParse("2018-01-01T12:02:00Z"), Log: "event 2", Stream: "stdout", PodName: "nginx-fghij", ContainerName: "nginx"},
+	}, result.LogRows, "unexpected query result")
+
+	// pod name prefix narrowed down to a single container name
+	q = &logstore.Query{
+		Namespace:     "default",
+		PodNamePrefix: "nginx-",
+		ContainerName: "nginx",
+		StartTime:     MustParse("2018-01-01T12:00:00Z"),
+		EndTime:       MustParse("2018-01-01T13:00:00Z"),
+	}
+	result, err = logStore.Query(q)
+	require.Nilf(t, err, "unexpected query error")
+	assert.Equalf(t, []logstore.LogRow{
+		{Time: MustParse("2018-01-01T12:00:00Z"), Log: "event 1", Stream: "stdout", PodName: "nginx-abcde", ContainerName: "nginx"},
+		{Time: MustParse("2018-01-01T12:02:00Z"), Log: "event 2", Stream: "stdout", PodName: "nginx-fghij", ContainerName: "nginx"},
+	}, result.LogRows, "unexpected query result")
+}
+
+// The catalog should list the namespaces, pods and containers with log entries
+// in a time interval.
+func TestLogStoreCatalog(t *testing.T) {
+	logStore := connectedLogStore(t, &Options{})
+
+	sidecar := logEntry("nginx-abcde", MustParse("2018-01-01T12:00:00Z"), "sidecar event")
+	sidecar.Kubernetes.ContainerName = "sidecar"
+	otherNamespace := logEntry("coredns-abcde", MustParse("2018-01-01T12:30:00Z"), "dns event")
+	otherNamespace.Kubernetes.Namespace = "kube-system"
+	err := logStore.Write([]logstore.LogEntry{
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:00:00Z"), "event 1"),
+		logEntry("nginx-fghij", MustParse("2018-01-01T14:00:00Z"), "event 2"),
+		sidecar,
+		otherNamespace,
+	})
+	require.Nilf(t, err, "unexpected write error")
+
+	start, end := MustParse("2018-01-01T11:00:00Z"), MustParse("2018-01-01T13:00:00Z")
+	namespaces, err := logStore.Namespaces(start, end)
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, []string{"default", "kube-system"}, namespaces, "unexpected namespaces")
+
+	pods, err := logStore.Pods("default", start, end)
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, []string{"nginx-abcde"}, pods, "unexpected pods")
+	pods, err = logStore.Pods("default", start, MustParse("2018-01-01T15:00:00Z"))
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, []string{"nginx-abcde", "nginx-fghij"}, pods, "unexpected pods")
+
+	containers, err := logStore.Containers("default", "nginx-abcde", start, end)
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, []string{"nginx", "sidecar"}, containers, "unexpected containers")
+
+	containers, err = logStore.Containers("default", "unknown", start, end)
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, []string{}, containers, "expected no containers")
+}
+
+// QueryStream should pass the matching entries to the handler, in time order,
+// ignoring pagination.
+func TestLogStoreQueryStream(t *testing.T) {
+	logStore := connectedLogStore(t, &Options{})
+
+	err := logStore.Write([]logstore.LogEntry{
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:01:00Z"), "event 2"),
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:00:00Z"), "event 1"),
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:02:00Z"), "event 3"),
+	})
+	require.Nilf(t, err, "unexpected write error")
+
+	q := query("nginx-abcde", MustParse("2018-01-01T12:00:00Z"), MustParse("2018-01-01T13:00:00Z"))
+	q.Limit = 1
+	streamed := []string{}
+	err = logStore.QueryStream(q, func(row *logstore.LogRow) error {
+		streamed = append(streamed, row.Log)
+		return nil
+	})
+	require.Nilf(t, err, "unexpected query error")
+	assert.Equalf(t, []string{"event 1", "event 2", "event 3"}, streamed, "unexpected streamed rows")
+}
+
+// A descending query should return the newest entries first, and a tail query
+// should only return the latest entries.
+func TestLogStoreQueryLatest(t *testing.T) {
+	logStore := connectedLogStore(t, &Options{})
+
+	err := logStore.Write([]logstore.LogEntry{
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:00:00Z"), "event 1"),
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:01:00Z"), "event 2"),
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:02:00Z"), "noise"),
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:03:00Z"), "event 3"),
+	})
+	require.Nilf(t, err, "unexpected write error")
+
+	tests := []struct {
+		order    string
+		tail     int
+		expected []string
+	}{
+		{order: "desc", expected: []string{"event 3", "event 2", "event 1"}},
+		{tail: 2, expected: []string{"event 2", "event 3"}},
+		{order: "desc", tail: 2, expected: []string{"event 3", "event 2"}},
+		{tail: 10, expected: []string{"event 1", "event 2", "event 3"}},
+	}
+	for _, test := range tests {
+		q := query("nginx-abcde", MustParse("2018-01-01T12:00:00Z"), MustParse("2018-01-01T13:00:00Z"))
+		q.Contains = "event"
+		q.Order, q.Tail = test.order, test.tail
+		result, err := logStore.Query(q)
+		require.Nilf(t, err, "unexpected query error")
+		messages := []string{}
+		for _, row := range result.LogRows {
+			messages = append(messages, row.Log)
+		}
+		assert.Equalf(t, test.expected, messages, "unexpected result for order=%s, tail=%d", test.order, test.tail)
+	}
+}
+
+// Just like for Cassandra, a log entry with the same timestamp and content as
+// an already stored entry should overwrite it, while log entries with the same
+// timestamp but different content should all be kept.
+func TestLogStoreWriteWithSameTime(t *testing.T) {
+	logStore := connectedLogStore(t, &Options{})
+
+	retried := logEntry("nginx-abcde", MustParse("2018-01-01T12:00:00Z"), "event 1")
+	retried.Kubernetes.Host = "worker2"
+	require.Nil(t, logStore.Write([]logstore.LogEntry{
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:00:00Z"), "event 1"),
+	}))
+	require.Nil(t, logStore.Write([]logstore.LogEntry{
+		retried,
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:00:00Z"), "event 2"),
+	}))
+
+	result, err := logStore.Query(query("nginx-abcde", MustParse("2018-01-01T11:00:00Z"), MustParse("2018-01-01T13:00:00Z")))
+	require.Nilf(t, err, "unexpected query error")
+	assert.ElementsMatchf(t, []logstore.LogRow{
+		{Time: MustParse("2018-01-01T12:00:00Z"), Log: "event 1", Stream: "stdout"},
+		{Time: MustParse("2018-01-01T12:00:00Z"), Log: "event 2", Stream: "stdout"},
+	}, result.LogRows, "unexpected query result")
+	for _, entry := range logStore.entries[keyOf(&retried)] {
+		if entry.Log == retried.Log {
+			assert.Equalf(t, "worker2", entry.Kubernetes.Host, "expected retried entry to overwrite the stored one")
+		}
+	}
+}
+
+// A page boundary that falls between log entries with the same timestamp
+// should neither skip nor repeat any of them.
+func TestLogStoreQueryWithLimitOnSameTime(t *testing.T) {
+	logStore := connectedLogStore(t, &Options{})
+
+	require.Nil(t, logStore.Write([]logstore.LogEntry{
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:00:00Z"), "event 1"),
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:00:00Z"), "event 2"),
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:00:00Z"), "event 3"),
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:01:00Z"), "event 4"),
+	}))
+
+	q := query("nginx-abcde", MustParse("2018-01-01T12:00:00Z"), MustParse("2018-01-01T13:00:00Z"))
+	all, err := logStore.Query(q)
+	require.Nilf(t, err, "unexpected query error")
+	require.Equalf(t, 4, len(all.LogRows), "unexpected number of log rows")
+
+	q.Limit = 2
+	paged := make([]logstore.LogRow, 0)
+	for {
+		result, err := logStore.Query(q)
+		require.Nilf(t, err, "unexpected query error")
+		paged = append(paged, result.LogRows...)
+		if result.NextToken == "" {
+			break
+		}
+		q.NextToken = result.NextToken
+	}
+	assert.Equalf(t, all.LogRows, paged, "expected pages to hold all log rows in order")
+}
+
+// When the retention cap is reached, the oldest entries should be evicted.
+func TestLogStoreRetentionCap(t *testing.T) {
+	logStore := connectedLogStore(t, &Options{MaxEntries: 2})
+
+	require.Nil(t, logStore.Write([]logstore.LogEntry{
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:00:00Z"), "event 1"),
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:01:00Z"), "event 2"),
+		logEntry("nginx-abcde", MustParse("2018-01-01T12:02:00Z"), "event 3"),
+		// cap is enforced per container
+		logEntry("nginx-fghij", MustParse("2018-01-01T12:00:00Z"), "other pod"),
+	}))
+
+	result, err := logStore.Query(query("nginx-abcde", MustParse("2018-01-01T11:00:00Z"), MustParse("2018-01-01T13:00:00Z")))
+	require.Nilf(t, err, "unexpected query error")
+	expectedRows := []logstore.LogRow{
+		{Time: MustParse("2018-01-01T12:01:00Z"), Log: "event 2", Stream: "stdout"},
+		{Time: MustParse("2018-01-01T12:02:00Z"), Log: "event 3", Stream: "stdout"},
+	}
+	assert.Equalf(t, expectedRows, result.LogRows, "unexpected query result")
+
+	result, err = logStore.Query(query("nginx-fghij", MustParse("2018-01-01T11:00:00Z"), MustParse("2018-01-01T13:00:00Z")))
+	require.Nilf(t, err, "unexpected query error")
+	assert.Equalf(t, 1, len(result.LogRows), "unexpected query result")
+}
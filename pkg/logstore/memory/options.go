@@ -0,0 +1,34 @@
+package memory
+
+import "fmt"
+
+// OptionError is returned when an invalid set of in-memory LogStore Options
+// are supplied.
+type OptionError struct {
+	Message string
+}
+
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("invalid memory options: %s", e.Message)
+}
+
+// Options describes in-memory LogStore options.
+type Options struct {
+	// MaxEntries is the retention cap of the LogStore: the maximum number of
+	// log entries to keep for each (namespace, pod, container). Once the
+	// cap is reached, the oldest log entries are evicted to make room for
+	// new ones. A value of zero means that no cap is enforced.
+	MaxEntries int
+}
+
+// Validate ensures that the given Options are valid.
+func (opts *Options) Validate() error {
+	if opts.MaxEntries < 0 {
+		return &OptionError{"MaxEntries must be a non-negative value"}
+	}
+	return nil
+}
+
+func (opts *Options) String() string {
+	return fmt.Sprintf("%+v", *opts)
+}
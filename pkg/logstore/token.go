@@ -0,0 +1,43 @@
+package logstore
+
+import (
+	"encoding/base64"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EncodeEntryToken encodes the time and entry hash (see EntryHash) of the
+// last returned LogRow of a page into an opaque continuation token. It is
+// intended for LogStores that order the log entries of a container by time
+// and entry hash (see EntryBefore), where the next page simply starts after
+// that log entry, even if it has the same timestamp.
+func EncodeEntryToken(lastTime time.Time, lastHash int64) string {
+	token := lastTime.UTC().Format(time.RFC3339Nano) + " " + strconv.FormatInt(lastHash, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(token))
+}
+
+// DecodeEntryToken decodes a continuation token created by EncodeEntryToken.
+// Tokens without an entry hash (created before entry hashes were introduced)
+// resume after all log entries with the given time. A QueryError is returned
+// for a malformed token.
+func DecodeEntryToken(token string) (time.Time, int64, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return time.Time{}, 0, QueryError("query parameter next_token: malformed token")
+	}
+	parts := strings.SplitN(string(decoded), " ", 2)
+	lastTime, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, 0, QueryError("query parameter next_token: malformed token")
+	}
+	if len(parts) == 1 {
+		return lastTime, math.MaxInt64, nil
+	}
+	lastHash, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, QueryError("query parameter next_token: malformed token")
+	}
+	return lastTime, lastHash, nil
+}
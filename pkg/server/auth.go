@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/elastisys/kube-insight-logserver/pkg/auth"
+	"github.com/elastisys/kube-insight-logserver/pkg/log"
+	"github.com/elastisys/kube-insight-logserver/pkg/logstore"
+)
+
+// principalKey is the request context key under which the authenticated
+// Principal is stored.
+type principalKey struct{}
+
+// principalOf returns the authenticated Principal of a request, or nil if
+// authentication is disabled.
+func principalOf(r *http.Request) *auth.Principal {
+	principal, _ := r.Context().Value(principalKey{}).(*auth.Principal)
+	return principal
+}
+
+// authenticate is a middleware that requires every request (except for the
+// GET /write health probe) to carry a bearer token recognized by the
+// configured Authenticator. The Principal that the token belongs to is made
+// available to handlers via principalOf.
+func (s *HTTPServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && r.URL.Path == "/write" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			s.unauthorized(w, "a bearer token is required")
+			return
+		}
+		token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+
+		principal, err := s.config.Authenticator.Authenticate(token)
+		if err != nil {
+			log.Errorf("failed to authenticate request: %s", err)
+			s.errorResponse(w, http.StatusServiceUnavailable,
+				logstore.APIError{Message: "authentication failed", Detail: err.Error()})
+			return
+		}
+		if principal == nil {
+			s.unauthorized(w, "invalid bearer token")
+			return
+		}
+
+		log.Debugf("authenticated request from %s", principal)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	})
+}
+
+// authorized returns true if the principal of a request is allowed to perform
+// a verb on a namespace. Without a configured Authorizer, every authenticated
+// principal is allowed everything.
+func (s *HTTPServer) authorized(r *http.Request, verb auth.Verb, namespace string) bool {
+	if s.config.Authorizer == nil {
+		return true
+	}
+	principal := principalOf(r)
+	if principal == nil {
+		return false
+	}
+	return s.config.Authorizer.Authorize(principal, verb, namespace)
+}
+
+func (s *HTTPServer) unauthorized(w http.ResponseWriter, detail string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="kube-insight-logserver"`)
+	s.errorResponse(w, http.StatusUnauthorized,
+		logstore.APIError{Message: "unauthorized", Detail: detail})
+}
+
+func (s *HTTPServer) forbidden(w http.ResponseWriter, verb auth.Verb, namespace string) {
+	s.errorResponse(w, http.StatusForbidden,
+		logstore.APIError{Message: "forbidden", Detail: "not allowed to " + string(verb) + " namespace " + namespace})
+}
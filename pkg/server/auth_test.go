@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/elastisys/kube-insight-logserver/pkg/auth"
+	"github.com/elastisys/kube-insight-logserver/pkg/logstore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// newAuthTestServer creates a HTTPServer that authenticates the tokens
+// "writer-token" (may write any namespace) and "reader-token" (may only read
+// the "default" namespace).
+func newAuthTestServer(t *testing.T, logStore logstore.LogStore) *HTTPServer {
+	authorizer, err := auth.NewRuleAuthorizer([]auth.Rule{
+		{Users: []string{"writer"}, Verbs: []auth.Verb{auth.WriteVerb}, Namespaces: []string{"*"}},
+		{Groups: []string{"readers"}, Verbs: []auth.Verb{auth.ReadVerb}, Namespaces: []string{"default"}},
+	})
+	require.Nil(t, err)
+	return NewHTTP(&Config{
+		BindAddress: "127.0.0.1:8080",
+		Authenticator: auth.NewStaticTokenAuthenticator(map[string]*auth.Principal{
+			"writer-token": {Name: "writer"},
+			"reader-token": {Name: "reader", Groups: []string{"readers"}},
+		}),
+		Authorizer: authorizer,
+	}, logStore)
+}
+
+func doRequest(t *testing.T, method, url, token string, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.Nil(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	return resp
+}
+
+// With an authenticator configured, requests without a valid bearer token
+// should be rejected with 401, except for the health probe.
+func TestAuthenticationRequired(t *testing.T) {
+	mockLogStore := new(MockedLogStore)
+	server := newAuthTestServer(t, mockLogStore)
+	testServer := httptest.NewServer(server.server.Handler)
+	defer testServer.Close()
+
+	// set up mock expectations
+	mockLogStore.On("Ready").Return(true, nil)
+
+	// make calls
+	resp := doRequest(t, "POST", testServer.URL+"/write", "", "[]")
+	assert.Equalf(t, http.StatusUnauthorized, resp.StatusCode, "unexpected response code")
+	assert.Equalf(t, `Bearer realm="kube-insight-logserver"`, resp.Header.Get("WWW-Authenticate"), "unexpected challenge")
+	assert.Equalf(t, `{"message":"unauthorized","detail":"a bearer token is required"}`, readBody(t, resp), "unexpected response")
+
+	resp = doRequest(t, "GET", testServer.URL+"/metrics", "bogus-token", "")
+	assert.Equalf(t, http.StatusUnauthorized, resp.StatusCode, "unexpected response code")
+	assert.Equalf(t, `{"message":"unauthorized","detail":"invalid bearer token"}`, readBody(t, resp), "unexpected response")
+
+	resp = doRequest(t, "GET", testServer.URL+"/write", "", "")
+	assert.Equalf(t, http.StatusOK, resp.StatusCode, "health probe should not require authentication")
+}
+
+// POST /write should only accept log entries for namespaces that the client
+// is allowed to write to.
+func TestPostWriteAuthorization(t *testing.T) {
+	mockLogStore := new(MockedLogStore)
+	server := newAuthTestServer(t, mockLogStore)
+	testServer := httptest.NewServer(server.server.Handler)
+	defer testServer.Close()
+
+	logsToWrite := []logstore.LogEntry{logEntry(MustParse("2018-01-01T12:00:00.000Z"), "event 1")}
+	jsonBytes, _ := json.Marshal(logsToWrite)
+
+	// set up mock expectations
+	mockLogStore.On("Ready").Return(true, nil)
+	mockLogStore.On("Write", logsToWrite).Return(nil)
+
+	// make calls
+	resp := doRequest(t, "POST", testServer.URL+"/write", "reader-token", string(jsonBytes))
+	assert.Equalf(t, http.StatusForbidden, resp.StatusCode, "unexpected response code")
+	assert.Equalf(t, `{"message":"forbidden","detail":"not allowed to write namespace default"}`, readBody(t, resp), "unexpected response")
+
+	resp = doRequest(t, "POST", testServer.URL+"/write", "writer-token", string(jsonBytes))
+	assert.Equalf(t, http.StatusOK, resp.StatusCode, "unexpected response code")
+
+	// verify that the forbidden write never reached the LogStore
+	mockLogStore.AssertNumberOfCalls(t, "Write", 1)
+}
+
+// GET /query should only be allowed for namespaces that the client is
+// allowed to read.
+func TestGetQueryAuthorization(t *testing.T) {
+	mockLogStore := new(MockedLogStore)
+	server := newAuthTestServer(t, mockLogStore)
+	testServer := httptest.NewServer(server.server.Handler)
+	defer testServer.Close()
+
+	queryURL := func(namespace string) string {
+		values := url.Values{}
+		addQueryParams(&values, map[string]string{
+			"namespace":      namespace,
+			"pod_name":       "nginx-deployment-abcde",
+			"container_name": "nginx",
+			"start_time":     "2018-01-01T12:00:00.000Z",
+			"end_time":       "2018-01-01T13:00:00.000Z",
+		})
+		return testServer.URL + "/query?" + values.Encode()
+	}
+
+	// set up mock expectations
+	mockLogStore.On("Ready").Return(true, nil)
+	mockLogStore.On("Query", mock.Anything).Return(&logstore.QueryResult{LogRows: []logstore.LogRow{}}, nil)
+
+	// make calls
+	resp := doRequest(t, "GET", queryURL("default"), "reader-token", "")
+	assert.Equalf(t, http.StatusOK, resp.StatusCode, "unexpected response code")
+
+	resp = doRequest(t, "GET", queryURL("kube-system"), "reader-token", "")
+	assert.Equalf(t, http.StatusForbidden, resp.StatusCode, "unexpected response code")
+	assert.Equalf(t, `{"message":"forbidden","detail":"not allowed to read namespace kube-system"}`, readBody(t, resp), "unexpected response")
+
+	resp = doRequest(t, "GET", queryURL("default"), "writer-token", "")
+	assert.Equalf(t, http.StatusForbidden, resp.StatusCode, "unexpected response code")
+
+	mockLogStore.AssertNumberOfCalls(t, "Query", 1)
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/elastisys/kube-insight-logserver/pkg/auth"
+	"github.com/elastisys/kube-insight-logserver/pkg/logstore"
+	"github.com/gorilla/mux"
+)
+
+// namespacesGetHandler responds to GET /namespaces by listing the namespaces
+// with log entries in a time interval. Only namespaces that the client is
+// allowed to read are listed.
+func (s *HTTPServer) namespacesGetHandler(w http.ResponseWriter, r *http.Request) {
+	start, end, ok := s.catalogInterval(w, r)
+	if !ok {
+		return
+	}
+
+	namespaces, err := s.logStore.Namespaces(start, end)
+	if err != nil {
+		s.errorResponse(w, http.StatusInternalServerError,
+			logstore.APIError{Message: "catalog query error", Detail: err.Error()})
+		return
+	}
+	readable := make([]string, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		if s.authorized(r, auth.ReadVerb, namespace) {
+			readable = append(readable, namespace)
+		}
+	}
+	s.catalogResponse(w, map[string][]string{"namespaces": readable})
+}
+
+// podsGetHandler responds to GET /namespaces/{namespace}/pods by listing the
+// pods of a namespace with log entries in a time interval.
+func (s *HTTPServer) podsGetHandler(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+	if !s.authorized(r, auth.ReadVerb, namespace) {
+		s.forbidden(w, auth.ReadVerb, namespace)
+		return
+	}
+	start, end, ok := s.catalogInterval(w, r)
+	if !ok {
+		return
+	}
+
+	pods, err := s.logStore.Pods(namespace, start, end)
+	if err != nil {
+		s.errorResponse(w, http.StatusInternalServerError,
+			logstore.APIError{Message: "catalog query error", Detail: err.Error()})
+		return
+	}
+	s.catalogResponse(w, map[string][]string{"pods": pods})
+}
+
+// containersGetHandler responds to GET
+// /namespaces/{namespace}/pods/{pod}/containers by listing the containers of
+// a pod with log entries in a time interval.
+func (s *HTTPServer) containersGetHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, pod := mux.Vars(r)["namespace"], mux.Vars(r)["pod"]
+	if !s.authorized(r, auth.ReadVerb, namespace) {
+		s.forbidden(w, auth.ReadVerb, namespace)
+		return
+	}
+	start, end, ok := s.catalogInterval(w, r)
+	if !ok {
+		return
+	}
+
+	containers, err := s.logStore.Containers(namespace, pod, start, end)
+	if err != nil {
+		s.errorResponse(w, http.StatusInternalServerError,
+			logstore.APIError{Message: "catalog query error", Detail: err.Error()})
+		return
+	}
+	s.catalogResponse(w, map[string][]string{"containers": containers})
+}
+
+// maxCatalogSpan is the longest time interval of a catalog request. Log stores
+// look up the catalog one date at a time, so the span bounds the number of
+// lookups that a single request can cause.
+const maxCatalogSpan = 366 * 24 * time.Hour
+
+// catalogInterval parses and validates the time interval of a catalog request
+// and checks that the LogStore is ready. On failure, an error response is
+// written and false is returned.
+func (s *HTTPServer) catalogInterval(w http.ResponseWriter, r *http.Request) (start, end time.Time, ok bool) {
+	start, end, err := intervalFromRequest(r)
+	if err == nil && !start.Before(end) {
+		err = logstore.QueryError("query time-interval: start_time must be earlier than end_time")
+	}
+	if err == nil && end.Sub(start) > maxCatalogSpan {
+		err = logstore.QueryError(fmt.Sprintf("query time-interval: may span at most %d days",
+			maxCatalogSpan/(24*time.Hour)))
+	}
+	if err != nil {
+		s.errorResponse(w, http.StatusBadRequest,
+			logstore.APIError{Message: "invalid query", Detail: err.Error()})
+		return start, end, false
+	}
+
+	if _, err := s.logStore.Ready(); err != nil {
+		s.errorResponse(w, http.StatusServiceUnavailable,
+			logstore.APIError{Message: "data store is not ready", Detail: err.Error()})
+		return start, end, false
+	}
+	return start, end, true
+}
+
+func (s *HTTPServer) catalogResponse(w http.ResponseWriter, result map[string][]string) {
+	bytes, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		s.errorResponse(w, http.StatusInternalServerError,
+			logstore.APIError{Message: "failed to serialize response", Detail: err.Error()})
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
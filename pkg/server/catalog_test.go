@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// GET /namespaces, /namespaces/{namespace}/pods and
+// /namespaces/{namespace}/pods/{pod}/containers should list the names that
+// the LogStore catalog holds for the requested time interval.
+func TestGetCatalog(t *testing.T) {
+	// set up test server and mocked LogStore
+	mockLogStore := new(MockedLogStore)
+	server := newTestServer(mockLogStore)
+	testServer := httptest.NewServer(server.server.Handler)
+	defer testServer.Close()
+	client := testServer.Client()
+
+	start, end := MustParse("2018-01-01T00:00:00Z"), MustParse("2018-01-02T00:00:00Z")
+	interval := "start_time=2018-01-01T00:00:00Z&end_time=2018-01-02T00:00:00Z"
+
+	//
+	// set up mock expectations
+	//
+	mockLogStore.On("Ready").Return(true, nil)
+	mockLogStore.On("Namespaces", start, end).Return([]string{"default", "kube-system"}, nil)
+	mockLogStore.On("Pods", "default", start, end).Return([]string{"nginx-abcde", "nginx-fghij"}, nil)
+	mockLogStore.On("Containers", "default", "nginx-abcde", start, end).Return([]string{"nginx"}, nil)
+
+	//
+	// make calls
+	//
+	resp, _ := client.Get(testServer.URL + "/namespaces?" + interval)
+	assert.Equalf(t, http.StatusOK, resp.StatusCode, "unexpected response code")
+	assert.JSONEqf(t, `{"namespaces": ["default", "kube-system"]}`, readBody(t, resp), "unexpected response")
+
+	resp, _ = client.Get(testServer.URL + "/namespaces/default/pods?" + interval)
+	assert.Equalf(t, http.StatusOK, resp.StatusCode, "unexpected response code")
+	assert.JSONEqf(t, `{"pods": ["nginx-abcde", "nginx-fghij"]}`, readBody(t, resp), "unexpected response")
+
+	resp, _ = client.Get(testServer.URL + "/namespaces/default/pods/nginx-abcde/containers?" + interval)
+	assert.Equalf(t, http.StatusOK, resp.StatusCode, "unexpected response code")
+	assert.JSONEqf(t, `{"containers": ["nginx"]}`, readBody(t, resp), "unexpected response")
+
+	// verify that expected calls were made
+	mockLogStore.AssertExpectations(t)
+}
+
+// Catalog requests with an invalid time interval should be rejected with 400
+// (Bad Request), and LogStore errors should result in 500.
+func TestGetCatalogOnError(t *testing.T) {
+	// set up test server and mocked LogStore
+	mockLogStore := new(MockedLogStore)
+	server := newTestServer(mockLogStore)
+	testServer := httptest.NewServer(server.server.Handler)
+	defer testServer.Close()
+	client := testServer.Client()
+
+	//
+	// set up mock expectations
+	//
+	mockLogStore.On("Ready").Return(true, nil)
+	start, end := MustParse("2018-01-01T00:00:00Z"), MustParse("2018-01-02T00:00:00Z")
+	mockLogStore.On("Namespaces", start, end).Return(nil, fmt.Errorf("connection refused"))
+
+	//
+	// make calls
+	//
+	resp, _ := client.Get(testServer.URL + "/namespaces")
+	assert.Equalf(t, http.StatusBadRequest, resp.StatusCode, "unexpected response code")
+	assert.Equalf(t, `{"message":"invalid query","detail":"missing query parameter: start_time"}`,
+		readBody(t, resp), "unexpected response")
+
+	resp, _ = client.Get(testServer.URL + "/namespaces?start_time=2018-01-02T00:00:00Z&end_time=2018-01-01T00:00:00Z")
+	assert.Equalf(t, http.StatusBadRequest, resp.StatusCode, "unexpected response code")
+	assert.Equalf(t, `{"message":"invalid query","detail":"query time-interval: start_time must be earlier than end_time"}`,
+		readBody(t, resp), "unexpected response")
+
+	resp, _ = client.Get(testServer.URL + "/namespaces?start_time=0001-01-01T00:00:00Z&end_time=2018-01-01T00:00:00Z")
+	assert.Equalf(t, http.StatusBadRequest, resp.StatusCode, "unexpected response code")
+	assert.Equalf(t, `{"message":"invalid query","detail":"query time-interval: may span at most 366 days"}`,
+		readBody(t, resp), "unexpected response")
+
+	resp, _ = client.Get(testServer.URL + "/namespaces?start_time=2018-01-01T00:00:00Z&end_time=2018-01-02T00:00:00Z")
+	assert.Equalf(t, http.StatusInternalServerError, resp.StatusCode, "unexpected response code")
+	assert.Equalf(t, `{"message":"catalog query error","detail":"connection refused"}`,
+		readBody(t, resp), "unexpected response")
+
+	// verify that expected calls were made
+	mockLogStore.AssertExpectations(t)
+}
+
+// Catalog requests should only reveal the namespaces that the client is
+// allowed to read.
+func TestGetCatalogAuthorization(t *testing.T) {
+	mockLogStore := new(MockedLogStore)
+	server := newAuthTestServer(t, mockLogStore)
+	testServer := httptest.NewServer(server.server.Handler)
+	defer testServer.Close()
+
+	start, end := MustParse("2018-01-01T00:00:00Z"), MustParse("2018-01-02T00:00:00Z")
+	interval := "start_time=2018-01-01T00:00:00Z&end_time=2018-01-02T00:00:00Z"
+
+	// set up mock expectations
+	mockLogStore.On("Ready").Return(true, nil)
+	mockLogStore.On("Namespaces", start, end).Return([]string{"default", "kube-system"}, nil)
+
+	// make calls
+	resp := doRequest(t, "GET", testServer.URL+"/namespaces?"+interval, "reader-token", "")
+	assert.Equalf(t, http.StatusOK, resp.StatusCode, "unexpected response code")
+	assert.JSONEqf(t, `{"namespaces": ["default"]}`, readBody(t, resp), "unexpected response")
+
+	resp = doRequest(t, "GET", testServer.URL+"/namespaces/kube-system/pods?"+interval, "reader-token", "")
+	assert.Equalf(t, http.StatusForbidden, resp.StatusCode, "unexpected response code")
+
+	resp = doRequest(t, "GET", testServer.URL+"/namespaces/kube-system/pods/coredns-abcde/containers?"+interval, "reader-token", "")
+	assert.Equalf(t, http.StatusForbidden, resp.StatusCode, "unexpected response code")
+
+	// verify that expected calls were made
+	mockLogStore.AssertExpectations(t)
+}
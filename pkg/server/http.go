@@ -2,14 +2,20 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/pprof"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/elastisys/kube-insight-logserver/pkg/auth"
 	"github.com/elastisys/kube-insight-logserver/pkg/log"
 	"github.com/elastisys/kube-insight-logserver/pkg/logstore"
+	"github.com/elastisys/kube-insight-logserver/pkg/spool"
 	"github.com/gorilla/mux"
 )
 
@@ -22,13 +28,72 @@ type Config struct {
 	// endpoints that, for example, can be queried with
 	//    go tool pprof <binary> http://<host>:<port>/debug/pprof/heap
 	EnableProfiling bool
+
+	// TLSCertPath is the path to a PEM-encoded server certificate. When
+	// given (together with TLSKeyPath), the server serves HTTPS. The
+	// certificate is reloaded whenever it is modified on disk.
+	TLSCertPath string
+	// TLSKeyPath is the path to the PEM-encoded private key of the server
+	// certificate.
+	TLSKeyPath string
+	// TLSClientCAPath is the path to a PEM-encoded CA bundle used to verify
+	// client certificates. When given, log entries can only be written by
+	// clients that present a certificate signed by one of these CAs.
+	TLSClientCAPath string
+	// TLSRequireClientCert, when true, requires a verified client
+	// certificate for every request, not only for writes.
+	TLSRequireClientCert bool
+
+	// Authenticator, when set, is used to authenticate the bearer token
+	// that every request (except for health probes) must carry.
+	Authenticator auth.Authenticator
+	// Authorizer, when set, decides on which namespaces an authenticated
+	// client may query and write. It requires an Authenticator.
+	Authorizer auth.Authorizer
+
+	// Spool, when set, is an (opened) on-disk spool to which log entries are
+	// written when the LogStore is not ready or fails to write them. The
+	// spool replays them into the LogStore once it is ready again.
+	Spool *spool.Spool
+	// AsyncIngest, when true, makes POST /write acknowledge log entries as
+	// soon as they have been appended to the Spool, which then serves as a
+	// write-ahead log that is drained into the LogStore in the background.
+	// It requires a Spool.
+	AsyncIngest bool
+}
+
+// Validate ensures that the given Config is valid.
+func (c *Config) Validate() error {
+	if (c.TLSCertPath == "") != (c.TLSKeyPath == "") {
+		return fmt.Errorf("invalid server config: a TLS certificate and key must be given together")
+	}
+	if c.TLSClientCAPath != "" && c.TLSCertPath == "" {
+		return fmt.Errorf("invalid server config: a client CA requires a TLS certificate to be given")
+	}
+	if c.TLSRequireClientCert && c.TLSClientCAPath == "" {
+		return fmt.Errorf("invalid server config: requiring client certificates requires a client CA to be given")
+	}
+	if c.Authorizer != nil && c.Authenticator == nil {
+		return fmt.Errorf("invalid server config: an authorizer requires an authenticator to be given")
+	}
+	if c.AsyncIngest && c.Spool == nil {
+		return fmt.Errorf("invalid server config: asynchronous ingest requires a spool to be given")
+	}
+	return nil
+}
+
+// tlsEnabled returns true if the server is to serve HTTPS.
+func (c *Config) tlsEnabled() bool {
+	return c.TLSCertPath != ""
 }
 
 // HTTPServer represents a HTTP/REST API server for a particular LogStore.
 type HTTPServer struct {
+	config            *Config
 	server            *http.Server
 	logStore          logstore.LogStore
 	metricsMiddleware *MetricsMiddleware
+	tailBroker        *tailBroker
 }
 
 // NewHTTP creates a new HTTP (REST API) server with a given configuration and
@@ -37,15 +102,29 @@ func NewHTTP(serverConfig *Config, logStore logstore.LogStore) *HTTPServer {
 	// register handlers
 	r := mux.NewRouter()
 	s := HTTPServer{
+		config:            serverConfig,
 		server:            &http.Server{Addr: serverConfig.BindAddress, Handler: r},
 		logStore:          logStore,
 		metricsMiddleware: NewMetricsMiddleware(),
+		tailBroker:        newTailBroker(),
 	}
 
 	r.Use(s.metricsMiddleware.Intercept)
+	if serverConfig.Authenticator != nil {
+		r.Use(s.authenticate)
+	}
 	r.HandleFunc("/write", s.writeGetHandler).Methods("GET")
-	r.HandleFunc("/write", s.writePostHandler).Methods("POST")
+	if serverConfig.TLSClientCAPath != "" {
+		// only allow writes from clients with a verified certificate
+		r.Handle("/write", requireClientCert(http.HandlerFunc(s.writePostHandler))).Methods("POST")
+	} else {
+		r.HandleFunc("/write", s.writePostHandler).Methods("POST")
+	}
 	r.HandleFunc("/query", s.queryGetHandler).Methods("GET")
+	r.HandleFunc("/tail", s.tailGetHandler).Methods("GET")
+	r.HandleFunc("/namespaces", s.namespacesGetHandler).Methods("GET")
+	r.HandleFunc("/namespaces/{namespace}/pods", s.podsGetHandler).Methods("GET")
+	r.HandleFunc("/namespaces/{namespace}/pods/{pod}/containers", s.containersGetHandler).Methods("GET")
 	r.HandleFunc("/metrics", s.metricsGetHandler).Methods("GET")
 
 	if serverConfig.EnableProfiling {
@@ -67,13 +146,56 @@ func NewHTTP(serverConfig *Config, logStore logstore.LogStore) *HTTPServer {
 // Start starts the HTTP server. If successful, this method will block until the
 // server is stopped.
 func (s *HTTPServer) Start() error {
-	log.Infof("starting server on address %s ...", s.server.Addr)
-	return s.server.ListenAndServe()
+	if !s.config.tlsEnabled() {
+		log.Infof("starting server on address %s ...", s.server.Addr)
+		return s.server.ListenAndServe()
+	}
+
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		return err
+	}
+	s.server.TLSConfig = tlsConfig
+	log.Infof("starting TLS server on address %s ...", s.server.Addr)
+	return s.server.ListenAndServeTLS("", "")
+}
+
+// tlsConfig sets up a server TLS configuration that reloads certificates when
+// they are modified on disk.
+func (s *HTTPServer) tlsConfig() (*tls.Config, error) {
+	clientAuth := tls.VerifyClientCertIfGiven
+	if s.config.TLSRequireClientCert {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	reloader, err := newCertReloader(s.config.TLSCertPath, s.config.TLSKeyPath, s.config.TLSClientCAPath, clientAuth)
+	if err != nil {
+		return nil, err
+	}
+	return reloader.tlsConfig(), nil
+}
+
+// requireClientCert wraps a handler to only let through requests made with a
+// client certificate that was verified during the TLS handshake.
+func requireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			bytes, _ := json.Marshal(logstore.APIError{
+				Message: "forbidden", Detail: "a verified client certificate is required"})
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write(bytes)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 // Stop shuts down the HTTP server.
 func (s *HTTPServer) Stop() error {
 	log.Infof("stopping server ...")
+	// disconnect followers (which would otherwise keep the server from
+	// shutting down)
+	s.tailBroker.close()
 	return s.server.Shutdown(context.Background())
 }
 
@@ -99,8 +221,23 @@ func (s *HTTPServer) writeGetHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(bytes)
 }
 
-// writePostHandler reponds to POST /write
+// writePostHandler reponds to POST /write. With partial=true, invalid log
+// entries and log entries that could not be stored are reported by index in a
+// WriteResult, instead of failing the entire request, and all other log
+// entries are stored.
 func (s *HTTPServer) writePostHandler(w http.ResponseWriter, r *http.Request) {
+	// partial is optional
+	partial := false
+	partialStr, err := getQueryParam("partial", r)
+	if err == nil {
+		partial, err = strconv.ParseBool(partialStr)
+		if err != nil {
+			s.errorResponse(w, http.StatusBadRequest,
+				logstore.APIError{Message: "invalid request", Detail: "failed to parse partial"})
+			return
+		}
+	}
+
 	logEntries := make([]logstore.LogEntry, 0)
 	if err := json.NewDecoder(r.Body).Decode(&logEntries); err != nil {
 		s.errorResponse(w, http.StatusBadRequest,
@@ -108,33 +245,158 @@ func (s *HTTPServer) writePostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// ensure log entries are valid (and can be inserted into data store)
+	// ensure log entries are valid (and can be inserted into data store). A
+	// partial write leaves out (and reports) the invalid ones.
+	result := logstore.WriteResult{Failed: make([]logstore.WriteFailure, 0)}
+	validEntries := make([]logstore.LogEntry, 0, len(logEntries))
+	// indices holds the position in the request of every valid log entry
+	indices := make([]int, 0, len(logEntries))
+	for i := range logEntries {
+		if err := logEntries[i].Validate(); err != nil {
+			if !partial {
+				s.errorResponse(w, http.StatusBadRequest,
+					logstore.APIError{Message: "invalid log entry", Detail: err.Error()})
+				return
+			}
+			result.Failed = append(result.Failed, logstore.WriteFailure{Index: i, Error: err.Error()})
+			continue
+		}
+		validEntries = append(validEntries, logEntries[i])
+		indices = append(indices, i)
+	}
+	logEntries = validEntries
+
+	// ensure the client may write to the namespaces of all log entries
 	for _, logEntry := range logEntries {
-		lp := &logEntry
-		if err := lp.Validate(); err != nil {
-			s.errorResponse(w, http.StatusBadRequest,
-				logstore.APIError{Message: "invalid log entry", Detail: err.Error()})
+		namespace := logEntry.Kubernetes.Namespace
+		if !s.authorized(r, auth.WriteVerb, namespace) {
+			s.forbidden(w, auth.WriteVerb, namespace)
 			return
 		}
 	}
 
 	log.Debugf("received %d log entries", len(logEntries))
+	if len(logEntries) == 0 && partial {
+		s.writeResponse(w, http.StatusOK, partial, &result, 0)
+		return
+	}
+
+	if s.config.AsyncIngest {
+		if s.enqueueEntries(w, logEntries) {
+			s.writeResponse(w, http.StatusAccepted, partial, &result, len(logEntries))
+		}
+		return
+	}
 
-	_, err := s.logStore.Ready()
+	_, err = s.logStore.Ready()
 	if err != nil {
+		if s.spoolEntries(logEntries) {
+			s.writeResponse(w, http.StatusAccepted, partial, &result, len(logEntries))
+			return
+		}
 		s.errorResponse(w, http.StatusServiceUnavailable,
 			logstore.APIError{Message: "data store is not ready", Detail: err.Error()})
 		return
 	}
 
 	// write to backend
-	if err := s.logStore.Write(logEntries); err != nil {
+	err = s.logStore.Write(logEntries)
+	if writeErr, ok := err.(logstore.WriteError); ok {
+		// only the log entries that were not stored need to be spooled (or
+		// reported)
+		log.Errorf("failed to store log entries: %s", err)
+		stored, failed := writeErr.Split(logEntries)
+		s.tailBroker.publish(stored)
+		if s.spoolEntries(failed) {
+			s.writeResponse(w, http.StatusAccepted, partial, &result, len(logEntries))
+			return
+		}
+		if partial {
+			for _, failure := range writeErr.Failures {
+				result.Failed = append(result.Failed, logstore.WriteFailure{
+					Index: indices[failure.Index], Error: failure.Err.Error(), Retryable: true})
+			}
+			s.writeResponse(w, http.StatusOK, partial, &result, len(stored))
+			return
+		}
+		s.errorResponse(w, http.StatusInternalServerError,
+			logstore.APIError{Message: "failed to store entries", Detail: err.Error()})
+		return
+	}
+	if err != nil {
 		log.Errorf("failed to store log entries: %s", err)
+		if s.spoolEntries(logEntries) {
+			s.writeResponse(w, http.StatusAccepted, partial, &result, len(logEntries))
+			return
+		}
 		s.errorResponse(w, http.StatusInternalServerError,
 			logstore.APIError{Message: "failed to store entries", Detail: err.Error()})
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+	s.tailBroker.publish(logEntries)
+	s.writeResponse(w, http.StatusOK, partial, &result, len(logEntries))
+}
+
+// writeResponse responds to a POST /write whose log entries were (at least
+// partially) stored. A partial write is answered with a WriteResult.
+func (s *HTTPServer) writeResponse(w http.ResponseWriter, statusCode int, partial bool, result *logstore.WriteResult, stored int) {
+	if !partial {
+		w.WriteHeader(statusCode)
+		return
+	}
+
+	result.Stored = stored
+	sort.Slice(result.Failed, func(i, j int) bool { return result.Failed[i].Index < result.Failed[j].Index })
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		s.errorResponse(w, http.StatusInternalServerError,
+			logstore.APIError{Message: "failed to serialize response", Detail: err.Error()})
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(bytes)
+}
+
+// asyncRetryAfter is the time that clients are asked to wait before retrying
+// a write that was rejected since the write-ahead log was full.
+const asyncRetryAfter = 10 * time.Second
+
+// enqueueEntries appends log entries to the write-ahead log of asynchronous
+// ingest, and returns true once they are on disk. When the write-ahead log is
+// full, the client is asked to back off with 429 (Too Many Requests).
+func (s *HTTPServer) enqueueEntries(w http.ResponseWriter, logEntries []logstore.LogEntry) bool {
+	err := s.config.Spool.Append(logEntries)
+	if _, ok := err.(spool.FullError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(asyncRetryAfter/time.Second)))
+		s.errorResponse(w, http.StatusTooManyRequests,
+			logstore.APIError{Message: "write queue is full", Detail: err.Error()})
+		return false
+	}
+	if err != nil {
+		log.Errorf("failed to enqueue log entries: %s", err)
+		s.errorResponse(w, http.StatusInternalServerError,
+			logstore.APIError{Message: "failed to enqueue entries", Detail: err.Error()})
+		return false
+	}
+	s.tailBroker.publish(logEntries)
+	return true
+}
+
+// spoolEntries appends log entries that could not be written to the LogStore
+// to the spool, if there is one. Returns false if the entries could not be
+// spooled.
+func (s *HTTPServer) spoolEntries(logEntries []logstore.LogEntry) bool {
+	if s.config.Spool == nil {
+		return false
+	}
+	if err := s.config.Spool.Append(logEntries); err != nil {
+		log.Errorf("failed to spool log entries: %s", err)
+		return false
+	}
+	log.Debugf("spooled %d log entries", len(logEntries))
+	s.tailBroker.publish(logEntries)
+	return true
 }
 
 // queryGetHandler reponds to GET /query
@@ -151,6 +413,11 @@ func (s *HTTPServer) queryGetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.authorized(r, auth.ReadVerb, query.Namespace) {
+		s.forbidden(w, auth.ReadVerb, query.Namespace)
+		return
+	}
+
 	_, err = s.logStore.Ready()
 	if err != nil {
 		s.errorResponse(w, http.StatusServiceUnavailable,
@@ -158,8 +425,25 @@ func (s *HTTPServer) queryGetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if streamRequested(r) {
+		if query.Limit > 0 || query.NextToken != "" {
+			s.errorResponse(w, http.StatusBadRequest,
+				logstore.APIError{Message: "invalid query", Detail: "limit and next_token cannot be used with ndjson streaming"})
+			return
+		}
+		log.Debugf("received streamed query: %s", query)
+		s.streamQuery(w, query)
+		return
+	}
+
 	log.Debugf("received query: %s", query)
 	rows, err := s.logStore.Query(query)
+	if _, ok := err.(logstore.QueryError); ok {
+		// for example, a malformed next_token
+		s.errorResponse(w, http.StatusBadRequest,
+			logstore.APIError{Message: "invalid query", Detail: err.Error()})
+		return
+	}
 	if err != nil {
 		s.errorResponse(w, http.StatusInternalServerError,
 			logstore.APIError{Message: "query execution error", Detail: err.Error()})
@@ -177,53 +461,349 @@ func (s *HTTPServer) queryGetHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(bytes)
 }
 
+// ndjsonFlushInterval is the number of log rows written between flushes of a
+// streamed query response.
+const ndjsonFlushInterval = 100
+
+// streamRequested returns true if a query response is to be streamed as
+// newline-delimited JSON.
+func streamRequested(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "ndjson" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// streamQuery runs a query and streams the matching log rows as
+// newline-delimited JSON (one LogRow per line) as they are fetched from the
+// LogStore. Should the query fail once rows have been written, the response
+// is aborted (rather than properly terminated) to let the client know that it
+// is incomplete.
+func (s *HTTPServer) streamQuery(w http.ResponseWriter, query *logstore.Query) {
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	rowsWritten := 0
+	writeHeader := func() {
+		w.Header().Add("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+	}
+
+	err := s.logStore.QueryStream(query, func(row *logstore.LogRow) error {
+		if rowsWritten == 0 {
+			writeHeader()
+		}
+		if err := encoder.Encode(row); err != nil {
+			return err
+		}
+		rowsWritten++
+		if flusher != nil && rowsWritten%ndjsonFlushInterval == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		if rowsWritten == 0 {
+			statusCode, message := http.StatusInternalServerError, "query execution error"
+			if _, ok := err.(logstore.QueryError); ok {
+				statusCode, message = http.StatusBadRequest, "invalid query"
+			}
+			s.errorResponse(w, statusCode, logstore.APIError{Message: message, Detail: err.Error()})
+			return
+		}
+		log.Errorf("streamed query aborted after %d rows: %s", rowsWritten, err)
+		// the metrics middleware records the request before passing the
+		// panic on
+		panic(http.ErrAbortHandler)
+	}
+
+	if rowsWritten == 0 {
+		writeHeader()
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// Limits of GET /tail
+const (
+	// maxTailBackfill is the maximum number of backfilled log rows.
+	maxTailBackfill = 10000
+	// tailBackfillWindow is how far back in time to look for log rows to
+	// backfill.
+	tailBackfillWindow = 1 * time.Hour
+	// tailKeepAliveInterval is the interval between keep-alive comments
+	// sent to followers, to keep idle connections from being closed by
+	// proxies.
+	tailKeepAliveInterval = 15 * time.Second
+)
+
+// tailGetHandler reponds to GET /tail by pushing the log entries of the
+// selected pod container(s) to the client as Server-Sent Events as they are
+// written.
+func (s *HTTPServer) tailGetHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := selectorFromRequest(r)
+	if err != nil {
+		s.errorResponse(w, http.StatusBadRequest,
+			logstore.APIError{Message: "invalid query", Detail: err.Error()})
+		return
+	}
+	// backfill is optional
+	backfill := 0
+	backfillStr, err := getQueryParam("backfill", r)
+	if err == nil {
+		backfill, err = strconv.Atoi(backfillStr)
+		if err != nil || backfill < 0 || backfill > maxTailBackfill {
+			s.errorResponse(w, http.StatusBadRequest, logstore.APIError{Message: "invalid query",
+				Detail: fmt.Sprintf("backfill must be a number between 0 and %d", maxTailBackfill)})
+			return
+		}
+	}
+	// validate as a query over the backfill window
+	query.EndTime = time.Now().UTC()
+	query.StartTime = query.EndTime.Add(-tailBackfillWindow)
+	if err := query.Validate(); err != nil {
+		s.errorResponse(w, http.StatusBadRequest,
+			logstore.APIError{Message: "invalid query", Detail: err.Error()})
+		return
+	}
+	filter, _ := query.Filter()
+
+	if !s.authorized(r, auth.ReadVerb, query.Namespace) {
+		s.forbidden(w, auth.ReadVerb, query.Namespace)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.errorResponse(w, http.StatusInternalServerError,
+			logstore.APIError{Message: "streaming not supported", Detail: "response cannot be flushed"})
+		return
+	}
+
+	// subscribe before backfilling, to not miss any entries written meanwhile
+	subscriber := s.tailBroker.subscribe(query, filter)
+	defer s.tailBroker.unsubscribe(subscriber)
+
+	backfilled, err := s.backfill(query, backfill)
+	if err != nil {
+		s.errorResponse(w, http.StatusInternalServerError,
+			logstore.APIError{Message: "query execution error", Detail: err.Error()})
+		return
+	}
+
+	log.Debugf("client following %s", query)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	// rows written while backfilling may be both backfilled and published
+	backfilledRows := make(map[tailRowKey]bool, len(backfilled))
+	for i := range backfilled {
+		if err := writeEvent(w, &backfilled[i]); err != nil {
+			return
+		}
+		backfilledRows[tailRowKeyOf(&backfilled[i])] = true
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(tailKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case row, ok := <-subscriber.rows:
+			if !ok {
+				// dropped by the broker (lagging behind or shutting down)
+				return
+			}
+			// skip rows that were already backfilled
+			if key := tailRowKeyOf(&row); backfilledRows[key] {
+				delete(backfilledRows, key)
+				continue
+			}
+			if err := writeEvent(w, &row); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// backfill returns the (at most) n latest log rows that a query matches,
+// oldest first. They are fetched with a Tail query, which LogStores scan newest
+// first and stop scanning once n rows have been found.
+func (s *HTTPServer) backfill(query *logstore.Query, n int) ([]logstore.LogRow, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	tailQuery := *query
+	tailQuery.Tail = n
+	rows := make([]logstore.LogRow, 0, n)
+	err := s.logStore.QueryStream(&tailQuery, func(row *logstore.LogRow) error {
+		rows = append(rows, *row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// tailRowKey identifies a log row by its container, time and content, to
+// recognize published rows that were already backfilled.
+type tailRowKey struct {
+	podName       string
+	containerName string
+	time          int64
+	stream        string
+	log           string
+}
+
+func tailRowKeyOf(row *logstore.LogRow) tailRowKey {
+	return tailRowKey{
+		podName: row.PodName, containerName: row.ContainerName,
+		time: row.Time.UnixNano(), stream: row.Stream, log: row.Log,
+	}
+}
+
+// writeEvent writes a log row as a Server-Sent Event.
+func writeEvent(w http.ResponseWriter, row *logstore.LogRow) error {
+	bytes, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", bytes)
+	return err
+}
+
 // metricsGetHandler reponds to GET /metrics
 func (s *HTTPServer) metricsGetHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	s.metricsMiddleware.Metrics().WriteTo(w)
+	if s.config.Spool != nil {
+		stats := s.config.Spool.Stats()
+		fmt.Fprintf(w, "spool_batches %d\n", stats.Batches)
+		fmt.Fprintf(w, "spool_entries %d\n", stats.Entries)
+		fmt.Fprintf(w, "spool_bytes %d\n", stats.Bytes)
+		fmt.Fprintf(w, "spool_oldest_age_seconds %f\n", stats.OldestAge.Seconds())
+		fmt.Fprintf(w, "spool_set_aside_files %d\n", stats.SetAsideFiles)
+		fmt.Fprintf(w, "spool_set_aside_bytes %d\n", stats.SetAsideBytes)
+	}
 }
 
 func queryFromRequest(r *http.Request) (*logstore.Query, error) {
-	namespace, err := getQueryParam("namespace", r)
+	query, err := selectorFromRequest(r)
 	if err != nil {
 		return nil, err
 	}
-	podName, err := getQueryParam("pod_name", r)
+
+	query.StartTime, query.EndTime, err = intervalFromRequest(r)
 	if err != nil {
 		return nil, err
 	}
-	containerName, err := getQueryParam("container_name", r)
-	if err != nil {
-		return nil, err
+
+	// limit and next_token are optional
+	limitStr, err := getQueryParam("limit", r)
+	if err == nil {
+		query.Limit, err = strconv.Atoi(limitStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse limit")
+		}
 	}
+	query.NextToken, _ = getQueryParam("next_token", r)
+
+	// order and tail are optional
+	query.Order, _ = getQueryParam("order", r)
+	tailStr, err := getQueryParam("tail", r)
+	if err == nil {
+		query.Tail, err = strconv.Atoi(tailStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse tail")
+		}
+	}
+
+	return query, nil
+}
+
+// intervalFromRequest parses the start_time and (optional) end_time query
+// parameters. The end time defaults to the current time.
+func intervalFromRequest(r *http.Request) (start, end time.Time, err error) {
 	startTimeStr, err := getQueryParam("start_time", r)
 	if err != nil {
-		return nil, err
+		return start, end, err
 	}
-	startTime, err := time.Parse(time.RFC3339Nano, startTimeStr)
+	start, err = time.Parse(time.RFC3339Nano, startTimeStr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse start_time")
+		return start, end, fmt.Errorf("failed to parse start_time")
 	}
-	// end_time is optional (defaults to current time)
-	endTime := time.Now().UTC()
+	end = time.Now().UTC()
 	endTimeStr, err := getQueryParam("end_time", r)
 	if err == nil {
-		endTime, err = time.Parse(time.RFC3339Nano, endTimeStr)
+		end, err = time.Parse(time.RFC3339Nano, endTimeStr)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse end_time")
+			return start, end, fmt.Errorf("failed to parse end_time")
+		}
+	}
+	return start, end, nil
+}
+
+// selectorFromRequest parses the query parameters that select pod containers
+// and filter their log entries, which are shared by GET /query and GET /tail.
+func selectorFromRequest(r *http.Request) (*logstore.Query, error) {
+	namespace, err := getQueryParam("namespace", r)
+	if err != nil {
+		return nil, err
+	}
+	// pods are either selected by pod_name (together with container_name)
+	// or by pod_name_prefix and/or label_selector: the combination is
+	// checked by Query.Validate()
+	// contains, regex, ignore_case and stream are optional
+	optional := make(map[string]string)
+	for _, paramName := range []string{
+		"pod_name", "container_name", "pod_name_prefix", "label_selector",
+		"contains", "regex", "ignore_case", "stream"} {
+		value, err := getOptionalQueryParam(paramName, r)
+		if err != nil {
+			return nil, err
+		}
+		optional[paramName] = value
+	}
+	ignoreCase := false
+	if optional["ignore_case"] != "" {
+		ignoreCase, err = strconv.ParseBool(optional["ignore_case"])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ignore_case")
 		}
 	}
 
 	query := logstore.Query{
 		Namespace:     namespace,
-		PodName:       podName,
-		ContainerName: containerName,
-		StartTime:     startTime,
-		EndTime:       endTime,
+		PodName:       optional["pod_name"],
+		ContainerName: optional["container_name"],
+		PodNamePrefix: optional["pod_name_prefix"],
+		LabelSelector: optional["label_selector"],
+		Contains:      optional["contains"],
+		Regex:         optional["regex"],
+		IgnoreCase:    ignoreCase,
+		Stream:        optional["stream"],
 	}
 	return &query, nil
 }
 
+// getOptionalQueryParam returns the value of a query parameter, or an empty
+// string if it is missing. Like for getQueryParam, a parameter that is given
+// more than once is an error.
+func getOptionalQueryParam(paramName string, r *http.Request) (string, error) {
+	if _, exist := r.URL.Query()[paramName]; !exist {
+		return "", nil
+	}
+	return getQueryParam(paramName, r)
+}
+
 func getQueryParam(paramName string, r *http.Request) (string, error) {
 	var paramValues []string
 	paramValues, exist := r.URL.Query()[paramName]
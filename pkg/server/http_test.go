@@ -7,11 +7,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/elastisys/kube-insight-logserver/pkg/logstore"
+	"github.com/elastisys/kube-insight-logserver/pkg/spool"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -51,6 +53,43 @@ func (m *MockedLogStore) Query(query *logstore.Query) (*logstore.QueryResult, er
 	return args.Get(0).(*logstore.QueryResult), args.Error(1)
 }
 
+func (m *MockedLogStore) QueryStream(query *logstore.Query, handler logstore.LogRowHandler) error {
+	args := m.Called(query)
+	// feed the given rows to the handler
+	if rows, ok := args.Get(0).([]logstore.LogRow); ok {
+		for i := range rows {
+			if err := handler(&rows[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return args.Error(1)
+}
+
+func (m *MockedLogStore) Namespaces(start, end time.Time) ([]string, error) {
+	args := m.Called(start, end)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockedLogStore) Pods(namespace string, start, end time.Time) ([]string, error) {
+	args := m.Called(namespace, start, end)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockedLogStore) Containers(namespace, podName string, start, end time.Time) ([]string, error) {
+	args := m.Called(namespace, podName, start, end)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]string), args.Error(1)
+}
+
 // newTestServer creates a HTTPServer associated with a given LogStore.
 // The HTTPServer is intended to be used with a httptest Server
 func newTestServer(logStore logstore.LogStore) *HTTPServer {
@@ -266,6 +305,103 @@ func TestPostWriteWhenLogStoreWriteFails(t *testing.T) {
 	mockLogStore.AssertExpectations(t)
 }
 
+// POST /write should spool log entries, and respond with 202 (Accepted), when
+// the LogStore is not ready or fails to write them and a spool is configured.
+func TestPostWriteSpoolsOnLogStoreFailure(t *testing.T) {
+	// set up test server with a spool and mocked LogStore
+	dir, err := ioutil.TempDir("", "server-spool-test")
+	require.Nilf(t, err, "failed to create temp dir")
+	defer os.RemoveAll(dir)
+	mockLogStore := new(MockedLogStore)
+	logSpool := spool.NewSpool(&spool.Options{Directory: dir, MaxBytes: 1024 * 1024, ReplayInterval: time.Hour}, mockLogStore)
+	require.Nilf(t, logSpool.Open(), "failed to open spool")
+	defer logSpool.Close()
+	server := NewHTTP(&Config{BindAddress: "127.0.0.1:8080", Spool: logSpool}, mockLogStore)
+	testServer := httptest.NewServer(server.server.Handler)
+	defer testServer.Close()
+	client := testServer.Client()
+
+	logsToWrite := []logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T12:00:00.000Z"), "event 1"),
+	}
+	jsonBytes, _ := json.Marshal(logsToWrite)
+
+	//
+	// set up mock expectations
+	//
+
+	// LogStore is not ready for the first write, and LogStore.Write() fails
+	// thereafter (also when the spool attempts to replay)
+	mockLogStore.On("Ready").Return(false, fmt.Errorf("connection refused")).Once()
+	mockLogStore.On("Ready").Return(true, nil)
+	mockLogStore.On("Write", logsToWrite).Return(fmt.Errorf("internal error"))
+
+	//
+	// make calls
+	//
+	resp, _ := client.Post(testServer.URL+"/write", "application/json", strings.NewReader(string(jsonBytes)))
+	assert.Equalf(t, http.StatusAccepted, resp.StatusCode, "unexpected response code")
+	resp, _ = client.Post(testServer.URL+"/write", "application/json", strings.NewReader(string(jsonBytes)))
+	assert.Equalf(t, http.StatusAccepted, resp.StatusCode, "unexpected response code")
+
+	assert.Equalf(t, 2, logSpool.Stats().Batches, "expected both batches to be spooled")
+	resp, _ = client.Get(testServer.URL + "/metrics")
+	body := readBody(t, resp)
+	assert.Containsf(t, body, "spool_batches 2\n", "missing expected metric")
+	assert.Containsf(t, body, "spool_entries 2\n", "missing expected metric")
+	assert.Containsf(t, body, "spool_set_aside_files 0\n", "missing expected metric")
+
+	// verify that expected calls were made
+	mockLogStore.AssertExpectations(t)
+}
+
+// With asynchronous ingest, POST /write should acknowledge log entries once
+// they are enqueued, and respond with 429 (Too Many Requests) and a
+// Retry-After header when the queue is full.
+func TestPostWriteAsync(t *testing.T) {
+	// set up test server with a (small) spool and mocked LogStore
+	dir, err := ioutil.TempDir("", "server-spool-test")
+	require.Nilf(t, err, "failed to create temp dir")
+	defer os.RemoveAll(dir)
+	mockLogStore := new(MockedLogStore)
+	logSpool := spool.NewSpool(&spool.Options{Directory: dir, MaxBytes: 500, ReplayInterval: time.Hour}, mockLogStore)
+	require.Nilf(t, logSpool.Open(), "failed to open spool")
+	defer logSpool.Close()
+	server := NewHTTP(&Config{BindAddress: "127.0.0.1:8080", Spool: logSpool, AsyncIngest: true}, mockLogStore)
+	testServer := httptest.NewServer(server.server.Handler)
+	defer testServer.Close()
+	client := testServer.Client()
+
+	logsToWrite := []logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T12:00:00.000Z"), "event 1"),
+	}
+	jsonBytes, _ := json.Marshal(logsToWrite)
+
+	//
+	// set up mock expectations
+	//
+
+	// the LogStore is unavailable, so entries stay in the queue
+	mockLogStore.On("Ready").Return(false, fmt.Errorf("connection refused"))
+	mockLogStore.On("Write", logsToWrite).Return(fmt.Errorf("connection refused"))
+
+	//
+	// make calls
+	//
+	resp, _ := client.Post(testServer.URL+"/write", "application/json", strings.NewReader(string(jsonBytes)))
+	assert.Equalf(t, http.StatusAccepted, resp.StatusCode, "unexpected response code")
+	assert.Equalf(t, 1, logSpool.Stats().Batches, "expected batch to be enqueued")
+
+	// the queue has no room for another batch
+	resp, _ = client.Post(testServer.URL+"/write", "application/json", strings.NewReader(string(jsonBytes)))
+	assert.Equalf(t, http.StatusTooManyRequests, resp.StatusCode, "unexpected response code")
+	assert.Equalf(t, "10", resp.Header.Get("Retry-After"), "unexpected Retry-After")
+	assert.Containsf(t, readBody(t, resp), `"message":"write queue is full"`, "unexpected response")
+
+	// verify that the enqueued batch is kept until the LogStore accepts it
+	assert.Equalf(t, 1, logSpool.Stats().Batches, "expected batch to stay enqueued")
+}
+
 // POST /write should respond with 400 (Bad Request) on non-json request
 func TestPostWriteOnNonJSONRequest(t *testing.T) {
 	// set up test server and mocked LogStore
@@ -323,6 +459,74 @@ func TestPostWriteOnInvalidLogEntry(t *testing.T) {
 	mockLogStore.AssertExpectations(t)
 }
 
+// POST /write?partial=true should store the valid log entries and report, by
+// index, the log entries that failed validation or could not be stored.
+func TestPostWritePartial(t *testing.T) {
+	// set up test server and mocked LogStore
+	mockLogStore := new(MockedLogStore)
+	server := newTestServer(mockLogStore)
+	testServer := httptest.NewServer(server.server.Handler)
+	defer testServer.Close()
+	client := testServer.Client()
+
+	logsToWrite := []logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T12:00:00.000Z"), "event 1"),
+		invalidLogEntry(),
+		logEntry(MustParse("2018-01-01T12:01:00.000Z"), "event 2"),
+		logEntry(MustParse("2018-01-01T12:02:00.000Z"), "event 3"),
+	}
+	validLogs := []logstore.LogEntry{logsToWrite[0], logsToWrite[2], logsToWrite[3]}
+
+	//
+	// set up mock expectations
+	//
+
+	mockLogStore.On("Ready").Return(true, nil)
+	// second valid log entry (index 2 of request) fails to be stored
+	writeErr := logstore.NewWriteError(map[int]error{1: fmt.Errorf("insert failed: timeout")})
+	mockLogStore.On("Write", validLogs).Return(writeErr)
+
+	//
+	// make call
+	//
+	jsonBytes, _ := json.Marshal(logsToWrite)
+	body := strings.NewReader(string(jsonBytes))
+	resp, _ := client.Post(testServer.URL+"/write?partial=true", "application/json", body)
+	// should return 200 (OK) with a write result
+	assert.Equalf(t, http.StatusOK, resp.StatusCode, "unexpected response code")
+	assert.Equalf(t, "application/json", resp.Header.Get("Content-Type"), "unexpected content type")
+	expected := `{"stored":2,"failed":[` +
+		`{"index":1,"error":"log entry missing namespace field","retryable":false},` +
+		`{"index":2,"error":"insert failed: timeout","retryable":true}]}`
+	assert.Equalf(t, expected, readBody(t, resp), "unexpected response")
+
+	// verify that expected calls were made
+	mockLogStore.AssertExpectations(t)
+}
+
+// POST /write should respond with 400 (Bad Request) on an invalid partial
+// query parameter.
+func TestPostWriteOnInvalidPartialParam(t *testing.T) {
+	// set up test server and mocked LogStore
+	mockLogStore := new(MockedLogStore)
+	server := newTestServer(mockLogStore)
+	testServer := httptest.NewServer(server.server.Handler)
+	defer testServer.Close()
+	client := testServer.Client()
+
+	//
+	// make call
+	//
+	body := strings.NewReader("[]")
+	resp, _ := client.Post(testServer.URL+"/write?partial=maybe", "application/json", body)
+	// should return 400 (Bad Request)
+	assert.Equalf(t, http.StatusBadRequest, resp.StatusCode, "unexpected response code")
+	assert.Equalf(t, `{"message":"invalid request","detail":"failed to parse partial"}`, readBody(t, resp), "unexpected response")
+
+	// verify that expected calls were made
+	mockLogStore.AssertExpectations(t)
+}
+
 // GET /query should call through to LogStore.Query()
 func TestGetQuery(t *testing.T) {
 	// set up test server and mocked LogStore
@@ -351,8 +555,9 @@ func TestGetQuery(t *testing.T) {
 	logStoreResult := logstore.QueryResult{
 		LogRows: []logstore.LogRow{
 			{
-				Time: startTime,
-				Log:  "event 1",
+				Time:   startTime,
+				Log:    "event 1",
+				Stream: "stdout",
 			},
 		},
 	}
@@ -384,6 +589,69 @@ func TestGetQuery(t *testing.T) {
 	mockLogStore.AssertExpectations(t)
 }
 
+// GET /query should pass the optional filter parameters on to
+// LogStore.Query() and reject a malformed regex with 400 (Bad Request).
+func TestGetQueryWithFilters(t *testing.T) {
+	// set up test server and mocked LogStore
+	mockLogStore := new(MockedLogStore)
+	server := newTestServer(mockLogStore)
+	testServer := httptest.NewServer(server.server.Handler)
+	defer testServer.Close()
+	client := testServer.Client()
+
+	query := logstore.Query{
+		Namespace:     "default",
+		PodName:       "nginx-deployment-abcde",
+		ContainerName: "nginx",
+		StartTime:     MustParse("2018-01-01T12:00:00.000Z"),
+		EndTime:       MustParse("2018-01-01T13:00:00.000Z"),
+		Contains:      "index.html",
+		Regex:         "5[0-9]{2}",
+		IgnoreCase:    true,
+		Stream:        "stderr",
+	}
+
+	//
+	// set up mock expectations
+	//
+	mockLogStore.On("Ready").Return(true, nil)
+	mockLogStore.On("Query", &query).Return(&logstore.QueryResult{LogRows: []logstore.LogRow{}}, nil)
+
+	//
+	// make call
+	//
+	params := map[string]string{
+		"namespace":      query.Namespace,
+		"pod_name":       query.PodName,
+		"container_name": query.ContainerName,
+		"start_time":     "2018-01-01T12:00:00.000Z",
+		"end_time":       "2018-01-01T13:00:00.000Z",
+		"contains":       "index.html",
+		"regex":          "5[0-9]{2}",
+		"ignore_case":    "true",
+		"stream":         "stderr",
+	}
+	queryURL, _ := url.Parse(testServer.URL + "/query")
+	queryParams := queryURL.Query()
+	addQueryParams(&queryParams, params)
+	queryURL.RawQuery = queryParams.Encode()
+	resp, _ := client.Get(queryURL.String())
+	assert.Equalf(t, http.StatusOK, resp.StatusCode, "unexpected response code")
+
+	// malformed regex
+	params["regex"] = "5[0-9"
+	queryParams = url.Values{}
+	addQueryParams(&queryParams, params)
+	queryURL.RawQuery = queryParams.Encode()
+	resp, _ = client.Get(queryURL.String())
+	assert.Equalf(t, http.StatusBadRequest, resp.StatusCode, "unexpected response code")
+	assert.Equalf(t, `{"message":"invalid query","detail":"query parameter regex: error parsing regexp: missing closing ]: `+"`[0-9`"+`"}`,
+		readBody(t, resp), "unexpected response")
+
+	// verify that expected calls were made
+	mockLogStore.AssertExpectations(t)
+}
+
 // addQueryParams adds a given map of parameters to a Values object.
 func addQueryParams(values *url.Values, parameters map[string]string) {
 	for key, value := range parameters {
@@ -391,6 +659,66 @@ func addQueryParams(values *url.Values, parameters map[string]string) {
 	}
 }
 
+// GET /query should accept pod_name_prefix and label_selector in place of
+// pod_name and return rows tagged with their pod and container.
+func TestGetQueryAcrossContainers(t *testing.T) {
+	// set up test server and mocked LogStore
+	mockLogStore := new(MockedLogStore)
+	server := newTestServer(mockLogStore)
+	testServer := httptest.NewServer(server.server.Handler)
+	defer testServer.Close()
+	client := testServer.Client()
+
+	query := logstore.Query{
+		Namespace:     "default",
+		PodNamePrefix: "nginx-deployment-",
+		LabelSelector: "app=nginx",
+		StartTime:     MustParse("2018-01-01T12:00:00.000Z"),
+		EndTime:       MustParse("2018-01-01T13:00:00.000Z"),
+	}
+
+	//
+	// set up mock expectations
+	//
+	mockLogStore.On("Ready").Return(true, nil)
+	mockLogStore.On("Query", &query).Return(&logstore.QueryResult{LogRows: []logstore.LogRow{
+		{Time: MustParse("2018-01-01T12:00:00.000Z"), Log: "event 1", Stream: "stdout",
+			PodName: "nginx-deployment-abcde", ContainerName: "nginx"},
+	}}, nil)
+
+	//
+	// make call
+	//
+	params := map[string]string{
+		"namespace":       query.Namespace,
+		"pod_name_prefix": query.PodNamePrefix,
+		"label_selector":  query.LabelSelector,
+		"start_time":      "2018-01-01T12:00:00.000Z",
+		"end_time":        "2018-01-01T13:00:00.000Z",
+	}
+	queryURL, _ := url.Parse(testServer.URL + "/query")
+	queryParams := queryURL.Query()
+	addQueryParams(&queryParams, params)
+	queryURL.RawQuery = queryParams.Encode()
+	resp, _ := client.Get(queryURL.String())
+	assert.Equalf(t, http.StatusOK, resp.StatusCode, "unexpected response code")
+	assert.Containsf(t, readBody(t, resp), `"pod_name": "nginx-deployment-abcde"`,
+		"expected log row to be tagged with its pod")
+
+	// pod_name cannot be combined with a selector
+	params["pod_name"] = "nginx-deployment-abcde"
+	queryParams = url.Values{}
+	addQueryParams(&queryParams, params)
+	queryURL.RawQuery = queryParams.Encode()
+	resp, _ = client.Get(queryURL.String())
+	assert.Equalf(t, http.StatusBadRequest, resp.StatusCode, "unexpected response code")
+	assert.Equalf(t, `{"message":"invalid query","detail":"query parameter pod_name: cannot be combined with pod_name_prefix or label_selector"}`,
+		readBody(t, resp), "unexpected response")
+
+	// verify that expected calls were made
+	mockLogStore.AssertExpectations(t)
+}
+
 // GET /query on missing query parameters should respond with 400 (Bad Request)
 func TestGetQueryOnMissingQueryParams(t *testing.T) {
 	// set up test server and mocked LogStore
@@ -500,6 +828,30 @@ func TestGetQueryOnMissingQueryParams(t *testing.T) {
 
 }
 
+// GET /query should respond with 400 (Bad Request) when an optional selector
+// parameter is given more than once, rather than ignore it.
+func TestGetQueryOnRepeatedSelectorParam(t *testing.T) {
+	// set up test server and mocked LogStore
+	mockLogStore := new(MockedLogStore)
+	server := newTestServer(mockLogStore)
+	testServer := httptest.NewServer(server.server.Handler)
+	defer testServer.Close()
+	client := testServer.Client()
+
+	for _, param := range []string{"pod_name_prefix", "label_selector"} {
+		resp, _ := client.Get(testServer.URL + "/query?namespace=default&" + param + "=a&" + param + "=b" +
+			"&start_time=2018-01-01T10:00:00.000Z&end_time=2018-01-01T12:00:00.000Z")
+		// should return 400 (Bad Request)
+		assert.Equalf(t, http.StatusBadRequest, resp.StatusCode, "unexpected response code")
+		expectedErr := fmt.Sprintf(`{"message":"invalid query",`+
+			`"detail":"query parameter %s has wrong number of values: was: 2, expected: 1"}`, param)
+		assert.Equalf(t, expectedErr, readBody(t, resp), "unexpected response")
+	}
+
+	// verify that expected calls were made
+	mockLogStore.AssertExpectations(t)
+}
+
 // GET /query when log store is not ready should respond with 503 (Service Unavailable)
 func TestGetQueryWhenLogStoreNotReady(t *testing.T) {
 	// set up test server and mocked LogStore
@@ -586,6 +938,283 @@ func TestGetQueryOnLogStoreError(t *testing.T) {
 	mockLogStore.AssertExpectations(t)
 }
 
+// GET /query should pass limit and next_token on to LogStore.Query(), return
+// the continuation token of the result, and respond with 400 (Bad Request)
+// when the LogStore rejects the query as invalid (e.g. a malformed token).
+func TestGetQueryWithLimit(t *testing.T) {
+	// set up test server and mocked LogStore
+	mockLogStore := new(MockedLogStore)
+	server := newTestServer(mockLogStore)
+	testServer := httptest.NewServer(server.server.Handler)
+	defer testServer.Close()
+	client := testServer.Client()
+
+	query := logstore.Query{
+		Namespace:     "default",
+		PodName:       "nginx-deployment-abcde",
+		ContainerName: "nginx",
+		StartTime:     MustParse("2018-01-01T12:00:00.000Z"),
+		EndTime:       MustParse("2018-01-01T13:00:00.000Z"),
+		Limit:         1,
+		NextToken:     "token1",
+	}
+	badQuery := query
+	badQuery.NextToken = "garbage"
+
+	//
+	// set up mock expectations
+	//
+	logStoreResult := logstore.QueryResult{
+		LogRows:   []logstore.LogRow{{Time: query.StartTime, Log: "event 1", Stream: "stdout"}},
+		NextToken: "token2",
+	}
+	mockLogStore.On("Ready").Return(true, nil)
+	mockLogStore.On("Query", &query).Return(&logStoreResult, nil)
+	mockLogStore.On("Query", &badQuery).Return(nil, logstore.QueryError("query parameter next_token: malformed token"))
+
+	//
+	// make calls
+	//
+	params := map[string]string{
+		"namespace":      query.Namespace,
+		"pod_name":       query.PodName,
+		"container_name": query.ContainerName,
+		"start_time":     "2018-01-01T12:00:00.000Z",
+		"end_time":       "2018-01-01T13:00:00.000Z",
+		"limit":          "1",
+		"next_token":     "token1",
+	}
+	queryURL, _ := url.Parse(testServer.URL + "/query")
+	queryParams := queryURL.Query()
+	addQueryParams(&queryParams, params)
+	queryURL.RawQuery = queryParams.Encode()
+	resp, _ := client.Get(queryURL.String())
+	assert.Equalf(t, http.StatusOK, resp.StatusCode, "unexpected response code")
+	var clientResult logstore.QueryResult
+	json.Unmarshal([]byte(readBody(t, resp)), &clientResult)
+	assert.Equalf(t, logStoreResult, clientResult, "unexpected query response")
+
+	params["next_token"] = "garbage"
+	queryParams = url.Values{}
+	addQueryParams(&queryParams, params)
+	queryURL.RawQuery = queryParams.Encode()
+	resp, _ = client.Get(queryURL.String())
+	assert.Equalf(t, http.StatusBadRequest, resp.StatusCode, "unexpected response code")
+	assert.Equalf(t, `{"message":"invalid query","detail":"query parameter next_token: malformed token"}`,
+		readBody(t, resp), "unexpected response")
+
+	// verify that expected calls were made
+	mockLogStore.AssertExpectations(t)
+}
+
+// GET /query should pass the order and tail parameters on to the LogStore and
+// reject invalid values.
+func TestGetQueryLatest(t *testing.T) {
+	// set up test server and mocked LogStore
+	mockLogStore := new(MockedLogStore)
+	server := newTestServer(mockLogStore)
+	testServer := httptest.NewServer(server.server.Handler)
+	defer testServer.Close()
+	client := testServer.Client()
+
+	query := logstore.Query{
+		Namespace:     "default",
+		PodName:       "nginx-deployment-abcde",
+		ContainerName: "nginx",
+		StartTime:     MustParse("2018-01-01T12:00:00.000Z"),
+		EndTime:       MustParse("2018-01-01T13:00:00.000Z"),
+		Order:         "desc",
+		Tail:          2,
+	}
+
+	//
+	// set up mock expectations
+	//
+	logStoreResult := logstore.QueryResult{LogRows: []logstore.LogRow{
+		{Time: MustParse("2018-01-01T12:02:00.000Z"), Log: "event 2", Stream: "stdout"},
+		{Time: MustParse("2018-01-01T12:01:00.000Z"), Log: "event 1", Stream: "stdout"},
+	}}
+	mockLogStore.On("Ready").Return(true, nil)
+	mockLogStore.On("Query", &query).Return(&logStoreResult, nil)
+
+	//
+	// make calls
+	//
+	tests := []struct {
+		order        string
+		tail         string
+		expectedCode int
+	}{
+		{order: "desc", tail: "2", expectedCode: http.StatusOK},
+		{order: "desc", tail: "two", expectedCode: http.StatusBadRequest},
+		{order: "desc", tail: "-1", expectedCode: http.StatusBadRequest},
+		{order: "newest", tail: "2", expectedCode: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		params := map[string]string{
+			"namespace":      query.Namespace,
+			"pod_name":       query.PodName,
+			"container_name": query.ContainerName,
+			"start_time":     "2018-01-01T12:00:00.000Z",
+			"end_time":       "2018-01-01T13:00:00.000Z",
+			"order":          test.order,
+			"tail":           test.tail,
+		}
+		queryURL, _ := url.Parse(testServer.URL + "/query")
+		queryParams := queryURL.Query()
+		addQueryParams(&queryParams, params)
+		queryURL.RawQuery = queryParams.Encode()
+		resp, _ := client.Get(queryURL.String())
+		assert.Equalf(t, test.expectedCode, resp.StatusCode, "unexpected response code for order=%s, tail=%s",
+			test.order, test.tail)
+		if test.expectedCode == http.StatusOK {
+			var clientResult logstore.QueryResult
+			json.Unmarshal([]byte(readBody(t, resp)), &clientResult)
+			assert.Equalf(t, logStoreResult, clientResult, "unexpected query response")
+		}
+	}
+
+	// verify that expected calls were made
+	mockLogStore.AssertExpectations(t)
+}
+
+// GET /query should stream the result as newline-delimited JSON when asked
+// to, either via the Accept header or the format parameter.
+func TestGetQueryStream(t *testing.T) {
+	// set up test server and mocked LogStore
+	mockLogStore := new(MockedLogStore)
+	server := newTestServer(mockLogStore)
+	testServer := httptest.NewServer(server.server.Handler)
+	defer testServer.Close()
+	client := testServer.Client()
+
+	query := logstore.Query{
+		Namespace:     "default",
+		PodName:       "nginx-deployment-abcde",
+		ContainerName: "nginx",
+		StartTime:     MustParse("2018-01-01T12:00:00.000Z"),
+		EndTime:       MustParse("2018-01-01T13:00:00.000Z"),
+	}
+
+	//
+	// set up mock expectations
+	//
+	mockLogStore.On("Ready").Return(true, nil)
+	mockLogStore.On("QueryStream", &query).Return([]logstore.LogRow{
+		{Time: MustParse("2018-01-01T12:00:00.000Z"), Log: "event 1", Stream: "stdout"},
+		{Time: MustParse("2018-01-01T12:01:00.000Z"), Log: "event 2", Stream: "stderr"},
+	}, nil)
+
+	//
+	// make calls
+	//
+	queryParams := url.Values{}
+	addQueryParams(&queryParams, map[string]string{
+		"namespace":      query.Namespace,
+		"pod_name":       query.PodName,
+		"container_name": query.ContainerName,
+		"start_time":     "2018-01-01T12:00:00.000Z",
+		"end_time":       "2018-01-01T13:00:00.000Z",
+	})
+	expectedBody := `{"time":"2018-01-01T12:00:00Z","log":"event 1","stream":"stdout"}` + "\n" +
+		`{"time":"2018-01-01T12:01:00Z","log":"event 2","stream":"stderr"}` + "\n"
+
+	req, _ := http.NewRequest("GET", testServer.URL+"/query?"+queryParams.Encode(), nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, _ := client.Do(req)
+	assert.Equalf(t, http.StatusOK, resp.StatusCode, "unexpected response code")
+	assert.Equalf(t, []string{"application/x-ndjson"}, resp.Header["Content-Type"], "unexpected Content-Type")
+	assert.Equalf(t, expectedBody, readBody(t, resp), "unexpected response")
+
+	queryParams.Set("format", "ndjson")
+	resp, _ = client.Get(testServer.URL + "/query?" + queryParams.Encode())
+	assert.Equalf(t, http.StatusOK, resp.StatusCode, "unexpected response code")
+	assert.Equalf(t, expectedBody, readBody(t, resp), "unexpected response")
+
+	// pagination cannot be combined with streaming
+	queryParams.Set("limit", "10")
+	resp, _ = client.Get(testServer.URL + "/query?" + queryParams.Encode())
+	assert.Equalf(t, http.StatusBadRequest, resp.StatusCode, "unexpected response code")
+
+	// verify that expected calls were made
+	mockLogStore.AssertExpectations(t)
+}
+
+// A streamed GET /query that fails before any rows have been written should
+// respond with a regular error response.
+func TestGetQueryStreamOnLogStoreError(t *testing.T) {
+	// set up test server and mocked LogStore
+	mockLogStore := new(MockedLogStore)
+	server := newTestServer(mockLogStore)
+	testServer := httptest.NewServer(server.server.Handler)
+	defer testServer.Close()
+	client := testServer.Client()
+
+	// set up mock expectations
+	mockLogStore.On("Ready").Return(true, nil)
+	mockLogStore.On("QueryStream", mock.Anything).Return(nil, fmt.Errorf("connection refused"))
+
+	// make call
+	queryParams := url.Values{}
+	addQueryParams(&queryParams, map[string]string{
+		"namespace":      "default",
+		"pod_name":       "nginx-deployment-abcde",
+		"container_name": "nginx",
+		"start_time":     "2018-01-01T12:00:00.000Z",
+		"end_time":       "2018-01-01T13:00:00.000Z",
+		"format":         "ndjson",
+	})
+	resp, _ := client.Get(testServer.URL + "/query?" + queryParams.Encode())
+	assert.Equalf(t, http.StatusInternalServerError, resp.StatusCode, "unexpected response code")
+	assert.Equalf(t, `{"message":"query execution error","detail":"connection refused"}`, readBody(t, resp), "unexpected response")
+
+	// verify that expected calls were made
+	mockLogStore.AssertExpectations(t)
+}
+
+// A streamed GET /query that fails once rows have been written should abort
+// the response, and still be recorded in the request metrics.
+func TestGetQueryStreamAbortedOnLogStoreError(t *testing.T) {
+	// set up test server and mocked LogStore
+	mockLogStore := new(MockedLogStore)
+	server := newTestServer(mockLogStore)
+	testServer := httptest.NewServer(server.server.Handler)
+	defer testServer.Close()
+	client := testServer.Client()
+
+	// set up mock expectations
+	mockLogStore.On("Ready").Return(true, nil)
+	mockLogStore.On("QueryStream", mock.Anything).Return([]logstore.LogRow{
+		{Time: MustParse("2018-01-01T12:00:00.000Z"), Log: "event 1", Stream: "stdout"},
+	}, fmt.Errorf("connection refused"))
+
+	// make call
+	queryParams := url.Values{}
+	addQueryParams(&queryParams, map[string]string{
+		"namespace":      "default",
+		"pod_name":       "nginx-deployment-abcde",
+		"container_name": "nginx",
+		"start_time":     "2018-01-01T12:00:00.000Z",
+		"end_time":       "2018-01-01T13:00:00.000Z",
+		"format":         "ndjson",
+	})
+	// (the response is aborted before or after its header has been received,
+	// depending on whether any rows were flushed)
+	resp, err := client.Get(testServer.URL + "/query?" + queryParams.Encode())
+	if err == nil {
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	assert.NotNilf(t, err, "expected response to be aborted")
+
+	resp, _ = client.Get(testServer.URL + "/metrics")
+	assert.Containsf(t, readBody(t, resp), `total_requests{method="GET",path="/query",statusCode="200"} 1`,
+		"expected aborted request to be recorded")
+
+	// verify that expected calls were made
+	mockLogStore.AssertExpectations(t)
+}
+
 // When run with EnableProfiling=true, it should be possible to get profiling
 // (e.g. via go tool pprof <binary> localhost:8080/debug/pprof/*)
 func TestWithProfilingEnabled(t *testing.T) {
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/elastisys/kube-insight-logserver/pkg/log"
+	"github.com/gorilla/mux"
 )
 
 // MetricDimensions represent the dimensions over which request
@@ -69,46 +70,68 @@ func (w *wrappedResponseWriter) WriteHeader(statusCode int) {
 	w.ResponseWriter.WriteHeader(statusCode)
 }
 
+// Flush overrides the method in the wrapped http.ResponseWriter (if it is a
+// http.Flusher) to allow handlers to stream responses.
+func (w *wrappedResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 // Intercept is called by gorilla mux prior to passing the request through to
 // the handling function `nextHandler`. Here, we time the request handling,
-// log the request, and update the metric counters.
+// log the request, and update the metric counters. This is also done for a
+// handler that panics (such as with http.ErrAbortHandler, to abort a streamed
+// response), before the panic is passed on.
 func (mw *MetricsMiddleware) Intercept(nextHandler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ww := newWrappedResponseWriter(w)
 
 		start := time.Now()
+		defer func() {
+			mw.record(r, ww.statusCode, time.Since(start).Seconds())
+		}()
 		nextHandler.ServeHTTP(ww, r)
-		elapsed := time.Since(start).Seconds()
+	})
+}
 
-		url, err := url.Parse(r.RequestURI)
-		if err != nil {
-			log.Errorf("failed to parse request URI: %s", err)
+// record logs a handled request and updates the metric counters.
+func (mw *MetricsMiddleware) record(r *http.Request, statusCode int, elapsed float64) {
+	url, err := url.Parse(r.RequestURI)
+	if err != nil {
+		log.Errorf("failed to parse request URI: %s", err)
+	}
+	// use the route template (such as /namespaces/{namespace}/pods), if
+	// any, to not track a separate metric for every namespace and pod
+	path := url.Path
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			path = template
 		}
-		metricDim := MetricDimensions{Method: r.Method, Path: url.Path, StatusCode: ww.statusCode}
-		log.Infof("%s => %s %s: %d [%fs]", r.RemoteAddr, r.Method, r.RequestURI, ww.statusCode, elapsed)
-
-		mw.updateMutex.Lock()
-		defer mw.updateMutex.Unlock()
+	}
+	metricDim := MetricDimensions{Method: r.Method, Path: path, StatusCode: statusCode}
+	log.Infof("%s => %s %s: %d [%fs]", r.RemoteAddr, r.Method, r.RequestURI, statusCode, elapsed)
 
-		// update request count for the given status code
-		_, ok := mw.TotalRequests[metricDim]
-		if !ok {
-			mw.TotalRequests[metricDim] = 0
-		}
-		mw.TotalRequests[metricDim]++
+	mw.updateMutex.Lock()
+	defer mw.updateMutex.Unlock()
 
-		// update sum of response times for the given status code
-		_, ok = mw.SumResponseTime[metricDim]
-		if !ok {
-			mw.SumResponseTime[metricDim] = 0
-		}
-		mw.SumResponseTime[metricDim] += elapsed
+	// update request count for the given status code
+	_, ok := mw.TotalRequests[metricDim]
+	if !ok {
+		mw.TotalRequests[metricDim] = 0
+	}
+	mw.TotalRequests[metricDim]++
 
-		// update average response time for the given status code
-		mw.AvgResponseTime[metricDim] =
-			mw.SumResponseTime[metricDim] / float64(mw.TotalRequests[metricDim])
+	// update sum of response times for the given status code
+	_, ok = mw.SumResponseTime[metricDim]
+	if !ok {
+		mw.SumResponseTime[metricDim] = 0
+	}
+	mw.SumResponseTime[metricDim] += elapsed
 
-	})
+	// update average response time for the given status code
+	mw.AvgResponseTime[metricDim] =
+		mw.SumResponseTime[metricDim] / float64(mw.TotalRequests[metricDim])
 }
 
 // Metrics returns a byte buffer containing a snapshot of the collected
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/elastisys/kube-insight-logserver/pkg/log"
+	"github.com/elastisys/kube-insight-logserver/pkg/logstore"
+)
+
+// tailBufferSize is the number of log rows that can be queued up for a
+// follower before it is considered to be lagging behind and is disconnected.
+const tailBufferSize = 1000
+
+// tailSubscriber is a follower of the log entries of the pod container(s)
+// selected by a query.
+type tailSubscriber struct {
+	query    logstore.Query
+	selector logstore.LabelSelector
+	filter   logstore.LogFilter
+	// rows receives the log rows written for the selected pod container(s).
+	// It is closed when the subscriber is dropped by the tailBroker.
+	rows chan logstore.LogRow
+}
+
+// follows returns true if a log entry is written by a pod container that
+// the subscriber follows.
+func (s *tailSubscriber) follows(entry *logstore.LogEntry) bool {
+	return s.query.MatchesContainer(entry.Kubernetes.PodName, entry.Kubernetes.ContainerName) &&
+		s.selector.Matches(entry.Kubernetes.Labels)
+}
+
+// tailBroker fans out written log entries to the followers of their pod
+// containers, so that followers do not need to poll the LogStore.
+type tailBroker struct {
+	// mutex protects subscribers
+	mutex sync.Mutex
+	// subscribers holds the current followers in each namespace.
+	subscribers map[string]map[*tailSubscriber]struct{}
+}
+
+func newTailBroker() *tailBroker {
+	return &tailBroker{subscribers: make(map[string]map[*tailSubscriber]struct{})}
+}
+
+// subscribe registers a follower of the log entries of the pod container(s)
+// that a (valid) query selects and that match its filter. The caller must
+// unsubscribe once done.
+func (b *tailBroker) subscribe(query *logstore.Query, filter logstore.LogFilter) *tailSubscriber {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	selector, _ := logstore.ParseLabelSelector(query.LabelSelector)
+	subscriber := &tailSubscriber{
+		query:    *query,
+		selector: selector,
+		filter:   filter,
+		rows:     make(chan logstore.LogRow, tailBufferSize),
+	}
+	if _, ok := b.subscribers[query.Namespace]; !ok {
+		b.subscribers[query.Namespace] = make(map[*tailSubscriber]struct{})
+	}
+	b.subscribers[query.Namespace][subscriber] = struct{}{}
+	return subscriber
+}
+
+// unsubscribe removes a follower (unless it has already been dropped).
+func (b *tailBroker) unsubscribe(subscriber *tailSubscriber) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.drop(subscriber)
+}
+
+// publish passes written log entries on to the followers of their pod
+// containers. It never blocks: a follower that cannot keep up is dropped.
+func (b *tailBroker) publish(entries []logstore.LogEntry) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.subscribers) == 0 {
+		return
+	}
+	for i := range entries {
+		entry := &entries[i]
+		for subscriber := range b.subscribers[entry.Kubernetes.Namespace] {
+			if !subscriber.follows(entry) {
+				continue
+			}
+			row := logstore.LogRow{Time: entry.Time, Log: entry.Log, Stream: entry.Stream}
+			if subscriber.query.MultiContainer() {
+				row.PodName, row.ContainerName = entry.Kubernetes.PodName, entry.Kubernetes.ContainerName
+			}
+			if !subscriber.filter(&row) {
+				continue
+			}
+			select {
+			case subscriber.rows <- row:
+			default:
+				log.Infof("dropping lagging follower of %s", &subscriber.query)
+				b.drop(subscriber)
+			}
+		}
+	}
+}
+
+// close drops all followers.
+func (b *tailBroker) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, subscribers := range b.subscribers {
+		for subscriber := range subscribers {
+			b.drop(subscriber)
+		}
+	}
+}
+
+// drop removes a follower and closes its channel. Must be called with the
+// mutex held.
+func (b *tailBroker) drop(subscriber *tailSubscriber) {
+	namespace := subscriber.query.Namespace
+	subscribers, ok := b.subscribers[namespace]
+	if !ok {
+		return
+	}
+	if _, ok := subscribers[subscriber]; !ok {
+		return
+	}
+	delete(subscribers, subscriber)
+	if len(subscribers) == 0 {
+		delete(b.subscribers, namespace)
+	}
+	close(subscriber.rows)
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastisys/kube-insight-logserver/pkg/logstore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func acceptAll(*logstore.LogRow) bool { return true }
+
+// The tailBroker should only pass on log entries of the followed container
+// that match the follower's filter.
+func TestTailBrokerPublish(t *testing.T) {
+	broker := newTailBroker()
+	query := &logstore.Query{Namespace: "default", PodName: "nginx-deployment-abcde", ContainerName: "nginx"}
+	subscriber := broker.subscribe(query, func(row *logstore.LogRow) bool {
+		return row.Stream == "stdout"
+	})
+	defer broker.unsubscribe(subscriber)
+
+	otherContainer := logEntry(MustParse("2018-01-01T12:00:00Z"), "other container")
+	otherContainer.Kubernetes.ContainerName = "sidecar"
+	filteredOut := logEntry(MustParse("2018-01-01T12:00:01Z"), "filtered out")
+	filteredOut.Stream = "stderr"
+	broker.publish([]logstore.LogEntry{
+		otherContainer,
+		filteredOut,
+		logEntry(MustParse("2018-01-01T12:00:02Z"), "event 1"),
+	})
+
+	require.Equalf(t, 1, len(subscriber.rows), "unexpected number of published rows")
+	row := <-subscriber.rows
+	assert.Equalf(t, "event 1", row.Log, "unexpected published row")
+}
+
+// A follower by label selector should receive the matching log entries of all
+// pods in the namespace, tagged with their pod and container.
+func TestTailBrokerPublishByLabelSelector(t *testing.T) {
+	broker := newTailBroker()
+	query := &logstore.Query{Namespace: "default", LabelSelector: "app=nginx"}
+	subscriber := broker.subscribe(query, acceptAll)
+	defer broker.unsubscribe(subscriber)
+
+	withLabels := func(entry logstore.LogEntry, podName string, labels map[string]string) logstore.LogEntry {
+		entry.Kubernetes.PodName = podName
+		entry.Kubernetes.Labels = labels
+		return entry
+	}
+	otherNamespace := withLabels(logEntry(MustParse("2018-01-01T12:00:01Z"), "other namespace"),
+		"nginx-deployment-abcde", map[string]string{"app": "nginx"})
+	otherNamespace.Kubernetes.Namespace = "kube-system"
+	broker.publish([]logstore.LogEntry{
+		withLabels(logEntry(MustParse("2018-01-01T12:00:00Z"), "other app"),
+			"redis-abcde", map[string]string{"app": "redis"}),
+		otherNamespace,
+		withLabels(logEntry(MustParse("2018-01-01T12:00:02Z"), "event 1"),
+			"nginx-deployment-fghij", map[string]string{"app": "nginx"}),
+	})
+
+	require.Equalf(t, 1, len(subscriber.rows), "unexpected number of published rows")
+	row := <-subscriber.rows
+	assert.Equalf(t, logstore.LogRow{Time: MustParse("2018-01-01T12:00:02Z"), Log: "event 1", Stream: "stdout",
+		PodName: "nginx-deployment-fghij", ContainerName: "nginx"}, row, "unexpected published row")
+}
+
+// A follower that cannot keep up should be dropped rather than block writes.
+func TestTailBrokerDropsLaggingSubscriber(t *testing.T) {
+	broker := newTailBroker()
+	query := &logstore.Query{Namespace: "default", PodName: "nginx-deployment-abcde", ContainerName: "nginx"}
+	subscriber := broker.subscribe(query, acceptAll)
+
+	entries := make([]logstore.LogEntry, tailBufferSize+1)
+	for i := range entries {
+		entries[i] = logEntry(MustParse("2018-01-01T12:00:00Z").Add(time.Duration(i)*time.Second), "event")
+	}
+	broker.publish(entries)
+
+	// drain channel: should be closed after the buffered rows
+	received := 0
+	for range subscriber.rows {
+		received++
+	}
+	assert.Equalf(t, tailBufferSize, received, "unexpected number of buffered rows")
+	assert.Emptyf(t, broker.subscribers, "expected lagging subscriber to be dropped")
+	// unsubscribing a dropped subscriber should be harmless
+	broker.unsubscribe(subscriber)
+}
+
+// GET /tail should push backfilled log rows followed by newly written ones
+// as Server-Sent Events.
+func TestGetTail(t *testing.T) {
+	// set up test server and mocked LogStore
+	mockLogStore := new(MockedLogStore)
+	server := newTestServer(mockLogStore)
+	testServer := httptest.NewServer(server.server.Handler)
+	defer testServer.Close()
+	defer server.tailBroker.close()
+	client := testServer.Client()
+
+	//
+	// set up mock expectations
+	//
+	// the latest log row should be backfilled with a tail query
+	mockLogStore.On("QueryStream", mock.MatchedBy(func(query *logstore.Query) bool {
+		return query.Tail == 1 && !query.Descending()
+	})).Return([]logstore.LogRow{
+		{Time: MustParse("2018-01-01T11:59:00Z"), Log: "old event 2", Stream: "stdout"},
+	}, nil)
+	mockLogStore.On("Ready").Return(true, nil)
+	newEntry := logEntry(MustParse("2018-01-01T12:00:00Z"), "new event")
+	mockLogStore.On("Write", []logstore.LogEntry{newEntry}).Return(nil)
+
+	//
+	// make calls
+	//
+	params := url.Values{}
+	addQueryParams(&params, map[string]string{
+		"namespace":      "default",
+		"pod_name":       "nginx-deployment-abcde",
+		"container_name": "nginx",
+		"backfill":       "1",
+	})
+	resp, err := client.Get(testServer.URL + "/tail?" + params.Encode())
+	require.Nilf(t, err, "unexpected error")
+	defer resp.Body.Close()
+	assert.Equalf(t, http.StatusOK, resp.StatusCode, "unexpected response code")
+	assert.Equalf(t, []string{"text/event-stream"}, resp.Header["Content-Type"], "unexpected Content-Type")
+	events := bufio.NewReader(resp.Body)
+	assert.Equalf(t, `data: {"time":"2018-01-01T11:59:00Z","log":"old event 2","stream":"stdout"}`,
+		readEvent(t, events), "unexpected backfilled event")
+
+	body, _ := json.Marshal([]logstore.LogEntry{newEntry})
+	writeResp, err := client.Post(testServer.URL+"/write", "application/json", strings.NewReader(string(body)))
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, http.StatusOK, writeResp.StatusCode, "unexpected response code")
+	assert.Equalf(t, `data: {"time":"2018-01-01T12:00:00Z","log":"new event","stream":"stdout"}`,
+		readEvent(t, events), "unexpected event")
+
+	// verify that expected calls were made
+	mockLogStore.AssertExpectations(t)
+}
+
+// GET /tail across containers should only skip the published rows that were
+// already backfilled, and not newer rows of a container whose clock is behind
+// that of another container, or distinct rows with an equal timestamp.
+func TestGetTailAcrossContainersWithSkewedClocks(t *testing.T) {
+	// set up test server and mocked LogStore
+	mockLogStore := new(MockedLogStore)
+	server := newTestServer(mockLogStore)
+	testServer := httptest.NewServer(server.server.Handler)
+	defer testServer.Close()
+	defer server.tailBroker.close()
+	client := testServer.Client()
+
+	inPod := func(entry logstore.LogEntry, podName string) logstore.LogEntry {
+		entry.Kubernetes.PodName = podName
+		return entry
+	}
+	// the clock of nginx-a is ahead of that of nginx-b
+	written := []logstore.LogEntry{
+		// already backfilled (written while backfilling)
+		inPod(logEntry(MustParse("2018-01-01T12:05:00Z"), "a event"), "nginx-a"),
+		inPod(logEntry(MustParse("2018-01-01T12:00:00Z"), "b event 1"), "nginx-b"),
+		inPod(logEntry(MustParse("2018-01-01T12:00:00Z"), "b event 2"), "nginx-b"),
+	}
+
+	//
+	// set up mock expectations
+	//
+	mockLogStore.On("QueryStream", mock.Anything).Return([]logstore.LogRow{
+		{Time: MustParse("2018-01-01T11:59:00Z"), Log: "b old event", Stream: "stdout", PodName: "nginx-b", ContainerName: "nginx"},
+		{Time: MustParse("2018-01-01T12:05:00Z"), Log: "a event", Stream: "stdout", PodName: "nginx-a", ContainerName: "nginx"},
+	}, nil)
+	mockLogStore.On("Ready").Return(true, nil)
+	mockLogStore.On("Write", written).Return(nil)
+
+	//
+	// make calls
+	//
+	params := url.Values{}
+	addQueryParams(&params, map[string]string{
+		"namespace":       "default",
+		"pod_name_prefix": "nginx-",
+		"backfill":        "2",
+	})
+	resp, err := client.Get(testServer.URL + "/tail?" + params.Encode())
+	require.Nilf(t, err, "unexpected error")
+	defer resp.Body.Close()
+	assert.Equalf(t, http.StatusOK, resp.StatusCode, "unexpected response code")
+	events := bufio.NewReader(resp.Body)
+	readEvent(t, events)
+	readEvent(t, events)
+
+	body, _ := json.Marshal(written)
+	writeResp, err := client.Post(testServer.URL+"/write", "application/json", strings.NewReader(string(body)))
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, http.StatusOK, writeResp.StatusCode, "unexpected response code")
+	assert.Equalf(t, `data: {"time":"2018-01-01T12:00:00Z","log":"b event 1","stream":"stdout","pod_name":"nginx-b","container_name":"nginx"}`,
+		readEvent(t, events), "unexpected event")
+	assert.Equalf(t, `data: {"time":"2018-01-01T12:00:00Z","log":"b event 2","stream":"stdout","pod_name":"nginx-b","container_name":"nginx"}`,
+		readEvent(t, events), "unexpected event")
+
+	// verify that expected calls were made
+	mockLogStore.AssertExpectations(t)
+}
+
+// GET /tail should respond with 400 (Bad Request) on invalid parameters.
+func TestGetTailOnInvalidParams(t *testing.T) {
+	// set up test server and mocked LogStore
+	mockLogStore := new(MockedLogStore)
+	server := newTestServer(mockLogStore)
+	testServer := httptest.NewServer(server.server.Handler)
+	defer testServer.Close()
+	client := testServer.Client()
+
+	resp, _ := client.Get(testServer.URL + "/tail?namespace=default&pod_name=nginx")
+	assert.Equalf(t, http.StatusBadRequest, resp.StatusCode, "unexpected response code")
+	assert.Equalf(t, `{"message":"invalid query","detail":"missing query parameter: container_name"}`,
+		readBody(t, resp), "unexpected response")
+
+	resp, _ = client.Get(testServer.URL + "/tail?namespace=default&pod_name=nginx&container_name=nginx&backfill=-1")
+	assert.Equalf(t, http.StatusBadRequest, resp.StatusCode, "unexpected response code")
+	assert.Equalf(t, `{"message":"invalid query","detail":"backfill must be a number between 0 and 10000"}`,
+		readBody(t, resp), "unexpected response")
+}
+
+// readEvent reads the data line of the next Server-Sent Event.
+func readEvent(t *testing.T, events *bufio.Reader) string {
+	line, err := events.ReadString('\n')
+	require.Nilf(t, err, "failed to read event")
+	blank, err := events.ReadString('\n')
+	require.Nilf(t, err, "failed to read event")
+	require.Equalf(t, "\n", blank, "expected blank line after event")
+	return strings.TrimSuffix(line, "\n")
+}
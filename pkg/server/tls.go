@@ -0,0 +1,150 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/elastisys/kube-insight-logserver/pkg/log"
+)
+
+// certReloader keeps the server certificate (and the CA bundle used to verify
+// client certificates) loaded from disk, and reloads them whenever any of the
+// files is modified. This allows certificates to be rotated without
+// restarting the server.
+type certReloader struct {
+	certPath     string
+	keyPath      string
+	clientCAPath string
+	clientAuth   tls.ClientAuthType
+
+	// mutex protects the fields below
+	mutex sync.Mutex
+	// config is the TLS configuration built from the currently loaded files.
+	config *tls.Config
+	// modTimes holds the modification times of the currently loaded files.
+	modTimes map[string]time.Time
+}
+
+// newCertReloader creates a certReloader and performs an initial load of the
+// certificate files. The clientCAPath is optional. If given, clients are
+// verified according to clientAuth.
+func newCertReloader(certPath, keyPath, clientCAPath string, clientAuth tls.ClientAuthType) (*certReloader, error) {
+	r := &certReloader{
+		certPath:     certPath,
+		keyPath:      keyPath,
+		clientCAPath: clientCAPath,
+		clientAuth:   clientAuth,
+	}
+
+	modTimes, err := r.statFiles()
+	if err != nil {
+		return nil, err
+	}
+	config, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	r.config, r.modTimes = config, modTimes
+	return r, nil
+}
+
+// tlsConfig returns a server TLS configuration that, for every new
+// connection, hands out the most recently loaded certificates.
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: r.getConfigForClient,
+		// also set GetCertificate to make the config acceptable to
+		// http.Server.ServeTLS (GetConfigForClient takes precedence)
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			config, _ := r.getConfigForClient(hello)
+			return &config.Certificates[0], nil
+		},
+	}
+}
+
+func (r *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.reloadIfModified()
+	return r.config, nil
+}
+
+// reloadIfModified reloads the certificate files if any of them have been
+// modified since they were last loaded. On failure to reload, the previously
+// loaded certificates are kept. Must be called with the mutex held.
+func (r *certReloader) reloadIfModified() {
+	modTimes, err := r.statFiles()
+	if err != nil {
+		log.Errorf("failed to check TLS certificates for modifications: %s", err)
+		return
+	}
+	modified := false
+	for path, modTime := range modTimes {
+		if !modTime.Equal(r.modTimes[path]) {
+			modified = true
+		}
+	}
+	if !modified {
+		return
+	}
+
+	log.Infof("TLS certificates modified on disk, reloading ...")
+	config, err := r.load()
+	if err != nil {
+		// a certificate and key may be in the midst of being replaced: try
+		// again on next connection
+		log.Errorf("failed to reload TLS certificates: %s", err)
+		return
+	}
+	r.config, r.modTimes = config, modTimes
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.certPath, r.keyPath}
+	if r.clientCAPath != "" {
+		files = append(files, r.clientCAPath)
+	}
+	return files
+}
+
+func (r *certReloader) statFiles() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, path := range r.files() {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[path] = stat.ModTime()
+	}
+	return modTimes, nil
+}
+
+// load builds a TLS configuration from the certificate files.
+func (r *certReloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %s", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if r.clientCAPath != "" {
+		pem, err := ioutil.ReadFile(r.clientCAPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA bundle: %s", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("failed to parse client CA bundle: %s", r.clientCAPath)
+		}
+		config.ClientCAs = clientCAs
+		config.ClientAuth = r.clientAuth
+	}
+
+	return config, nil
+}
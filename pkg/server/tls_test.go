@@ -0,0 +1,227 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastisys/kube-insight-logserver/pkg/auth"
+	"github.com/elastisys/kube-insight-logserver/pkg/logstore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA is a certificate authority used to issue test certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(1 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue creates a certificate (and key) signed by the CA, returned in PEM form.
+func (ca *testCA) issue(t *testing.T, commonName string, serial int64) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(1 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	require.Nil(t, ioutil.WriteFile(path, data, 0600))
+}
+
+// Verify the behavior of Config.Validate()
+func TestConfigValidation(t *testing.T) {
+	tests := []struct {
+		config                  Config
+		expectedValidationError string
+	}{
+		{
+			config:                  Config{BindAddress: "0.0.0.0:8080"},
+			expectedValidationError: "",
+		},
+		{
+			config:                  Config{TLSCertPath: "server.pem", TLSKeyPath: "server-key.pem", TLSClientCAPath: "ca.pem", TLSRequireClientCert: true},
+			expectedValidationError: "",
+		},
+		{
+			config:                  Config{TLSCertPath: "server.pem"},
+			expectedValidationError: "invalid server config: a TLS certificate and key must be given together",
+		},
+		{
+			config:                  Config{TLSClientCAPath: "ca.pem"},
+			expectedValidationError: "invalid server config: a client CA requires a TLS certificate to be given",
+		},
+		{
+			config:                  Config{TLSCertPath: "server.pem", TLSKeyPath: "server-key.pem", TLSRequireClientCert: true},
+			expectedValidationError: "invalid server config: requiring client certificates requires a client CA to be given",
+		},
+		{
+			config:                  Config{Authorizer: &auth.RuleAuthorizer{}},
+			expectedValidationError: "invalid server config: an authorizer requires an authenticator to be given",
+		},
+		{
+			config:                  Config{AsyncIngest: true},
+			expectedValidationError: "invalid server config: asynchronous ingest requires a spool to be given",
+		},
+	}
+
+	for _, test := range tests {
+		err := test.config.Validate()
+		if test.expectedValidationError == "" {
+			assert.Nilf(t, err, "expected config to be valid: %+v", test.config)
+		} else {
+			require.NotNilf(t, err, "expected config to be invalid: %+v", test.config)
+			assert.Equalf(t, test.expectedValidationError, err.Error(), "unexpected validation error")
+		}
+	}
+}
+
+// With a client CA configured, POST /write should only be accepted from
+// clients with a verified certificate, whereas other endpoints remain open.
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server-tls-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "server", 2)
+	clientCert, clientKey := ca.issue(t, "fluent-bit", 3)
+	writeFile(t, filepath.Join(dir, "ca.pem"), ca.pem)
+	writeFile(t, filepath.Join(dir, "server.pem"), serverCert)
+	writeFile(t, filepath.Join(dir, "server-key.pem"), serverKey)
+
+	mockLogStore := new(MockedLogStore)
+	server := NewHTTP(&Config{
+		BindAddress:     "127.0.0.1:8080",
+		TLSCertPath:     filepath.Join(dir, "server.pem"),
+		TLSKeyPath:      filepath.Join(dir, "server-key.pem"),
+		TLSClientCAPath: filepath.Join(dir, "ca.pem"),
+	}, mockLogStore)
+	tlsConfig, err := server.tlsConfig()
+	require.Nilf(t, err, "unexpected error setting up TLS")
+	testServer := httptest.NewUnstartedServer(server.server.Handler)
+	testServer.TLS = tlsConfig
+	testServer.StartTLS()
+	defer testServer.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(ca.cert)
+	anonymousClient := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: rootCAs}}}
+	clientKeyPair, err := tls.X509KeyPair(clientCert, clientKey)
+	require.Nil(t, err)
+	authenticatedClient := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: rootCAs, Certificates: []tls.Certificate{clientKeyPair}}}}
+
+	logsToWrite := []logstore.LogEntry{logEntry(MustParse("2018-01-01T12:00:00.000Z"), "event 1")}
+	mockLogStore.On("Ready").Return(true, nil)
+	mockLogStore.On("Write", logsToWrite).Return(nil)
+	body := `[{"kubernetes": {"pod_name": "nginx-deployment-abcde", "container_name": "nginx", ` +
+		`"namespace_name": "default", "docker_id": "e4b0b3eb8c25a73351c5cfeb37a9d64736584c640f21010443fe2e7e5b9c085b", ` +
+		`"labels": {"pod-template-generation": "1", "app": "nginx"}, "host": "worker0", ` +
+		`"pod_id": "1021f36b-4e9e-11e8-8b6b-02425d6e035a"}, "date": 1514808000, ` +
+		`"log": "event 1", "stream": "stdout", "time": "2018-01-01T12:00:00Z"}]`
+
+	// without client certificate: write should be forbidden
+	resp, err := anonymousClient.Post(testServer.URL+"/write", "application/json", strings.NewReader(body))
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, http.StatusForbidden, resp.StatusCode, "unexpected response code")
+	// ... but health probe should be allowed
+	resp, err = anonymousClient.Get(testServer.URL + "/write")
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, http.StatusOK, resp.StatusCode, "unexpected response code")
+
+	// with client certificate: write should be accepted
+	resp, err = authenticatedClient.Post(testServer.URL+"/write", "application/json", strings.NewReader(body))
+	require.Nilf(t, err, "unexpected error")
+	assert.Equalf(t, http.StatusOK, resp.StatusCode, "unexpected response code")
+	mockLogStore.AssertExpectations(t)
+}
+
+// A certificate that is replaced on disk should be picked up by new
+// connections.
+func TestCertReloaderReloadsModifiedCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server-tls-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certPath, keyPath := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")
+
+	ca := newTestCA(t)
+	cert, key := ca.issue(t, "server", 2)
+	writeFile(t, certPath, cert)
+	writeFile(t, keyPath, key)
+	reloader, err := newCertReloader(certPath, keyPath, "", tls.NoClientCert)
+	require.Nilf(t, err, "unexpected error loading certificates")
+
+	config, _ := reloader.getConfigForClient(nil)
+	leaf, _ := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	assert.Equalf(t, int64(2), leaf.SerialNumber.Int64(), "unexpected certificate")
+
+	// rotate certificate (make sure modification time differs)
+	cert, key = ca.issue(t, "server", 3)
+	writeFile(t, certPath, cert)
+	writeFile(t, keyPath, key)
+	later := time.Now().Add(1 * time.Minute)
+	require.Nil(t, os.Chtimes(certPath, later, later))
+	require.Nil(t, os.Chtimes(keyPath, later, later))
+
+	config, _ = reloader.getConfigForClient(nil)
+	leaf, _ = x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	assert.Equalf(t, int64(3), leaf.SerialNumber.Int64(), "expected rotated certificate to be loaded")
+
+	// a broken certificate should not replace the loaded one
+	writeFile(t, certPath, []byte("garbage"))
+	evenLater := later.Add(1 * time.Minute)
+	require.Nil(t, os.Chtimes(certPath, evenLater, evenLater))
+	config, _ = reloader.getConfigForClient(nil)
+	leaf, _ = x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	assert.Equalf(t, int64(3), leaf.SerialNumber.Int64(), "expected previous certificate to be kept")
+}
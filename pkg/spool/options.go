@@ -0,0 +1,47 @@
+package spool
+
+import (
+	"fmt"
+	"time"
+)
+
+// OptionError is returned when an invalid set of spool Options are supplied.
+type OptionError struct {
+	Message string
+}
+
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("invalid spool options: %s", e.Message)
+}
+
+// Options describes spool options.
+type Options struct {
+	// Directory is the directory in which spooled log entry batches are
+	// stored. It will be created if it does not exist.
+	Directory string
+	// MaxBytes is the maximum total size of the spooled batches and the
+	// files of set-aside log entries. Batches that would make the spool grow
+	// beyond this size are rejected.
+	MaxBytes int64
+	// ReplayInterval is the time between attempts to replay spooled batches
+	// into the LogStore.
+	ReplayInterval time.Duration
+}
+
+// Validate ensures that the given Options are valid.
+func (opts *Options) Validate() error {
+	if opts.Directory == "" {
+		return &OptionError{"no directory given"}
+	}
+	if opts.MaxBytes < 1 {
+		return &OptionError{"max bytes must be a positive number"}
+	}
+	if opts.ReplayInterval <= 0 {
+		return &OptionError{"replay interval must be a positive duration"}
+	}
+	return nil
+}
+
+func (opts *Options) String() string {
+	return fmt.Sprintf("%+v", *opts)
+}
@@ -0,0 +1,522 @@
+package spool
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastisys/kube-insight-logserver/pkg/log"
+	"github.com/elastisys/kube-insight-logserver/pkg/logstore"
+)
+
+const (
+	// batchSuffix is the file name suffix of spooled batch files.
+	batchSuffix = ".json"
+	// tempSuffix is the file name suffix of batch files being written.
+	tempSuffix = ".tmp"
+	// corruptSuffix is the file name suffix given to batch files that
+	// cannot be decoded, which are kept for inspection but never replayed.
+	corruptSuffix = ".corrupt"
+	// rejectedSuffix is the file name suffix of files holding spooled log
+	// entries that the target LogStore rejected, which are kept for
+	// inspection but never replayed.
+	rejectedSuffix = ".rejected"
+	// maxReplayAttempts is the number of times that the target LogStore may
+	// fail to write a log entry of a batch (while it accepts writes) before
+	// the log entry is set aside as rejected.
+	maxReplayAttempts = 10
+)
+
+// FullError is returned when a batch cannot be spooled without making the
+// spool grow beyond its maximum size.
+type FullError struct {
+	// Size is the current size of the spool in bytes.
+	Size int64
+}
+
+func (e FullError) Error() string {
+	return fmt.Sprintf("spool is full: %d bytes spooled", e.Size)
+}
+
+// Target is the LogStore that spooled log entries are replayed into.
+type Target interface {
+	logstore.LogWriter
+	// Ready returns true if the Target accepts writes.
+	Ready() (bool, error)
+}
+
+// Stats describes the backlog of a Spool.
+type Stats struct {
+	// Batches is the number of spooled batches.
+	Batches int
+	// Entries is the number of spooled log entries.
+	Entries int
+	// Bytes is the total size of the spooled batches.
+	Bytes int64
+	// OldestAge is the time since the oldest spooled batch was spooled. It is
+	// zero when the spool is empty.
+	OldestAge time.Duration
+	// SetAsideFiles is the number of files of set-aside (corrupt or
+	// rejected) log entries in the spool directory.
+	SetAsideFiles int
+	// SetAsideBytes is the total size of the files of set-aside log entries.
+	SetAsideBytes int64
+}
+
+// batch is a spooled batch of log entries, stored in a file of its own.
+type batch struct {
+	// seq orders batches by the time they were spooled.
+	seq uint64
+	// path is the path of the batch file.
+	path string
+	// size is the size in bytes of the batch file.
+	size int64
+	// entries is the number of log entries in the batch.
+	entries int
+	// spooledAt is the time at which the batch was spooled.
+	spooledAt time.Time
+	// attempts is the number of replays of the batch in which the target
+	// LogStore failed to write some of its log entries.
+	attempts int
+}
+
+// Spool is a bounded, on-disk queue of log entry batches that could not be
+// written to a LogStore, for example during a Cassandra outage. Each batch is
+// stored in a file of its own under the spool directory, named by a sequence
+// number, so spooled batches survive restarts. A background goroutine replays
+// the batches, oldest first, into the LogStore once it is ready again, and
+// removes each batch once it has been written. As long as the LogStore accepts
+// writes, appended batches are replayed right away, which allows the Spool to
+// serve as a write-ahead log for asynchronous ingest.
+type Spool struct {
+	options *Options
+	target  Target
+
+	// mutex protects the fields below.
+	mutex sync.Mutex
+	// batches are the spooled batches, oldest first.
+	batches []*batch
+	// size is the total size in bytes of the spooled batches.
+	size int64
+	// nextSeq is the sequence number of the next spooled batch.
+	nextSeq uint64
+	// setAsideFiles is the number of files of set-aside log entries, which
+	// are kept until an operator removes them.
+	setAsideFiles int
+	// setAsideSize is the total size in bytes of the files of set-aside log
+	// entries. It counts toward the maximum size of the spool.
+	setAsideSize int64
+
+	// appendChan signals the replay goroutine that a batch was appended.
+	appendChan chan struct{}
+	// stopChan is closed to stop the replay goroutine.
+	stopChan chan struct{}
+	// doneChan is closed by the replay goroutine when it has stopped.
+	doneChan chan struct{}
+}
+
+// NewSpool creates a Spool with the given (validated) Options that replays
+// spooled batches into a target LogStore. Open() must be called before use.
+func NewSpool(options *Options, target Target) *Spool {
+	return &Spool{
+		options:    options,
+		target:     target,
+		batches:    make([]*batch, 0),
+		appendChan: make(chan struct{}, 1),
+	}
+}
+
+// Open creates the spool directory, unless it already exists, picks up any
+// batches spooled before a restart, and starts replaying them.
+func (s *Spool) Open() error {
+	if err := os.MkdirAll(s.options.Directory, 0755); err != nil {
+		return fmt.Errorf("failed to create spool directory: %s", err)
+	}
+	if err := s.load(); err != nil {
+		return err
+	}
+	if len(s.batches) > 0 {
+		log.Infof("found %d spooled batch(es) to replay", len(s.batches))
+	}
+	s.scanSetAside()
+	if s.setAsideFiles > 0 {
+		log.Warnf("found %d file(s) of set-aside log entries (%d bytes) in the spool directory",
+			s.setAsideFiles, s.setAsideSize)
+	}
+
+	s.stopChan = make(chan struct{})
+	s.doneChan = make(chan struct{})
+	go s.replayLoop()
+	return nil
+}
+
+// Close stops replaying spooled batches. Any batches that remain in the spool
+// are replayed the next time the Spool is opened.
+func (s *Spool) Close() error {
+	if s.stopChan == nil {
+		return nil
+	}
+	close(s.stopChan)
+	<-s.doneChan
+	s.stopChan = nil
+	return nil
+}
+
+// Append spools a batch of log entries. The batch is on disk when Append
+// returns. A FullError is returned if the spool lacks room for the batch. Files
+// of set-aside log entries take up room in the spool until they are removed.
+func (s *Spool) Append(entries []logstore.LogEntry) error {
+	bytes, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("failed to encode spooled batch: %s", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.size+s.setAsideSize+int64(len(bytes)) > s.options.MaxBytes {
+		return FullError{Size: s.size + s.setAsideSize}
+	}
+
+	seq := s.nextSeq
+	path := filepath.Join(s.options.Directory, fmt.Sprintf("%020d%s", seq, batchSuffix))
+	if err := writeFileSynced(path, bytes); err != nil {
+		return fmt.Errorf("failed to write spooled batch: %s", err)
+	}
+	s.nextSeq++
+	s.batches = append(s.batches, &batch{
+		seq: seq, path: path, size: int64(len(bytes)), entries: len(entries), spooledAt: time.Now(),
+	})
+	s.size += int64(len(bytes))
+	log.Debugf("spooled batch %d of %d log entries", seq, len(entries))
+
+	// wake up the replay goroutine, unless it already has been
+	select {
+	case s.appendChan <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Stats returns the current backlog of the Spool.
+func (s *Spool) Stats() Stats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats := Stats{
+		Batches: len(s.batches), Bytes: s.size, SetAsideFiles: s.setAsideFiles, SetAsideBytes: s.setAsideSize,
+	}
+	for _, batch := range s.batches {
+		stats.Entries += batch.entries
+	}
+	if len(s.batches) > 0 {
+		stats.OldestAge = time.Since(s.batches[0].spooledAt)
+	}
+	return stats
+}
+
+// replayLoop replays spooled batches every replay interval, and whenever a
+// batch is appended while the target LogStore accepts writes, until the Spool
+// is closed. Every replay interval, it also counts the files of set-aside log
+// entries anew, to notice the ones that an operator has removed.
+func (s *Spool) replayLoop() {
+	defer close(s.doneChan)
+
+	ticker := time.NewTicker(s.options.ReplayInterval)
+	defer ticker.Stop()
+	// failing is true when the last replay was cut short by the target, in
+	// which case replays wait for the next tick to not hammer the target, and
+	// first check that the target is ready again. Readiness checks can be
+	// costly (a Cassandra LogStore connects to the cluster), so they are only
+	// made then.
+	failing := false
+	for {
+		select {
+		case <-ticker.C:
+			s.scanSetAside()
+			failing = !s.replay(failing)
+		case <-s.appendChan:
+			if !failing {
+				failing = !s.replay(false)
+			}
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// replay writes spooled batches, oldest first, into the target LogStore for
+// as long as it accepts them. If checkReady is true, nothing is written
+// unless the target is ready. Returns false if the target was not ready or
+// failed to write a batch.
+func (s *Spool) replay(checkReady bool) bool {
+	if checkReady && s.oldest() != nil {
+		if ready, _ := s.target.Ready(); !ready {
+			return false
+		}
+	}
+	for {
+		select {
+		case <-s.stopChan:
+			return true
+		default:
+		}
+
+		oldest := s.oldest()
+		if oldest == nil {
+			return true
+		}
+
+		entries, err := readBatch(oldest.path)
+		if err != nil {
+			// never replayable: set the batch aside and move on
+			log.Errorf("dropping corrupt spooled batch %d: %s", oldest.seq, err)
+			s.remove(oldest)
+			if os.Rename(oldest.path, oldest.path+corruptSuffix) == nil {
+				s.addSetAside(oldest.size)
+			}
+			continue
+		}
+		entries = s.setAsideInvalid(oldest, entries)
+		err = s.target.Write(entries)
+		if writeErr, ok := err.(logstore.WriteError); ok {
+			// only the log entries that failed need to be replayed again
+			_, failed := writeErr.Split(entries)
+			oldest.attempts++
+			if oldest.attempts < maxReplayAttempts {
+				log.Warnf("failed to replay %d log entries of spooled batch %d (will retry): %s",
+					len(failed), oldest.seq, err)
+				s.rewrite(oldest, failed)
+				return false
+			}
+			log.Errorf("setting aside %d log entries of spooled batch %d that failed to be replayed %d times: %s",
+				len(failed), oldest.seq, oldest.attempts, err)
+			s.setAside(oldest, failed)
+		} else if err != nil {
+			log.Warnf("failed to replay spooled batch %d (will retry): %s", oldest.seq, err)
+			return false
+		}
+		if err := os.Remove(oldest.path); err != nil {
+			log.Errorf("failed to remove replayed batch %d: %s", oldest.seq, err)
+		}
+		s.remove(oldest)
+		log.Debugf("replayed spooled batch %d of %d log entries", oldest.seq, len(entries))
+	}
+}
+
+// setAsideInvalid sets aside the log entries of a batch that fail validation,
+// since no LogStore would ever accept them, rewrites the batch without them
+// and returns the valid ones.
+func (s *Spool) setAsideInvalid(b *batch, entries []logstore.LogEntry) []logstore.LogEntry {
+	valid := make([]logstore.LogEntry, 0, len(entries))
+	invalid := make([]logstore.LogEntry, 0)
+	for _, entry := range entries {
+		if err := entry.Validate(); err != nil {
+			invalid = append(invalid, entry)
+			continue
+		}
+		valid = append(valid, entry)
+	}
+	if len(invalid) > 0 {
+		log.Errorf("setting aside %d invalid log entries of spooled batch %d", len(invalid), b.seq)
+		s.setAside(b, invalid)
+		s.rewrite(b, valid)
+	}
+	return valid
+}
+
+// setAside writes rejected log entries of a batch to a file of their own,
+// where they are kept for inspection but never replayed.
+func (s *Spool) setAside(b *batch, entries []logstore.LogEntry) {
+	bytes, err := json.Marshal(entries)
+	if err == nil {
+		path := fmt.Sprintf("%s.%d%s", b.path, time.Now().UnixNano(), rejectedSuffix)
+		err = writeFileSynced(path, bytes)
+	}
+	if err != nil {
+		log.Errorf("failed to set aside rejected log entries of spooled batch %d: %s", b.seq, err)
+		return
+	}
+	s.addSetAside(int64(len(bytes)))
+}
+
+// addSetAside accounts for a file of set-aside log entries of the given size.
+func (s *Spool) addSetAside(size int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.setAsideFiles++
+	s.setAsideSize += size
+}
+
+// scanSetAside counts the files of set-aside (corrupt or rejected) log
+// entries in the spool directory.
+func (s *Spool) scanSetAside() {
+	files, err := ioutil.ReadDir(s.options.Directory)
+	if err != nil {
+		log.Warnf("failed to list spool directory: %s", err)
+		return
+	}
+
+	count, size := 0, int64(0)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(file.Name(), corruptSuffix) || strings.HasSuffix(file.Name(), rejectedSuffix) {
+			count++
+			size += file.Size()
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.setAsideFiles = count
+	s.setAsideSize = size
+}
+
+// rewrite replaces the log entries of a spooled batch with the given ones
+// (the ones that remain to be replayed). Should the batch fail to be
+// rewritten, all of its log entries are replayed again, which is harmless
+// since writes are idempotent.
+func (s *Spool) rewrite(b *batch, entries []logstore.LogEntry) {
+	bytes, err := json.Marshal(entries)
+	if err == nil {
+		err = writeFileSynced(b.path, bytes)
+	}
+	if err != nil {
+		log.Errorf("failed to rewrite spooled batch %d: %s", b.seq, err)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.size += int64(len(bytes)) - b.size
+	b.size = int64(len(bytes))
+	b.entries = len(entries)
+}
+
+// oldest returns the oldest spooled batch, or nil if the spool is empty.
+func (s *Spool) oldest() *batch {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.batches) == 0 {
+		return nil
+	}
+	return s.batches[0]
+}
+
+// remove removes the oldest spooled batch from the spool. Since batches are
+// only ever appended by Append(), it is the batch that oldest() returned.
+func (s *Spool) remove(oldest *batch) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.batches = s.batches[1:]
+	s.size -= oldest.size
+}
+
+// load picks up the batches in the spool directory, and removes the remains
+// of batches that were being written when the server stopped.
+func (s *Spool) load() error {
+	files, err := ioutil.ReadDir(s.options.Directory)
+	if err != nil {
+		return fmt.Errorf("failed to list spool directory: %s", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, file := range files {
+		path := filepath.Join(s.options.Directory, file.Name())
+		if strings.HasSuffix(file.Name(), tempSuffix) {
+			os.Remove(path)
+			continue
+		}
+		if file.IsDir() || !strings.HasSuffix(file.Name(), batchSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), batchSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		entries, err := readBatch(path)
+		if err != nil {
+			log.Errorf("setting aside corrupt spooled batch %d: %s", seq, err)
+			os.Rename(path, path+corruptSuffix)
+			continue
+		}
+		s.batches = append(s.batches, &batch{
+			seq: seq, path: path, size: file.Size(), entries: len(entries), spooledAt: file.ModTime(),
+		})
+		s.size += file.Size()
+	}
+
+	sort.Slice(s.batches, func(i, j int) bool { return s.batches[i].seq < s.batches[j].seq })
+	if len(s.batches) > 0 {
+		s.nextSeq = s.batches[len(s.batches)-1].seq + 1
+	}
+	return nil
+}
+
+// readBatch reads the log entries of a spooled batch file.
+func readBatch(path string) ([]logstore.LogEntry, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []logstore.LogEntry
+	if err := json.Unmarshal(bytes, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// writeFileSynced writes a file and flushes it to stable storage. The file is
+// written under a temporary name and then renamed, so that a crash never
+// leaves a partially written file under its final name. The directory is
+// flushed as well, so that the rename survives a power loss.
+func writeFileSynced(path string, data []byte) error {
+	tempPath := path + tempSuffix
+	file, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes a directory (and thereby the files created in, renamed
+// into or removed from it) to stable storage.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
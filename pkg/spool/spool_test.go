@@ -0,0 +1,370 @@
+package spool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastisys/kube-insight-logserver/pkg/logstore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTarget is a Target whose readiness and write errors can be controlled,
+// and which records the batches written to it.
+type fakeTarget struct {
+	mutex    sync.Mutex
+	ready    bool
+	writeErr error
+	// rejected holds the log messages of log entries that always fail to
+	// be written
+	rejected map[string]bool
+	written  [][]logstore.LogEntry
+	// readyChecks is the number of calls to Ready()
+	readyChecks int
+}
+
+func (f *fakeTarget) Ready() (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.readyChecks++
+	if !f.ready {
+		return false, fmt.Errorf("connection refused")
+	}
+	return true, nil
+}
+
+func (f *fakeTarget) Write(entries []logstore.LogEntry) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.ready {
+		return fmt.Errorf("connection refused")
+	}
+	if f.writeErr != nil {
+		return f.writeErr
+	}
+	stored := make([]logstore.LogEntry, 0, len(entries))
+	entryErrs := make(map[int]error)
+	for i, entry := range entries {
+		if f.rejected[entry.Log] {
+			entryErrs[i] = fmt.Errorf("value too large")
+			continue
+		}
+		stored = append(stored, entry)
+	}
+	if len(stored) > 0 {
+		f.written = append(f.written, stored)
+	}
+	if len(entryErrs) > 0 {
+		return logstore.NewWriteError(entryErrs)
+	}
+	return nil
+}
+
+func (f *fakeTarget) set(ready bool, writeErr error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.ready = ready
+	f.writeErr = writeErr
+}
+
+func (f *fakeTarget) batches() [][]logstore.LogEntry {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.written
+}
+
+func MustParse(isoTime string) time.Time {
+	t, _ := time.Parse(time.RFC3339, isoTime)
+	return t
+}
+
+func logEntry(timestamp time.Time, message string) logstore.LogEntry {
+	return logstore.LogEntry{
+		Date: float64(timestamp.UnixNano() / 1.0e9),
+		Kubernetes: logstore.KubernetesMetadata{
+			PodName:       "nginx-deployment-abcde",
+			ContainerName: "nginx",
+			Namespace:     "default",
+		},
+		Log:    message,
+		Stream: "stdout",
+		Time:   timestamp,
+	}
+}
+
+// tempDir creates a temporary spool directory. The caller is responsible for
+// removing it.
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spool-test")
+	require.Nilf(t, err, "failed to create temp dir")
+	return dir
+}
+
+func openSpool(t *testing.T, dir string, maxBytes int64, target Target) *Spool {
+	spool := NewSpool(&Options{Directory: dir, MaxBytes: maxBytes, ReplayInterval: 10 * time.Millisecond}, target)
+	require.Nilf(t, spool.Open(), "open not expected to fail")
+	return spool
+}
+
+// waitUntilDrained waits (for at most a second) for all spooled batches to be
+// replayed.
+func waitUntilDrained(t *testing.T, spool *Spool) {
+	deadline := time.Now().Add(time.Second)
+	for spool.Stats().Batches > 0 {
+		require.Truef(t, time.Now().Before(deadline), "expected spool to be drained")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Verify the behavior of Options.Validate()
+func TestOptionValidation(t *testing.T) {
+	valid := Options{Directory: "/var/spool/logs", MaxBytes: 1024, ReplayInterval: time.Second}
+	assert.Nilf(t, valid.Validate(), "expected options to be valid")
+
+	tests := []struct {
+		options     Options
+		expectedErr string
+	}{
+		{Options{MaxBytes: 1024, ReplayInterval: time.Second}, "invalid spool options: no directory given"},
+		{Options{Directory: "/var/spool/logs", ReplayInterval: time.Second}, "invalid spool options: max bytes must be a positive number"},
+		{Options{Directory: "/var/spool/logs", MaxBytes: 1024}, "invalid spool options: replay interval must be a positive duration"},
+	}
+	for _, test := range tests {
+		err := test.options.Validate()
+		require.NotNilf(t, err, "expected options to be invalid: %s", test.options.String())
+		assert.Equalf(t, test.expectedErr, err.Error(), "unexpected validation error")
+	}
+}
+
+// Spooled batches should be replayed, oldest first, once the target is ready.
+func TestSpoolReplay(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	target := &fakeTarget{}
+	spool := openSpool(t, dir, 1024*1024, target)
+	defer spool.Close()
+
+	batch1 := []logstore.LogEntry{logEntry(MustParse("2018-01-01T12:00:00.000Z"), "event 1")}
+	batch2 := []logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T12:01:00.000Z"), "event 2"),
+		logEntry(MustParse("2018-01-01T12:02:00.000Z"), "event 3"),
+	}
+	require.Nilf(t, spool.Append(batch1), "append not expected to fail")
+	require.Nilf(t, spool.Append(batch2), "append not expected to fail")
+
+	// nothing is replayed while the target is not ready
+	time.Sleep(50 * time.Millisecond)
+	stats := spool.Stats()
+	assert.Equalf(t, 2, stats.Batches, "unexpected spooled batches")
+	assert.Equalf(t, 3, stats.Entries, "unexpected spooled entries")
+	assert.Truef(t, stats.Bytes > 0, "expected spooled bytes")
+	assert.Truef(t, stats.OldestAge > 0, "expected an age of the oldest batch")
+	assert.Emptyf(t, target.batches(), "expected no batches to be replayed")
+
+	target.set(true, nil)
+	waitUntilDrained(t, spool)
+	assert.Equalf(t, [][]logstore.LogEntry{batch1, batch2}, target.batches(), "unexpected replayed batches")
+	assert.Equalf(t, Stats{}, spool.Stats(), "expected an empty spool")
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Emptyf(t, files, "expected replayed batch files to be removed")
+}
+
+// A batch that fails to be written should be kept and retried.
+func TestSpoolReplayRetriesOnWriteError(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	target := &fakeTarget{}
+	target.set(true, fmt.Errorf("write timeout"))
+	spool := openSpool(t, dir, 1024*1024, target)
+	defer spool.Close()
+
+	batch := []logstore.LogEntry{logEntry(MustParse("2018-01-01T12:00:00.000Z"), "event 1")}
+	require.Nilf(t, spool.Append(batch), "append not expected to fail")
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equalf(t, 1, spool.Stats().Batches, "expected batch to be kept")
+
+	target.set(true, nil)
+	waitUntilDrained(t, spool)
+	assert.Equalf(t, [][]logstore.LogEntry{batch}, target.batches(), "unexpected replayed batches")
+}
+
+// Only the log entries of a batch that failed to be written should be
+// replayed again, and log entries that keep failing should be set aside, so
+// that they do not hold up later batches.
+func TestSpoolReplaySetsAsideRejectedEntries(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	target := &fakeTarget{rejected: map[string]bool{"event 2": true}}
+	spool := openSpool(t, dir, 1024*1024, target)
+	defer spool.Close()
+
+	batch1 := []logstore.LogEntry{
+		logEntry(MustParse("2018-01-01T12:00:00.000Z"), "event 1"),
+		logEntry(MustParse("2018-01-01T12:01:00.000Z"), "event 2"),
+		logEntry(MustParse("2018-01-01T12:02:00.000Z"), "event 3"),
+	}
+	batch2 := []logstore.LogEntry{logEntry(MustParse("2018-01-01T12:03:00.000Z"), "event 4")}
+	require.Nilf(t, spool.Append(batch1), "append not expected to fail")
+	require.Nilf(t, spool.Append(batch2), "append not expected to fail")
+
+	target.set(true, nil)
+	waitUntilDrained(t, spool)
+	assert.Equalf(t, [][]logstore.LogEntry{{batch1[0], batch1[2]}, batch2}, target.batches(),
+		"unexpected replayed batches")
+
+	rejected, _ := filepath.Glob(filepath.Join(dir, "*"+rejectedSuffix))
+	require.Equalf(t, 1, len(rejected), "expected rejected log entries to be set aside")
+	entries, err := readBatch(rejected[0])
+	require.Nilf(t, err, "failed to read rejected log entries")
+	assert.Equalf(t, []logstore.LogEntry{batch1[1]}, entries, "unexpected rejected log entries")
+}
+
+// Log entries that fail validation should be set aside without being
+// replayed.
+func TestSpoolReplaySetsAsideInvalidEntries(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	target := &fakeTarget{}
+	spool := openSpool(t, dir, 1024*1024, target)
+	defer spool.Close()
+
+	invalid := logEntry(MustParse("2018-01-01T12:01:00.000Z"), "event 2")
+	invalid.Kubernetes.Namespace = ""
+	batch := []logstore.LogEntry{logEntry(MustParse("2018-01-01T12:00:00.000Z"), "event 1"), invalid}
+	require.Nilf(t, spool.Append(batch), "append not expected to fail")
+
+	target.set(true, nil)
+	waitUntilDrained(t, spool)
+	assert.Equalf(t, [][]logstore.LogEntry{{batch[0]}}, target.batches(), "unexpected replayed batches")
+
+	rejected, _ := filepath.Glob(filepath.Join(dir, "*"+rejectedSuffix))
+	require.Equalf(t, 1, len(rejected), "expected invalid log entries to be set aside")
+	entries, err := readBatch(rejected[0])
+	require.Nilf(t, err, "failed to read rejected log entries")
+	assert.Equalf(t, []logstore.LogEntry{invalid}, entries, "unexpected rejected log entries")
+
+	info, err := os.Stat(rejected[0])
+	require.Nilf(t, err, "failed to stat rejected log entries")
+	stats := spool.Stats()
+	assert.Equalf(t, 1, stats.SetAsideFiles, "expected set-aside file to be counted")
+	assert.Equalf(t, info.Size(), stats.SetAsideBytes, "unexpected size of set-aside files")
+}
+
+// Appended batches should be replayed right away while the target accepts
+// writes, without waiting for the replay interval.
+func TestSpoolReplaysOnAppend(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	target := &fakeTarget{}
+	target.set(true, nil)
+	spool := NewSpool(&Options{Directory: dir, MaxBytes: 1024 * 1024, ReplayInterval: time.Hour}, target)
+	require.Nilf(t, spool.Open(), "open not expected to fail")
+	defer spool.Close()
+
+	batch := []logstore.LogEntry{logEntry(MustParse("2018-01-01T12:00:00.000Z"), "event 1")}
+	require.Nilf(t, spool.Append(batch), "append not expected to fail")
+	waitUntilDrained(t, spool)
+	assert.Equalf(t, [][]logstore.LogEntry{batch}, target.batches(), "unexpected replayed batches")
+}
+
+// The readiness of the target should only be checked before replaying after a
+// failure, and not for every replayed batch.
+func TestSpoolReplayChecksReadinessAfterFailure(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	target := &fakeTarget{}
+	target.set(true, nil)
+	spool := openSpool(t, dir, 1024*1024, target)
+	defer spool.Close()
+
+	for i := 0; i < 5; i++ {
+		batch := []logstore.LogEntry{logEntry(MustParse("2018-01-01T12:00:00.000Z"), fmt.Sprintf("event %d", i))}
+		require.Nilf(t, spool.Append(batch), "append not expected to fail")
+		waitUntilDrained(t, spool)
+	}
+	assert.Equalf(t, 5, len(target.batches()), "unexpected number of replayed batches")
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+	assert.Equalf(t, 0, target.readyChecks, "expected readiness not to be checked")
+}
+
+// Append should be rejected when the spool would grow beyond its maximum size.
+func TestSpoolFull(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	spool := openSpool(t, dir, 300, &fakeTarget{})
+	defer spool.Close()
+
+	batch := []logstore.LogEntry{logEntry(MustParse("2018-01-01T12:00:00.000Z"), "event 1")}
+	require.Nilf(t, spool.Append(batch), "append not expected to fail")
+	size := spool.Stats().Bytes
+
+	err := spool.Append(batch)
+	require.Equalf(t, FullError{Size: size}, err, "expected spool to be full")
+	assert.Equalf(t, 1, spool.Stats().Batches, "unexpected spooled batches")
+}
+
+// Files of set-aside log entries should take up room in the spool until they
+// are removed.
+func TestSpoolFullOfSetAsideEntries(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	// a corrupt batch, which is set aside when the spool is opened
+	corrupt := []byte(strings.Repeat("[", 200))
+	require.Nilf(t, ioutil.WriteFile(filepath.Join(dir, "00000000000000000000.json"), corrupt, 0644),
+		"failed to write corrupt batch")
+	spool := openSpool(t, dir, 300, &fakeTarget{})
+	defer spool.Close()
+
+	stats := spool.Stats()
+	assert.Equalf(t, 0, stats.Batches, "expected corrupt batch not to be picked up")
+	assert.Equalf(t, 1, stats.SetAsideFiles, "expected corrupt batch to be set aside")
+	assert.Equalf(t, int64(len(corrupt)), stats.SetAsideBytes, "unexpected size of set-aside files")
+
+	batch := []logstore.LogEntry{logEntry(MustParse("2018-01-01T12:00:00.000Z"), "event 1")}
+	err := spool.Append(batch)
+	require.Equalf(t, FullError{Size: int64(len(corrupt))}, err, "expected spool to be full")
+
+	// once removed, the set-aside file should no longer take up room
+	require.Nilf(t, os.Remove(filepath.Join(dir, "00000000000000000000.json"+corruptSuffix)),
+		"failed to remove corrupt batch")
+	deadline := time.Now().Add(time.Second)
+	for spool.Stats().SetAsideFiles > 0 {
+		require.Truef(t, time.Now().Before(deadline), "expected removed set-aside file to be noticed")
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Nilf(t, spool.Append(batch), "append not expected to fail")
+}
+
+// Spooled batches should survive a restart.
+func TestSpoolReopen(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	target := &fakeTarget{}
+	spool := openSpool(t, dir, 1024*1024, target)
+
+	batch1 := []logstore.LogEntry{logEntry(MustParse("2018-01-01T12:00:00.000Z"), "event 1")}
+	batch2 := []logstore.LogEntry{logEntry(MustParse("2018-01-01T12:01:00.000Z"), "event 2")}
+	require.Nilf(t, spool.Append(batch1), "append not expected to fail")
+	require.Nilf(t, spool.Close(), "close not expected to fail")
+	// the remains of an interrupted append
+	ioutil.WriteFile(filepath.Join(dir, "00000000000000000001.json.tmp"), []byte("[{"), 0644)
+
+	spool = openSpool(t, dir, 1024*1024, target)
+	defer spool.Close()
+	assert.Equalf(t, 1, spool.Stats().Batches, "expected spooled batch to be picked up")
+	require.Nilf(t, spool.Append(batch2), "append not expected to fail")
+
+	target.set(true, nil)
+	waitUntilDrained(t, spool)
+	assert.Equalf(t, [][]logstore.LogEntry{batch1, batch2}, target.batches(), "unexpected replayed batches")
+}